@@ -0,0 +1,453 @@
+// Package asm assembles single Z80 instructions, for monitors and
+// debuggers that patch code in place. It accepts everything package
+// disasm produces, including the undocumented instructions, so listed
+// code can be edited and put back: its table of encodings is built by
+// disassembling every opcode.
+//
+// Numbers are decimal unless written as $FF, 0xFF, #FF or 0FFh (hex),
+// %1010 (binary) or 'c' (a character), or hex if an Assembler says so.
+// They may be negative and may be sums such as $4000+32, and $ alone is
+// the address of the instruction. Relative jumps take their target
+// address, so "jr $+2" jumps to the next instruction. The
+// accumulator may be given or left out of the ALU instructions, as in
+// "sub a,b" or "add b". Besides instructions, db and dw (or defb, defw
+// and defm) lay down bytes, little-endian words and "strings".
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ha1tch/zen80/disasm"
+)
+
+// operandKind is how an operand is encoded
+type operandKind int
+
+const (
+	fixed operandKind = iota // Part of the opcode, such as a or (hl)
+	imm8                     // n
+	imm16                    // nn
+	ind16                    // (nn)
+	port                     // (n)
+	disp                     // (ix+d) or (iy+d)
+	rel                      // A relative jump target
+)
+
+type operand struct {
+	kind  operandKind
+	text  string // The fixed text, or the index register for disp
+	holes []int  // Positions of the operand's bytes, low byte first
+}
+
+// template is one encoding, with its operand bytes zero
+type template struct {
+	code     []uint8
+	mnemonic string
+	operands []operand
+}
+
+var (
+	templates     map[string][]*template
+	templatesOnce sync.Once
+)
+
+// buildTemplates disassembles every encoding
+func buildTemplates() {
+	templates = make(map[string][]*template)
+	for op := 0; op < 256; op++ {
+		add([]uint8{uint8(op)})
+		add([]uint8{0xCB, uint8(op)})
+		add([]uint8{0xED, uint8(op)})
+		for _, prefix := range []uint8{0xDD, 0xFD} {
+			add([]uint8{prefix, uint8(op)})
+			addCode([]uint8{prefix, 0xCB, 0, uint8(op)}, []int{2})
+		}
+	}
+}
+
+// add adds the encoding starting with opcode, whose operand bytes
+// follow it
+func add(opcode []uint8) {
+	switch opcode[len(opcode)-1] {
+	case 0xCB, 0xDD, 0xED, 0xFD:
+		if len(opcode) == 1 || opcode[0] == 0xDD || opcode[0] == 0xFD {
+			return // A prefix, handled with what follows it
+		}
+	}
+	code := append(opcode, 0, 0, 0)
+	n := disasm.DecodeBytes(code, 0).Len()
+	var holes []int
+	for i := len(opcode); i < n; i++ {
+		holes = append(holes, i)
+	}
+	addCode(code[:n], holes)
+}
+
+// addCode adds an encoding whose operand bytes are at holes
+func addCode(code []uint8, holes []int) {
+	in := disasm.DecodeBytes(code, 0)
+	if in.Mnemonic == "db" || in.Len() != len(code) {
+		return
+	}
+	t := &template{code: code, mnemonic: in.Mnemonic}
+	base := splitOperands(in.Operands)
+	for _, text := range base {
+		t.operands = append(t.operands, operand{text: text})
+	}
+	// An operand is made of the bytes that change its text
+	for _, h := range holes {
+		c := append([]uint8(nil), code...)
+		c[h] = 1
+		changed := splitOperands(disasm.DecodeBytes(c, 0).Operands)
+		for i := range base {
+			if changed[i] != base[i] {
+				t.operands[i].holes = append(t.operands[i].holes, h)
+			}
+		}
+	}
+	for i := range t.operands {
+		o := &t.operands[i]
+		switch {
+		case len(o.holes) == 0:
+		case strings.HasPrefix(o.text, "(ix") || strings.HasPrefix(o.text, "(iy"):
+			o.kind, o.text = disp, o.text[1:3]
+		case len(o.holes) == 2 && o.text[0] == '(':
+			o.kind = ind16
+		case o.text[0] == '(':
+			o.kind = port
+		case len(o.holes) == 2:
+			o.kind = imm16
+		case t.mnemonic == "jr" || t.mnemonic == "djnz":
+			o.kind = rel
+		default:
+			o.kind = imm8
+		}
+	}
+	templates[t.mnemonic] = append(templates[t.mnemonic], t)
+}
+
+// aluOps may be written with or without the accumulator
+var aluOps = map[string]bool{
+	"add": true, "adc": true, "sub": true, "sbc": true,
+	"and": true, "xor": true, "or": true, "cp": true,
+}
+
+// Assembler assembles with a choice of number syntax
+type Assembler struct {
+	// Hex makes plain numbers hex, as monitors do, rather than decimal.
+	// Names of registers and conditions, such as c and de, are still
+	// never numbers.
+	Hex bool
+}
+
+// Assemble assembles one instruction, or a db or dw line, to go at addr,
+// with decimal numbers. Blank lines and comments assemble to nothing.
+func Assemble(line string, addr uint16) ([]uint8, error) {
+	return Assembler{}.Assemble(line, addr)
+}
+
+// Assemble assembles one instruction, or a db or dw line, to go at addr
+func (a Assembler) Assemble(line string, addr uint16) ([]uint8, error) {
+	templatesOnce.Do(buildTemplates)
+	line = strings.TrimSpace(stripComment(line))
+	if line == "" {
+		return nil, nil
+	}
+	mnemonic, rest, _ := strings.Cut(line, " ")
+	mnemonic = strings.ToLower(mnemonic)
+	var ops []string
+	for _, op := range splitOperands(strings.TrimSpace(rest)) {
+		ops = append(ops, normalize(op))
+	}
+
+	switch mnemonic {
+	case "db", "defb", "defm":
+		return a.data(ops, 1, addr)
+	case "dw", "defw":
+		return a.data(ops, 2, addr)
+	}
+
+	candidates, ok := templates[mnemonic]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %q", mnemonic)
+	}
+	tries := [][]string{ops}
+	if aluOps[mnemonic] {
+		if len(ops) == 2 && ops[0] == "a" {
+			tries = append(tries, ops[1:])
+		} else if len(ops) == 1 {
+			tries = append(tries, []string{"a", ops[0]})
+		}
+	}
+	var best []uint8
+	for _, ops := range tries {
+		for _, t := range candidates {
+			code, ok := t.match(ops, addr, a.Hex)
+			if ok && (best == nil || len(code) < len(best)) {
+				best = code
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("cannot assemble %q", line)
+	}
+	return best, nil
+}
+
+// match encodes the operands with this template if they fit it
+func (t *template) match(ops []string, addr uint16, hex bool) ([]uint8, bool) {
+	if len(ops) != len(t.operands) {
+		return nil, false
+	}
+	code := append([]uint8(nil), t.code...)
+	for i, o := range t.operands {
+		u := ops[i]
+		switch o.kind {
+		case fixed:
+			if u != o.text {
+				a, err1 := parseNumber(u, hex, int(addr))
+				b, err2 := ParseNumber(o.text)
+				if err1 != nil || err2 != nil || a != b {
+					return nil, false
+				}
+			}
+		case imm8, port, imm16, ind16:
+			if o.kind == port || o.kind == ind16 {
+				if len(u) < 2 || u[0] != '(' || u[len(u)-1] != ')' {
+					return nil, false
+				}
+				u = u[1 : len(u)-1]
+			}
+			v, err := parseNumber(u, hex, int(addr))
+			if err != nil || v < -32768 || v > 0xFFFF || len(o.holes) == 1 && (v < -128 || v > 255) {
+				return nil, false
+			}
+			code[o.holes[0]] = uint8(v)
+			if len(o.holes) == 2 {
+				code[o.holes[1]] = uint8(v >> 8)
+			}
+		case disp:
+			prefix := "(" + o.text
+			if !strings.HasPrefix(u, prefix) || !strings.HasSuffix(u, ")") {
+				return nil, false
+			}
+			v := 0
+			if d := u[len(prefix) : len(u)-1]; d != "" {
+				if d[0] != '+' && d[0] != '-' {
+					return nil, false
+				}
+				var err error
+				if v, err = parseNumber(d, hex, int(addr)); err != nil {
+					return nil, false
+				}
+			}
+			if v < -128 || v > 127 {
+				return nil, false
+			}
+			code[o.holes[0]] = uint8(v)
+		case rel:
+			v, err := parseNumber(u, hex, int(addr))
+			if err != nil {
+				return nil, false
+			}
+			off := int(int16(uint16(v) - addr - uint16(len(code))))
+			if off < -128 || off > 127 {
+				return nil, false
+			}
+			code[o.holes[0]] = uint8(off)
+		}
+	}
+	return code, true
+}
+
+// data assembles db (size 1) and dw (size 2) operands
+func (a Assembler) data(ops []string, size int, addr uint16) ([]uint8, error) {
+	var out []uint8
+	for _, op := range ops {
+		if size == 1 && len(op) >= 2 && op[0] == '"' && op[len(op)-1] == '"' {
+			out = append(out, op[1:len(op)-1]...)
+			continue
+		}
+		v, err := parseNumber(op, a.Hex, int(addr))
+		if err != nil {
+			return nil, err
+		}
+		if size == 1 && (v < -128 || v > 255) || v < -32768 || v > 0xFFFF {
+			return nil, fmt.Errorf("%s out of range", op)
+		}
+		out = append(out, uint8(v))
+		if size == 2 {
+			out = append(out, uint8(v>>8))
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no data")
+	}
+	return out, nil
+}
+
+// ParseNumber parses a number or a sum of numbers as Assemble does,
+// without $ for the current address
+func ParseNumber(s string) (int, error) {
+	return parseNumber(s, false, -1)
+}
+
+// names are the registers and conditions that could be read as hex
+var names = map[string]bool{
+	"a": true, "b": true, "c": true, "d": true, "e": true,
+	"af": true, "bc": true, "de": true,
+}
+
+// parseNumber parses a number or a sum; here is the value of $, or -1
+func parseNumber(s string, hex bool, here int) (int, error) {
+	s = strings.TrimSpace(s)
+	if hex && names[strings.ToLower(s)] {
+		return 0, fmt.Errorf("%s is a register", s)
+	}
+	total, sign := 0, 1
+	for {
+		if s == "" {
+			return 0, fmt.Errorf("missing number")
+		}
+		switch s[0] {
+		case '+':
+			s = s[1:]
+		case '-':
+			sign, s = -sign, s[1:]
+		}
+		// A term runs to the next + or - outside a character
+		end := len(s)
+		if len(s) < 3 || s[0] != '\'' || s[2] != '\'' {
+			if i := strings.IndexAny(s, "+-"); i > 0 {
+				end = i
+			}
+		} else {
+			end = 3
+		}
+		v, err := parseTerm(strings.TrimSpace(s[:end]), hex, here)
+		if err != nil {
+			return 0, err
+		}
+		total += sign * v
+		s = strings.TrimSpace(s[end:])
+		if s == "" {
+			return total, nil
+		}
+		sign = 1
+		if s[0] != '+' && s[0] != '-' {
+			return 0, fmt.Errorf("bad number %q", s)
+		}
+	}
+}
+
+func parseTerm(s string, hex bool, here int) (int, error) {
+	if s == "$" && here >= 0 {
+		return here, nil
+	}
+	base, digits := 10, s
+	if hex {
+		base = 16
+	}
+	lower := strings.ToLower(s)
+	switch {
+	case len(s) == 3 && s[0] == '\'' && s[2] == '\'':
+		return int(s[1]), nil
+	case strings.HasPrefix(s, "$"), strings.HasPrefix(s, "#"):
+		base, digits = 16, s[1:]
+	case strings.HasPrefix(lower, "0x"):
+		base, digits = 16, s[2:]
+	case strings.HasPrefix(s, "%"):
+		base, digits = 2, s[1:]
+	case strings.HasSuffix(lower, "h") && len(s) > 1 && (hex || s[0] >= '0' && s[0] <= '9'):
+		base, digits = 16, s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(digits, base, 32)
+	if err != nil || v > 0xFFFF {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return int(v), nil
+}
+
+// normalize lower-cases an operand and removes its spaces, leaving
+// strings and characters alone
+func normalize(op string) string {
+	var b strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(op); i++ {
+		c := op[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case opensQuote(op, i):
+			quote = c
+		case c == ' ' || c == '\t':
+			continue
+		case c >= 'A' && c <= 'Z':
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// opensQuote reports whether op[i] starts a string or character. The
+// quote in af' does not.
+func opensQuote(op string, i int) bool {
+	switch op[i] {
+	case '"':
+		return true
+	case '\'':
+		return i == 0 || !isLetter(op[i-1])
+	}
+	return false
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// splitOperands splits at commas outside strings and characters
+func splitOperands(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	quote, start := byte(0), 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case opensQuote(s, i):
+			quote = s[i]
+		case s[i] == ',':
+			out = append(out, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(out, strings.TrimSpace(s[start:]))
+}
+
+// stripComment removes a ; comment
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == quote {
+				quote = 0
+			}
+		case opensQuote(line, i):
+			quote = line[i]
+		case line[i] == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,99 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ha1tch/zen80/disasm"
+)
+
+func TestAssemble(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want []uint8
+	}{
+		{"nop", []uint8{0x00}},
+		{"LD A, 5", []uint8{0x3E, 0x05}},
+		{"ld hl,$4000+32", []uint8{0x21, 0x20, 0x40}},
+		{"ld a,(0C000h)", []uint8{0x3A, 0x00, 0xC0}},
+		{"ld (ix - 2),'*'", []uint8{0xDD, 0x36, 0xFE, 0x2A}},
+		{"ld b,(iy)", []uint8{0xFD, 0x46, 0x00}},
+		{"jr nz,$8000", []uint8{0x20, 0xFE}},
+		{"djnz $7FF0", []uint8{0x10, 0xEE}},
+		{"jr $+2", []uint8{0x18, 0x00}},
+		{"jp $", []uint8{0xC3, 0x00, 0x80}},
+		{"ld hl,$-1", []uint8{0x21, 0xFF, 0x7F}},
+		{"rst 38h", []uint8{0xFF}},
+		{"sub a,b", []uint8{0x90}},
+		{"add c", []uint8{0x81}},
+		{"ex af,af'", []uint8{0x08}},
+		{"out (c),0", []uint8{0xED, 0x71}},
+		{"im 2", []uint8{0xED, 0x5E}},
+		{"set 7,(ix+1),a", []uint8{0xDD, 0xCB, 0x01, 0xFF}},
+		{"ld ixh,%101", []uint8{0xDD, 0x26, 0x05}},
+		{`db 1,"hi",-1 ; comment`, []uint8{1, 'h', 'i', 0xFF}},
+		{"dw $1234,0x10", []uint8{0x34, 0x12, 0x10, 0x00}},
+		{"; only a comment", nil},
+	} {
+		got, err := Assemble(c.line, 0x8000)
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%q: % x, %v; want % x", c.line, got, err, c.want)
+		}
+	}
+	for _, line := range []string{"ld a,256", "jr $9000", "ld (ix+128),a", "frob a", "ld a", "ld a,(bc"} {
+		if code, err := Assemble(line, 0x8000); err == nil {
+			t.Errorf("%q assembled to % x", line, code)
+		}
+	}
+}
+
+func TestHex(t *testing.T) {
+	a := Assembler{Hex: true}
+	for _, c := range []struct {
+		line string
+		want []uint8
+	}{
+		{"ld hl,9000", []uint8{0x21, 0x00, 0x90}},
+		{"ld a,c", []uint8{0x79}},
+		{"ld a,(bc)", []uint8{0x0A}},
+		{"jr c,8010", []uint8{0x38, 0x0E}},
+		{"rst 38", []uint8{0xFF}},
+		{"ld (ix+10),ffh", []uint8{0xDD, 0x36, 0x10, 0xFF}},
+		{"db 10,'A'", []uint8{0x10, 0x41}},
+		{"djnz $-10", []uint8{0x10, 0xEE}},
+	} {
+		got, err := a.Assemble(c.line, 0x8000)
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%q: % x, %v; want % x", c.line, got, err, c.want)
+		}
+	}
+	if code, err := a.Assemble("ld hl,(de)", 0x8000); err == nil {
+		t.Errorf("ld hl,(de) assembled to % x", code)
+	}
+}
+
+// TestRoundTrip assembles the disassembly of every instruction and
+// checks it disassembles the same
+func TestRoundTrip(t *testing.T) {
+	var codes [][]uint8
+	for op := 0; op < 256; op++ {
+		for _, prefix := range [][]uint8{nil, {0xCB}, {0xED}, {0xDD}, {0xFD}, {0xDD, 0xCB, 0x85}, {0xFD, 0xCB, 0x12}} {
+			codes = append(codes, append(append([]uint8(nil), prefix...), uint8(op), 0x85, 0xC3))
+		}
+	}
+	const addr = 0x8000
+	for _, code := range codes {
+		in := disasm.DecodeBytes(code, addr)
+		if in.Mnemonic == "db" {
+			continue
+		}
+		got, err := Assemble(in.String(), addr)
+		if err != nil {
+			t.Errorf("% x %s: %v", in.Bytes, in, err)
+			continue
+		}
+		if again := disasm.DecodeBytes(got, addr); again.String() != in.String() || len(got) > in.Len() {
+			t.Errorf("% x %s: assembled to % x %s", in.Bytes, in, got, again)
+		}
+	}
+}
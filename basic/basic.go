@@ -0,0 +1,233 @@
+// Package basic lists and builds ZX Spectrum BASIC programs: it expands
+// tokenized program lines into text and turns text listings back into the
+// tokenized form the ROM stores in memory and on tape.
+package basic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+// Reader is the memory a program is listed from (system.SpectrumMemory,
+// or any z80.MemoryInterface)
+type Reader interface {
+	Read(address uint16) uint8
+}
+
+// Memory is the memory a program is loaded into
+type Memory interface {
+	Reader
+	Write(address uint16, value uint8)
+}
+
+// System variables used to find the program
+const (
+	sysVARS   = 23627
+	sysPROG   = 23635
+	sysELINE  = 23641
+	sysKCUR   = 23643
+	sysWORKSP = 23649
+	sysSTKBOT = 23651
+	sysSTKEND = 23653
+	sysNXTLIN = 23637
+)
+
+// Byte codes with special meaning in program lines
+const (
+	numberMarker = 0x0E // Followed by the 5-byte form of the preceding number
+	lineEnd      = 0x0D
+	firstToken   = 0xA3
+)
+
+// tokens holds the keywords for codes 0xA3-0xFF. 0xA3 and 0xA4 are the
+// 128K SPECTRUM and PLAY keywords (UDGs T and U on the 48K).
+var tokens = [...]string{
+	"SPECTRUM", "PLAY", "RND", "INKEY$", "PI", "FN", "POINT", "SCREEN$", "ATTR", "AT",
+	"TAB", "VAL$", "CODE", "VAL", "LEN", "SIN", "COS", "TAN", "ASN", "ACS",
+	"ATN", "LN", "EXP", "INT", "SQR", "SGN", "ABS", "PEEK", "IN", "USR",
+	"STR$", "CHR$", "NOT", "BIN", "OR", "AND", "<=", ">=", "<>", "LINE",
+	"THEN", "TO", "STEP", "DEF FN", "CAT", "FORMAT", "MOVE", "ERASE", "OPEN #", "CLOSE #",
+	"MERGE", "VERIFY", "BEEP", "CIRCLE", "INK", "PAPER", "FLASH", "BRIGHT", "INVERSE", "OVER",
+	"OUT", "LPRINT", "LLIST", "STOP", "READ", "DATA", "RESTORE", "NEW", "BORDER", "CONTINUE",
+	"DIM", "REM", "FOR", "GO TO", "GO SUB", "INPUT", "LOAD", "LIST", "LET", "PAUSE",
+	"NEXT", "POKE", "PRINT", "PLOT", "RUN", "SAVE", "RANDOMIZE", "IF", "CLS", "DRAW",
+	"CLEAR", "RETURN", "COPY",
+}
+
+// Token returns the keyword for a token code
+func Token(code uint8) (string, bool) {
+	if code < firstToken {
+		return "", false
+	}
+	return tokens[code-firstToken], true
+}
+
+// Line is one program line
+type Line struct {
+	Number int
+	Text   []uint8 // Tokenized text without the terminating ENTER
+}
+
+// ParseProgram splits a tokenized program (as stored from PROG, or in a
+// tape data block) into lines
+func ParseProgram(data []uint8) ([]Line, error) {
+	var lines []Line
+	for pos := 0; pos < len(data); {
+		if data[pos] >= 0x40 {
+			break // Start of the variables area
+		}
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("line header truncated at offset %d", pos)
+		}
+		number := int(binary.BigEndian.Uint16(data[pos:]))
+		length := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		pos += 4
+		if length < 1 || pos+length > len(data) {
+			return nil, fmt.Errorf("line %d truncated", number)
+		}
+		text := data[pos : pos+length]
+		if text[length-1] == lineEnd {
+			text = text[:length-1]
+		}
+		lines = append(lines, Line{Number: number, Text: text})
+		pos += length
+	}
+	return lines, nil
+}
+
+// Program reads the program bytes between PROG and VARS
+func Program(mem Reader) []uint8 {
+	prog := readWord(mem, sysPROG)
+	vars := readWord(mem, sysVARS)
+	data := make([]uint8, 0, int(vars-prog))
+	for addr := prog; addr != vars; addr++ {
+		data = append(data, mem.Read(addr))
+	}
+	return data
+}
+
+// List returns the listing of the program in memory
+func List(mem Reader) (string, error) {
+	return Detokenize(Program(mem))
+}
+
+// Detokenize lists a tokenized program, one line per text line
+func Detokenize(data []uint8) (string, error) {
+	lines, err := ParseProgram(data)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.String())
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// String lists the line the way the ROM does: keywords spelled out and
+// surrounded by spaces, functions followed by one, hidden numbers left
+// out. Bytes without a printable form are written as \#nnn escapes.
+func (l Line) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d ", l.Number)
+	start := b.Len()
+	text := l.Text
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == numberMarker:
+			i += 5
+		case c >= 0x10 && c <= 0x15: // INK, PAPER, FLASH, BRIGHT, INVERSE, OVER
+			writeEscapes(&b, text[i:min(i+2, len(text))])
+			i++
+		case c == 0x16 || c == 0x17: // AT, TAB
+			writeEscapes(&b, text[i:min(i+3, len(text))])
+			i += 2
+		case c >= firstToken:
+			kw := tokens[c-firstToken]
+			if c >= 0xA5 && c <= 0xA7 || c >= 0xC7 && c <= 0xC9 {
+				b.WriteString(kw) // RND, INKEY$, PI and comparisons have no spaces
+				continue
+			}
+			// Functions, FN to BIN, only have a space after them
+			if s := b.String(); (c < 0xA8 || c > 0xC4) && len(s) > start && s[len(s)-1] != ' ' {
+				b.WriteByte(' ')
+			}
+			b.WriteString(kw)
+			b.WriteByte(' ')
+		default:
+			if r, ok := charRune(c); ok {
+				b.WriteRune(r)
+			} else {
+				writeEscapes(&b, []uint8{c})
+			}
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func writeEscapes(b *strings.Builder, data []uint8) {
+	for _, c := range data {
+		fmt.Fprintf(b, "\\#%03d", c)
+	}
+}
+
+// charRune returns the rune for a printable character code: the runes
+// system.ScreenText uses, except that the empty block graphic is a
+// no-break space to keep it distinct from a space
+func charRune(c uint8) (rune, bool) {
+	switch {
+	case c == 0x80:
+		return '\u00A0', true
+	case c >= 0x90 && c < firstToken:
+		return system.UDGBase + rune(c-0x90), true
+	}
+	return system.CharRune(c)
+}
+
+// runeChar is the inverse of charRune
+func runeChar(r rune) (uint8, bool) {
+	switch {
+	case r == '\u00A0':
+		return 0x80, true
+	case r >= system.UDGBase && r < system.UDGBase+firstToken-0x90:
+		return uint8(0x90 + r - system.UDGBase), true
+	}
+	return system.RuneChar(r)
+}
+
+func readWord(mem Reader, addr uint16) uint16 {
+	return uint16(mem.Read(addr)) | uint16(mem.Read(addr+1))<<8
+}
+
+func writeWord(mem Memory, addr, value uint16) {
+	mem.Write(addr, uint8(value))
+	mem.Write(addr+1, uint8(value>>8))
+}
+
+// Load replaces the program in memory with a tokenized program, leaving no
+// variables and an empty edit line, as after LOAD. Memory above the edit
+// line is left alone; the program must fit below RAMTOP.
+func Load(mem Memory, prog []uint8) {
+	addr := readWord(mem, sysPROG)
+	for _, b := range prog {
+		mem.Write(addr, b)
+		addr++
+	}
+	writeWord(mem, sysVARS, addr)
+	writeWord(mem, sysNXTLIN, addr)
+	mem.Write(addr, 0x80) // End of variables
+	addr++
+	writeWord(mem, sysELINE, addr)
+	writeWord(mem, sysKCUR, addr)
+	mem.Write(addr, lineEnd)
+	mem.Write(addr+1, 0x80)
+	addr += 2
+	writeWord(mem, sysWORKSP, addr)
+	writeWord(mem, sysSTKBOT, addr)
+	writeWord(mem, sysSTKEND, addr)
+}
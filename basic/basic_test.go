@@ -0,0 +1,134 @@
+package basic
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+func TestNumberBytes(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  [5]uint8
+	}{
+		{10, [5]uint8{0x00, 0x00, 0x0A, 0x00, 0x00}},
+		{65535, [5]uint8{0x00, 0x00, 0xFF, 0xFF, 0x00}},
+		{-1, [5]uint8{0x00, 0xFF, 0xFF, 0xFF, 0x00}},
+		{0.5, [5]uint8{0x80, 0x00, 0x00, 0x00, 0x00}},
+		{-0.25, [5]uint8{0x7F, 0x80, 0x00, 0x00, 0x00}},
+		{100000, [5]uint8{0x91, 0x43, 0x50, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		got, err := NumberBytes(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("NumberBytes(%g) = % X, %v; want % X", tt.value, got, err, tt.want)
+		}
+		if v := NumberValue(got); v != tt.value {
+			t.Errorf("NumberValue(% X) = %g, want %g", got, v, tt.value)
+		}
+	}
+}
+
+func TestTokenizeDetokenize(t *testing.T) {
+	listing := `10 REM  zen80 test
+20 FOR i=1 TO 3: PRINT AT i,0;"line ";i: NEXT i
+30 LET a$="PRINT": IF a$<>"" THEN GOTO 50
+40 LET x=INT (RND*10)+BIN 101
+50 PRINT "£ ©"
+`
+	prog, err := Tokenize(listing)
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+
+	lines, err := ParseProgram(prog)
+	if err != nil || len(lines) != 5 {
+		t.Fatalf("ParseProgram: %d lines, %v", len(lines), err)
+	}
+	if !bytes.HasPrefix(lines[1].Text, []uint8{0xEB, 'i', '=', '1', numberMarker, 0, 0, 1, 0, 0, 0xCC}) {
+		t.Errorf("line 20 = % X", lines[1].Text)
+	}
+	if line, err := TokenizeLine("FOR i=1TO 3"); err != nil || !bytes.Contains(line, []uint8{0xCC}) {
+		t.Errorf("TO after a digit not tokenized: % X (%v)", line, err)
+	}
+	if !bytes.Contains(lines[2].Text, []uint8("\"PRINT\"")) {
+		t.Errorf("keyword inside a string was tokenized: % X", lines[2].Text)
+	}
+
+	text, err := Detokenize(prog)
+	if err != nil {
+		t.Fatalf("Detokenize: %v", err)
+	}
+	want := `10 REM  zen80 test
+20 FOR i=1 TO 3: PRINT AT i,0;"line ";i: NEXT i
+30 LET a$="PRINT": IF a$<>"" THEN GO TO 50
+40 LET x=INT (RND*10)+BIN 101
+50 PRINT "£ ©"
+`
+	if text != want {
+		t.Errorf("Detokenize =\n%s\nwant\n%s", text, want)
+	}
+
+	again, err := Tokenize(text)
+	if err != nil || !bytes.Equal(again, prog) {
+		t.Errorf("listing did not tokenize back to the same program (%v)", err)
+	}
+}
+
+func TestLoadAndRunInROM(t *testing.T) {
+	rom, err := os.ReadFile(filepath.Join("..", "rom", "48.rom"))
+	if err != nil {
+		t.Skipf("missing 48.rom in ../rom directory: %v", err)
+	}
+	s := system.NewSpectrum()
+	if err := s.LoadROM(rom); err != nil {
+		t.Fatalf("LoadROM: %v", err)
+	}
+	s.SetUnlimited(true)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+
+	prog, err := Tokenize("10 PRINT \"sum=\";2+3\n")
+	if err != nil {
+		t.Fatalf("Tokenize: %v", err)
+	}
+	Load(s.Memory(), prog)
+	if listed, err := List(s.Memory()); err != nil || listed != "10 PRINT \"sum=\";2+3\n" {
+		t.Errorf("List = %q, %v", listed, err)
+	}
+
+	s.TypeText("RUN\n")
+	for i := 0; i < 300 && s.Typing(); i++ {
+		s.RunFrame()
+	}
+	for i := 0; i < 20; i++ {
+		s.RunFrame()
+	}
+	if text := s.ScreenText(); !strings.Contains(text, "sum=5") {
+		t.Errorf("program output not on screen:\n%s", text)
+	}
+}
+
+func TestWriteTAP(t *testing.T) {
+	prog, _ := Tokenize("10 CLS\n")
+	var buf bytes.Buffer
+	if err := WriteTAP(&buf, "hello", prog, 10); err != nil {
+		t.Fatalf("WriteTAP: %v", err)
+	}
+	blocks, err := system.ParseTAP(buf.Bytes())
+	if err != nil || len(blocks) != 2 {
+		t.Fatalf("ParseTAP: %d blocks, %v", len(blocks), err)
+	}
+	hdr := blocks[0].Data
+	if len(hdr) != 19 || string(hdr[2:12]) != "hello     " || hdr[14] != 10 || hdr[15] != 0 {
+		t.Errorf("header = % X", hdr)
+	}
+	if !bytes.Equal(blocks[1].Data[1:len(blocks[1].Data)-1], prog) {
+		t.Errorf("data block does not hold the program")
+	}
+}
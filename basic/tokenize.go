@@ -0,0 +1,345 @@
+package basic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+// keyword is a spelling the tokenizer recognises
+type keyword struct {
+	text string
+	code uint8
+}
+
+// keywords lists every spelling, longest first so that "GO SUB" wins over
+// "GO" prefixes and "<=" over "<"
+var keywords = func() []keyword {
+	var list []keyword
+	for i, kw := range tokens {
+		list = append(list, keyword{kw, uint8(firstToken + i)})
+	}
+	list = append(list,
+		keyword{"GOTO", 0xEC},
+		keyword{"GOSUB", 0xED},
+		keyword{"DEFFN", 0xCE},
+		keyword{"OPEN#", 0xD3},
+		keyword{"CLOSE#", 0xD4},
+		keyword{"RANDOMISE", 0xF9},
+	)
+	sort.SliceStable(list, func(i, j int) bool { return len(list[i].text) > len(list[j].text) })
+	return list
+}()
+
+// Tokenize converts a text listing into a tokenized program. Each line
+// starts with its line number. Keywords may be written in any case (GOTO
+// and GOSUB are accepted too) and spaces around them are dropped, as the
+// ROM adds its own when listing. Numbers get their hidden 5-byte form.
+// \#nnn writes a raw byte, for colour controls and the like.
+func Tokenize(listing string) ([]uint8, error) {
+	var prog []uint8
+	last := 0
+	sc := bufio.NewScanner(strings.NewReader(listing))
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		digits := strings.IndexFunc(text, func(r rune) bool { return r < '0' || r > '9' })
+		if digits == -1 {
+			digits = len(text)
+		}
+		number, err := strconv.Atoi(text[:digits])
+		if err != nil || number < 1 || number > 9999 {
+			return nil, fmt.Errorf("line %d: missing or invalid line number", n)
+		}
+		if number <= last {
+			return nil, fmt.Errorf("line %d: line number %d is not after %d", n, number, last)
+		}
+		last = number
+
+		body, err := TokenizeLine(strings.TrimLeft(text[digits:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		body = append(body, lineEnd)
+		var hdr [4]uint8
+		binary.BigEndian.PutUint16(hdr[:], uint16(number))
+		binary.LittleEndian.PutUint16(hdr[2:], uint16(len(body)))
+		prog = append(prog, hdr[:]...)
+		prog = append(prog, body...)
+	}
+	return prog, sc.Err()
+}
+
+// TokenizeLine tokenizes the text of one line, without its line number or
+// the terminating ENTER
+func TokenizeLine(text string) ([]uint8, error) {
+	var out []uint8
+	runes := []rune(text)
+	inString := false
+	inBIN := false // Inside a BIN literal
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if r == '\\' && i+4 < len(runes) && runes[i+1] == '#' {
+			v, err := strconv.Atoi(string(runes[i+2 : i+5]))
+			if err != nil || v > 255 {
+				return nil, fmt.Errorf("bad escape %q", string(runes[i:i+5]))
+			}
+			out = append(out, uint8(v))
+			i += 4
+			continue
+		}
+
+		if inString {
+			c, ok := runeChar(r)
+			if !ok {
+				return nil, fmt.Errorf("no Spectrum character for %q", r)
+			}
+			out = append(out, c)
+			inString = r != '"'
+			continue
+		}
+
+		if r == '"' {
+			inString = true
+			out = append(out, '"')
+			continue
+		}
+
+		if kw, n := matchKeyword(runes, i); n > 0 {
+			out = trimSpaces(out)
+			out = append(out, kw.code)
+			i += n - 1
+			if kw.code == 0xEA { // REM: the rest of the line is literal
+				rest := runes[i+1:]
+				if len(rest) > 0 && rest[0] == ' ' {
+					rest = rest[1:]
+				}
+				for _, r := range rest {
+					c, ok := runeChar(r)
+					if !ok {
+						return nil, fmt.Errorf("no Spectrum character for %q", r)
+					}
+					out = append(out, c)
+				}
+				return out, nil
+			}
+			for i+1 < len(runes) && runes[i+1] == ' ' {
+				i++
+			}
+			inBIN = kw.code == 0xC4
+			continue
+		}
+
+		if startsNumber(runes, i) {
+			end := numberEnd(runes, i, inBIN)
+			literal := string(runes[i:end])
+			var value float64
+			var err error
+			if inBIN {
+				var v uint64
+				v, err = strconv.ParseUint(literal, 2, 16)
+				value = float64(v)
+			} else {
+				value, err = strconv.ParseFloat(literal, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", literal)
+			}
+			five, err := NumberBytes(value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, literal...)
+			out = append(out, numberMarker)
+			out = append(out, five[:]...)
+			i = end - 1
+			inBIN = false
+			continue
+		}
+
+		c, ok := runeChar(r)
+		if !ok {
+			return nil, fmt.Errorf("no Spectrum character for %q", r)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// matchKeyword finds a keyword at position i. Keywords that start or end
+// with a letter must not be part of a longer name.
+func matchKeyword(runes []rune, i int) (keyword, int) {
+	for _, kw := range keywords {
+		n := len([]rune(kw.text))
+		if i+n > len(runes) || !strings.EqualFold(string(runes[i:i+n]), kw.text) {
+			continue
+		}
+		// A keyword may follow a number, as in FOR i=1TO 3, but not a letter
+		if isLetter(rune(kw.text[0])) && i > 0 && isLetter(runes[i-1]) {
+			continue
+		}
+		if isLetter(rune(kw.text[len(kw.text)-1])) && i+n < len(runes) && isNameChar(runes[i+n]) {
+			continue
+		}
+		return kw, n
+	}
+	return keyword{}, 0
+}
+
+func trimSpaces(out []uint8) []uint8 {
+	for len(out) > 0 && out[len(out)-1] == ' ' {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+func isLetter(r rune) bool {
+	return r < 0x80 && unicode.IsLetter(r)
+}
+
+func isNameChar(r rune) bool {
+	return isLetter(r) || r >= '0' && r <= '9'
+}
+
+// startsNumber reports whether a numeric literal starts at i, as opposed
+// to digits inside a variable name such as a1
+func startsNumber(runes []rune, i int) bool {
+	r := runes[i]
+	if r == '.' {
+		if i+1 >= len(runes) || runes[i+1] < '0' || runes[i+1] > '9' {
+			return false
+		}
+	} else if r < '0' || r > '9' {
+		return false
+	}
+	return i == 0 || !isNameChar(runes[i-1])
+}
+
+// numberEnd returns the end of the literal starting at i
+func numberEnd(runes []rune, i int, bin bool) int {
+	digit := func(r rune) bool { return r >= '0' && r <= '9' }
+	if bin {
+		for i < len(runes) && (runes[i] == '0' || runes[i] == '1') {
+			i++
+		}
+		return i
+	}
+	for i < len(runes) && digit(runes[i]) {
+		i++
+	}
+	if i < len(runes) && runes[i] == '.' {
+		i++
+		for i < len(runes) && digit(runes[i]) {
+			i++
+		}
+	}
+	if i+1 < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+		j := i + 1
+		if runes[j] == '+' || runes[j] == '-' {
+			j++
+		}
+		if j < len(runes) && digit(runes[j]) {
+			for j < len(runes) && digit(runes[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
+
+// NumberBytes returns the 5-byte floating point form of a number: the
+// small integer form for whole numbers up to 65535 in magnitude, and
+// exponent plus 32-bit mantissa otherwise
+func NumberBytes(v float64) ([5]uint8, error) {
+	var b [5]uint8
+	if v == math.Trunc(v) && math.Abs(v) <= 65535 {
+		n := int(v)
+		if n < 0 {
+			b[1] = 0xFF
+			n += 65536
+		}
+		b[2], b[3] = uint8(n), uint8(n>>8)
+		return b, nil
+	}
+
+	frac, exp := math.Frexp(math.Abs(v))
+	mantissa := math.Round(frac * (1 << 32))
+	if mantissa >= 1<<32 {
+		mantissa /= 2
+		exp++
+	}
+	if exp+128 < 1 || exp+128 > 255 {
+		return b, fmt.Errorf("number %g out of range", v)
+	}
+	m := uint32(mantissa) &^ 0x80000000
+	if v < 0 {
+		m |= 0x80000000
+	}
+	b[0] = uint8(exp + 128)
+	binary.BigEndian.PutUint32(b[1:], m)
+	return b, nil
+}
+
+// NumberValue decodes a 5-byte floating point number
+func NumberValue(b [5]uint8) float64 {
+	if b[0] == 0 {
+		n := int(b[2]) | int(b[3])<<8
+		if b[1] == 0xFF {
+			n -= 65536
+		}
+		return float64(n)
+	}
+	m := binary.BigEndian.Uint32(b[1:])
+	v := math.Ldexp(float64(m|0x80000000)/(1<<32), int(b[0])-128)
+	if m&0x80000000 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// TAPBlocks returns the header and data blocks that SAVE "name" LINE n
+// writes for a program without variables. A negative autostart line
+// saves without LINE.
+func TAPBlocks(name string, prog []uint8, autostart int) []system.TapeBlock {
+	header := make([]uint8, 18)
+	header[0] = 0x00 // Header flag
+	header[1] = 0x00 // Program
+	copy(header[2:12], fmt.Sprintf("%-10.10s", name))
+	if autostart < 0 || autostart > 9999 {
+		autostart = 32768
+	}
+	binary.LittleEndian.PutUint16(header[12:], uint16(len(prog)))
+	binary.LittleEndian.PutUint16(header[14:], uint16(autostart))
+	binary.LittleEndian.PutUint16(header[16:], uint16(len(prog))) // Start of variables
+	data := append([]uint8{0xFF}, prog...)
+
+	return []system.TapeBlock{
+		{Data: withChecksum(header), Standard: true, Pause: system.StandardPause},
+		{Data: withChecksum(data), Standard: true, Pause: system.StandardPause},
+	}
+}
+
+// WriteTAP writes a program as a TAP file
+func WriteTAP(w io.Writer, name string, prog []uint8, autostart int) error {
+	return system.WriteTAP(w, TAPBlocks(name, prog, autostart))
+}
+
+func withChecksum(block []uint8) []uint8 {
+	var sum uint8
+	for _, b := range block {
+		sum ^= b
+	}
+	return append(block, sum)
+}
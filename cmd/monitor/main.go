@@ -0,0 +1,129 @@
+// Command monitor is a machine-code monitor in the tradition of the ROM
+// monitors of 8-bit computers. It examines and changes registers and
+// memory, lists and assembles code, loads and saves binary files, reads
+// and writes I/O ports and runs code under breakpoints and watchpoints.
+//
+// By default the machine is a Z80 with 64K of RAM and mapped I/O, with
+// any file loaded at -org where execution starts. -console makes writes
+// to a port print characters. With -spectrum it is a ZX Spectrum instead,
+// and a .sna, .z80 or .szx file is loaded as a snapshot. Its history is
+// kept, so the monitor can step back, go back frames and rewind.
+//
+// Usage:
+//
+//	monitor [flags] [file]
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ha1tch/zen80/debug"
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/system"
+	"github.com/ha1tch/zen80/z80"
+)
+
+type options struct {
+	spectrum bool
+	model    string
+	romDir   string
+	org      string
+	console  string
+	history  bool
+}
+
+func main() {
+	var opt options
+	flag.BoolVar(&opt.spectrum, "spectrum", false, "monitor a ZX Spectrum instead of a bare Z80 with RAM")
+	flag.StringVar(&opt.model, "model", "48k", "Spectrum model: 48k, 128k, plus2, plus2a, plus3, pentagon")
+	flag.StringVar(&opt.romDir, "rom", "rom", "directory holding the Spectrum ROM images")
+	flag.StringVar(&opt.org, "org", "0", "address (hex) to load a binary file at and start from")
+	flag.StringVar(&opt.console, "console", "", "port (hex) whose writes print characters, for the bare Z80")
+	flag.BoolVar(&opt.history, "history", true, "keep the last minute of the Spectrum's history, so that tb, fb and rw can go back")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	m, err := newMachine(opt, flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "monitor: %v\n", err)
+		os.Exit(2)
+	}
+	mon := newMonitor(debug.New(m), bufio.NewScanner(os.Stdin), os.Stdout)
+	mon.Run()
+}
+
+// newMachine builds the machine and loads the file, if any
+func newMachine(opt options, file string) (debug.Machine, error) {
+	org, err := strconv.ParseUint(strings.TrimPrefix(opt.org, "0x"), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad -org %q", opt.org)
+	}
+	var data []uint8
+	format := ""
+	if file != "" {
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	}
+
+	if opt.spectrum {
+		model, err := system.ParseModel(opt.model)
+		if err != nil {
+			return nil, err
+		}
+		spec, err := system.NewSpectrumROMDir(model, opt.romDir)
+		if err != nil {
+			return nil, err
+		}
+		spec.SetUnlimited(true)
+		switch {
+		case format == "sna" || format == "z80" || format == "szx":
+			if err := spec.LoadSnapshotFormat(format, data); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		case file != "":
+			for i := range data {
+				spec.CPU.Memory.Write(uint16(org)+uint16(i), data[i])
+			}
+			spec.CPU.PC = uint16(org)
+		}
+		m := debug.NewSpectrum(spec)
+		if opt.history {
+			if err := m.RecordHistory(system.HistoryOptions{}); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	mem := memory.NewRAM()
+	mem.Load(uint16(org), data)
+	ports := zio.NewMappedIO()
+	if opt.console != "" {
+		port, err := strconv.ParseUint(strings.TrimPrefix(opt.console, "0x"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad -console %q", opt.console)
+		}
+		ports.RegisterWriteHandler(uint16(port), func(_ uint16, value uint8) {
+			os.Stdout.Write([]uint8{value})
+		})
+	}
+	cpu := z80.New(mem, ports)
+	cpu.PC = uint16(org)
+	return debug.NewCPU(cpu), nil
+}
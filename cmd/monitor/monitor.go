@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ha1tch/zen80/asm"
+	"github.com/ha1tch/zen80/debug"
+	"github.com/ha1tch/zen80/disasm"
+	"github.com/ha1tch/zen80/trace"
+)
+
+const helpText = `Numbers are hex. An address may also be a register, as in "u pc";
+write hex that reads as a register name with $, as in "d $de".
+  r [REG=VALUE ...]        show registers, or set them first
+  d [ADDR [LEN]]           dump memory
+  e ADDR BYTE...           enter bytes; "text" enters characters
+  f ADDR LEN BYTE...       fill memory with a pattern
+  c SRC DST LEN            copy memory
+  h ADDR LEN BYTE...       hunt for bytes
+  u [ADDR [N]]             disassemble N instructions
+  a [ADDR]                 assemble lines until an empty one
+  load FILE [ADDR]         load a binary file (default at PC)
+  save FILE ADDR LEN       save memory to a file
+  b [ADDR]                 set a breakpoint, or list them
+  bc ADDR|*                clear breakpoints
+  w [ADDR [LEN] [r|w|rw]]  watch memory (default rw), or list watchpoints
+  wc ADDR|*                clear watchpoints
+  t [N]                    trace N instructions
+  n                        next: step over calls, loops and block instructions
+  ret                      run until the current subroutine returns
+  tb [N]                   step back N instructions, with -history
+  fb [N]                   go back N frames, with -history
+  rw SECONDS               rewind by SECONDS (decimal) of emulated time
+  g [ADDR]                 go until a breakpoint, watchpoint or Ctrl-C
+  i PORT                   read an I/O port
+  o PORT VALUE             write an I/O port
+  reset                    reset the machine
+  q                        quit
+`
+
+// dumpLen and listLen are what d and u show by default
+const (
+	dumpLen = 0x80
+	listLen = 16
+)
+
+type monitor struct {
+	d    *debug.Debugger
+	in   *bufio.Scanner
+	out  io.Writer
+	dump uint16 // Where d carries on from
+	list uint16 // Where u carries on from
+}
+
+func newMonitor(d *debug.Debugger, in *bufio.Scanner, out io.Writer) *monitor {
+	pc := d.CPU().PC
+	return &monitor{d: d, in: in, out: out, dump: pc, list: pc}
+}
+
+// Run reads and runs commands until q or the end of the input
+func (m *monitor) Run() {
+	name := "Z80"
+	if n, ok := m.d.Machine().(debug.Named); ok {
+		name = "ZX Spectrum " + n.Name()
+	}
+	fmt.Fprintf(m.out, "zen80 monitor: %s. Type ? for help.\n", name)
+	m.registers()
+	for {
+		fmt.Fprint(m.out, "> ")
+		if !m.in.Scan() {
+			fmt.Fprintln(m.out)
+			return
+		}
+		quit, err := m.exec(m.in.Text())
+		if err != nil {
+			fmt.Fprintf(m.out, "error: %v\n", err)
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// exec runs one command line
+func (m *monitor) exec(line string) (quit bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	cmd, args := strings.ToLower(fields[0]), fields[1:]
+	rest := strings.TrimSpace(strings.TrimSpace(line)[len(fields[0]):])
+	switch cmd {
+	case "?", "help":
+		fmt.Fprint(m.out, helpText)
+	case "q", "quit":
+		return true, nil
+	case "r":
+		err = m.setRegisters(args)
+	case "d":
+		err = m.dumpMemory(args)
+	case "e":
+		err = m.enter(rest)
+	case "f":
+		err = m.fill(rest)
+	case "c":
+		err = m.copyMemory(args)
+	case "h":
+		err = m.hunt(rest)
+	case "u":
+		err = m.disassemble(args)
+	case "a":
+		err = m.assemble(args)
+	case "load":
+		err = m.load(args)
+	case "save":
+		err = m.save(args)
+	case "b", "bc":
+		err = m.breakpoints(cmd == "bc", args)
+	case "w", "wc":
+		err = m.watchpoints(cmd == "wc", args)
+	case "t":
+		err = m.trace(args)
+	case "n":
+		m.running(m.d.StepOver)
+	case "ret":
+		m.running(m.d.StepOut)
+	case "tb", "fb":
+		err = m.back(cmd == "fb", args)
+	case "rw":
+		err = m.rewind(args)
+	case "g":
+		if len(args) > 0 {
+			pc, err := m.addr(args[0])
+			if err != nil {
+				return false, err
+			}
+			m.d.SetRegister("PC", pc)
+		}
+		m.running(m.d.Continue)
+	case "i":
+		err = m.portIn(args)
+	case "o":
+		err = m.portOut(args)
+	case "reset":
+		if err = m.d.Reset(); err == nil {
+			m.registers()
+		}
+	default:
+		// The machine may have commands of its own
+		c, ok := m.d.Machine().(debug.Commander)
+		if !ok {
+			return false, fmt.Errorf("unknown command %q; ? lists them", cmd)
+		}
+		out, err := c.Command(strings.TrimSpace(line))
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprint(m.out, out)
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			fmt.Fprintln(m.out)
+		}
+	}
+	return false, err
+}
+
+// registers shows the registers and the next instruction
+func (m *monitor) registers() {
+	z := m.d.CPU()
+	reg := func(name string) uint16 {
+		v, _ := m.d.Register(name)
+		return v
+	}
+	ints := "DI"
+	if z.IFF1 {
+		ints = "EI"
+	}
+	fmt.Fprintf(m.out, "AF=%04X BC=%04X DE=%04X HL=%04X IX=%04X IY=%04X SP=%04X PC=%04X\n",
+		reg("AF"), reg("BC"), reg("DE"), reg("HL"), reg("IX"), reg("IY"), z.SP, z.PC)
+	fmt.Fprintf(m.out, "AF'=%04X BC'=%04X DE'=%04X HL'=%04X I=%02X R=%02X IM%d %s  %s\n",
+		reg("AF'"), reg("BC'"), reg("DE'"), reg("HL'"), z.I, z.R, z.IM, ints, trace.Flags(z.F))
+	m.instruction(z.PC)
+}
+
+// instruction shows one instruction and returns its length
+func (m *monitor) instruction(addr uint16) int {
+	in := m.d.Disassemble(addr)
+	fmt.Fprintf(m.out, "%04X  %-12s %s\n", in.Addr, disasm.HexBytes(in.Bytes), in)
+	return in.Len()
+}
+
+func (m *monitor) setRegisters(args []string) error {
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("want REG=VALUE, not %q", arg)
+		}
+		v, err := parseHex(value)
+		if err != nil {
+			return err
+		}
+		if err := m.d.SetRegister(name, v); err != nil {
+			return err
+		}
+	}
+	m.registers()
+	return nil
+}
+
+func (m *monitor) dumpMemory(args []string) error {
+	addr, n := m.dump, dumpLen
+	if len(args) > 0 {
+		var err error
+		if addr, err = m.addr(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		v, err := parseHex(args[1])
+		if err != nil {
+			return err
+		}
+		n = int(v)
+	}
+	data := m.d.ReadBlock(addr, n)
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		var hex, text strings.Builder
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			if j >= len(line) {
+				hex.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hex, "%02X ", line[j])
+			if c := line[j]; c >= 0x20 && c < 0x7F {
+				text.WriteByte(c)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(m.out, "%04X  %s %s\n", addr+uint16(i), hex.String(), text.String())
+	}
+	m.dump = addr + uint16(n)
+	return nil
+}
+
+// addrAndBytes splits "ADDR [LEN] BYTE..." for e, f and h
+func (m *monitor) addrAndBytes(rest string, withLen bool) (addr uint16, n int, data []uint8, err error) {
+	fields := strings.Fields(rest)
+	want := 2
+	if withLen {
+		want = 3
+	}
+	if len(fields) < want {
+		return 0, 0, nil, fmt.Errorf("missing arguments; ? shows them")
+	}
+	if addr, err = m.addr(fields[0]); err != nil {
+		return
+	}
+	rest = strings.TrimSpace(rest[len(fields[0]):])
+	if withLen {
+		var v uint16
+		if v, err = parseHex(fields[1]); err != nil {
+			return
+		}
+		n = int(v)
+		rest = strings.TrimSpace(rest[len(fields[1]):])
+	}
+	data, err = parseBytes(rest)
+	return
+}
+
+func (m *monitor) enter(rest string) error {
+	addr, _, data, err := m.addrAndBytes(rest, false)
+	if err != nil {
+		return err
+	}
+	m.d.WriteBlock(addr, data)
+	return nil
+}
+
+func (m *monitor) fill(rest string) error {
+	addr, n, pattern, err := m.addrAndBytes(rest, true)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		m.d.Write(addr+uint16(i), pattern[i%len(pattern)])
+	}
+	return nil
+}
+
+func (m *monitor) copyMemory(args []string) error {
+	v, err := m.hexArgs(args, 3)
+	if err != nil {
+		return err
+	}
+	// Read it all first so overlapping copies work either way
+	m.d.WriteBlock(v[1], m.d.ReadBlock(v[0], int(v[2])))
+	return nil
+}
+
+func (m *monitor) hunt(rest string) error {
+	addr, n, want, err := m.addrAndBytes(rest, true)
+	if err != nil {
+		return err
+	}
+	data := m.d.ReadBlock(addr, n+len(want)-1)
+	found := 0
+	for i := 0; i < n; i++ {
+		if slices.Equal(data[i:i+len(want)], want) {
+			fmt.Fprintf(m.out, "%04X ", addr+uint16(i))
+			if found++; found%8 == 0 {
+				fmt.Fprintln(m.out)
+			}
+		}
+	}
+	if found == 0 {
+		fmt.Fprintln(m.out, "not found")
+	} else if found%8 != 0 {
+		fmt.Fprintln(m.out)
+	}
+	return nil
+}
+
+func (m *monitor) disassemble(args []string) error {
+	addr, n := m.list, listLen
+	if len(args) > 0 {
+		var err error
+		if addr, err = m.addr(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		v, err := parseHex(args[1])
+		if err != nil {
+			return err
+		}
+		n = int(v)
+	}
+	for i := 0; i < n; i++ {
+		addr += uint16(m.instruction(addr))
+	}
+	m.list = addr
+	return nil
+}
+
+// assemble reads instructions into memory, one per line, until an empty
+// line. A line that does not assemble can be typed again.
+func (m *monitor) assemble(args []string) error {
+	addr := m.d.CPU().PC
+	if len(args) > 0 {
+		var err error
+		if addr, err = m.addr(args[0]); err != nil {
+			return err
+		}
+	}
+	m.list = addr
+	for {
+		fmt.Fprintf(m.out, "%04X  ", addr)
+		if !m.in.Scan() || strings.TrimSpace(m.in.Text()) == "" {
+			return nil
+		}
+		code, err := asm.Assembler{Hex: true}.Assemble(m.in.Text(), addr)
+		if err != nil {
+			fmt.Fprintf(m.out, "error: %v\n", err)
+			continue
+		}
+		m.d.WriteBlock(addr, code)
+		addr += uint16(len(code))
+	}
+}
+
+func (m *monitor) load(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing file name")
+	}
+	addr := m.d.CPU().PC
+	if len(args) > 1 {
+		var err error
+		if addr, err = m.addr(args[1]); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(data) > 0x10000 {
+		return fmt.Errorf("%s is bigger than 64K", args[0])
+	}
+	m.d.WriteBlock(addr, data)
+	fmt.Fprintf(m.out, "%X bytes loaded at %04X-%04X\n", len(data), addr, addr+uint16(len(data))-1)
+	return nil
+}
+
+func (m *monitor) save(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("want FILE ADDR LEN")
+	}
+	v, err := m.hexArgs(args[1:], 2)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(args[0], m.d.ReadBlock(v[0], int(v[1])), 0o644)
+}
+
+func (m *monitor) breakpoints(clear bool, args []string) error {
+	switch {
+	case clear && len(args) > 0 && args[0] == "*":
+		m.d.ClearBreakpoints()
+	case len(args) > 0:
+		addr, err := m.addr(args[0])
+		if err != nil {
+			return err
+		}
+		if clear {
+			m.d.RemoveBreakpoint(addr)
+		} else {
+			m.d.AddBreakpoint(addr)
+		}
+	case clear:
+		return fmt.Errorf("want an address or *")
+	default:
+		list := m.d.Breakpoints()
+		slices.Sort(list)
+		for _, addr := range list {
+			m.instruction(addr)
+		}
+	}
+	return nil
+}
+
+func (m *monitor) watchpoints(clear bool, args []string) error {
+	switch {
+	case clear && len(args) > 0 && args[0] == "*":
+		m.d.ClearWatchpoints()
+	case clear && len(args) > 0:
+		addr, err := m.addr(args[0])
+		if err != nil {
+			return err
+		}
+		for _, w := range m.d.Watchpoints() {
+			if w.Addr == addr {
+				m.d.RemoveWatchpoint(w.Addr, w.Len)
+			}
+		}
+	case clear:
+		return fmt.Errorf("want an address or *")
+	case len(args) > 0:
+		w := debug.Watchpoint{Len: 1, Read: true, Write: true}
+		var err error
+		if w.Addr, err = m.addr(args[0]); err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			n, err := parseHex(args[1])
+			if err != nil {
+				return err
+			}
+			w.Len = int(n)
+		}
+		if len(args) > 2 {
+			mode := strings.ToLower(args[2])
+			w.Read, w.Write = strings.Contains(mode, "r"), strings.Contains(mode, "w")
+			if !w.Read && !w.Write || strings.Trim(mode, "rw") != "" {
+				return fmt.Errorf("want r, w or rw, not %q", args[2])
+			}
+		}
+		m.d.AddWatchpoint(w)
+	default:
+		for _, w := range m.d.Watchpoints() {
+			mode := ""
+			if w.Read {
+				mode += "r"
+			}
+			if w.Write {
+				mode += "w"
+			}
+			fmt.Fprintf(m.out, "%04X-%04X %s\n", w.Addr, w.Addr+uint16(max(w.Len, 1)-1), mode)
+		}
+	}
+	return nil
+}
+
+// trace steps N instructions, listing them as they run, and stops early
+// at a watchpoint or breakpoint
+func (m *monitor) trace(args []string) error {
+	n := 1
+	if len(args) > 0 {
+		v, err := parseHex(args[0])
+		if err != nil {
+			return err
+		}
+		n = int(v)
+	}
+	e := debug.Event{Reason: debug.Stepped}
+	for i := 0; i < n; i++ {
+		if n > 1 {
+			m.instruction(m.d.CPU().PC)
+		}
+		if e = m.d.Step(); e.Reason != debug.Stepped {
+			break
+		}
+		if pc := m.d.CPU().PC; i < n-1 && slices.Contains(m.d.Breakpoints(), pc) {
+			e = debug.Event{Reason: debug.Breakpoint, Addr: pc}
+			break
+		}
+	}
+	m.report(e)
+	return nil
+}
+
+// back steps back N instructions, or goes back N frames
+func (m *monitor) back(frames bool, args []string) error {
+	n := 1
+	if len(args) > 0 {
+		v, err := parseHex(args[0])
+		if err != nil {
+			return err
+		}
+		n = int(v)
+	}
+	var err error
+	if frames {
+		err = m.d.FrameBack(n)
+	} else {
+		for i := 0; i < n && err == nil; i++ {
+			err = m.d.StepBack()
+		}
+	}
+	m.registers()
+	return err
+}
+
+// rewind goes back by a number of seconds
+func (m *monitor) rewind(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("want the seconds to rewind")
+	}
+	secs, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || secs < 0 {
+		return fmt.Errorf("bad number of seconds %q", args[0])
+	}
+	err = m.d.Rewind(time.Duration(secs * float64(time.Second)))
+	m.registers()
+	return err
+}
+
+// running runs the machine with Ctrl-C stopping it rather than the
+// monitor
+func (m *monitor) running(run func(stop func() bool) debug.Event) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	m.report(run(func() bool {
+		select {
+		case <-sig:
+			return true
+		default:
+			return false
+		}
+	}))
+}
+
+// report says why the machine stopped, if not just because a step
+// finished, and shows where it is
+func (m *monitor) report(e debug.Event) {
+	if e.Reason != debug.Stepped {
+		fmt.Fprintf(m.out, "Stopped: %s\n", e)
+	}
+	m.registers()
+	m.list = m.d.CPU().PC
+}
+
+func (m *monitor) portIn(args []string) error {
+	v, err := m.hexArgs(args, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(m.out, "%02X\n", m.d.CPU().IO.In(v[0]))
+	return nil
+}
+
+func (m *monitor) portOut(args []string) error {
+	v, err := m.hexArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	if v[1] > 0xFF {
+		return fmt.Errorf("value %X is not a byte", v[1])
+	}
+	m.d.CPU().IO.Out(v[0], uint8(v[1]))
+	m.d.Changed()
+	return nil
+}
+
+// hexArgs parses exactly n numeric arguments; the first may be a register
+func (m *monitor) hexArgs(args []string, n int) ([]uint16, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("want %d arguments; ? shows them", n)
+	}
+	out := make([]uint16, n)
+	for i, arg := range args {
+		var err error
+		if i == 0 {
+			out[i], err = m.addr(arg)
+		} else {
+			out[i], err = parseHex(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// addr parses an address, which is a register name or hex. Register
+// names come first, so hex such as DE is written $DE.
+func (m *monitor) addr(s string) (uint16, error) {
+	if v, err := m.d.Register(s); err == nil {
+		return v, nil
+	}
+	if v, err := parseHex(s); err == nil {
+		return v, nil
+	}
+	return 0, fmt.Errorf("bad address %q", s)
+}
+
+// parseHex parses a hex number, which may also be written $FF, 0xFF,
+// #FF or FFh
+func parseHex(s string) (uint16, error) {
+	t := strings.ToLower(s)
+	for _, prefix := range []string{"$", "0x", "#"} {
+		t = strings.TrimPrefix(t, prefix)
+	}
+	if len(t) > 1 {
+		t = strings.TrimSuffix(t, "h")
+	}
+	v, err := strconv.ParseUint(t, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint16(v), nil
+}
+
+// parseBytes parses hex bytes and "quoted text", separated by spaces or
+// commas
+func parseBytes(s string) ([]uint8, error) {
+	var out []uint8
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " \t,") {
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated text")
+			}
+			out = append(out, s[1:end+1]...)
+			s = s[end+2:]
+			continue
+		}
+		field := s
+		if i := strings.IndexAny(s, " \t,"); i >= 0 {
+			field = s[:i]
+		}
+		v, err := parseHex(field)
+		if err != nil || v > 0xFF {
+			return nil, fmt.Errorf("bad byte %q", field)
+		}
+		out = append(out, uint8(v))
+		s = s[len(field):]
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no bytes given")
+	}
+	return out, nil
+}
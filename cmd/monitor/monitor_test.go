@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/debug"
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// runScript runs monitor commands on a bare Z80 and returns the output
+func runScript(t *testing.T, script string) string {
+	t.Helper()
+	cpu := z80.New(memory.NewRAM(), zio.NewMappedIO())
+	cpu.PC = 0x8000
+	var out bytes.Buffer
+	newMonitor(debug.New(debug.NewCPU(cpu)), bufio.NewScanner(strings.NewReader(script)), &out).Run()
+	return out.String()
+}
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]uint16{"ff": 0xFF, "$8000": 0x8000, "0x10": 0x10, "#c0": 0xC0, "0Ah": 0x0A} {
+		if v, err := parseHex(s); err != nil || v != want {
+			t.Errorf("parseHex(%q) = %X, %v", s, v, err)
+		}
+	}
+	for _, s := range []string{"h", "10000", "g"} {
+		if v, err := parseHex(s); err == nil {
+			t.Errorf("parseHex(%q) = %X", s, v)
+		}
+	}
+	got, err := parseBytes(`3e 1,"hi" ff`)
+	if err != nil || !bytes.Equal(got, []uint8{0x3E, 0x01, 'h', 'i', 0xFF}) {
+		t.Errorf("parseBytes = % X, %v", got, err)
+	}
+	for _, s := range []string{"", "100", `"open`, "zz"} {
+		if b, err := parseBytes(s); err == nil {
+			t.Errorf("parseBytes(%q) = % X", s, b)
+		}
+	}
+}
+
+func TestRegisterAddresses(t *testing.T) {
+	out := runScript(t, `e 9000 3e 01
+r de=9000
+u de 1
+d $de 1
+q
+`)
+	for _, want := range []string{"9000  3e 01", "00DE  00"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	out := runScript(t, `a
+ld hl,9000
+ld (hl),42
+inc hl
+jr $-3
+
+b 8006
+g
+d 9000 2
+t
+r a=7
+frob
+q
+`)
+	for _, want := range []string{
+		"8006  ",                      // a prompts for the address after the last instruction
+		"Stopped: breakpoint at 8006", // g ran to the breakpoint
+		"9000  42 00",                 // The loop stored one byte
+		"PC=8003",                     // t took the jump
+		"AF=07",                       // r set A
+		"error: unknown command \"frob\"",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "error: cannot assemble") {
+		t.Errorf("assembly failed:\n%s", out)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ha1tch/zen80/system"
+	"github.com/ha1tch/zen80/term"
+)
+
+// interactive runs the machine in real time, drawing every frame in the
+// terminal and typing the keys read from stdin, until Ctrl-C or until
+// frame returns true
+func interactive(spec *system.Spectrum, scale int, frame func() bool) error {
+	if restore, err := term.MakeRaw(os.Stdin); err == nil {
+		defer restore()
+	} else {
+		fmt.Fprintf(os.Stderr, "spectrum: no keyboard input: %v\r\n", err)
+	}
+	fmt.Print("\x1b[?25l\x1b[2J") // Hide the cursor and clear the screen
+	defer fmt.Print("\x1b[0m\x1b[?25h\r\n")
+
+	input := make(chan []uint8)
+	go func() {
+		buf := make([]uint8, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- append([]uint8(nil), buf[:n]...)
+		}
+	}()
+
+	r := term.NewRenderer(scale)
+	for {
+		select {
+		case data, ok := <-input:
+			if !ok {
+				input = nil // Stdin closed: keep running without input
+				break
+			}
+			strokes, quit := term.DecodeKeys(data)
+			if quit {
+				return nil
+			}
+			for _, keys := range strokes {
+				spec.QueueKeys(keys...)
+			}
+		default:
+		}
+		if frame() {
+			return nil
+		}
+		if err := r.Draw(os.Stdout, spec.Render()); err != nil {
+			return err
+		}
+	}
+}
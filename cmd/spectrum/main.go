@@ -1,189 +1,435 @@
+// Command spectrum runs a ZX Spectrum without a display. It boots a model
+// with ROMs from a directory, loads a snapshot, tape, screen or RZX
+// recording, can type text, runs until a frame limit or a condition is met
+// and writes a screenshot (PNG or SCR), beeper audio, a GIF or Y4M video
+// and a final snapshot. It can also write an instruction trace of
+// everything run after loading, or hand the machine to a remote debugger
+// such as DeZog with -zrcp or gdb with -gdb. With -term it draws the
+// screen in the terminal and takes keyboard input instead.
+//
+// Usage:
+//
+//	spectrum [flags] [file.sna|.z80|.szx|.tap|.csw|.wav|.rzx|.scr]
+//
+// It exits with status 1 if an -until condition was given and not met
+// within -frames frames, so it can be used in scripts.
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
-	"log"
-	"time"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/ha1tch/zen80/debug"
+	"github.com/ha1tch/zen80/gdbstub"
 	"github.com/ha1tch/zen80/system"
+	"github.com/ha1tch/zen80/term"
+	"github.com/ha1tch/zen80/trace"
+	"github.com/ha1tch/zen80/video"
+	"github.com/ha1tch/zen80/zrcp"
 )
 
+type options struct {
+	model      string
+	romDir     string
+	frames     int
+	boot       int
+	untilPC    string
+	untilText  string
+	typeText   string
+	screenshot string
+	shotScale  int
+	noBorder   bool
+	audio      string
+	audioRate  int
+	record     string
+	recSkip    int
+	recScale   int
+	save       string
+	printText  bool
+	ansi       bool
+	term       bool
+	termScale  int
+	realtime   bool
+	trace      string
+	traceFmt   string
+	traceRing  int
+	tracePC    string
+	zrcp       string
+	gdb        string
+}
+
 func main() {
-	fmt.Println("=== ZX Spectrum Timing Test ===")
-	
-	// Create a Spectrum system
-	spec := system.NewSpectrum()
-	
-	// Load a simple test ROM (just NOPs and a jump loop)
-	testROM := make([]uint8, 16384)
-	// Simple infinite loop at address 0:
-	// 0000: NOP (4 cycles)
-	// 0001: NOP (4 cycles)  
-	// 0002: JP 0000 (10 cycles)
-	// Total: 18 cycles per loop
-	testROM[0] = 0x00  // NOP
-	testROM[1] = 0x00  // NOP
-	testROM[2] = 0xC3  // JP nn
-	testROM[3] = 0x00  // Low byte of address
-	testROM[4] = 0x00  // High byte of address
-	
-	err := spec.LoadROM(testROM)
+	var opt options
+	flag.StringVar(&opt.model, "model", "", "machine model: 48k, 128k, plus2, plus2a, plus3, pentagon (default: from the file, else 48k)")
+	flag.StringVar(&opt.romDir, "rom", "rom", "directory holding the ROM images")
+	flag.IntVar(&opt.frames, "frames", 500, "maximum number of frames to run after loading")
+	flag.IntVar(&opt.boot, "boot", 0, "frames to run before loading a tape or typing (default: 150, or 0 for snapshots)")
+	flag.StringVar(&opt.untilPC, "until-pc", "", "stop when PC reaches this address (hex, e.g. 0x8000)")
+	flag.StringVar(&opt.untilText, "until-text", "", "stop when this text appears on screen")
+	flag.StringVar(&opt.typeText, "type", "", "text to type once booted; \\n is ENTER")
+	flag.StringVar(&opt.screenshot, "screenshot", "", "write the final screen to this .png or .scr file")
+	flag.IntVar(&opt.shotScale, "screenshot-scale", 1, "pixel magnification of PNG screenshots")
+	flag.BoolVar(&opt.noBorder, "no-border", false, "leave the border out of PNG screenshots")
+	flag.StringVar(&opt.audio, "audio", "", "write the beeper output to this WAV file")
+	flag.IntVar(&opt.audioRate, "audio-rate", 44100, "audio sample rate")
+	flag.StringVar(&opt.record, "record", "", "record video to this .gif or .y4m file, with the audio in a .wav file alongside unless -audio is given")
+	flag.IntVar(&opt.recSkip, "record-skip", 0, "frames to drop after each recorded frame")
+	flag.IntVar(&opt.recScale, "record-scale", 1, "pixel magnification of the recorded video")
+	flag.StringVar(&opt.save, "save", "", "write a final snapshot (.sna, .z80 or .szx)")
+	flag.BoolVar(&opt.printText, "text", false, "print the final screen as text")
+	flag.BoolVar(&opt.ansi, "ansi", false, "print the final screen as ANSI colour graphics")
+	flag.BoolVar(&opt.term, "term", false, "show the screen in the terminal and take keyboard input until Ctrl-C (ignores -frames)")
+	flag.IntVar(&opt.termScale, "term-scale", 2, "shrink factor for -term and -ansi")
+	flag.BoolVar(&opt.realtime, "realtime", false, "run at the real speed instead of as fast as possible")
+	flag.StringVar(&opt.trace, "trace", "", "write an instruction trace of the session after loading to this file")
+	flag.StringVar(&opt.traceFmt, "trace-format", "text", "trace format: text, mame or binary")
+	flag.IntVar(&opt.traceRing, "trace-ring", 0, "trace only the last N instructions, written when the session ends")
+	flag.StringVar(&opt.tracePC, "trace-pc", "", "trace only instructions in these comma-separated hex ranges, e.g. 8000-80FF,38")
+	flag.StringVar(&opt.zrcp, "zrcp", "", "after loading, serve one ZEsarUX remote protocol (DeZog) session on this address, e.g. "+zrcp.DefaultAddr+", instead of running frames")
+	flag.StringVar(&opt.gdb, "gdb", "", "after loading, serve one GDB remote protocol session on this address, e.g. "+gdbstub.DefaultAddr+", instead of running frames")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	met, err := run(opt, flag.Arg(0))
 	if err != nil {
-		log.Fatal(err)
-	}
-	
-	// Reset and run for exactly 1 second
-	spec.Reset()
-	
-	// Run in a goroutine
-	done := make(chan bool)
-	go func() {
-		startTime := time.Now()
-		frameCount := 0
-		startCycles := spec.CPU.Cycles
-		
-		for time.Since(startTime) < time.Second {
-			spec.RunFrame()
-			frameCount++
-		}
-		
-		endCycles := spec.CPU.Cycles
-		done <- true
-		fmt.Printf("Frames executed in 1 second: %d (target: 50)\n", frameCount)
-		fmt.Printf("CPU cycles executed: %d (expected: ~3,500,000)\n", endCycles - startCycles)
-	}()
-	
-	// Wait for completion
-	<-done
-	
-	// Get statistics
-	stats := spec.GetStatistics()
-	fmt.Printf("\n=== Timing Statistics ===\n")
-	fmt.Printf("Target CPU frequency: %.0f Hz\n", stats.TargetHz)
-	fmt.Printf("Actual CPU frequency: %.0f Hz\n", stats.ActualHz)
-	fmt.Printf("Accuracy: %.2f%%\n", (stats.ActualHz/stats.TargetHz)*100)
-	fmt.Printf("Frame rate: %.2f FPS (target: 50)\n", stats.FrameRate)
-	fmt.Printf("Total cycles: %d\n", stats.TotalCycles)
-	fmt.Printf("CPU Cycles counter: %d\n", spec.CPU.Cycles)
-	
-	// Test different speed multipliers
-	fmt.Println("\n=== Speed Multiplier Test ===")
-	testSpeeds := []float64{0.5, 1.0, 2.0}
-	
-	for _, speed := range testSpeeds {
-		spec.Reset()
-		spec.SetSpeed(speed)
-		
-		startTime := time.Now()
-		startCycles := spec.GetStatistics().TotalCycles
-		
-		// Run for 100 frames
-		for i := 0; i < 100; i++ {
+		fmt.Fprintf(os.Stderr, "spectrum: %v\n", err)
+		os.Exit(2)
+	}
+	if !met {
+		fmt.Fprintln(os.Stderr, "spectrum: stop condition not reached")
+		os.Exit(1)
+	}
+}
+
+// run executes one session and reports whether the stop condition, if
+// any, was met
+func run(opt options, file string) (met bool, err error) {
+	var data []uint8
+	format := ""
+	if file != "" {
+		if data, err = os.ReadFile(file); err != nil {
+			return false, err
+		}
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	}
+
+	model, err := chooseModel(opt.model, format, data)
+	if err != nil {
+		return false, err
+	}
+	spec, err := system.NewSpectrumROMDir(model, opt.romDir)
+	if err != nil {
+		return false, err
+	}
+	spec.SetUnlimited(!opt.realtime)
+	if opt.record != "" && opt.audio == "" {
+		opt.audio = strings.TrimSuffix(opt.record, filepath.Ext(opt.record)) + ".wav"
+	}
+
+	stopPC := -1
+	if opt.untilPC != "" {
+		pc, err := strconv.ParseUint(opt.untilPC, 0, 16)
+		if err != nil {
+			return false, fmt.Errorf("bad -until-pc %q", opt.untilPC)
+		}
+		stopPC = int(pc)
+	}
+	if opt.save != "" {
+		// Checked now rather than after the run, so a typo does not waste it
+		switch strings.ToLower(filepath.Ext(opt.save)) {
+		case ".sna", ".z80", ".szx":
+		default:
+			return false, fmt.Errorf("unsupported snapshot type %q", opt.save)
+		}
+	}
+
+	isSnapshot := format == "sna" || format == "z80" || format == "szx" || format == "rzx"
+	boot := opt.boot
+	if boot == 0 && !isSnapshot && (file != "" || opt.typeText != "") {
+		boot = 150
+	}
+	for i := 0; i < boot; i++ {
+		spec.RunFrame()
+	}
+
+	if err := load(spec, format, data); err != nil {
+		return false, fmt.Errorf("%s: %w", file, err)
+	}
+	if opt.typeText != "" {
+		if err := spec.TypeText(strings.ReplaceAll(opt.typeText, `\n`, "\n")); err != nil {
+			return false, err
+		}
+	}
+
+	// Capture from here on, so recordings start with the loaded program
+	if opt.trace != "" {
+		stop, traceErr := startTrace(spec, opt)
+		if traceErr != nil {
+			return false, traceErr
+		}
+		defer func() {
+			if stopErr := stop(); stopErr != nil && err == nil {
+				err = stopErr
+			}
+		}()
+	}
+	if opt.audio != "" {
+		if err := spec.StartAudio(opt.audioRate); err != nil {
+			return false, err
+		}
+	}
+	if opt.record != "" {
+		format := strings.TrimPrefix(filepath.Ext(opt.record), ".")
+		if err := video.CheckFormat(format); err != nil {
+			return false, err
+		}
+		f, createErr := os.Create(opt.record)
+		if createErr != nil {
+			return false, createErr
+		}
+		defer f.Close()
+		rec, recErr := video.Record(spec, f, format, video.Options{Skip: opt.recSkip, Scale: opt.recScale})
+		if recErr != nil {
+			return false, recErr
+		}
+		defer func() {
+			if stopErr := rec.Stop(); stopErr != nil && err == nil {
+				err = stopErr
+			}
+		}()
+	}
+
+	// frame runs one frame and reports whether the stop condition was met
+	frame := func() bool {
+		met := false
+		if stopPC >= 0 {
+			met = spec.RunFrameUntil(func() bool { return int(spec.CPU.PC) == stopPC })
+		} else {
 			spec.RunFrame()
 		}
-		
-		elapsed := time.Since(startTime)
-		endCycles := spec.GetStatistics().TotalCycles
-		cyclesExecuted := endCycles - startCycles
-		
-		expectedTime := (2.0 / speed) // 100 frames at 50 FPS = 2 seconds
-		fmt.Printf("\nSpeed %.1fx:\n", speed)
-		fmt.Printf("  Expected time: %.2f seconds\n", expectedTime)
-		fmt.Printf("  Actual time: %.2f seconds\n", elapsed.Seconds())
-		fmt.Printf("  Cycles executed: %d\n", cyclesExecuted)
-		fmt.Printf("  CPU cycles counter: %d\n", spec.CPU.Cycles)
-		fmt.Printf("  Effective frequency: %.0f Hz\n", 
-			float64(cyclesExecuted)/elapsed.Seconds())
-	}
-	
-	// Test instruction cycle accuracy
-	fmt.Println("\n=== Instruction Cycle Accuracy Test ===")
-	testInstructionTiming(spec)
+		if opt.untilText != "" && strings.Contains(spec.ScreenText(), opt.untilText) {
+			met = true
+		}
+		return met
+	}
+	conditional := stopPC >= 0 || opt.untilText != ""
+	met = !conditional
+	if opt.zrcp != "" || opt.gdb != "" {
+		if err := serveDebugger(spec, opt); err != nil {
+			return false, err
+		}
+		met = true
+	} else if opt.term {
+		spec.SetUnlimited(false)
+		if err := interactive(spec, opt.termScale, func() bool {
+			met = frame() || met
+			return conditional && met
+		}); err != nil {
+			return false, err
+		}
+	} else {
+		for i := 0; i < opt.frames; i++ {
+			if frame() {
+				met = true
+			}
+			if conditional && met {
+				break
+			}
+		}
+	}
+	// Show the screen as the condition saw it
+	spec.LatchScreen()
+	if err := spec.RZXError(); err != nil {
+		return false, err
+	}
+
+	return met, output(spec, opt)
+}
+
+// serveDebugger waits for a remote debugger and serves it until it
+// disconnects
+func serveDebugger(spec *system.Spectrum, opt options) error {
+	addr, client := opt.zrcp, "ZRCP"
+	if opt.gdb != "" {
+		addr, client = opt.gdb, "gdb"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "spectrum: waiting for a %s client on %s\n", client, l.Addr())
+	c, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	d := debug.New(debug.NewSpectrum(spec))
+	if opt.gdb != "" {
+		return gdbstub.NewServer(d).ServeConn(c)
+	}
+	return zrcp.NewServer(d).ServeConn(c)
+}
+
+// startTrace attaches a trace recorder writing to the -trace file and
+// returns a function that detaches it and closes the file
+func startTrace(spec *system.Spectrum, opt options) (func() error, error) {
+	format, err := trace.ParseFormat(opt.traceFmt)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []trace.Range
+	if opt.tracePC != "" {
+		for _, s := range strings.Split(opt.tracePC, ",") {
+			r, err := trace.ParseRange(s)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	f, err := os.Create(opt.trace)
+	if err != nil {
+		return nil, err
+	}
+	rec := trace.New(spec.CPU, f, trace.Options{Format: format, Ring: opt.traceRing, PC: ranges})
+	return func() error {
+		err := rec.Stop()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// chooseModel picks the -model flag, or the model a snapshot was saved from
+func chooseModel(name, format string, data []uint8) (system.Model, error) {
+	if name != "" {
+		return system.ParseModel(name)
+	}
+	switch format {
+	case "z80":
+		return system.Z80SnapshotModel(data)
+	case "szx":
+		return system.SZXSnapshotModel(data)
+	case "sna":
+		if len(data) > 49179 {
+			return system.Model128K, nil
+		}
+	case "rzx":
+		r, err := system.ParseRZX(data)
+		if err != nil {
+			return 0, err
+		}
+		if len(r.Segments) > 0 {
+			return chooseModel("", r.Segments[0].SnapshotFormat, r.Segments[0].Snapshot)
+		}
+	}
+	return system.Model48K, nil
+}
+
+// load restores a snapshot, starts an RZX recording or inserts a tape and
+// starts it loading
+func load(spec *system.Spectrum, format string, data []uint8) error {
+	var tape *system.PulseTape
+	var err error
+	switch format {
+	case "":
+		return nil
+	case "sna", "z80", "szx":
+		return spec.LoadSnapshotFormat(format, data)
+	case "scr":
+		return spec.LoadSCR(data)
+	case "rzx":
+		r, err := system.ParseRZX(data)
+		if err != nil {
+			return err
+		}
+		return spec.PlayRZX(r)
+	case "tap":
+		tape, err = system.LoadTAP(data)
+	case "csw":
+		tape, err = system.LoadCSW(data)
+	case "wav":
+		tape, err = system.LoadWAV(data, system.DefaultWAVOptions())
+	default:
+		return fmt.Errorf("unsupported file type %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	spec.InsertTape(tape)
+	spec.PlayTape()
+	if spec.Model() == system.Model48K {
+		return spec.TypeText("LOAD \"\"\n")
+	}
+	return spec.TypeText("\n") // Tape Loader is the first menu option
 }
 
-func testInstructionTiming(spec *system.Spectrum) {
-	// Test patterns with known cycle counts
-	testPatterns := []struct {
-		name     string
-		code     []uint8
-		cycles   int
-		desc     string
-	}{
-		{
-			"NOP sequence",
-			[]uint8{0x00, 0x00, 0x00, 0x00, 0x76}, // 4 NOPs + HALT
-			20, // 4*4 + 4 = 20
-			"Basic instruction timing",
-		},
-		{
-			"Register loads",
-			[]uint8{
-				0x06, 0x42,  // LD B,42h (7 cycles)
-				0x0E, 0x84,  // LD C,84h (7 cycles)
-				0x78,        // LD A,B (4 cycles)
-				0x76,        // HALT (4 cycles)
-			},
-			22,
-			"Immediate and register loads",
-		},
-		{
-			"16-bit operations",
-			[]uint8{
-				0x01, 0x34, 0x12,  // LD BC,1234h (10 cycles)
-				0x11, 0x78, 0x56,  // LD DE,5678h (10 cycles)
-				0x09,              // ADD HL,BC (11 cycles)
-				0x76,              // HALT (4 cycles)
-			},
-			35,
-			"16-bit load and arithmetic",
-		},
-		{
-			"Stack operations",
-			[]uint8{
-				0x31, 0x00, 0x60,  // LD SP,6000h (10 cycles)
-				0x01, 0x34, 0x12,  // LD BC,1234h (10 cycles)
-				0xC5,              // PUSH BC (11 cycles)
-				0xC1,              // POP BC (10 cycles)
-				0x76,              // HALT (4 cycles)
-			},
-			45,
-			"Stack push/pop",
-		},
-		{
-			"Conditional jump taken",
-			[]uint8{
-				0x3E, 0x00,        // LD A,0 (7 cycles)
-				0x28, 0x02,        // JR Z,+2 (12 cycles - taken)
-				0x00, 0x00,        // NOPs (skipped)
-				0x76,              // HALT (4 cycles)
-			},
-			23,
-			"Conditional relative jump",
-		},
-	}
-	
-	for _, test := range testPatterns {
-		// Load test code at address 0x8000
-		spec.Reset()
-		spec.LoadSnapshot(0x8000, test.code)
-		spec.CPU.PC = 0x8000
-		
-		// Execute until HALT
-		totalCycles := 0
-		for !spec.CPU.Halted && totalCycles < 1000 {
-			cycles := spec.CPU.Step()
-			totalCycles += cycles
-		}
-		
-		fmt.Printf("\n%s:\n", test.name)
-		fmt.Printf("  Description: %s\n", test.desc)
-		fmt.Printf("  Expected cycles: %d\n", test.cycles)
-		fmt.Printf("  Actual cycles: %d\n", totalCycles)
-		if totalCycles == test.cycles {
-			fmt.Printf("  Result: ✓ PASS\n")
+// output writes the requested screenshot, audio, snapshot and screen text
+func output(spec *system.Spectrum, opt options) error {
+	if opt.screenshot != "" {
+		var buf bytes.Buffer
+		var err error
+		if strings.EqualFold(filepath.Ext(opt.screenshot), ".scr") {
+			err = spec.SaveSCR(&buf)
 		} else {
-			fmt.Printf("  Result: ✗ FAIL (difference: %+d)\n", 
-				totalCycles - test.cycles)
+			err = spec.WritePNG(&buf, system.ScreenshotOptions{NoBorder: opt.noBorder, Scale: opt.shotScale})
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(opt.screenshot, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	if a := spec.StopAudio(); a != nil && opt.audio != "" {
+		var buf bytes.Buffer
+		if err := a.WriteWAV(&buf); err != nil {
+			return err
+		}
+		if err := os.WriteFile(opt.audio, buf.Bytes(), 0o644); err != nil {
+			return err
 		}
 	}
-}
\ No newline at end of file
+	if opt.save != "" {
+		var buf bytes.Buffer
+		var err error
+		switch strings.ToLower(filepath.Ext(opt.save)) {
+		case ".sna":
+			err = spec.SaveSNA(&buf)
+		case ".z80":
+			err = spec.SaveZ80(&buf)
+		case ".szx":
+			err = spec.SaveSZX(&buf)
+		default:
+			return fmt.Errorf("unsupported snapshot type %q", opt.save)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(opt.save, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	if opt.printText {
+		fmt.Println(spec.ScreenText())
+	}
+	if opt.ansi {
+		fmt.Print(term.Render(spec.Render(), opt.termScale))
+	}
+	return nil
+}
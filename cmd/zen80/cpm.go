@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ha1tch/zen80/cpm"
+	"github.com/ha1tch/zen80/term"
+)
+
+// flushSteps is how many instructions run between flushes of the output
+const flushSteps = 200000
+
+// runCPM implements "zen80 cpm": run a .COM file as if it were a host
+// tool, or with -disk boot CP/M 2.2 or non-banked CP/M 3 from disk
+// images, where -drive and -user do not apply. It exits with status 0
+// when the program warm-boots or the input ends, 1 if the program set a
+// failure return code with BDOS function 108, 2 on errors and 130 if
+// interrupted.
+func runCPM(args []string) int {
+	fs := flag.NewFlagSet("cpm", flag.ExitOnError)
+	var drives, disks [cpm.NumDrives]string
+	fs.Func("drive", "map a drive to a host directory, as B=dir (repeatable; A: is the current directory unless mapped)", func(s string) error {
+		d, dir, err := driveArg(s)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		drives[d] = dir
+		return nil
+	})
+	fs.Func("disk", "boot CP/M with a disk image in a drive, as A=file.img or A=file.img,format (repeatable)", func(s string) error {
+		d, file, err := driveArg(s)
+		disks[d] = file
+		return err
+	})
+	format := fs.String("format", "ibm-3740", "format of -disk images: "+formatNames())
+	system := fs.String("system", "", "boot from this CP/M 2.2 CCP and BDOS image or CP/M 3 CPM3.SYS instead of drive A:")
+	user := fs.Int("user", 0, "user area to start in (0-15)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: zen80 cpm [flags] program[.com] [args...]")
+		fmt.Fprintln(fs.Output(), "       zen80 cpm -disk A=file.img [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	booting := disks != [cpm.NumDrives]string{}
+	if (fs.NArg() < 1 && !booting) || (fs.NArg() > 0 && booting) || *user < 0 || *user > 15 {
+		fs.Usage()
+		return 2
+	}
+	if booting {
+		// Host directories and the user area belong to the emulated BDOS;
+		// a booted system has its own
+		rejected := ""
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "drive" || f.Name == "user" {
+				rejected = f.Name
+			}
+		})
+		if rejected != "" {
+			fmt.Fprintf(os.Stderr, "zen80 cpm: -%s cannot be used with -disk\n", rejected)
+			return 2
+		}
+		return bootCPM(disks, *format, *system)
+	}
+
+	program, err := readProgram(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zen80 cpm: %v\n", err)
+		return 2
+	}
+	if drives[0] == "" {
+		drives[0] = "."
+	}
+
+	console, restore := newHostConsole()
+	defer restore()
+	m := cpm.New(console, drives[0])
+	for d, dir := range drives {
+		m.SetDrive(d, dir)
+	}
+	m.SetUser(*user)
+	if err := m.LoadCOM(program, fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "zen80 cpm: %v\n", err)
+		return 2
+	}
+
+	err = runMachine(m.Step, console)
+	if status := finish(err, console, restore); status != 0 {
+		return status
+	}
+	if m.ReturnCode() >= 0xFF00 {
+		return 1
+	}
+	return 0
+}
+
+// bootCPM boots CP/M from disk images and runs it until the input ends
+func bootCPM(disks [cpm.NumDrives]string, format, system string) int {
+	var image []uint8
+	if system != "" {
+		var err error
+		if image, err = os.ReadFile(system); err != nil {
+			fmt.Fprintf(os.Stderr, "zen80 cpm: %v\n", err)
+			return 2
+		}
+	}
+	console, restore := newHostConsole()
+	defer restore()
+	s := cpm.NewSystem(console)
+	for drive, spec := range disks {
+		if spec == "" {
+			continue
+		}
+		file, name, _ := strings.Cut(spec, ",")
+		if name == "" {
+			name = format
+		}
+		f, ok := cpm.Formats[name]
+		if !ok {
+			restore()
+			fmt.Fprintf(os.Stderr, "zen80 cpm: unknown disk format %q (known: %s)\n", name, formatNames())
+			return 2
+		}
+		d, err := cpm.OpenDisk(file, f)
+		if err == nil {
+			defer d.Close()
+			err = s.Mount(drive, d)
+		}
+		if err != nil {
+			restore()
+			fmt.Fprintf(os.Stderr, "zen80 cpm: %v\n", err)
+			return 2
+		}
+	}
+
+	var err error
+	if image != nil {
+		if base, ok := cpm.CCPBase(image); ok {
+			err = s.BootImage(image, base)
+		} else if err = s.BootCPM3(image); err != nil {
+			restore()
+			fmt.Fprintf(os.Stderr, "zen80 cpm: %s is neither a CP/M 2.2 CCP and BDOS nor a CPM3.SYS: %v\n", system, err)
+			return 2
+		}
+	} else {
+		err = s.Boot()
+	}
+	if err == nil {
+		err = runMachine(func() (bool, error) { return false, s.Step() }, console)
+	}
+	return finish(err, console, restore)
+}
+
+// finish flushes the console and reports how a run ended: 0 if the
+// program exited or the input ended, 2 on errors
+func finish(err error, console *hostConsole, restore func()) int {
+	console.close()
+	if err == nil || errors.Is(err, cpm.ErrInputClosed) {
+		// Input piped from a file running out is the usual way to end
+		return 0
+	}
+	restore()
+	fmt.Fprintf(os.Stderr, "\nzen80 cpm: %v\n", err)
+	return 2
+}
+
+// driveArg parses a drive letter and a value, as B=value
+func driveArg(s string) (int, string, error) {
+	letter, value, ok := strings.Cut(s, "=")
+	letter = strings.TrimSuffix(strings.ToUpper(letter), ":")
+	if !ok || len(letter) != 1 || letter[0] < 'A' || letter[0] >= 'A'+cpm.NumDrives || value == "" {
+		return 0, "", fmt.Errorf("want a drive letter and a value, as B=value")
+	}
+	return int(letter[0] - 'A'), value, nil
+}
+
+// formatNames lists the known disk formats
+func formatNames() string {
+	names := make([]string, 0, len(cpm.Formats))
+	for name := range cpm.Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// readProgram reads a .COM file. If name is not found as given, a file
+// whose name matches it without regard to case, with or without the .COM
+// extension, is looked for in the same directory.
+func readProgram(name string) ([]uint8, error) {
+	data, err := os.ReadFile(name)
+	if err == nil {
+		return data, nil
+	}
+	dir, base := filepath.Split(name)
+	entries, _ := os.ReadDir(filepath.Clean(dir + "."))
+	for _, e := range entries {
+		n := e.Name()
+		if strings.EqualFold(n, base) || strings.EqualFold(n, base+".com") {
+			return os.ReadFile(filepath.Join(dir, n))
+		}
+	}
+	return nil, err
+}
+
+// runMachine runs the machine until step reports an exit or an error,
+// flushing its output now and then so that progress shows while it
+// computes
+func runMachine(step func() (bool, error), console *hostConsole) error {
+	for {
+		for i := 0; i < flushSteps; i++ {
+			exited, err := step()
+			if err != nil || exited {
+				return err
+			}
+		}
+		console.flush()
+	}
+}
+
+// hostConsole connects a CP/M program to stdin and stdout. On a terminal
+// it puts the terminal in raw mode, so keys reach the program as typed
+// and Ctrl-C is passed on (CP/M programs treat it as "abort"); pressing
+// Ctrl-C again before the program has read the first one interrupts
+// zen80. Piped input has its line ends turned into CRs, and piped output
+// has CR LF turned into LF.
+type hostConsole struct {
+	*cpm.StreamConsole
+	out       *bufio.Writer
+	toText    bool         // Convert CR LF to LF on output
+	pendingCR bool         // A CR is held back in case LF follows
+	breaks    atomic.Int32 // Ctrl-Cs typed but not yet read
+}
+
+// newHostConsole creates the console, returning a function that puts the
+// terminal back as it was
+func newHostConsole() (*hostConsole, func()) {
+	c := &hostConsole{
+		out:    bufio.NewWriter(os.Stdout),
+		toText: !isTerminal(os.Stdout),
+	}
+	restore := func() {}
+	raw := false
+	if isTerminal(os.Stdin) {
+		if r, err := term.MakeRaw(os.Stdin); err == nil {
+			restore, raw = r, true
+		}
+	}
+	var once atomic.Bool
+	done := func() {
+		if once.CompareAndSwap(false, true) {
+			restore()
+		}
+	}
+
+	abort := func() {
+		done()
+		fmt.Fprintln(os.Stderr, "\r\nzen80 cpm: interrupted")
+		os.Exit(130)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		abort()
+	}()
+
+	c.StreamConsole = cpm.NewStreamConsole(&keyReader{r: os.Stdin, c: c, raw: raw, abort: abort}, c.out)
+	return c, done
+}
+
+// Status implements cpm.Console, flushing output first as a program
+// polling the keyboard is usually waiting for the user
+func (c *hostConsole) Status() bool {
+	c.flush()
+	return c.StreamConsole.Status()
+}
+
+// Read implements cpm.Console
+func (c *hostConsole) Read() (uint8, error) {
+	c.flush()
+	b, err := c.StreamConsole.Read()
+	if err == nil && b == 0x03 {
+		c.breaks.Add(-1)
+	}
+	return b, err
+}
+
+// Write implements cpm.Console
+func (c *hostConsole) Write(b uint8) error {
+	if !c.toText {
+		return c.out.WriteByte(b)
+	}
+	if c.pendingCR {
+		c.pendingCR = false
+		if b != '\n' {
+			c.out.WriteByte('\r')
+		}
+	}
+	if b == '\r' {
+		c.pendingCR = true
+		return nil
+	}
+	return c.out.WriteByte(b)
+}
+
+// flush writes out buffered output
+func (c *hostConsole) flush() {
+	c.out.Flush()
+}
+
+// close writes out the rest of the output, including a held back CR
+func (c *hostConsole) close() {
+	if c.pendingCR {
+		c.pendingCR = false
+		c.out.WriteByte('\r')
+	}
+	c.out.Flush()
+}
+
+// keyReader reads console input for a hostConsole
+type keyReader struct {
+	r      io.Reader
+	c      *hostConsole
+	raw    bool // Reading a terminal in raw mode
+	lastCR bool
+	abort  func()
+}
+
+func (k *keyReader) Read(p []uint8) (int, error) {
+	n, err := k.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		switch {
+		case k.raw:
+			if b == 0x03 && k.c.breaks.Add(1) > 1 {
+				k.abort()
+			}
+		case b == '\n':
+			if k.lastCR {
+				k.lastCR = false
+				continue // The line was ended by the CR
+			}
+			b = '\r'
+		default:
+			k.lastCR = b == '\r'
+		}
+		out = append(out, b)
+	}
+	return len(out), err
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
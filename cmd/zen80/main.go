@@ -0,0 +1,54 @@
+// Command zen80 gathers the emulator's tools as subcommands.
+//
+// Usage:
+//
+//	zen80 <command> [flags] [args]
+//
+// Run "zen80 <command> -h" for the flags of a command.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a zen80 subcommand. run returns the exit status.
+type command struct {
+	run     func(args []string) int
+	summary string
+}
+
+var commands = map[string]command{
+	"cpm": {runCPM, "run a CP/M .COM program with drives mapped to host directories"},
+	"zex": {runZEX, "run the ZEXALL or ZEXDOC test groups in parallel"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "zen80: unknown command %q\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: zen80 <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/ha1tch/zen80/zex"
+)
+
+// runZEX implements "zen80 zex": run the test groups of ZEXALL or ZEXDOC
+// in parallel. It exits with status 1 if any group fails.
+func runZEX(args []string) int {
+	fs := flag.NewFlagSet("zex", flag.ExitOnError)
+	workers := fs.Int("j", runtime.NumCPU(), "number of test groups to run at once")
+	match := fs.String("run", "", "run only the groups whose names match this regular expression")
+	maxSteps := fs.Uint64("max-steps", 0, "give up on a group after this many instructions (0 for no limit)")
+	list := fs.Bool("list", false, "list the test groups and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: zen80 zex [flags] [zexall.com|zexdoc.com]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	file := "rom/zexall.com"
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	program, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zen80 zex: %v\n", err)
+		return 2
+	}
+
+	if *list {
+		tests, err := zex.Tests(program)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zen80 zex: %v\n", err)
+			return 2
+		}
+		for _, t := range tests {
+			fmt.Printf("%2d  %08x  %s\n", t.Index, t.Expected, t.Name)
+		}
+		return 0
+	}
+
+	opts := zex.Options{Workers: *workers, MaxSteps: *maxSteps}
+	if *match != "" {
+		if opts.Match, err = regexp.Compile(*match); err != nil {
+			fmt.Fprintf(os.Stderr, "zen80 zex: bad -run: %v\n", err)
+			return 2
+		}
+	}
+	opts.Progress = func(r zex.Result) {
+		switch {
+		case r.Err != nil:
+			fmt.Printf("FAIL  %-30s  %v\n", r.Name, r.Err)
+		case r.Passed:
+			fmt.Printf("ok    %-30s  crc %08x  %6.1fs\n", r.Name, r.Found, r.Duration.Seconds())
+		default:
+			fmt.Printf("FAIL  %-30s  crc %08x, expected %08x  %6.1fs\n", r.Name, r.Found, r.Expected, r.Duration.Seconds())
+		}
+	}
+
+	start := time.Now()
+	results, err := zex.Run(program, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zen80 zex: %v\n", err)
+		return 2
+	}
+	failed := 0
+	var cpu time.Duration
+	for _, r := range results {
+		if !r.Passed {
+			failed++
+		}
+		cpu += r.Duration
+	}
+	fmt.Printf("%d groups, %d passed, %d failed in %.1fs (%.1fs of CPU)\n",
+		len(results), len(results)-failed, failed, time.Since(start).Seconds(), cpu.Seconds())
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,630 @@
+package cpm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BDOS function numbers
+const (
+	fnSystemReset    = 0
+	fnConsoleInput   = 1
+	fnConsoleOutput  = 2
+	fnReaderInput    = 3
+	fnPunchOutput    = 4
+	fnListOutput     = 5
+	fnDirectIO       = 6
+	fnGetIOByte      = 7
+	fnSetIOByte      = 8
+	fnPrintString    = 9
+	fnReadBuffer     = 10
+	fnConsoleStatus  = 11
+	fnVersion        = 12
+	fnResetDisks     = 13
+	fnSelectDisk     = 14
+	fnOpenFile       = 15
+	fnCloseFile      = 16
+	fnSearchFirst    = 17
+	fnSearchNext     = 18
+	fnDeleteFile     = 19
+	fnReadSeq        = 20
+	fnWriteSeq       = 21
+	fnMakeFile       = 22
+	fnRenameFile     = 23
+	fnLoginVector    = 24
+	fnCurrentDisk    = 25
+	fnSetDMA         = 26
+	fnAllocVector    = 27
+	fnWriteProtect   = 28
+	fnReadOnlyVector = 29
+	fnSetAttributes  = 30
+	fnDiskParams     = 31
+	fnUserCode       = 32
+	fnReadRandom     = 33
+	fnWriteRandom    = 34
+	fnFileSize       = 35
+	fnSetRandom      = 36
+	fnResetDrive     = 37
+	fnWriteZeroFill  = 40
+	fnReturnCode     = 108 // CP/M 3
+)
+
+// Console control characters
+const (
+	ctrlC     = 0x03
+	backspace = 0x08
+	tab       = 0x09
+	lf        = 0x0A
+	cr        = 0x0D
+	ctrlU     = 0x15
+	ctrlX     = 0x18
+	ctrlZ     = 0x1A
+	rubout    = 0x7F
+)
+
+// Result codes of the file functions
+const (
+	resultEOF     = 0x01 // Read past the end of the file
+	resultNoData  = 0x01 // Random read of an unwritten record
+	resultSeek    = 0x06 // Random record number out of range
+	resultFailure = 0xFF
+)
+
+// bdos serves the call in register C with parameter DE (or E)
+func (m *Machine) bdos() error {
+	de := m.CPU.DE()
+	e := m.CPU.E
+	m.setResult(0)
+
+	switch m.CPU.C {
+	case fnSystemReset:
+		m.exited = true
+	case fnConsoleInput:
+		c, err := m.conin()
+		if err != nil {
+			return err
+		}
+		if err := m.echo(c); err != nil {
+			return err
+		}
+		m.setResult(uint16(c))
+	case fnConsoleOutput:
+		return m.conout(e)
+	case fnReaderInput:
+		m.setResult(ctrlZ)
+	case fnPunchOutput, fnListOutput:
+		// No punch or printer attached
+	case fnDirectIO:
+		switch e {
+		case 0xFF:
+			if m.Console.Status() {
+				c, err := m.conin()
+				if err != nil {
+					return err
+				}
+				m.setResult(uint16(c))
+			}
+		case 0xFE:
+			m.setResult(m.status())
+		default:
+			return m.conout(e)
+		}
+	case fnGetIOByte:
+		m.setResult(uint16(m.iobyte))
+	case fnSetIOByte:
+		m.iobyte = e
+		m.Memory.Write(0x0003, e)
+	case fnPrintString:
+		for addr := de; m.Memory.Read(addr) != '$'; addr++ {
+			if err := m.conout(m.Memory.Read(addr)); err != nil {
+				return err
+			}
+		}
+	case fnReadBuffer:
+		return m.readLine(de)
+	case fnConsoleStatus:
+		m.setResult(m.status())
+	case fnVersion:
+		m.setResult(0x0022)
+	case fnResetDisks:
+		m.drive, m.dma = 0, DefaultDMA
+		m.setDriveUser()
+	case fnSelectDisk:
+		if int(e) >= NumDrives || m.drives[e] == "" {
+			m.setResult(resultFailure)
+			break
+		}
+		m.drive = int(e)
+		m.setDriveUser()
+	case fnOpenFile:
+		m.openFile(de)
+	case fnCloseFile:
+		if _, ok := m.findFile(de); !ok {
+			m.setResult(resultFailure)
+		}
+	case fnSearchFirst:
+		m.searchFirst(de)
+	case fnSearchNext:
+		m.searchNext()
+	case fnDeleteFile:
+		m.deleteFile(de)
+	case fnReadSeq:
+		m.readRecord(de, true)
+	case fnWriteSeq:
+		m.writeRecord(de, true)
+	case fnMakeFile:
+		m.makeFile(de)
+	case fnRenameFile:
+		m.renameFile(de)
+	case fnLoginVector:
+		var v uint16
+		for i, dir := range m.drives {
+			if dir != "" {
+				v |= 1 << i
+			}
+		}
+		m.setResult(v)
+	case fnCurrentDisk:
+		m.setResult(uint16(m.drive))
+	case fnSetDMA:
+		m.dma = de
+	case fnAllocVector:
+		m.setResult(alvAddr)
+	case fnWriteProtect, fnResetDrive:
+		// Host directories are always writable
+	case fnReadOnlyVector:
+		m.setResult(0)
+	case fnSetAttributes:
+		if _, ok := m.findFile(de); !ok {
+			m.setResult(resultFailure)
+		}
+	case fnDiskParams:
+		m.setResult(dpbAddr)
+	case fnUserCode:
+		if e == 0xFF {
+			m.setResult(uint16(m.user))
+			break
+		}
+		m.user = int(e & 0x0F)
+		m.setDriveUser()
+	case fnReadRandom:
+		if m.seekRandom(de) {
+			m.readRecord(de, false)
+		}
+	case fnWriteRandom, fnWriteZeroFill:
+		if m.seekRandom(de) {
+			m.writeRecord(de, false)
+		}
+	case fnFileSize:
+		f, ok := m.findFile(de)
+		if !ok {
+			m.setResult(resultFailure)
+			break
+		}
+		m.setRandomRecord(de, int((f.size+recordSize-1)/recordSize))
+	case fnSetRandom:
+		m.setRandomRecord(de, m.position(de))
+	case fnReturnCode:
+		if de == 0xFFFF {
+			m.setResult(m.returnCode)
+			break
+		}
+		m.returnCode = de
+	}
+	return nil
+}
+
+// setResult returns a value in HL, with A=L and B=H as CP/M 2.2 does
+func (m *Machine) setResult(v uint16) {
+	m.CPU.SetHL(v)
+	m.CPU.A = uint8(v)
+	m.CPU.B = uint8(v >> 8)
+}
+
+// status returns 0xFF if a character is waiting, otherwise 0
+func (m *Machine) status() uint16 {
+	if m.Console.Status() {
+		return 0xFF
+	}
+	return 0
+}
+
+// conin waits for a console character
+func (m *Machine) conin() (uint8, error) {
+	c, err := m.Console.Read()
+	if errors.Is(err, io.EOF) {
+		return 0, ErrInputClosed
+	}
+	return c, err
+}
+
+func (m *Machine) conout(c uint8) error {
+	return m.Console.Write(c)
+}
+
+// echo echoes a character typed at the console, showing control
+// characters as ^X
+func (m *Machine) echo(c uint8) error {
+	switch {
+	case c >= ' ' || c == cr || c == lf || c == backspace || c == tab:
+		return m.conout(c)
+	}
+	if err := m.conout('^'); err != nil {
+		return err
+	}
+	return m.conout(c + '@')
+}
+
+// readLine implements function 10: read an edited line into the buffer
+// at addr, whose first byte holds its size
+func (m *Machine) readLine(addr uint16) error {
+	size := int(m.Memory.Read(addr))
+	var line []uint8
+	for len(line) < size {
+		c, err := m.conin()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case cr, lf:
+			if c == lf && m.lastCR && len(line) == 0 {
+				m.lastCR = false
+				continue // Second half of a CR LF pair ending the previous line
+			}
+			m.lastCR = c == cr
+			m.Memory.Write(addr+1, uint8(len(line)))
+			return m.conout(cr)
+		case ctrlC:
+			if len(line) == 0 {
+				m.exited = true
+				return m.echo(c)
+			}
+		case backspace, rubout:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				m.Memory.Write(addr+2+uint16(len(line)), 0)
+				if err := m.erase(); err != nil {
+					return err
+				}
+			}
+			continue
+		case ctrlU, ctrlX:
+			for ; len(line) > 0; line = line[:len(line)-1] {
+				if err := m.erase(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		m.lastCR = false
+		m.Memory.Write(addr+2+uint16(len(line)), c)
+		line = append(line, c)
+		if err := m.echo(c); err != nil {
+			return err
+		}
+	}
+	m.Memory.Write(addr+1, uint8(len(line)))
+	return nil
+}
+
+// erase removes the last character from the screen
+func (m *Machine) erase() error {
+	for _, c := range []uint8{backspace, ' ', backspace} {
+		if err := m.conout(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fcbDir returns the host directory of the drive an FCB refers to
+func (m *Machine) fcbDir(addr uint16) (string, bool) {
+	d := m.drive
+	if dr := m.Memory.Read(addr); dr != 0 && dr != '?' {
+		d = int(dr&0x1F) - 1
+	}
+	if d < 0 || d >= NumDrives || m.drives[d] == "" {
+		return "", false
+	}
+	return m.drives[d], true
+}
+
+// fcbFileName reads the name and type from an FCB
+func (m *Machine) fcbFileName(addr uint16) fileName {
+	var n fileName
+	for i := range n {
+		n[i] = m.Memory.Read(addr + fcbName + uint16(i))
+	}
+	return n.clean()
+}
+
+// findFile finds the first file matching an FCB in the current user area
+func (m *Machine) findFile(addr uint16) (dirEntry, bool) {
+	dir, ok := m.fcbDir(addr)
+	if !ok {
+		return dirEntry{}, false
+	}
+	pattern := m.fcbFileName(addr)
+	for _, f := range listDir(dir, m.user) {
+		if f.name.match(pattern) {
+			return f, true
+		}
+	}
+	return dirEntry{}, false
+}
+
+// position returns the sequential record number an FCB points at
+func (m *Machine) position(addr uint16) int {
+	return int(m.Memory.Read(addr+fcbS2)&0x3F)<<12 |
+		int(m.Memory.Read(addr+fcbEX)&0x1F)<<7 |
+		int(m.Memory.Read(addr+fcbCR)&0x7F)
+}
+
+// setPosition points an FCB at a record and fills in the directory
+// fields of its extent for a file of size bytes
+func (m *Machine) setPosition(addr uint16, record int, size int64) {
+	m.Memory.Write(addr+fcbCR, uint8(record&0x7F))
+	m.Memory.Write(addr+fcbEX, uint8(record>>7&0x1F))
+	m.Memory.Write(addr+fcbS2, uint8(record>>12))
+	m.fillExtent(addr, record>>7, size)
+}
+
+// fillExtent sets the record count and allocation map of an FCB for one
+// extent of a file
+func (m *Machine) fillExtent(addr uint16, extent int, size int64) {
+	rc, alloc := extentFields(extent, size)
+	m.Memory.Write(addr+fcbRC, rc)
+	m.Memory.Load(addr+fcbAlloc, alloc[:])
+}
+
+// extentFields returns the record count and allocation map of one extent
+// of a file of size bytes. Block numbers are made up but non-zero, as
+// some programs count used blocks.
+func extentFields(extent int, size int64) (rc uint8, alloc [16]uint8) {
+	records := int((size + recordSize - 1) / recordSize)
+	n := min(max(records-extent*extentRecords, 0), extentRecords)
+	blocks := (n*recordSize + blockSize - 1) / blockSize
+	for i := 0; i < blocks; i++ {
+		block := extent*8 + i + 1
+		alloc[2*i] = uint8(block)
+		alloc[2*i+1] = uint8(block >> 8)
+	}
+	return uint8(n), alloc
+}
+
+func (m *Machine) openFile(addr uint16) {
+	f, ok := m.findFile(addr)
+	if !ok {
+		m.setResult(resultFailure)
+		return
+	}
+	m.Memory.Write(addr+fcbS2, 0)
+	extent := int(m.Memory.Read(addr+fcbEX) & 0x1F)
+	m.fillExtent(addr, extent, f.size)
+}
+
+func (m *Machine) makeFile(addr uint16) {
+	dir, ok := m.fcbDir(addr)
+	name := m.fcbFileName(addr)
+	if !ok || containsWildcard(name) {
+		m.setResult(resultFailure)
+		return
+	}
+	path := filepath.Join(userDir(dir, m.user), name.String())
+	if f, ok := m.findFile(addr); ok {
+		path = f.path
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		m.setResult(resultFailure)
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		m.setResult(resultFailure)
+		return
+	}
+	f.Close()
+	m.Memory.Write(addr+fcbS2, 0)
+	m.fillExtent(addr, int(m.Memory.Read(addr+fcbEX)&0x1F), 0)
+}
+
+func containsWildcard(n fileName) bool {
+	for _, c := range n {
+		if c == '?' {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Machine) deleteFile(addr uint16) {
+	dir, ok := m.fcbDir(addr)
+	if !ok {
+		m.setResult(resultFailure)
+		return
+	}
+	pattern := m.fcbFileName(addr)
+	deleted := false
+	for _, f := range listDir(dir, m.user) {
+		if f.name.match(pattern) && os.Remove(f.path) == nil {
+			deleted = true
+		}
+	}
+	if !deleted {
+		m.setResult(resultFailure)
+	}
+}
+
+func (m *Machine) renameFile(addr uint16) {
+	f, ok := m.findFile(addr)
+	newName := m.fcbFileName(addr + 16)
+	if !ok || containsWildcard(newName) {
+		m.setResult(resultFailure)
+		return
+	}
+	dir, _ := m.fcbDir(addr)
+	for _, other := range listDir(dir, m.user) {
+		if other.name == newName && other.path != f.path {
+			m.setResult(resultFailure)
+			return
+		}
+	}
+	if os.Rename(f.path, filepath.Join(filepath.Dir(f.path), newName.String())) != nil {
+		m.setResult(resultFailure)
+	}
+}
+
+// searchFirst implements function 17. Each match is reported as one
+// directory entry per 16K extent when the FCB's extent byte is "?", or
+// as the entry of the extent it asks for (usually 0).
+func (m *Machine) searchFirst(addr uint16) {
+	m.search = nil
+	dir, ok := m.fcbDir(addr)
+	if !ok {
+		m.setResult(resultFailure)
+		return
+	}
+	pattern := m.fcbFileName(addr)
+	allUsers := m.Memory.Read(addr) == '?'
+	ex := m.Memory.Read(addr + fcbEX)
+	users := []int{m.user}
+	if allUsers {
+		users = users[:0]
+		for u := 0; u < 16; u++ {
+			users = append(users, u)
+		}
+		pattern = fileName{'?', '?', '?', '?', '?', '?', '?', '?', '?', '?', '?'}
+		ex = '?'
+	}
+	for _, u := range users {
+		for _, f := range listDir(dir, u) {
+			if !f.name.match(pattern) {
+				continue
+			}
+			records := int((f.size + recordSize - 1) / recordSize)
+			extents := max((records+extentRecords-1)/extentRecords, 1)
+			for x := 0; x < extents; x++ {
+				if ex == '?' || int(ex&0x1F) == x {
+					m.search = append(m.search, dirRecord(f, x))
+				}
+			}
+		}
+	}
+	m.searchNext()
+}
+
+// searchNext implements function 18
+func (m *Machine) searchNext() {
+	if len(m.search) == 0 {
+		m.setResult(resultFailure)
+		return
+	}
+	m.Memory.Load(m.dma, m.search[0][:])
+	for i := uint16(32); i < recordSize; i++ {
+		m.Memory.Write(m.dma+i, 0xE5) // Unused entries
+	}
+	m.search = m.search[1:]
+	m.setResult(0) // The entry is the first of the four in the record
+}
+
+// dirRecord builds the 32-byte directory entry for one extent of a file
+func dirRecord(f dirEntry, extent int) [32]uint8 {
+	var rec [32]uint8
+	rec[0] = uint8(f.user)
+	copy(rec[fcbName:fcbEX], f.name[:])
+	rec[fcbEX] = uint8(extent & 0x1F)
+	rec[fcbS2] = uint8(extent >> 5)
+	var alloc [16]uint8
+	rec[fcbRC], alloc = extentFields(extent, f.size)
+	copy(rec[fcbAlloc:], alloc[:])
+	return rec
+}
+
+// readRecord reads the record an FCB points at into the DMA buffer,
+// advancing to the next record for sequential reads
+func (m *Machine) readRecord(addr uint16, sequential bool) {
+	f, ok := m.findFile(addr)
+	if !ok {
+		m.setResult(resultFailure)
+		return
+	}
+	record := m.position(addr)
+	offset := int64(record) * recordSize
+	if offset >= f.size {
+		if sequential {
+			m.setResult(resultEOF)
+		} else {
+			m.setResult(resultNoData)
+		}
+		return
+	}
+	buf := make([]uint8, recordSize)
+	file, err := os.Open(f.path)
+	if err != nil {
+		m.setResult(resultFailure)
+		return
+	}
+	n, _ := file.ReadAt(buf, offset)
+	file.Close()
+	for i := n; i < recordSize; i++ {
+		buf[i] = ctrlZ
+	}
+	m.Memory.Load(m.dma, buf)
+	if sequential {
+		record++
+	}
+	m.setPosition(addr, record, f.size)
+}
+
+// writeRecord writes the DMA buffer to the record an FCB points at,
+// advancing to the next record for sequential writes
+func (m *Machine) writeRecord(addr uint16, sequential bool) {
+	f, ok := m.findFile(addr)
+	if !ok {
+		m.setResult(resultFailure)
+		return
+	}
+	record := m.position(addr)
+	buf := make([]uint8, recordSize)
+	for i := range buf {
+		buf[i] = m.Memory.Read(m.dma + uint16(i))
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY, 0)
+	if err != nil {
+		m.setResult(resultFailure)
+		return
+	}
+	_, err = file.WriteAt(buf, int64(record)*recordSize)
+	file.Close()
+	if err != nil {
+		m.setResult(resultFailure)
+		return
+	}
+	size := max(f.size, int64(record+1)*recordSize)
+	if sequential {
+		record++
+	}
+	m.setPosition(addr, record, size)
+}
+
+// seekRandom points an FCB at its random record number, reporting false
+// (with the error result set) if it is out of range
+func (m *Machine) seekRandom(addr uint16) bool {
+	if m.Memory.Read(addr+fcbR0+2) != 0 {
+		m.setResult(resultSeek)
+		return false
+	}
+	record := int(m.readWord(addr + fcbR0))
+	f, _ := m.findFile(addr)
+	m.setPosition(addr, record, f.size)
+	return true
+}
+
+// setRandomRecord stores a record number in an FCB's random record field
+func (m *Machine) setRandomRecord(addr uint16, record int) {
+	m.Memory.Write(addr+fcbR0, uint8(record))
+	m.Memory.Write(addr+fcbR0+1, uint8(record>>8))
+	m.Memory.Write(addr+fcbR0+2, uint8(record>>16))
+}
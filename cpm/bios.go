@@ -0,0 +1,475 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// CP/M 2.2 system layout: the CCP and BDOS are loaded together and the
+// BIOS follows them
+const (
+	ccpSize    = 0x0800
+	bdosSize   = 0x0E00
+	SystemSize = ccpSize + bdosSize // Bytes of CCP and BDOS in a system image
+)
+
+// System is a Z80 running a real CP/M system with a BIOS emulated in Go
+// and drives backed by disk images. It boots a CP/M 2.2 CCP and BDOS,
+// loaded from the system tracks of drive A: or from an image, or a
+// non-banked CP/M 3 from CPM3.SYS, with CCP.COM loaded from drive A: on
+// each boot as the CP/M 3 BIOS does. Banked CP/M 3 needs memory banks
+// and is not supported.
+//
+// The BIOS jump table holds real JP instructions whose targets are
+// trapped, so programs may read the table or patch it to hook the BIOS.
+// For CP/M 3 the table replaces the one of the BIOS linked into CPM3.SYS.
+type System struct {
+	CPU     *z80.Z80
+	Memory  *memory.RAM
+	Console Console
+
+	disks  [NumDrives]*Disk
+	dph    [NumDrives]uint16 // Disk parameter header of each drive
+	image  []uint8           // CCP and BDOS, reloaded on warm boot
+	ccp    uint16
+	bios   uint16
+	traps  uint16 // Addresses trapped for the BIOS entries
+	top    int    // End of the memory the BIOS may use
+	cpm3   bool
+	bdos   uint16 // CP/M 3 BDOS entry
+	devtbl uint16 // CP/M 3 character device table
+	drvtbl uint16 // CP/M 3 drive table
+	disk   int    // Selected by SELDSK
+	track  int
+	sector int
+	dma    uint16
+}
+
+// NewSystem creates a CP/M machine. Mount disks, then Boot it.
+func NewSystem(console Console) *System {
+	mem := memory.NewRAM()
+	return &System{
+		CPU:     z80.New(mem, zio.NewNullIO()),
+		Memory:  mem,
+		Console: console,
+	}
+}
+
+// Mount puts a disk in a drive (0 for A:), or empties it if d is nil.
+// Drives mounted after booting are not seen until the next boot.
+func (s *System) Mount(drive int, d *Disk) error {
+	if drive < 0 || drive >= NumDrives {
+		return fmt.Errorf("cpm: no drive %d", drive)
+	}
+	if d != nil && d.Format.SectorsPerTrack > 0xFF {
+		return fmt.Errorf("cpm: %s disks are not supported", d.Format.Name)
+	}
+	s.disks[drive] = d
+	return nil
+}
+
+// Disk returns the disk in a drive, or nil
+func (s *System) Disk(drive int) *Disk {
+	if drive < 0 || drive >= NumDrives {
+		return nil
+	}
+	return s.disks[drive]
+}
+
+// CCPBase returns the address a CP/M 2.2 CCP was built to run at, found
+// from the two jumps it starts with
+func CCPBase(image []uint8) (uint16, bool) {
+	if len(image) < 6 || image[0] != 0xC3 || image[3] != 0xC3 {
+		return 0, false
+	}
+	start := uint16(image[1]) | uint16(image[2])<<8
+	clear := uint16(image[4]) | uint16(image[5])<<8
+	base := start - 0x035C
+	if clear-0x0358 != base || base&0xFF != 0 || int(base)+SystemSize > 0xFF00 {
+		return 0, false
+	}
+	return base, true
+}
+
+// Boot cold-boots from drive A:. A CP/M 2.2 CCP and BDOS is loaded from
+// the system tracks, which hold a boot sector followed by the system.
+// Failing that, CPM3.SYS is loaded from the directory, as CPMLDR would.
+func (s *System) Boot() error {
+	d := s.disks[0]
+	if d == nil {
+		return fmt.Errorf("cpm: no disk in drive A:")
+	}
+	if image, ok := s.systemTracks(d); ok {
+		base, _ := CCPBase(image)
+		return s.BootImage(image, base)
+	}
+	sys, err := d.ReadFile("CPM3.SYS")
+	if err != nil {
+		return fmt.Errorf("cpm: no CP/M 2.2 system tracks or CPM3.SYS on the disk in drive A:")
+	}
+	return s.BootCPM3(sys)
+}
+
+// systemTracks returns the CCP and BDOS on the system tracks of a disk,
+// reporting false if they do not hold a CP/M 2.2 system
+func (s *System) systemTracks(d *Disk) ([]uint8, bool) {
+	image := make([]uint8, 0, SystemSize)
+	buf := make([]uint8, SectorSize)
+	for n := 1; len(image) < SystemSize; n++ { // Sector 0 is the boot loader
+		track, sector := n/d.Format.SectorsPerTrack, n%d.Format.SectorsPerTrack
+		if track >= d.Format.BootTracks || d.ReadSector(track, sector, buf) != nil {
+			return nil, false
+		}
+		image = append(image, buf...)
+	}
+	_, ok := CCPBase(image)
+	return image, ok
+}
+
+// BootImage cold-boots from a CCP and BDOS image (such as one saved by
+// MOVCPM or SYSGEN) built to run at base
+func (s *System) BootImage(image []uint8, base uint16) error {
+	if len(image) < SystemSize {
+		return fmt.Errorf("cpm: system image is %d bytes, want %d", len(image), SystemSize)
+	}
+	s.image = append([]uint8(nil), image[:SystemSize]...)
+	s.ccp = base
+	s.bios = base + SystemSize
+	s.traps = s.bios + 3*biosEntries
+	s.top = 0x10000
+	s.cpm3 = false
+
+	s.Memory.Clear()
+	s.CPU.Reset()
+	if err := s.buildBIOS(); err != nil {
+		return err
+	}
+	s.Memory.Write(0x0003, 0) // IOBYTE
+	s.Memory.Write(0x0004, 0) // Drive A:, user 0
+	s.boot(0)
+	return nil
+}
+
+// BootCPM3 cold-boots a non-banked CP/M 3 from the contents of CPM3.SYS.
+// The file starts with a header record and a record of text CPMLDR
+// prints, followed by the resident system stored top down. CCP.COM is
+// loaded from drive A:.
+func (s *System) BootCPM3(sys []uint8) error {
+	if len(sys) < 2*SectorSize {
+		return fmt.Errorf("cpm: CPM3.SYS is too short")
+	}
+	top := int(sys[0]) << 8
+	if top == 0 {
+		top = 0x10000
+	}
+	size := int(sys[1]) << 8
+	if sys[3] != 0 {
+		return fmt.Errorf("cpm: banked CP/M 3 is not supported")
+	}
+	base := top - size
+	bios := int(sys[4]) | int(sys[5])<<8
+	if size == 0 || base < TPA || len(sys) < 2*SectorSize+size || bios < base || bios+4*bios3Entries > top {
+		return fmt.Errorf("cpm: not a CP/M 3 CPM3.SYS")
+	}
+
+	s.Memory.Clear()
+	s.CPU.Reset()
+	data := sys[2*SectorSize:]
+	for addr := top - SectorSize; addr >= base; addr -= SectorSize {
+		s.Memory.Load(uint16(addr), data[:SectorSize])
+		data = data[SectorSize:]
+	}
+	// The resident BDOS starts with its serial number and a jump to its
+	// entry
+	s.bdos = uint16(base) + 6
+	if s.Memory.Read(s.bdos) != 0xC3 {
+		return fmt.Errorf("cpm: no BDOS entry at %04X in CPM3.SYS", s.bdos)
+	}
+	s.image = nil
+	s.bios = uint16(bios)
+	s.traps = s.bios + 3*bios3Entries
+	s.top = top
+	s.cpm3 = true
+	if err := s.buildBIOS(); err != nil {
+		return err
+	}
+	s.Memory.Load(0x0005, []uint8{0xC3, uint8(s.bdos), uint8(s.bdos >> 8)})
+	return s.boot3()
+}
+
+// entries returns the number of BIOS entries
+func (s *System) entries() int {
+	if s.cpm3 {
+		return bios3Entries
+	}
+	return biosEntries
+}
+
+// buildBIOS writes the jump table and the disk tables of the mounted
+// drives above the BDOS
+func (s *System) buildBIOS() error {
+	entries := uint16(s.entries())
+	for i := uint16(0); i < entries; i++ {
+		target := s.traps + i
+		s.Memory.Load(s.bios+3*i, []uint8{0xC3, uint8(target), uint8(target >> 8)})
+		s.Memory.Write(target, 0xC9)
+	}
+	next := int(s.traps + entries)
+	alloc := func(n int) uint16 {
+		addr := uint16(next)
+		next += n
+		return addr
+	}
+
+	// CP/M 2.2 shares one directory buffer between the drives. CP/M 3
+	// reaches its buffers through buffer control blocks, and a
+	// non-banked system has one for the directory and one for data.
+	dirbuf := alloc(SectorSize)
+	var dirBCB, dataBCB uint16
+	if s.cpm3 {
+		s.devtbl = alloc(1)
+		s.Memory.Write(s.devtbl, 0) // No character devices
+		s.drvtbl = alloc(2 * NumDrives)
+		dataBuf := alloc(SectorSize)
+		dirBCB, dataBCB = alloc(15), alloc(15)
+		for _, b := range [][2]uint16{{dirBCB, dirbuf}, {dataBCB, dataBuf}} {
+			s.Memory.Load(b[0], []uint8{0xFF, 0, 0, 0, 0, 0, 0, 0, 0, 0, uint8(b[1]), uint8(b[1] >> 8), 0, 0, 0})
+		}
+	}
+	for drive, d := range s.disks {
+		s.dph[drive] = 0
+		if d == nil {
+			continue
+		}
+		f := d.Format
+		dpb := f.DPB()
+		dpbBytes, dphSize, alvSize := dpb[:], 16, f.blocks()/8+1
+		if s.cpm3 {
+			dpb3 := f.DPB3()
+			// Room for the BDOS's double-bit allocation vectors
+			dpbBytes, dphSize, alvSize = dpb3[:], 25, (f.blocks()-1)/4+2
+		}
+		xlt := f.XLT()
+		dph := alloc(dphSize)
+		xltAddr := uint16(0)
+		if len(xlt) > 0 {
+			xltAddr = alloc(len(xlt))
+		}
+		dpbAddr := alloc(len(dpbBytes))
+		csv := alloc(int(dpbBytes[11]) | int(dpbBytes[12]&0x7F)<<8)
+		alv := alloc(alvSize)
+		if next > s.top {
+			return fmt.Errorf("cpm: the drive tables do not fit above a BIOS at %04X", s.bios)
+		}
+
+		s.Memory.Load(xltAddr, xlt)
+		s.Memory.Load(dpbAddr, dpbBytes)
+		if s.cpm3 {
+			s.Memory.Load(dph, []uint8{
+				uint8(xltAddr), uint8(xltAddr >> 8),
+				0, 0, 0, 0, 0, 0, 0, 0, 0, // BDOS scratch
+				0, // Media flag
+				uint8(dpbAddr), uint8(dpbAddr >> 8),
+				uint8(csv), uint8(csv >> 8),
+				uint8(alv), uint8(alv >> 8),
+				uint8(dirBCB), uint8(dirBCB >> 8),
+				uint8(dataBCB), uint8(dataBCB >> 8),
+				0xFF, 0xFF, // No directory hashing
+				0,
+			})
+			s.Memory.Load(s.drvtbl+2*uint16(drive), []uint8{uint8(dph), uint8(dph >> 8)})
+		} else {
+			s.Memory.Load(dph, []uint8{
+				uint8(xltAddr), uint8(xltAddr >> 8),
+				0, 0, 0, 0, 0, 0, // BDOS scratch
+				uint8(dirbuf), uint8(dirbuf >> 8),
+				uint8(dpbAddr), uint8(dpbAddr >> 8),
+				uint8(csv), uint8(csv >> 8),
+				uint8(alv), uint8(alv >> 8),
+			})
+		}
+		s.dph[drive] = dph
+	}
+	return nil
+}
+
+// boot reloads the CCP and BDOS, sets up the zero page and enters the
+// CCP: at its start on a cold boot, so that a command stored in the image
+// runs, or at its second entry on a warm boot, which clears the command
+// buffer
+func (s *System) boot(entry uint16) {
+	s.Memory.Load(s.ccp, s.image)
+	bdos := s.ccp + ccpSize + 6
+	wboot := s.bios + 3*biosWBoot
+	s.Memory.Load(0x0000, []uint8{0xC3, uint8(wboot), uint8(wboot >> 8)})
+	s.Memory.Load(0x0005, []uint8{0xC3, uint8(bdos), uint8(bdos >> 8)})
+	s.dma = DefaultDMA
+	s.CPU.SP = DefaultDMA
+	s.CPU.C = s.Memory.Read(0x0004)
+	s.CPU.PC = s.ccp + entry
+}
+
+// boot3 boots CP/M 3 as its BIOS does: it sets up the zero page and
+// loads CCP.COM from drive A: to run at 0100. A warm boot keeps the BDOS
+// entry at 0006, which resident system extensions move below themselves.
+func (s *System) boot3() error {
+	wboot := s.bios + 3*biosWBoot
+	s.Memory.Load(0x0000, []uint8{0xC3, uint8(wboot), uint8(wboot >> 8)})
+	s.Memory.Write(0x0005, 0xC3)
+	d := s.disks[0]
+	if d == nil {
+		return fmt.Errorf("cpm: no disk in drive A:")
+	}
+	ccp, err := d.ReadFile("CCP.COM")
+	if err != nil {
+		return fmt.Errorf("cpm: no CCP.COM on the disk in drive A:")
+	}
+	if len(ccp) > int(s.bdos)-TPA {
+		return fmt.Errorf("cpm: CCP.COM does not fit below the BDOS")
+	}
+	s.Memory.Load(TPA, ccp)
+	s.dma = DefaultDMA
+	s.CPU.SP = TPA
+	s.CPU.PC = TPA
+	return nil
+}
+
+// Run executes until an error occurs, such as ErrInputClosed when the
+// console input has ended. CP/M itself never stops.
+func (s *System) Run() error {
+	for {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+}
+
+// Step executes one instruction or one trapped BIOS call
+func (s *System) Step() error {
+	if s.image == nil && !s.cpm3 {
+		return fmt.Errorf("cpm: system not booted")
+	}
+	pc := s.CPU.PC
+	if pc >= s.traps && int(pc-s.traps) < s.entries() {
+		return s.biosCall(int(pc - s.traps))
+	}
+	s.CPU.Step()
+	return nil
+}
+
+// biosCall performs a BIOS function and returns from it
+func (s *System) biosCall(fn int) error {
+	switch fn {
+	case biosBoot, biosWBoot:
+		if s.cpm3 {
+			return s.boot3()
+		}
+		if fn == biosBoot {
+			s.Memory.Write(0x0004, 0)
+			s.boot(0)
+		} else {
+			s.boot(3)
+		}
+		return nil
+	case biosConst:
+		s.CPU.A = 0
+		if s.Console.Status() {
+			s.CPU.A = 0xFF
+		}
+	case biosConin:
+		c, err := s.Console.Read()
+		if errors.Is(err, io.EOF) {
+			return ErrInputClosed
+		}
+		if err != nil {
+			return err
+		}
+		s.CPU.A = c & 0x7F
+	case biosConout:
+		if err := s.Console.Write(s.CPU.C); err != nil {
+			return err
+		}
+	case biosList, biosPunch:
+		// Nothing attached
+	case biosReader:
+		s.CPU.A = ctrlZ
+	case biosHome:
+		s.track = 0
+	case biosSeldsk:
+		d := int(s.CPU.C)
+		hl := uint16(0)
+		if d < NumDrives && s.dph[d] != 0 {
+			s.disk, hl = d, s.dph[d]
+		}
+		s.CPU.SetHL(hl)
+	case biosSettrk:
+		s.track = int(s.CPU.BC())
+	case biosSetsec:
+		s.sector = int(s.CPU.BC())
+	case biosSetdma:
+		s.dma = s.CPU.BC()
+	case biosRead, biosWrite:
+		s.CPU.A = s.transfer(fn == biosWrite)
+	case biosListst, biosConost, biosAuxost:
+		s.CPU.A = 0xFF
+	case biosSectran:
+		sector := s.CPU.BC()
+		if xlt := s.CPU.DE(); xlt != 0 {
+			sector = uint16(s.Memory.Read(xlt + sector))
+		}
+		s.CPU.SetHL(sector)
+	case biosAuxist, biosFlush:
+		s.CPU.A = 0
+	case biosDevtbl:
+		s.CPU.SetHL(s.devtbl)
+	case biosDrvtbl:
+		s.CPU.SetHL(s.drvtbl)
+	case biosMove:
+		// LDIR from DE to HL, leaving both past the block
+		dst, src := s.CPU.HL(), s.CPU.DE()
+		for n := s.CPU.BC(); n > 0; n-- {
+			s.Memory.Write(dst, s.Memory.Read(src))
+			dst, src = dst+1, src+1
+		}
+		s.CPU.SetHL(dst)
+		s.CPU.SetDE(src)
+		// DEVINI, MULTIO, TIME and the bank entries have nothing to do:
+		// records are transferred one at a time and there is no clock
+	}
+	s.CPU.PC = uint16(s.Memory.Read(s.CPU.SP)) | uint16(s.Memory.Read(s.CPU.SP+1))<<8
+	s.CPU.SP += 2
+	return nil
+}
+
+// transfer reads or writes the selected sector at the DMA address,
+// returning the BIOS result: 0 for success, 1 for an error
+func (s *System) transfer(write bool) uint8 {
+	d := s.disks[s.disk]
+	if d == nil || s.dph[s.disk] == 0 {
+		return 1
+	}
+	sector := s.sector
+	if d.Format.skewed() {
+		sector-- // Physical sectors are numbered from 1
+	}
+	buf := make([]uint8, SectorSize)
+	if write {
+		for i := range buf {
+			buf[i] = s.Memory.Read(s.dma + uint16(i))
+		}
+		if d.WriteSector(s.track, sector, buf) != nil {
+			return 1
+		}
+		return 0
+	}
+	if d.ReadSector(s.track, sector, buf) != nil {
+		return 1
+	}
+	s.Memory.Load(s.dma, buf)
+	return 0
+}
@@ -0,0 +1,247 @@
+package cpm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memStorage is a disk image in memory
+type memStorage []uint8
+
+func (m memStorage) ReadAt(p []uint8, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memStorage) WriteAt(p []uint8, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+func TestDiskFormats(t *testing.T) {
+	f := Formats["ibm-3740"]
+	want := [15]uint8{26, 0, 3, 7, 0, 242, 0, 63, 0, 0xC0, 0, 16, 0, 2, 0}
+	if dpb := f.DPB(); dpb != want {
+		t.Errorf("ibm-3740 DPB = % X, want % X", dpb, want)
+	}
+	xlt := f.XLT()
+	if !bytes.Equal(xlt[:8], []uint8{1, 7, 13, 19, 25, 5, 11, 17}) || len(xlt) != 26 {
+		t.Errorf("ibm-3740 XLT = %v", xlt)
+	}
+	if f.Size() != 256256 {
+		t.Errorf("ibm-3740 image is %d bytes", f.Size())
+	}
+	hd := Formats["4mb-hd"].DPB()
+	if dsm := int(hd[5]) | int(hd[6])<<8; dsm != 2047 || hd[4] != 0 {
+		t.Errorf("4mb-hd DSM %d EXM %d", dsm, hd[4])
+	}
+}
+
+func TestOpenDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.img")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenDisk(path, Formats["ibm-3740"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]uint8, SectorSize)
+	buf[0] = 0x42
+	if err := d.WriteSector(40, 3, buf); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	data, _ := os.ReadFile(path)
+	if int64(len(data)) != d.Format.Size() || data[0] != 0xE5 || data[(40*26+3)*SectorSize] != 0x42 {
+		t.Errorf("image is %d bytes", len(data))
+	}
+}
+
+func TestBootSystem(t *testing.T) {
+	const base = 0xE400
+	const bios = base + SystemSize
+
+	// A stand-in CCP that prints "A", reads the first data sector through
+	// the BIOS, prints its first byte and warm-boots into a HALT
+	image := make([]uint8, SystemSize)
+	copy(image, []uint8{0xC3, 0x5C, 0xE7, 0xC3, 0x58, 0xE7})
+	image[0x358] = 0x76 // HALT
+	call := func(fn int) []uint8 {
+		addr := bios + 3*fn
+		return []uint8{0xCD, uint8(addr), uint8(addr >> 8)}
+	}
+	var code []uint8
+	add := func(b ...[]uint8) {
+		for _, x := range b {
+			code = append(code, x...)
+		}
+	}
+	add([]uint8{0x0E, 'A'}, call(biosConout))
+	add([]uint8{0x0E, 0x00}, call(biosSeldsk))
+	add([]uint8{0xE5}) // PUSH HL
+	add([]uint8{0x01, 0x02, 0x00}, call(biosSettrk))
+	add([]uint8{0xE1, 0x5E, 0x23, 0x56}) // POP HL; LD E,(HL); INC HL; LD D,(HL): the XLT
+	add([]uint8{0x01, 0x00, 0x00}, call(biosSectran))
+	add([]uint8{0x44, 0x4D}, call(biosSetsec)) // LD B,H; LD C,L
+	add([]uint8{0x01, 0x00, 0x10}, call(biosSetdma))
+	add(call(biosRead))
+	add([]uint8{0x3A, 0x00, 0x10, 0x4F}, call(biosConout)) // LD A,(1000h); LD C,A
+	add([]uint8{0xC3, 0x00, 0x00})                         // JP 0
+	copy(image[0x35C:], code)
+
+	format := Formats["ibm-3740"]
+	storage := make(memStorage, format.Size())
+	copy(storage[SectorSize:], image) // After the boot sector
+	storage[2*26*SectorSize] = 'Z'    // Track 2, sector 1
+	var out bytes.Buffer
+	s := NewSystem(NewStreamConsole(strings.NewReader(""), &out))
+	if err := s.Mount(0, NewDisk(storage, format)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if s.ccp != base || s.bios != bios {
+		t.Fatalf("CCP at %04X, BIOS at %04X", s.ccp, s.bios)
+	}
+
+	for i := 0; i < 1000 && !s.CPU.Halted; i++ {
+		if err := s.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.CPU.Halted || s.CPU.PC < base+0x358 || s.CPU.PC > base+0x359 {
+		t.Fatalf("did not warm-boot into the CCP: PC %04X out %q", s.CPU.PC, out.String())
+	}
+	if out.String() != "AZ" {
+		t.Errorf("console output %q, want %q", out.String(), "AZ")
+	}
+	if jp := s.Memory.Read(0x0005); jp != 0xC3 || s.Memory.Read(0x0007) != (base+ccpSize)>>8 {
+		t.Errorf("BDOS jump not set up")
+	}
+}
+
+// putFile writes a file of up to 16K to user area 0 of a disk, in
+// directory entry n and in blocks from first on
+func putFile(t *testing.T, d *Disk, n int, name string, first int, data []uint8) {
+	t.Helper()
+	f := d.Format
+	xlt := f.XLT()
+	place := func(rec int) (int, int) {
+		return f.BootTracks + rec/f.SectorsPerTrack, int(xlt[rec%f.SectorsPerTrack]) - 1
+	}
+	write := func(rec int, buf []uint8) {
+		track, sector := place(rec)
+		if err := d.WriteSector(track, sector, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs := (len(data) + SectorSize - 1) / SectorSize
+	perBlock := f.BlockSize / SectorSize
+	fn, _ := hostName(name)
+	entry := append([]uint8{0}, fn[:]...)
+	entry = append(entry, 0, 0, 0, uint8(recs))
+	for b := 0; b < 16; b++ {
+		if b*perBlock < recs {
+			entry = append(entry, uint8(first+b))
+		} else {
+			entry = append(entry, 0)
+		}
+	}
+	dir := make([]uint8, SectorSize)
+	track, sector := place(0)
+	d.ReadSector(track, sector, dir)
+	copy(dir[32*n:], entry)
+	write(0, dir)
+	for r := 0; r < recs; r++ {
+		buf := make([]uint8, SectorSize)
+		copy(buf, data[r*SectorSize:])
+		write(first*perBlock+r, buf)
+	}
+}
+
+func TestBootCPM3(t *testing.T) {
+	const base, bios = 0xFC00, 0xFD00
+
+	// A stand-in resident BDOS whose only function prints E through the
+	// BIOS, stored top down after the header and print records
+	res := make([]uint8, 0x400)
+	copy(res[6:], []uint8{0xC3, 0x09, 0xFC, 0x4B, 0xC3, 0x0C, 0xFD}) // JP $+3; LD C,E; JP CONOUT
+	sys := make([]uint8, 2*SectorSize)
+	copy(sys, []uint8{0x00, 0x04, 0x00, 0x00, bios & 0xFF, bios >> 8})
+	for addr := len(res) - SectorSize; addr >= 0; addr -= SectorSize {
+		sys = append(sys, res[addr:addr+SectorSize]...)
+	}
+
+	// A stand-in CCP that counts its runs at 9000, prints "3", copies its
+	// first two bytes to 9100 with the BIOS MOVE and warm-boots, halting
+	// when run a second time
+	move := bios + 3*biosMove
+	ccp := []uint8{
+		0x21, 0x00, 0x90, 0x34, 0x7E, 0xFE, 0x02, 0xCA, 0x1F, 0x01, // LD HL,9000h; INC (HL); LD A,(HL); CP 2; JP Z,halt
+		0x0E, 0x02, 0x1E, '3', 0xCD, 0x05, 0x00, // LD C,2; LD E,'3'; CALL 5
+		0x21, 0x00, 0x91, 0x11, 0x00, 0x01, 0x01, 0x02, 0x00, // LD HL,9100h; LD DE,0100h; LD BC,2
+		0xCD, uint8(move), uint8(move >> 8), // CALL MOVE
+		0xC3, 0x00, 0x00, // JP 0
+		0x76, // halt: HALT
+	}
+
+	format := Formats["ibm-3740"]
+	storage := make(memStorage, format.Size())
+	for i := range storage {
+		storage[i] = 0xE5
+	}
+	d := NewDisk(storage, format)
+	putFile(t, d, 0, "CCP.COM", 2, ccp)
+	putFile(t, d, 1, "CPM3.SYS", 3, sys)
+	if got, err := d.ReadFile("ccp.com"); err != nil || !bytes.Equal(got[:len(ccp)], ccp) {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	var out bytes.Buffer
+	s := NewSystem(NewStreamConsole(strings.NewReader(""), &out))
+	s.Mount(0, d)
+	if err := s.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000 && !s.CPU.Halted; i++ {
+		if err := s.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.CPU.Halted || s.Memory.Read(0x9000) != 2 {
+		t.Fatalf("CCP.COM not reloaded on warm boot: PC %04X runs %d", s.CPU.PC, s.Memory.Read(0x9000))
+	}
+	if out.String() != "3" {
+		t.Errorf("console output %q, want %q", out.String(), "3")
+	}
+	if s.Memory.Read(0x9100) != 0x21 || s.Memory.Read(0x9101) != 0x00 {
+		t.Errorf("MOVE did not copy")
+	}
+	if s.Memory.Read(0x0006) != 0x06 || s.Memory.Read(0x0007) != base>>8 {
+		t.Errorf("BDOS jump not set up")
+	}
+	dph := s.dph[0]
+	dpb := uint16(s.Memory.Read(dph+12)) | uint16(s.Memory.Read(dph+13))<<8
+	want := format.DPB3()
+	for i, b := range want {
+		if s.Memory.Read(dpb+uint16(i)) != b {
+			t.Fatalf("DPB byte %d differs", i)
+		}
+	}
+
+	sys[3] = 1 // A banked system
+	if err := NewSystem(nil).BootCPM3(sys); err == nil {
+		t.Error("banked CPM3.SYS booted")
+	}
+}
@@ -0,0 +1,89 @@
+package cpm
+
+import (
+	"io"
+	"sync"
+)
+
+// Console is the terminal a CP/M program talks to
+type Console interface {
+	// Status reports whether a character is waiting
+	Status() bool
+	// Read waits for a character. It returns io.EOF once input has ended.
+	Read() (uint8, error)
+	// Write sends a character to the screen
+	Write(c uint8) error
+}
+
+// StreamConsole is a Console reading from an io.Reader and writing to an
+// io.Writer, such as a pipe, a file or a terminal
+type StreamConsole struct {
+	r    io.Reader
+	w    io.Writer
+	once sync.Once
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []uint8 // Characters read ahead
+	err  error   // Why input ended
+}
+
+// NewStreamConsole creates a console on r and w. Input is read ahead in
+// the background so that Status does not block.
+func NewStreamConsole(r io.Reader, w io.Writer) *StreamConsole {
+	c := &StreamConsole{r: r, w: w}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *StreamConsole) start() {
+	c.once.Do(func() {
+		go func() {
+			buf := make([]uint8, 256)
+			for {
+				n, err := c.r.Read(buf)
+				c.mu.Lock()
+				c.buf = append(c.buf, buf[:n]...)
+				if err != nil {
+					c.err = err
+				}
+				c.cond.Broadcast()
+				c.mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Status implements Console. A console whose input has ended reports a
+// character waiting, so that programs polling it go on to read and see
+// the end of input.
+func (c *StreamConsole) Status() bool {
+	c.start()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf) > 0 || c.err != nil
+}
+
+// Read implements Console
+func (c *StreamConsole) Read() (uint8, error) {
+	c.start()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		return 0, c.err
+	}
+	b := c.buf[0]
+	c.buf = c.buf[1:]
+	return b, nil
+}
+
+// Write implements Console
+func (c *StreamConsole) Write(b uint8) error {
+	_, err := c.w.Write([]uint8{b})
+	return err
+}
@@ -0,0 +1,316 @@
+// Package cpm runs CP/M 2.2 programs. The BDOS is emulated in Go: calls
+// through 0x0005 are trapped and served from directories on the host, so
+// .COM tools such as assemblers and compilers can read and write host
+// files directly.
+//
+// Each drive (A: to P:) maps to a host directory. User area 0 is the
+// directory itself and user areas 1-15 are subdirectories named 1 to 15.
+// Host files are visible when their names fit the 8.3 form; names are
+// matched without regard to case and new files are created in upper
+// case.
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// Memory layout. There is no CCP, so the TPA runs up to the BDOS.
+const (
+	TPA         = 0x0100 // Where .COM files load
+	DefaultFCB  = 0x005C
+	DefaultFCB2 = 0x006C
+	DefaultDMA  = 0x0080 // Also holds the command tail
+	bdosCall    = 0x0005
+	bdosBase    = 0xFA00
+	bdosEntry   = bdosBase + 6 // Target of the JP at 0x0005
+	alvAddr     = 0xFA10       // Allocation vector (always empty)
+	biosBase    = 0xFE00       // BIOS jump table
+	dpbAddr     = 0xFE40       // Disk parameter block shared by all drives
+)
+
+// BIOS entry points, in jump table order
+const (
+	biosBoot = iota
+	biosWBoot
+	biosConst
+	biosConin
+	biosConout
+	biosList
+	biosPunch
+	biosReader
+	biosHome
+	biosSeldsk
+	biosSettrk
+	biosSetsec
+	biosSetdma
+	biosRead
+	biosWrite
+	biosListst
+	biosSectran
+	biosEntries // Entries of a CP/M 2.2 BIOS; CP/M 3 adds these
+)
+
+const (
+	biosConost = biosEntries + iota
+	biosAuxist
+	biosAuxost
+	biosDevtbl
+	biosDevini
+	biosDrvtbl
+	biosMultio
+	biosFlush
+	biosMove
+	biosTime
+	biosSelmem
+	biosSetbnk
+	biosXmove
+	biosUserf
+	biosReserv1
+	biosReserv2
+	bios3Entries
+)
+
+// Disk geometry reported to programs: 8MB drives with 2K blocks, so one
+// directory entry covers a 16K extent
+const (
+	blockSize     = 2048
+	diskBlocks    = 4096
+	extentRecords = 128
+	recordSize    = 128
+)
+
+// NumDrives is the number of drive letters, A: to P:
+const NumDrives = 16
+
+// ErrInputClosed is returned by Run when a program waits for console
+// input after the input has ended
+var ErrInputClosed = errors.New("cpm: console input closed")
+
+// Machine is a Z80 with 64K of RAM running CP/M
+type Machine struct {
+	CPU     *z80.Z80
+	Memory  *memory.RAM
+	Console Console
+
+	drives     [NumDrives]string // Host directory of each drive, "" if unmapped
+	drive      int               // Current drive
+	user       int               // Current user area
+	dma        uint16
+	iobyte     uint8
+	search     [][32]uint8 // Directory entries left for search next
+	lastCR     bool        // The last console line ended with CR
+	returnCode uint16      // Set by BDOS function 108
+	exited     bool
+}
+
+// New creates a machine with the zero page and BDOS set up and drive A:
+// mapped to dir
+func New(console Console, dir string) *Machine {
+	mem := memory.NewRAM()
+	m := &Machine{
+		CPU:     z80.New(mem, zio.NewNullIO()),
+		Memory:  mem,
+		Console: console,
+		dma:     DefaultDMA,
+	}
+	m.drives[0] = dir
+	m.Reset()
+	return m
+}
+
+// Reset clears memory and sets up the zero page, BDOS entry, BIOS jump
+// table and disk parameter block
+func (m *Machine) Reset() {
+	m.Memory.Clear()
+	m.CPU.Reset()
+
+	m.Memory.Load(0x0000, []uint8{0xC3, (biosBase + 3) & 0xFF, (biosBase + 3) >> 8}) // JP WBOOT
+	m.Memory.Write(0x0003, m.iobyte)
+	m.Memory.Load(bdosCall, []uint8{0xC3, bdosEntry & 0xFF, bdosEntry >> 8}) // JP BDOS
+	m.Memory.Write(bdosEntry, 0xC9)
+
+	// The BIOS entries return at once unless trapped
+	for i := 0; i < 17; i++ {
+		m.Memory.Write(uint16(biosBase+3*i), 0xC9)
+	}
+	m.Memory.Load(dpbAddr, []uint8{
+		64, 0, // SPT: records per track
+		4,                                              // BSH: 2K blocks
+		15,                                             // BLM
+		0,                                              // EXM: one 16K extent per directory entry
+		(diskBlocks - 1) & 0xFF, (diskBlocks - 1) >> 8, // DSM
+		0xFF, 0x03, // DRM: 1024 directory entries
+		0xFF, 0xFF, // AL0, AL1
+		0, 0, // CKS: fixed disk
+		0, 0, // OFF
+	})
+
+	m.dma = DefaultDMA
+	m.search = nil
+	m.exited = false
+	m.setDriveUser()
+}
+
+// SetDrive maps a drive (0 for A:) to a host directory, or unmaps it if
+// dir is empty
+func (m *Machine) SetDrive(drive int, dir string) error {
+	if drive < 0 || drive >= NumDrives {
+		return fmt.Errorf("cpm: no drive %d", drive)
+	}
+	m.drives[drive] = dir
+	return nil
+}
+
+// Drive returns the host directory mapped to a drive
+func (m *Machine) Drive(drive int) string {
+	if drive < 0 || drive >= NumDrives {
+		return ""
+	}
+	return m.drives[drive]
+}
+
+// SetUser selects the user area (0-15) files are found in
+func (m *Machine) SetUser(user int) error {
+	if user < 0 || user > 15 {
+		return fmt.Errorf("cpm: no user area %d", user)
+	}
+	m.user = user
+	m.setDriveUser()
+	return nil
+}
+
+// LoadCOM loads a program at 0x0100 and sets up the default FCBs and the
+// command tail from args, as the CCP would
+func (m *Machine) LoadCOM(program []uint8, args []string) error {
+	if len(program) > bdosBase-TPA {
+		return fmt.Errorf("cpm: program is %d bytes, the TPA holds %d", len(program), bdosBase-TPA)
+	}
+	m.Memory.Load(TPA, program)
+
+	tail := strings.ToUpper(strings.Join(args, " "))
+	if tail != "" {
+		tail = " " + tail
+	}
+	if len(tail) > 127 {
+		return fmt.Errorf("cpm: command tail is longer than 127 characters")
+	}
+	m.Memory.Write(DefaultDMA, uint8(len(tail)))
+	m.Memory.Load(DefaultDMA+1, append([]uint8(tail), 0))
+
+	for i := uint16(0); i < 36; i++ {
+		m.Memory.Write(DefaultFCB+i, 0)
+	}
+	fcbs := [2]uint16{DefaultFCB, DefaultFCB2}
+	for i, addr := range fcbs {
+		var fcb [16]uint8
+		if i < len(args) {
+			fcb = ParseFCB(args[i])
+		} else {
+			fcb = ParseFCB("")
+		}
+		m.Memory.Load(addr, fcb[:])
+	}
+
+	m.CPU.PC = TPA
+	m.CPU.SP = bdosBase
+	m.push(0x0000) // Returning from the program warm-boots
+	return nil
+}
+
+// Run executes the program until it warm-boots (BDOS function 0, or a
+// jump to 0x0000) or an error occurs
+func (m *Machine) Run() error {
+	for {
+		exited, err := m.Step()
+		if err != nil || exited {
+			return err
+		}
+	}
+}
+
+// Step executes one instruction or one trapped BDOS/BIOS call. It reports
+// whether the program has exited. Of the BIOS, the boot and character I/O
+// entries are served; the disk entries return at once.
+func (m *Machine) Step() (bool, error) {
+	if m.exited {
+		return true, nil
+	}
+	switch m.CPU.PC {
+	case bdosEntry:
+		err := m.bdos()
+		if m.exited {
+			return true, err
+		}
+		m.ret()
+		return false, err
+	case biosBase, biosBase + 3: // BOOT, WBOOT
+		m.exited = true
+		return true, nil
+	case biosBase + 3*biosConst, biosBase + 3*biosConin, biosBase + 3*biosConout,
+		biosBase + 3*biosList, biosBase + 3*biosPunch, biosBase + 3*biosReader:
+		err := m.biosConsole(int(m.CPU.PC-biosBase) / 3)
+		m.ret()
+		return false, err
+	}
+	m.CPU.Step()
+	return false, nil
+}
+
+// biosConsole serves the character I/O entries of the BIOS jump table,
+// for programs that bypass the BDOS
+func (m *Machine) biosConsole(fn int) error {
+	switch fn {
+	case biosConst:
+		m.CPU.A = uint8(m.status())
+	case biosConin:
+		c, err := m.conin()
+		if err != nil {
+			return err
+		}
+		m.CPU.A = c
+	case biosConout:
+		return m.conout(m.CPU.C)
+	case biosReader:
+		m.CPU.A = ctrlZ
+	}
+	return nil // No printer or punch attached
+}
+
+// Exited reports whether the program has warm-booted
+func (m *Machine) Exited() bool {
+	return m.exited
+}
+
+// ReturnCode returns the program return code set with BDOS function 108
+// (a CP/M 3 call). Codes 0xFF00 and above mean failure.
+func (m *Machine) ReturnCode() uint16 {
+	return m.returnCode
+}
+
+// push pushes a word onto the Z80 stack
+func (m *Machine) push(v uint16) {
+	m.CPU.SP -= 2
+	m.Memory.Write(m.CPU.SP, uint8(v))
+	m.Memory.Write(m.CPU.SP+1, uint8(v>>8))
+}
+
+// ret returns from a trapped call
+func (m *Machine) ret() {
+	m.CPU.PC = m.readWord(m.CPU.SP)
+	m.CPU.SP += 2
+}
+
+func (m *Machine) readWord(addr uint16) uint16 {
+	return uint16(m.Memory.Read(addr)) | uint16(m.Memory.Read(addr+1))<<8
+}
+
+// setDriveUser stores the current drive and user in the zero page
+func (m *Machine) setDriveUser() {
+	m.Memory.Write(0x0004, uint8(m.user<<4|m.drive))
+}
@@ -0,0 +1,306 @@
+package cpm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testFCB = 0x2000
+
+// call makes a BDOS call as a program would and returns A
+func call(t *testing.T, m *Machine, fn uint8, de uint16) uint8 {
+	t.Helper()
+	m.CPU.C = fn
+	m.CPU.SetDE(de)
+	m.CPU.SP = 0xF000
+	m.push(0x1234)
+	m.CPU.PC = bdosEntry
+	if _, err := m.Step(); err != nil {
+		t.Fatalf("BDOS %d: %v", fn, err)
+	}
+	if m.CPU.PC != 0x1234 && !m.Exited() {
+		t.Fatalf("BDOS %d returned to %04X", fn, m.CPU.PC)
+	}
+	return m.CPU.A
+}
+
+func readBytes(m *Machine, addr uint16, n int) []uint8 {
+	b := make([]uint8, n)
+	for i := range b {
+		b[i] = m.Memory.Read(addr + uint16(i))
+	}
+	return b
+}
+
+func setFCB(m *Machine, name string) {
+	fcb := ParseFCB(name)
+	m.Memory.Load(testFCB, fcb[:])
+	for i := uint16(16); i < fcbLength; i++ {
+		m.Memory.Write(testFCB+i, 0)
+	}
+}
+
+func TestParseFCB(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"prog.asm", "\x00PROG    ASM"},
+		{"B:*.COM", "\x02????????COM"},
+		{"c:file", "\x03FILE       "},
+		{"LONGNAME123.TEXT", "\x00LONGNAMETEX"},
+		{"", "\x00           "},
+	}
+	for _, tt := range tests {
+		fcb := ParseFCB(tt.text)
+		if got := string(fcb[:fcbEX]); got != tt.want {
+			t.Errorf("ParseFCB(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHostName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"hello.txt": true, "README": true, "a.b.c": false,
+		"toolongname.txt": false, "x.long": false, "a*b.txt": false,
+	} {
+		if _, ok := hostName(name); ok != want {
+			t.Errorf("hostName(%q) ok = %v, want %v", name, ok, want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	m := New(NewStreamConsole(strings.NewReader(""), &bytes.Buffer{}), dir)
+	m.dma = 0x3000
+
+	setFCB(m, "TEST.DAT")
+	if a := call(t, m, fnOpenFile, testFCB); a != resultFailure {
+		t.Fatalf("opening a missing file returned %02X", a)
+	}
+	if a := call(t, m, fnMakeFile, testFCB); a == resultFailure {
+		t.Fatal("make file failed")
+	}
+	for r := 0; r < 130; r++ {
+		for i := uint16(0); i < recordSize; i++ {
+			m.Memory.Write(0x3000+i, uint8(r))
+		}
+		if a := call(t, m, fnWriteSeq, testFCB); a != 0 {
+			t.Fatalf("write record %d returned %02X", r, a)
+		}
+	}
+	if ex := m.Memory.Read(testFCB + fcbEX); ex != 1 {
+		t.Errorf("extent after 130 records = %d, want 1", ex)
+	}
+	call(t, m, fnCloseFile, testFCB)
+	data, err := os.ReadFile(filepath.Join(dir, "TEST.DAT"))
+	if err != nil || len(data) != 130*recordSize || data[129*recordSize] != 129 {
+		t.Fatalf("host file is %d bytes, err %v", len(data), err)
+	}
+
+	// Sequential read back from the start, then past the end
+	setFCB(m, "test.dat")
+	if a := call(t, m, fnOpenFile, testFCB); a != 0 {
+		t.Fatalf("open returned %02X", a)
+	}
+	if rc := m.Memory.Read(testFCB + fcbRC); rc != 128 {
+		t.Errorf("RC of extent 0 = %d, want 128", rc)
+	}
+	for r := 0; r < 130; r++ {
+		if a := call(t, m, fnReadSeq, testFCB); a != 0 || m.Memory.Read(0x3000) != uint8(r) {
+			t.Fatalf("read record %d returned %02X with data %d", r, a, m.Memory.Read(0x3000))
+		}
+	}
+	if a := call(t, m, fnReadSeq, testFCB); a != resultEOF {
+		t.Errorf("read past the end returned %02X", a)
+	}
+
+	// Random access and file size
+	m.setRandomRecord(testFCB, 42)
+	if a := call(t, m, fnReadRandom, testFCB); a != 0 || m.Memory.Read(0x3000) != 42 {
+		t.Errorf("random read returned %02X with data %d", a, m.Memory.Read(0x3000))
+	}
+	call(t, m, fnSetRandom, testFCB)
+	if r := m.readWord(testFCB + fcbR0); r != 42 {
+		t.Errorf("set random record = %d, want 42", r)
+	}
+	call(t, m, fnFileSize, testFCB)
+	if r := m.readWord(testFCB + fcbR0); r != 130 {
+		t.Errorf("file size = %d records, want 130", r)
+	}
+	m.setRandomRecord(testFCB, 200)
+	if a := call(t, m, fnReadRandom, testFCB); a != resultNoData {
+		t.Errorf("reading an unwritten record returned %02X", a)
+	}
+
+	// Search reports one entry per extent with "?" in EX
+	os.WriteFile(filepath.Join(dir, "other.txt"), []uint8("hi"), 0o644)
+	setFCB(m, "*.*")
+	m.Memory.Write(testFCB+fcbEX, '?')
+	var found []string
+	for a := call(t, m, fnSearchFirst, testFCB); a != resultFailure; a = call(t, m, fnSearchNext, 0) {
+		var n fileName
+		copy(n[:], readBytes(m, 0x3000+fcbName, len(n)))
+		found = append(found, n.String())
+	}
+	if got := strings.Join(found, " "); got != "OTHER.TXT TEST.DAT TEST.DAT" {
+		t.Errorf("search found %q", got)
+	}
+
+	// Rename, then delete
+	setFCB(m, "TEST.DAT")
+	newName := ParseFCB("NEW.DAT")
+	m.Memory.Load(testFCB+16, newName[:])
+	if a := call(t, m, fnRenameFile, testFCB); a != 0 {
+		t.Fatalf("rename returned %02X", a)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "NEW.DAT")); err != nil {
+		t.Errorf("renamed file missing: %v", err)
+	}
+	setFCB(m, "*.*")
+	if a := call(t, m, fnDeleteFile, testFCB); a != 0 {
+		t.Fatalf("delete returned %02X", a)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left after deleting *.*", len(entries))
+	}
+}
+
+func TestUserAreas(t *testing.T) {
+	dir := t.TempDir()
+	m := New(NewStreamConsole(strings.NewReader(""), &bytes.Buffer{}), dir)
+	call(t, m, fnUserCode, 3)
+	if u := call(t, m, fnUserCode, 0xFF); u != 3 {
+		t.Fatalf("user = %d, want 3", u)
+	}
+	if z := m.Memory.Read(0x0004); z != 0x30 {
+		t.Errorf("drive/user byte = %02X, want 30", z)
+	}
+	setFCB(m, "U3.TXT")
+	call(t, m, fnMakeFile, testFCB)
+	if _, err := os.Stat(filepath.Join(dir, "3", "U3.TXT")); err != nil {
+		t.Errorf("file not created in the user directory: %v", err)
+	}
+	call(t, m, fnUserCode, 0)
+	if a := call(t, m, fnOpenFile, testFCB); a != resultFailure {
+		t.Errorf("user 3 file visible in user 0")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	var out bytes.Buffer
+	m := New(NewStreamConsole(strings.NewReader("hellp\bo\r\n"), &out), t.TempDir())
+
+	m.Memory.Load(0x3000, []uint8("Hi there$"))
+	call(t, m, fnPrintString, 0x3000)
+
+	m.Memory.Write(0x3100, 20)
+	call(t, m, fnReadBuffer, 0x3100)
+	line := readBytes(m, 0x3102, int(m.Memory.Read(0x3101)))
+	if string(line) != "hello" {
+		t.Errorf("read line %q, want %q", line, "hello")
+	}
+	if got := out.String(); got != "Hi therehellp\b \bo\r" {
+		t.Errorf("console output %q", got)
+	}
+
+	// The LF of the CR LF pair does not end an empty second line
+	m.Console = NewStreamConsole(strings.NewReader("\nx\r"), &out)
+	call(t, m, fnReadBuffer, 0x3100)
+	if n := m.Memory.Read(0x3101); n != 1 || m.Memory.Read(0x3102) != 'x' {
+		t.Errorf("second line has %d characters", n)
+	}
+
+	m.CPU.C = fnConsoleInput
+	m.CPU.PC = bdosEntry
+	if _, err := m.Step(); err != ErrInputClosed {
+		t.Errorf("reading past the end of input returned %v", err)
+	}
+}
+
+// testConsole is a Console with its input given up front
+type testConsole struct {
+	in   []uint8
+	out  []uint8
+	fail bool // Writes fail
+}
+
+func (c *testConsole) Status() bool { return len(c.in) > 0 }
+
+func (c *testConsole) Read() (uint8, error) {
+	if len(c.in) == 0 {
+		return 0, io.EOF
+	}
+	b := c.in[0]
+	c.in = c.in[1:]
+	return b, nil
+}
+
+func (c *testConsole) Write(b uint8) error {
+	if c.fail {
+		return os.ErrClosed
+	}
+	c.out = append(c.out, b)
+	return nil
+}
+
+func TestBIOSConsole(t *testing.T) {
+	// CALL CONST; LD B,A; CALL CONIN; LD C,A; CALL CONOUT; LD C,B; CALL CONOUT; RET
+	program := []uint8{
+		0xCD, 0x06, 0xFE, 0x47, 0xCD, 0x09, 0xFE, 0x4F, 0xCD, 0x0C, 0xFE,
+		0x48, 0xCD, 0x0C, 0xFE, 0xC9,
+	}
+	console := &testConsole{in: []uint8("x")}
+	m := New(console, t.TempDir())
+	if err := m.LoadCOM(program, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "x\xFF"; string(console.out) != want {
+		t.Errorf("output %q, want %q", console.out, want)
+	}
+
+	// An echo that cannot be written is an error
+	m = New(&testConsole{in: []uint8("y"), fail: true}, t.TempDir())
+	m.CPU.C = fnConsoleInput
+	m.CPU.PC = bdosEntry
+	if _, err := m.Step(); err != os.ErrClosed {
+		t.Errorf("console input returned %v after a failed echo", err)
+	}
+}
+
+func TestRunProgram(t *testing.T) {
+	// LD DE,msg; LD C,9; CALL 5; LD DE,7; LD C,108; CALL 5; RET; msg: "OK$"
+	program := []uint8{
+		0x11, 0x12, 0x01, 0x0E, 0x09, 0xCD, 0x05, 0x00,
+		0x11, 0x07, 0x00, 0x0E, 0x6C, 0xCD, 0x05, 0x00,
+		0xC9, 0x00, 'O', 'K', '$',
+	}
+	var out bytes.Buffer
+	m := New(NewStreamConsole(strings.NewReader(""), &out), t.TempDir())
+	if err := m.LoadCOM(program, []string{"b:in.txt", "out"}); err != nil {
+		t.Fatal(err)
+	}
+	if tail := readBytes(m, 0x81, int(m.Memory.Read(0x80))); string(tail) != " B:IN.TXT OUT" {
+		t.Errorf("command tail %q", tail)
+	}
+	if dr := m.Memory.Read(DefaultFCB); dr != 2 {
+		t.Errorf("first FCB drive = %d, want 2", dr)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "OK" {
+		t.Errorf("output %q, want %q", out.String(), "OK")
+	}
+	if !m.Exited() || m.ReturnCode() != 7 {
+		t.Errorf("exited %v with code %d", m.Exited(), m.ReturnCode())
+	}
+}
@@ -0,0 +1,297 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// SectorSize is the sector size of the supported disk formats. Formats
+// with larger physical sectors would need the BIOS to deblock them.
+const SectorSize = 128
+
+// DiskFormat describes the geometry and file system of a disk image, as a
+// cpmtools diskdefs entry does
+type DiskFormat struct {
+	Name            string
+	Tracks          int
+	SectorsPerTrack int
+	BlockSize       int
+	MaxDir          int  // Directory entries
+	Skew            int  // Sector skew of the data tracks, 0 or 1 for none
+	BootTracks      int  // Reserved system tracks
+	Removable       bool // Directory checksums are kept to notice disk changes
+}
+
+// Formats holds the built-in formats by their cpmtools names
+var Formats = map[string]DiskFormat{
+	// 8" single-sided single-density, the standard CP/M 2.2 distribution disk
+	"ibm-3740": {Name: "ibm-3740", Tracks: 77, SectorsPerTrack: 26, BlockSize: 1024, MaxDir: 64, Skew: 6, BootTracks: 2, Removable: true},
+	// 4MB hard disk
+	"4mb-hd": {Name: "4mb-hd", Tracks: 1024, SectorsPerTrack: 32, BlockSize: 2048, MaxDir: 256},
+	// z80pack hard disk
+	"z80pack-hd": {Name: "z80pack-hd", Tracks: 255, SectorsPerTrack: 128, BlockSize: 2048, MaxDir: 1024},
+}
+
+// Size returns the size of a disk image in bytes
+func (f DiskFormat) Size() int64 {
+	return int64(f.Tracks) * int64(f.SectorsPerTrack) * SectorSize
+}
+
+// blocks returns the number of allocation blocks after the system tracks
+func (f DiskFormat) blocks() int {
+	return (f.Tracks - f.BootTracks) * f.SectorsPerTrack * SectorSize / f.BlockSize
+}
+
+// skewed reports whether the data tracks use a translation table, in
+// which case sectors are numbered from 1 as on a real 8" disk
+func (f DiskFormat) skewed() bool {
+	return f.Skew > 1
+}
+
+// DPB returns the 15-byte CP/M 2.2 disk parameter block
+func (f DiskFormat) DPB() [15]uint8 {
+	recs := f.BlockSize / SectorSize
+	bsh := 0
+	for 1<<bsh < recs {
+		bsh++
+	}
+	dsm := f.blocks() - 1
+	exm := f.BlockSize/1024 - 1
+	if dsm > 255 {
+		exm = f.BlockSize/2048 - 1
+	}
+	drm := f.MaxDir - 1
+	var al uint16
+	dirBlocks := (f.MaxDir*32 + f.BlockSize - 1) / f.BlockSize
+	for i := 0; i < dirBlocks && i < 16; i++ {
+		al |= 0x8000 >> i
+	}
+	cks := 0
+	if f.Removable {
+		cks = f.MaxDir / 4
+	}
+	return [15]uint8{
+		uint8(f.SectorsPerTrack), uint8(f.SectorsPerTrack >> 8),
+		uint8(bsh), uint8(recs - 1), uint8(exm),
+		uint8(dsm), uint8(dsm >> 8),
+		uint8(drm), uint8(drm >> 8),
+		uint8(al >> 8), uint8(al),
+		uint8(cks), uint8(cks >> 8),
+		uint8(f.BootTracks), uint8(f.BootTracks >> 8),
+	}
+}
+
+// DPB3 returns the 17-byte CP/M 3 disk parameter block: the CP/M 2.2
+// one with fixed disks marked as permanently mounted, and the physical
+// sector shift and mask of 128-byte sectors
+func (f DiskFormat) DPB3() [17]uint8 {
+	var dpb [17]uint8
+	dpb22 := f.DPB()
+	copy(dpb[:], dpb22[:])
+	if !f.Removable {
+		dpb[12] = 0x80
+	}
+	return dpb
+}
+
+// XLT returns the sector translation table of the data tracks, or nil if
+// the format has no skew. The table is built as cpmtools builds it, so
+// images written with cpmtools read back correctly.
+func (f DiskFormat) XLT() []uint8 {
+	if !f.skewed() {
+		return nil
+	}
+	n := f.SectorsPerTrack
+	used := make([]bool, n)
+	xlt := make([]uint8, n)
+	for i, j := 0, 0; i < n; i, j = i+1, (j+f.Skew)%n {
+		for used[j] {
+			j = (j + 1) % n
+		}
+		used[j] = true
+		xlt[i] = uint8(j + 1)
+	}
+	return xlt
+}
+
+// Storage holds the bytes of a disk image. *os.File is a Storage.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Disk is a disk image in a given format. Sectors beyond the end of the
+// storage read as 0xE5, as on a freshly formatted disk.
+type Disk struct {
+	Format   DiskFormat
+	ReadOnly bool
+	storage  Storage
+}
+
+// NewDisk creates a disk on storage
+func NewDisk(storage Storage, format DiskFormat) *Disk {
+	return &Disk{Format: format, storage: storage}
+}
+
+// OpenDisk opens an image file, read-only if it cannot be written. A
+// short writable image, such as a new empty file, is extended to its full
+// size as a formatted disk, so that writes leave no unformatted gaps.
+func OpenDisk(path string, format DiskFormat) (*Disk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	readOnly := false
+	if errors.Is(err, os.ErrPermission) {
+		f, err = os.Open(path)
+		readOnly = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		if err := formatTail(f, format.Size()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	d := NewDisk(f, format)
+	d.ReadOnly = readOnly
+	return d, nil
+}
+
+// formatTail fills a file with 0xE5 up to size
+func formatTail(f *os.File, size int64) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() >= size {
+		return err
+	}
+	fill := make([]uint8, size-info.Size())
+	for i := range fill {
+		fill[i] = 0xE5
+	}
+	_, err = f.WriteAt(fill, info.Size())
+	return err
+}
+
+// Close closes the storage if it can be closed
+func (d *Disk) Close() error {
+	if c, ok := d.storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// offset returns the position of a sector, numbered from 0
+func (d *Disk) offset(track, sector int) (int64, error) {
+	if track < 0 || track >= d.Format.Tracks || sector < 0 || sector >= d.Format.SectorsPerTrack {
+		return 0, fmt.Errorf("cpm: no track %d sector %d on a %s disk", track, sector, d.Format.Name)
+	}
+	return (int64(track)*int64(d.Format.SectorsPerTrack) + int64(sector)) * SectorSize, nil
+}
+
+// ReadSector reads a sector, numbered from 0 within its track
+func (d *Disk) ReadSector(track, sector int, buf []uint8) error {
+	off, err := d.offset(track, sector)
+	if err != nil {
+		return err
+	}
+	n, err := d.storage.ReadAt(buf[:SectorSize], off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < SectorSize; i++ {
+		buf[i] = 0xE5
+	}
+	return nil
+}
+
+// WriteSector writes a sector, numbered from 0 within its track
+func (d *Disk) WriteSector(track, sector int, buf []uint8) error {
+	if d.ReadOnly {
+		return fmt.Errorf("cpm: disk is read-only")
+	}
+	off, err := d.offset(track, sector)
+	if err != nil {
+		return err
+	}
+	_, err = d.storage.WriteAt(buf[:SectorSize], off)
+	return err
+}
+
+// ReadFile reads a file from user area 0 of the disk's directory, as the
+// CP/M 3 loader reads CPM3.SYS and the BIOS reads CCP.COM
+func (d *Disk) ReadFile(name string) ([]uint8, error) {
+	want, ok := hostName(name)
+	if !ok {
+		return nil, fmt.Errorf("cpm: bad file name %q", name)
+	}
+	f := d.Format
+	xlt := f.XLT()
+	recsPerBlock := f.BlockSize / SectorSize
+	read := func(rec int) ([]uint8, error) {
+		track, sector := f.BootTracks+rec/f.SectorsPerTrack, rec%f.SectorsPerTrack
+		if xlt != nil {
+			sector = int(xlt[sector]) - 1
+		}
+		buf := make([]uint8, SectorSize)
+		return buf, d.ReadSector(track, sector, buf)
+	}
+
+	// Each directory entry is an extent holding up to 16 block numbers,
+	// of 16 bits on disks of more than 256 blocks
+	type extent struct {
+		n       int
+		records int
+		blocks  []int
+	}
+	var extents []extent
+	for rec := 0; rec < (f.MaxDir*32+SectorSize-1)/SectorSize; rec++ {
+		buf, err := read(rec)
+		if err != nil {
+			return nil, err
+		}
+		for e := buf; len(e) >= 32; e = e[32:] {
+			var n fileName
+			copy(n[:], e[1:12])
+			if e[0] != 0 || n.clean() != want {
+				continue
+			}
+			x := extent{n: int(e[12]) + 32*int(e[14]&0x3F)}
+			x.records = x.n*extentRecords + int(e[15])
+			for i := 16; i < 32; i++ {
+				b := int(e[i])
+				if f.blocks() > 256 {
+					b |= int(e[i+1]) << 8
+					i++
+				}
+				if b != 0 {
+					x.blocks = append(x.blocks, b)
+				}
+			}
+			extents = append(extents, x)
+		}
+	}
+	if len(extents) == 0 {
+		return nil, fmt.Errorf("cpm: no %s on the disk", name)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].n < extents[j].n })
+
+	records := extents[len(extents)-1].records
+	data := make([]uint8, 0, records*SectorSize)
+	for _, x := range extents {
+		for _, b := range x.blocks {
+			for r := 0; r < recsPerBlock && len(data) < records*SectorSize; r++ {
+				buf, err := read(b*recsPerBlock + r)
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, buf...)
+			}
+		}
+	}
+	if len(data) < records*SectorSize {
+		return nil, fmt.Errorf("cpm: %s is missing blocks", name)
+	}
+	return data, nil
+}
@@ -0,0 +1,158 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FCB field offsets
+const (
+	fcbDrive  = 0
+	fcbName   = 1  // 8 characters, then 3 of type
+	fcbEX     = 12 // Extent, low bits of the record number / 128
+	fcbS2     = 14 // Extent, high bits
+	fcbRC     = 15 // Records in the current extent
+	fcbAlloc  = 16 // Allocation map of the directory entry
+	fcbCR     = 32 // Current record within the extent
+	fcbR0     = 33 // Random record number, 3 bytes
+	fcbLength = 36
+)
+
+// ParseFCB parses a file name such as "B:PROG.ASM" or "*.COM" into the
+// first 16 bytes of an FCB: drive (0 for the default, 1 for A:), name and
+// type padded with spaces, "*" expanded to "?" and the extent fields
+// zeroed. Anything that is not a file name, such as an option, is parsed
+// the same way the CCP does.
+func ParseFCB(text string) [16]uint8 {
+	var fcb [16]uint8
+	for i := fcbName; i < fcbEX; i++ {
+		fcb[i] = ' '
+	}
+	text = strings.ToUpper(strings.TrimSpace(text))
+	if len(text) >= 2 && text[1] == ':' && text[0] >= 'A' && text[0] <= 'P' {
+		fcb[fcbDrive] = text[0] - 'A' + 1
+		text = text[2:]
+	}
+	name, ext, _ := strings.Cut(text, ".")
+	fillName(fcb[fcbName:fcbName+8], name)
+	fillName(fcb[fcbName+8:fcbEX], ext)
+	return fcb
+}
+
+// fillName copies a name part into field, expanding "*"
+func fillName(field []uint8, part string) {
+	for i := 0; i < len(field) && i < len(part); i++ {
+		if part[i] == '*' {
+			for ; i < len(field); i++ {
+				field[i] = '?'
+			}
+			return
+		}
+		field[i] = part[i]
+	}
+}
+
+// fileName is the 11-character name and type of a directory entry
+type fileName [11]uint8
+
+// String returns the name in NAME.TYP form
+func (n fileName) String() string {
+	name := strings.TrimRight(string(n[:8]), " ")
+	ext := strings.TrimRight(string(n[8:]), " ")
+	if ext == "" {
+		return name
+	}
+	return name + "." + ext
+}
+
+// match reports whether n matches a pattern that may contain "?"
+func (n fileName) match(pattern fileName) bool {
+	for i := range n {
+		p := pattern[i] & 0x7F
+		if p != '?' && p != n[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// clean strips the attribute bits from a name taken from an FCB
+func (n fileName) clean() fileName {
+	for i := range n {
+		n[i] &= 0x7F
+	}
+	return n
+}
+
+// hostName converts a host file name to CP/M form, reporting false if it
+// does not fit 8.3 or uses characters CP/M does not allow
+func hostName(name string) (fileName, bool) {
+	var n fileName
+	base, ext, _ := strings.Cut(strings.ToUpper(name), ".")
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return n, false
+	}
+	if !validName(base) || !validName(ext) {
+		return n, false
+	}
+	for i := range n {
+		n[i] = ' '
+	}
+	copy(n[:8], base)
+	copy(n[8:], ext)
+	return n, true
+}
+
+func validName(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7F || strings.ContainsRune("<>.,;:=?*[]", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// dirEntry is a host file visible to CP/M
+type dirEntry struct {
+	name fileName
+	user int
+	path string
+	size int64
+}
+
+// userDir returns the host directory holding a user area of a drive
+func userDir(dir string, user int) string {
+	if user == 0 {
+		return dir
+	}
+	return filepath.Join(dir, strconv.Itoa(user))
+}
+
+// listDir returns the files of a user area in name order
+func listDir(dir string, user int) []dirEntry {
+	path := userDir(dir, user)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	var files []dirEntry
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		n, ok := hostName(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, dirEntry{name: n, user: user, path: filepath.Join(path, e.Name()), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return string(files[i].name[:]) < string(files[j].name[:]) })
+	return files
+}
@@ -0,0 +1,392 @@
+// Package debug is the machine-independent core of zen80's debuggers: the
+// remote protocol servers and the monitor. A Debugger drives a Machine,
+// anything built around a z80.Z80, one instruction at a time and handles
+// breakpoints, watchpoints and stepping over calls, so that each front
+// end only has to speak its protocol.
+package debug
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ha1tch/zen80/disasm"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// Machine is an emulated machine built around a Z80
+type Machine interface {
+	// CPU returns the machine's processor
+	CPU() *z80.Z80
+	// Step runs one instruction along with the rest of the machine and
+	// returns the cycles it took
+	Step() int
+}
+
+// Resetter is a machine that can be reset
+type Resetter interface {
+	Reset()
+}
+
+// Named is a machine that can say what it is
+type Named interface {
+	Name() string
+}
+
+// Snapshotter is a machine whose whole state can be saved and restored
+type Snapshotter interface {
+	SaveState(w io.Writer) error
+	LoadState(data []uint8) error
+}
+
+// Commander is a machine that takes its own text commands, which remote
+// debuggers pass on from their "monitor" commands
+type Commander interface {
+	Command(cmd string) (string, error)
+}
+
+// Rewinder is a machine that keeps its recent past and can go back in it
+type Rewinder interface {
+	StepBack() error
+	FrameBack(n int) error
+	Rewind(d time.Duration) error
+	// Changed tells the machine its state was changed from outside, so
+	// that its past no longer leads to its present
+	Changed()
+}
+
+// Page is what a Paged machine has mapped in part of the address space
+type Page struct {
+	Start uint16
+	Size  int
+	ROM   bool
+	Bank  int
+}
+
+// Paged is a machine with banked memory
+type Paged interface {
+	Pages() []Page
+}
+
+// NewCPU returns a Machine that is nothing but a CPU with its memory and
+// I/O, stepping it directly
+func NewCPU(cpu *z80.Z80) Machine {
+	return cpuMachine{cpu}
+}
+
+type cpuMachine struct{ cpu *z80.Z80 }
+
+func (m cpuMachine) CPU() *z80.Z80 { return m.cpu }
+func (m cpuMachine) Step() int     { return m.cpu.Step() }
+func (m cpuMachine) Reset()        { m.cpu.Reset() }
+
+// Reason says why the machine stopped
+type Reason int
+
+const (
+	Stepped     Reason = iota // A step finished
+	Breakpoint                // PC reached a breakpoint
+	WatchRead                 // A watched address was read
+	WatchWrite                // A watched address was written
+	Interrupted               // The caller asked to stop
+)
+
+var reasonNames = [...]string{"stepped", "breakpoint", "read watchpoint", "write watchpoint", "interrupted"}
+
+func (r Reason) String() string {
+	if int(r) < len(reasonNames) {
+		return reasonNames[r]
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// Event describes why the machine stopped. Addr is the PC for a
+// breakpoint and the data address for a watchpoint.
+type Event struct {
+	Reason Reason
+	Addr   uint16
+}
+
+func (e Event) String() string {
+	switch e.Reason {
+	case Breakpoint, WatchRead, WatchWrite:
+		return fmt.Sprintf("%s at %04X", e.Reason, e.Addr)
+	}
+	return e.Reason.String()
+}
+
+// Watchpoint watches Len bytes from Addr for reads, writes or both
+type Watchpoint struct {
+	Addr  uint16
+	Len   int
+	Read  bool
+	Write bool
+}
+
+func (w Watchpoint) covers(addr uint16) bool {
+	return int(addr-w.Addr) < max(w.Len, 1)
+}
+
+// checkInterval is how many instructions Continue runs between polls of
+// its stop function
+const checkInterval = 1000
+
+// Debugger controls a machine for a debugger front end
+type Debugger struct {
+	m           Machine
+	cpu         *z80.Z80
+	breakpoints map[uint16]bool
+	watchpoints []Watchpoint
+	log         z80.BusLog
+}
+
+// New creates a debugger for a machine
+func New(m Machine) *Debugger {
+	return &Debugger{m: m, cpu: m.CPU(), breakpoints: make(map[uint16]bool)}
+}
+
+// Machine returns the machine being debugged
+func (d *Debugger) Machine() Machine {
+	return d.m
+}
+
+// CPU returns the machine's processor
+func (d *Debugger) CPU() *z80.Z80 {
+	return d.cpu
+}
+
+// Read reads memory as the CPU sees it
+func (d *Debugger) Read(addr uint16) uint8 {
+	return d.cpu.Memory.Read(addr)
+}
+
+// Write writes memory as the CPU would; writes to ROM are lost
+func (d *Debugger) Write(addr uint16, value uint8) {
+	d.cpu.Memory.Write(addr, value)
+	d.Changed()
+}
+
+// ReadBlock reads n bytes from addr, wrapping at the top of memory
+func (d *Debugger) ReadBlock(addr uint16, n int) []uint8 {
+	out := make([]uint8, n)
+	for i := range out {
+		out[i] = d.Read(addr + uint16(i))
+	}
+	return out
+}
+
+// WriteBlock writes bytes from addr, wrapping at the top of memory
+func (d *Debugger) WriteBlock(addr uint16, data []uint8) {
+	for i, b := range data {
+		d.cpu.Memory.Write(addr+uint16(i), b)
+	}
+	d.Changed()
+}
+
+// Disassemble decodes the instruction at addr
+func (d *Debugger) Disassemble(addr uint16) disasm.Instruction {
+	return disasm.Decode(d.Read, addr)
+}
+
+// AddBreakpoint stops execution when PC reaches addr
+func (d *Debugger) AddBreakpoint(addr uint16) {
+	d.breakpoints[addr] = true
+}
+
+// RemoveBreakpoint removes the breakpoint at addr
+func (d *Debugger) RemoveBreakpoint(addr uint16) {
+	delete(d.breakpoints, addr)
+}
+
+// ClearBreakpoints removes every breakpoint
+func (d *Debugger) ClearBreakpoints() {
+	clear(d.breakpoints)
+}
+
+// Breakpoints returns the breakpoint addresses in no particular order
+func (d *Debugger) Breakpoints() []uint16 {
+	var out []uint16
+	for addr := range d.breakpoints {
+		out = append(out, addr)
+	}
+	return out
+}
+
+// AddWatchpoint stops execution after an instruction that reads or
+// writes watched memory. Instruction fetches do not count.
+func (d *Debugger) AddWatchpoint(w Watchpoint) {
+	d.watchpoints = append(d.watchpoints, w)
+}
+
+// RemoveWatchpoint removes the watchpoints on the same range
+func (d *Debugger) RemoveWatchpoint(addr uint16, n int) {
+	kept := d.watchpoints[:0]
+	for _, w := range d.watchpoints {
+		if w.Addr != addr || w.Len != n {
+			kept = append(kept, w)
+		}
+	}
+	d.watchpoints = kept
+}
+
+// ClearWatchpoints removes every watchpoint
+func (d *Debugger) ClearWatchpoints() {
+	d.watchpoints = nil
+}
+
+// Watchpoints returns the watchpoints
+func (d *Debugger) Watchpoints() []Watchpoint {
+	return append([]Watchpoint(nil), d.watchpoints...)
+}
+
+// Step runs one instruction. The event is a watchpoint if it touched
+// watched memory and Stepped otherwise.
+func (d *Debugger) Step() Event {
+	if len(d.watchpoints) == 0 {
+		d.m.Step()
+		return Event{Reason: Stepped, Addr: d.cpu.PC}
+	}
+	pc := d.cpu.PC
+	size := uint16(d.Disassemble(pc).Len())
+	d.cpu.BusLog = &d.log
+	d.m.Step()
+	d.cpu.BusLog = nil
+	for _, e := range d.log.Events {
+		if e.Kind == z80.BusRead && e.Addr-pc < size {
+			continue // Operand bytes of the instruction itself
+		}
+		for _, w := range d.watchpoints {
+			if !w.covers(e.Addr) {
+				continue
+			}
+			if e.Kind == z80.BusRead && w.Read {
+				return Event{Reason: WatchRead, Addr: e.Addr}
+			}
+			if e.Kind == z80.BusWrite && w.Write {
+				return Event{Reason: WatchWrite, Addr: e.Addr}
+			}
+		}
+	}
+	return Event{Reason: Stepped, Addr: d.cpu.PC}
+}
+
+// Continue runs until a breakpoint or watchpoint, or until stop, polled
+// every so often, returns true. The instruction at PC runs first even if
+// it has a breakpoint, so Continue can be used to leave one.
+func (d *Debugger) Continue(stop func() bool) Event {
+	return d.runTo(-1, stop)
+}
+
+// runTo continues until PC reaches target as well, if it is not negative
+func (d *Debugger) runTo(target int, stop func() bool) Event {
+	for n := 1; ; n++ {
+		if e := d.Step(); e.Reason != Stepped {
+			return e
+		}
+		pc := d.cpu.PC
+		if int(pc) == target {
+			return Event{Reason: Stepped, Addr: pc}
+		}
+		if d.breakpoints[pc] {
+			return Event{Reason: Breakpoint, Addr: pc}
+		}
+		if stop != nil && n%checkInterval == 0 && stop() {
+			return Event{Reason: Interrupted, Addr: pc}
+		}
+	}
+}
+
+// overMnemonics are the instructions StepOver runs to completion
+var overMnemonics = map[string]bool{
+	"call": true, "rst": true, "djnz": true, "halt": true,
+	"ldir": true, "lddr": true, "cpir": true, "cpdr": true,
+	"inir": true, "indr": true, "otir": true, "otdr": true,
+}
+
+// StepOver runs one instruction, but runs calls, restarts, DJNZ loops
+// and repeating block instructions until they return to the next one
+func (d *Debugger) StepOver(stop func() bool) Event {
+	in := d.Disassemble(d.cpu.PC)
+	if !overMnemonics[in.Mnemonic] {
+		return d.Step()
+	}
+	return d.runTo(int(in.Addr+uint16(in.Len())), stop)
+}
+
+// StepOut runs until the current subroutine returns: until a RET, RETI
+// or RETN is executed with SP at or above its value now
+func (d *Debugger) StepOut(stop func() bool) Event {
+	sp := d.cpu.SP
+	for n := 1; ; n++ {
+		in := d.Disassemble(d.cpu.PC)
+		ret := strings.HasPrefix(in.Mnemonic, "ret")
+		if e := d.Step(); e.Reason != Stepped {
+			return e
+		}
+		pc := d.cpu.PC
+		if ret && d.cpu.SP > sp && pc != in.Addr+uint16(in.Len()) {
+			return Event{Reason: Stepped, Addr: pc}
+		}
+		if d.breakpoints[pc] {
+			return Event{Reason: Breakpoint, Addr: pc}
+		}
+		if stop != nil && n%checkInterval == 0 && stop() {
+			return Event{Reason: Interrupted, Addr: pc}
+		}
+	}
+}
+
+// Reset resets the machine if it can be
+func (d *Debugger) Reset() error {
+	r, ok := d.m.(Resetter)
+	if !ok {
+		return fmt.Errorf("machine cannot be reset")
+	}
+	r.Reset()
+	return nil
+}
+
+// StepBack goes back one instruction in the machine's history
+func (d *Debugger) StepBack() error {
+	r, err := d.rewinder()
+	if err != nil {
+		return err
+	}
+	return r.StepBack()
+}
+
+// FrameBack goes back n frames in the machine's history
+func (d *Debugger) FrameBack(n int) error {
+	r, err := d.rewinder()
+	if err != nil {
+		return err
+	}
+	return r.FrameBack(n)
+}
+
+// Rewind goes back by an amount of emulated time in the machine's history
+func (d *Debugger) Rewind(t time.Duration) error {
+	r, err := d.rewinder()
+	if err != nil {
+		return err
+	}
+	return r.Rewind(t)
+}
+
+func (d *Debugger) rewinder() (Rewinder, error) {
+	r, ok := d.m.(Rewinder)
+	if !ok {
+		return nil, fmt.Errorf("machine keeps no history")
+	}
+	return r, nil
+}
+
+// Changed tells the machine that its state was changed other than by
+// stepping it, such as by a port write. Writes and register changes made
+// through the Debugger do this themselves.
+func (d *Debugger) Changed() {
+	if r, ok := d.m.(Rewinder); ok {
+		r.Changed()
+	}
+}
@@ -0,0 +1,125 @@
+package debug
+
+import (
+	"testing"
+
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/system"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// 0000 call 0008; ld a,($9000); halt; ...; 0008 ld ($9000),a; ld b,$90; ret
+var program = []uint8{
+	0xCD, 0x08, 0x00, 0x3A, 0x00, 0x90, 0x76, 0x00,
+	0x32, 0x00, 0x90, 0x06, 0x90, 0xC9,
+}
+
+func newDebugger() *Debugger {
+	mem := memory.NewRAM()
+	mem.Load(0, program)
+	cpu := z80.New(mem, zio.NewNullIO())
+	cpu.SP = 0xFF00
+	return New(NewCPU(cpu))
+}
+
+func TestStepping(t *testing.T) {
+	d := newDebugger()
+	if e := d.StepOver(nil); e.Reason != Stepped || d.CPU().PC != 0x0003 {
+		t.Fatalf("StepOver: %v, PC=%04X", e, d.CPU().PC)
+	}
+	d.CPU().PC = 0
+	d.Step()
+	if e := d.StepOut(nil); e.Reason != Stepped || d.CPU().PC != 0x0003 || d.CPU().SP != 0xFF00 {
+		t.Fatalf("StepOut: %v, PC=%04X SP=%04X", e, d.CPU().PC, d.CPU().SP)
+	}
+
+	d.CPU().PC = 0
+	d.AddBreakpoint(0x000B)
+	if e := d.Continue(nil); e.Reason != Breakpoint || e.Addr != 0x000B {
+		t.Fatalf("Continue: %v", e)
+	}
+	d.RemoveBreakpoint(0x000B)
+	if len(d.Breakpoints()) != 0 {
+		t.Error("breakpoint not removed")
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	d := newDebugger()
+	d.AddWatchpoint(Watchpoint{Addr: 0x9000, Len: 1, Read: true})
+	// The operand bytes of ld b,$90 and the $9000 address are not data reads
+	d.AddWatchpoint(Watchpoint{Addr: 0x000C, Len: 1, Read: true})
+	if e := d.Continue(nil); e.Reason != WatchRead || e.Addr != 0x9000 || d.CPU().PC != 0x0006 {
+		t.Fatalf("read watch: %v, PC=%04X", e, d.CPU().PC)
+	}
+
+	d.ClearWatchpoints()
+	d.CPU().PC = 0
+	d.AddWatchpoint(Watchpoint{Addr: 0x8FFF, Len: 2, Write: true})
+	if e := d.Continue(nil); e.Reason != WatchWrite || e.Addr != 0x9000 || d.CPU().PC != 0x000B {
+		t.Fatalf("write watch: %v, PC=%04X", e, d.CPU().PC)
+	}
+	if d.CPU().BusLog != nil {
+		t.Error("bus log left attached")
+	}
+
+	d.ClearWatchpoints()
+	d.CPU().PC = 0x0006
+	n := 0
+	if e := d.Continue(func() bool { n++; return true }); e.Reason != Interrupted || n != 1 {
+		t.Errorf("halted CPU: %v after %d polls", e, n)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	d := newDebugger()
+	for name, v := range map[string]uint16{"hl": 0x1234, "AF'": 0xBEEF, "ixl": 0x56, "MEMPTR": 0x9999, "im": 2} {
+		if err := d.SetRegister(name, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := d.Register(name); got != v {
+			t.Errorf("%s = %04X, want %04X", name, got, v)
+		}
+	}
+	if got, _ := d.Register("L"); got != 0x34 {
+		t.Errorf("L = %02X", got)
+	}
+	if d.SetRegister("A", 0x100) == nil || d.SetRegister("IM", 3) == nil || d.SetRegister("Q", 0) == nil {
+		t.Error("bad register values accepted")
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	if err := newDebugger().StepBack(); err == nil {
+		t.Error("StepBack on a bare CPU succeeded")
+	}
+
+	s := system.NewSpectrum()
+	s.SetUnlimited(true)
+	m := NewSpectrum(s)
+	if err := m.RecordHistory(system.HistoryOptions{}); err != nil {
+		t.Fatalf("RecordHistory: %v", err)
+	}
+	d := New(m)
+	for i := 0; i < 10; i++ {
+		d.Step()
+	}
+	pc, cycles := d.CPU().PC, d.CPU().Cycles
+	d.Step()
+	d.Step()
+	for i := 0; i < 2; i++ {
+		if err := d.StepBack(); err != nil {
+			t.Fatalf("StepBack: %v", err)
+		}
+	}
+	if d.CPU().PC != pc || d.CPU().Cycles != cycles {
+		t.Errorf("after stepping back PC=%04X at cycle %d, want %04X at %d", d.CPU().PC, d.CPU().Cycles, pc, cycles)
+	}
+
+	// A change made by the debugger starts the history again
+	d.SetRegister("PC", 0x1234)
+	if err := d.StepBack(); err == nil {
+		t.Error("StepBack past a register change succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+package debug
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ha1tch/zen80/z80"
+)
+
+// register reads and writes one register of a CPU
+type register struct {
+	get  func(z *z80.Z80) uint16
+	set  func(z *z80.Z80, v uint16)
+	bits int
+}
+
+func reg8(p func(z *z80.Z80) *uint8) register {
+	return register{
+		get:  func(z *z80.Z80) uint16 { return uint16(*p(z)) },
+		set:  func(z *z80.Z80, v uint16) { *p(z) = uint8(v) },
+		bits: 8,
+	}
+}
+
+func pair(hi, lo func(z *z80.Z80) *uint8) register {
+	return register{
+		get: func(z *z80.Z80) uint16 { return uint16(*hi(z))<<8 | uint16(*lo(z)) },
+		set: func(z *z80.Z80, v uint16) {
+			*hi(z), *lo(z) = uint8(v>>8), uint8(v)
+		},
+		bits: 16,
+	}
+}
+
+func reg16(p func(z *z80.Z80) *uint16) register {
+	return register{
+		get:  func(z *z80.Z80) uint16 { return *p(z) },
+		set:  func(z *z80.Z80, v uint16) { *p(z) = v },
+		bits: 16,
+	}
+}
+
+var registers = map[string]register{
+	"A":   reg8(func(z *z80.Z80) *uint8 { return &z.A }),
+	"F":   reg8(func(z *z80.Z80) *uint8 { return &z.F }),
+	"B":   reg8(func(z *z80.Z80) *uint8 { return &z.B }),
+	"C":   reg8(func(z *z80.Z80) *uint8 { return &z.C }),
+	"D":   reg8(func(z *z80.Z80) *uint8 { return &z.D }),
+	"E":   reg8(func(z *z80.Z80) *uint8 { return &z.E }),
+	"H":   reg8(func(z *z80.Z80) *uint8 { return &z.H }),
+	"L":   reg8(func(z *z80.Z80) *uint8 { return &z.L }),
+	"I":   reg8(func(z *z80.Z80) *uint8 { return &z.I }),
+	"R":   reg8(func(z *z80.Z80) *uint8 { return &z.R }),
+	"IXH": reg8(func(z *z80.Z80) *uint8 { return &z.IXH }),
+	"IXL": reg8(func(z *z80.Z80) *uint8 { return &z.IXL }),
+	"IYH": reg8(func(z *z80.Z80) *uint8 { return &z.IYH }),
+	"IYL": reg8(func(z *z80.Z80) *uint8 { return &z.IYL }),
+	"IM":  reg8(func(z *z80.Z80) *uint8 { return &z.IM }),
+	"AF":  pair(func(z *z80.Z80) *uint8 { return &z.A }, func(z *z80.Z80) *uint8 { return &z.F }),
+	"BC":  pair(func(z *z80.Z80) *uint8 { return &z.B }, func(z *z80.Z80) *uint8 { return &z.C }),
+	"DE":  pair(func(z *z80.Z80) *uint8 { return &z.D }, func(z *z80.Z80) *uint8 { return &z.E }),
+	"HL":  pair(func(z *z80.Z80) *uint8 { return &z.H }, func(z *z80.Z80) *uint8 { return &z.L }),
+	"AF'": pair(func(z *z80.Z80) *uint8 { return &z.A_ }, func(z *z80.Z80) *uint8 { return &z.F_ }),
+	"BC'": pair(func(z *z80.Z80) *uint8 { return &z.B_ }, func(z *z80.Z80) *uint8 { return &z.C_ }),
+	"DE'": pair(func(z *z80.Z80) *uint8 { return &z.D_ }, func(z *z80.Z80) *uint8 { return &z.E_ }),
+	"HL'": pair(func(z *z80.Z80) *uint8 { return &z.H_ }, func(z *z80.Z80) *uint8 { return &z.L_ }),
+	"IX":  pair(func(z *z80.Z80) *uint8 { return &z.IXH }, func(z *z80.Z80) *uint8 { return &z.IXL }),
+	"IY":  pair(func(z *z80.Z80) *uint8 { return &z.IYH }, func(z *z80.Z80) *uint8 { return &z.IYL }),
+	"SP":  reg16(func(z *z80.Z80) *uint16 { return &z.SP }),
+	"PC":  reg16(func(z *z80.Z80) *uint16 { return &z.PC }),
+	"WZ":  reg16(func(z *z80.Z80) *uint16 { return &z.WZ }),
+}
+
+// registerAliases are other names front ends use
+var registerAliases = map[string]string{"MEMPTR": "WZ", "AF_": "AF'", "BC_": "BC'", "DE_": "DE'", "HL_": "HL'"}
+
+func lookupRegister(name string) (register, bool) {
+	name = strings.ToUpper(name)
+	if alias, ok := registerAliases[name]; ok {
+		name = alias
+	}
+	r, ok := registers[name]
+	return r, ok
+}
+
+// Register returns a register by name: A to L, the pairs, the alternate
+// pairs as AF' and so on, IX, IY and their halves, SP, PC, I, R, IM and WZ
+func (d *Debugger) Register(name string) (uint16, error) {
+	r, ok := lookupRegister(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown register %q", name)
+	}
+	return r.get(d.cpu), nil
+}
+
+// SetRegister sets a register by name
+func (d *Debugger) SetRegister(name string, value uint16) error {
+	r, ok := lookupRegister(name)
+	if !ok {
+		return fmt.Errorf("unknown register %q", name)
+	}
+	if r.bits == 8 && value > 0xFF {
+		return fmt.Errorf("%s is an 8-bit register", strings.ToUpper(name))
+	}
+	if strings.EqualFold(name, "IM") && value > 2 {
+		return fmt.Errorf("bad interrupt mode %d", value)
+	}
+	r.set(d.cpu, value)
+	d.Changed()
+	return nil
+}
@@ -0,0 +1,124 @@
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ha1tch/zen80/system"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// Spectrum is a Machine for a system.Spectrum. Steps run the whole
+// machine, so the screen, interrupts, tape and sound carry on while the
+// CPU is stepped.
+type Spectrum struct {
+	S *system.Spectrum
+
+	history     *system.History
+	historyOpts system.HistoryOptions
+}
+
+// NewSpectrum wraps a Spectrum for debugging
+func NewSpectrum(s *system.Spectrum) *Spectrum {
+	return &Spectrum{S: s}
+}
+
+func (m *Spectrum) CPU() *z80.Z80 { return m.S.CPU }
+
+// Step runs one instruction: stopping after the first one is all
+// RunFrameUntil needs to do that
+func (m *Spectrum) Step() int {
+	start := m.S.CPU.Cycles
+	m.S.RunFrameUntil(func() bool { return true })
+	return int(m.S.CPU.Cycles - start)
+}
+
+func (m *Spectrum) Reset() {
+	m.S.Reset()
+	m.Changed()
+}
+
+func (m *Spectrum) Name() string { return m.S.Model().String() }
+
+// SaveState writes an SZX snapshot
+func (m *Spectrum) SaveState(w io.Writer) error { return m.S.SaveSZX(w) }
+
+// LoadState loads an SZX snapshot
+func (m *Spectrum) LoadState(data []uint8) error {
+	err := m.S.LoadSZX(data)
+	m.Changed()
+	return err
+}
+
+// RecordHistory starts keeping the machine's recent past, so that it can
+// be stepped back and rewound
+func (m *Spectrum) RecordHistory(opts system.HistoryOptions) error {
+	h, err := system.NewHistory(m.S, opts)
+	if err != nil {
+		return err
+	}
+	m.history, m.historyOpts = h, opts
+	return nil
+}
+
+// StepBack goes back one instruction
+func (m *Spectrum) StepBack() error {
+	if m.history == nil {
+		return errNoHistory
+	}
+	return m.history.StepBack()
+}
+
+// FrameBack goes back n frames
+func (m *Spectrum) FrameBack(n int) error {
+	if m.history == nil {
+		return errNoHistory
+	}
+	return m.history.FrameBack(n)
+}
+
+// Rewind goes back by an amount of emulated time
+func (m *Spectrum) Rewind(d time.Duration) error {
+	if m.history == nil {
+		return errNoHistory
+	}
+	return m.history.Rewind(d)
+}
+
+// Changed starts the history afresh, as replaying the old one would not
+// arrive at the changed state
+func (m *Spectrum) Changed() {
+	if m.history == nil {
+		return
+	}
+	m.history.Stop()
+	m.history, _ = system.NewHistory(m.S, m.historyOpts)
+}
+
+var errNoHistory = errors.New("history is not being recorded")
+
+// Pages returns the four 16K slots
+func (m *Spectrum) Pages() []Page {
+	pages := make([]Page, 4)
+	for i := range pages {
+		rom, bank := m.S.Memory().Slot(i)
+		pages[i] = Page{Start: uint16(i) * 0x4000, Size: 0x4000, ROM: rom, Bank: bank}
+	}
+	return pages
+}
+
+// Command runs the Spectrum's own commands: "screen" prints the screen as
+// text and "type TEXT" types on the keyboard (\n is ENTER)
+func (m *Spectrum) Command(cmd string) (string, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	switch name {
+	case "screen":
+		return m.S.ScreenText(), nil
+	case "type":
+		return "", m.S.TypeText(strings.ReplaceAll(arg, `\n`, "\n"))
+	}
+	return "", fmt.Errorf("unknown command %q: the Spectrum takes screen and type", name)
+}
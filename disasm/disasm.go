@@ -0,0 +1,462 @@
+// Package disasm disassembles Z80 machine code, including the
+// undocumented instructions: the IXH/IXL/IYH/IYL forms, SLL, the DDCB/FDCB
+// forms that also copy the result to a register, IN (C) and OUT (C),0.
+//
+// The output uses lower-case Zilog mnemonics with hex numbers written as
+// $1234, as MAME's disassembler does. Relative jumps show their target.
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction is one decoded instruction
+type Instruction struct {
+	Addr     uint16
+	Bytes    []uint8
+	Mnemonic string // Such as "ld"
+	Operands string // Such as "a,(ix+$05)", empty if none
+}
+
+// String returns the instruction as "ld a,(ix+$05)"
+func (in Instruction) String() string {
+	if in.Operands == "" {
+		return in.Mnemonic
+	}
+	return in.Mnemonic + " " + in.Operands
+}
+
+// Len returns the length of the instruction in bytes
+func (in Instruction) Len() int {
+	return len(in.Bytes)
+}
+
+// Decode disassembles the instruction at addr, reading memory through read
+func Decode(read func(addr uint16) uint8, addr uint16) Instruction {
+	d := decoder{read: read, addr: addr}
+	d.decode()
+	return Instruction{Addr: addr, Bytes: d.bytes, Mnemonic: d.mnemonic, Operands: d.operands}
+}
+
+// DecodeBytes disassembles the instruction at the start of code, which is
+// taken to be at addr. Bytes past the end of code read as zero.
+func DecodeBytes(code []uint8, addr uint16) Instruction {
+	return Decode(func(a uint16) uint8 {
+		if i := int(a - addr); i < len(code) {
+			return code[i]
+		}
+		return 0
+	}, addr)
+}
+
+// Disassemble lists n instructions starting at addr, one per line, as
+// "0100  3e 05        ld a,$05"
+func Disassemble(read func(addr uint16) uint8, addr uint16, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		in := Decode(read, addr)
+		fmt.Fprintf(&b, "%04X  %-12s %s\n", in.Addr, HexBytes(in.Bytes), in)
+		addr += uint16(in.Len())
+	}
+	return b.String()
+}
+
+// HexBytes formats instruction bytes as "dd 7e 05"
+func HexBytes(b []uint8) string {
+	var s strings.Builder
+	for i, v := range b {
+		if i > 0 {
+			s.WriteByte(' ')
+		}
+		fmt.Fprintf(&s, "%02x", v)
+	}
+	return s.String()
+}
+
+var (
+	regs8    = [8]string{"b", "c", "d", "e", "h", "l", "(hl)", "a"}
+	regs16   = [4]string{"bc", "de", "hl", "sp"}
+	regs16a  = [4]string{"bc", "de", "hl", "af"}
+	conds    = [8]string{"nz", "z", "nc", "c", "po", "pe", "p", "m"}
+	aluOps   = [8]string{"add", "adc", "sub", "sbc", "and", "xor", "or", "cp"}
+	rotOps   = [8]string{"rlc", "rrc", "rl", "rr", "sla", "sra", "sll", "srl"}
+	accOps   = [8]string{"rlca", "rrca", "rla", "rra", "daa", "cpl", "scf", "ccf"}
+	imModes  = [8]string{"0", "0", "1", "2", "0", "0", "1", "2"}
+	blockOps = [4][4]string{
+		{"ldi", "cpi", "ini", "outi"},
+		{"ldd", "cpd", "ind", "outd"},
+		{"ldir", "cpir", "inir", "otir"},
+		{"lddr", "cpdr", "indr", "otdr"},
+	}
+)
+
+// decoder reads one instruction
+type decoder struct {
+	read     func(uint16) uint8
+	addr     uint16
+	bytes    []uint8
+	index    string // "ix" or "iy" after a DD or FD prefix, else ""
+	disp     int    // Displacement of an indexed DDCB/FDCB instruction
+	hasDisp  bool
+	mnemonic string
+	operands string
+}
+
+func (d *decoder) next() uint8 {
+	b := d.read(d.addr + uint16(len(d.bytes)))
+	d.bytes = append(d.bytes, b)
+	return b
+}
+
+func (d *decoder) imm8() string {
+	return fmt.Sprintf("$%02X", d.next())
+}
+
+func (d *decoder) imm16() string {
+	lo := d.next()
+	return fmt.Sprintf("$%04X", uint16(d.next())<<8|uint16(lo))
+}
+
+func (d *decoder) rel() string {
+	e := int8(d.next())
+	return fmt.Sprintf("$%04X", d.addr+uint16(len(d.bytes))+uint16(e))
+}
+
+func (d *decoder) set(mnemonic string, operands ...string) {
+	d.mnemonic = mnemonic
+	d.operands = strings.Join(operands, ",")
+}
+
+// r names an 8-bit register operand, substituting the index register
+// halves or an indexed memory operand after a prefix. Indexed memory
+// reads its displacement, so operands must be named in byte order.
+func (d *decoder) r(i uint8) string {
+	switch {
+	case d.index == "":
+		return regs8[i]
+	case i == 6:
+		return d.mem()
+	case i == 4 || i == 5:
+		return d.index + regs8[i]
+	}
+	return regs8[i]
+}
+
+// mem names (hl), or (ix+d) reading the displacement
+func (d *decoder) mem() string {
+	if d.index == "" {
+		return "(hl)"
+	}
+	if !d.hasDisp {
+		d.disp = int(int8(d.next()))
+		d.hasDisp = true
+	}
+	if d.disp < 0 {
+		return fmt.Sprintf("(%s-$%02X)", d.index, -d.disp)
+	}
+	return fmt.Sprintf("(%s+$%02X)", d.index, d.disp)
+}
+
+// hl names HL or the index register
+func (d *decoder) hl() string {
+	if d.index != "" {
+		return d.index
+	}
+	return "hl"
+}
+
+func (d *decoder) rp(p uint8) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return regs16[p]
+}
+
+func (d *decoder) rp2(p uint8) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return regs16a[p]
+}
+
+func (d *decoder) decode() {
+	op := d.next()
+	switch op {
+	case 0xCB:
+		d.decodeCB()
+		return
+	case 0xED:
+		d.decodeED()
+		return
+	case 0xDD, 0xFD:
+		name := "ix"
+		if op == 0xFD {
+			name = "iy"
+		}
+		switch d.read(d.addr + 1) {
+		case 0xDD, 0xED, 0xFD:
+			// A prefix followed by another acts on its own
+			d.set("db", fmt.Sprintf("$%02X", op))
+			return
+		case 0xCB:
+			d.index = name
+			d.next()
+			d.decodeIndexedCB()
+			return
+		}
+		d.index = name
+		op = d.next()
+	}
+	d.decodeMain(op)
+}
+
+func (d *decoder) decodeMain(op uint8) {
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				d.set("nop")
+			case 1:
+				d.set("ex", "af", "af'")
+			case 2:
+				d.set("djnz", d.rel())
+			case 3:
+				d.set("jr", d.rel())
+			default:
+				d.set("jr", conds[y-4], d.rel())
+			}
+		case 1:
+			if q == 0 {
+				d.set("ld", d.rp(p), d.imm16())
+			} else {
+				d.set("add", d.hl(), d.rp(p))
+			}
+		case 2:
+			switch y {
+			case 0:
+				d.set("ld", "(bc)", "a")
+			case 1:
+				d.set("ld", "a", "(bc)")
+			case 2:
+				d.set("ld", "(de)", "a")
+			case 3:
+				d.set("ld", "a", "(de)")
+			case 4:
+				d.set("ld", "("+d.imm16()+")", d.hl())
+			case 5:
+				d.set("ld", d.hl(), "("+d.imm16()+")")
+			case 6:
+				d.set("ld", "("+d.imm16()+")", "a")
+			case 7:
+				d.set("ld", "a", "("+d.imm16()+")")
+			}
+		case 3:
+			if q == 0 {
+				d.set("inc", d.rp(p))
+			} else {
+				d.set("dec", d.rp(p))
+			}
+		case 4:
+			d.set("inc", d.r(y))
+		case 5:
+			d.set("dec", d.r(y))
+		case 6:
+			dst := d.r(y)
+			d.set("ld", dst, d.imm8())
+		case 7:
+			d.set(accOps[y])
+		}
+	case 1:
+		switch {
+		case y == 6 && z == 6:
+			d.set("halt")
+		case y == 6:
+			// ld (ix+d),r uses H and L, not the index halves
+			d.set("ld", d.mem(), regs8[z])
+		case z == 6:
+			d.set("ld", regs8[y], d.mem())
+		default:
+			d.set("ld", d.r(y), d.r(z))
+		}
+	case 2:
+		d.alu(y, d.r(z))
+	case 3:
+		d.decodeX3(y, z, p, q)
+	}
+}
+
+func (d *decoder) alu(y uint8, operand string) {
+	switch y {
+	case 0, 1, 3:
+		d.set(aluOps[y], "a", operand)
+	default:
+		d.set(aluOps[y], operand)
+	}
+}
+
+func (d *decoder) decodeX3(y, z, p, q uint8) {
+	switch z {
+	case 0:
+		d.set("ret", conds[y])
+	case 1:
+		switch {
+		case q == 0:
+			d.set("pop", d.rp2(p))
+		case p == 0:
+			d.set("ret")
+		case p == 1:
+			d.set("exx")
+		case p == 2:
+			d.set("jp", "("+d.hl()+")")
+		default:
+			d.set("ld", "sp", d.hl())
+		}
+	case 2:
+		d.set("jp", conds[y], d.imm16())
+	case 3:
+		switch y {
+		case 0:
+			d.set("jp", d.imm16())
+		case 2:
+			d.set("out", "("+d.imm8()+")", "a")
+		case 3:
+			d.set("in", "a", "("+d.imm8()+")")
+		case 4:
+			d.set("ex", "(sp)", d.hl())
+		case 5:
+			d.set("ex", "de", "hl") // Not affected by a prefix
+		case 6:
+			d.set("di")
+		case 7:
+			d.set("ei")
+		}
+	case 4:
+		d.set("call", conds[y], d.imm16())
+	case 5:
+		if q == 0 {
+			d.set("push", d.rp2(p))
+		} else {
+			d.set("call", d.imm16()) // p is 0: the prefixes are handled by decode
+		}
+	case 6:
+		d.alu(y, d.imm8())
+	case 7:
+		d.set("rst", fmt.Sprintf("$%02X", y*8))
+	}
+}
+
+func (d *decoder) decodeCB() {
+	op := d.next()
+	x, y, z := op>>6, op>>3&7, op&7
+	switch x {
+	case 0:
+		d.set(rotOps[y], regs8[z])
+	case 1:
+		d.set("bit", fmt.Sprint(y), regs8[z])
+	case 2:
+		d.set("res", fmt.Sprint(y), regs8[z])
+	case 3:
+		d.set("set", fmt.Sprint(y), regs8[z])
+	}
+}
+
+// decodeIndexedCB decodes DD CB d op and FD CB d op. Except for BIT, the
+// forms with a register other than (hl) also copy the result into it.
+func (d *decoder) decodeIndexedCB() {
+	mem := d.mem()
+	op := d.next()
+	x, y, z := op>>6, op>>3&7, op&7
+	var operands []string
+	switch x {
+	case 0:
+		operands = []string{mem}
+	case 1:
+		d.set("bit", fmt.Sprint(y), mem)
+		return
+	default:
+		operands = []string{fmt.Sprint(y), mem}
+	}
+	if z != 6 {
+		operands = append(operands, regs8[z])
+	}
+	switch x {
+	case 0:
+		d.set(rotOps[y], operands...)
+	case 2:
+		d.set("res", operands...)
+	case 3:
+		d.set("set", operands...)
+	}
+}
+
+func (d *decoder) decodeED() {
+	op := d.next()
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch {
+	case x == 1:
+		switch z {
+		case 0:
+			if y == 6 {
+				d.set("in", "(c)")
+			} else {
+				d.set("in", regs8[y], "(c)")
+			}
+		case 1:
+			if y == 6 {
+				d.set("out", "(c)", "0")
+			} else {
+				d.set("out", "(c)", regs8[y])
+			}
+		case 2:
+			if q == 0 {
+				d.set("sbc", "hl", regs16[p])
+			} else {
+				d.set("adc", "hl", regs16[p])
+			}
+		case 3:
+			if q == 0 {
+				d.set("ld", "("+d.imm16()+")", regs16[p])
+			} else {
+				d.set("ld", regs16[p], "("+d.imm16()+")")
+			}
+		case 4:
+			d.set("neg")
+		case 5:
+			if y == 1 {
+				d.set("reti")
+			} else {
+				d.set("retn")
+			}
+		case 6:
+			d.set("im", imModes[y])
+		case 7:
+			switch y {
+			case 0:
+				d.set("ld", "i", "a")
+			case 1:
+				d.set("ld", "r", "a")
+			case 2:
+				d.set("ld", "a", "i")
+			case 3:
+				d.set("ld", "a", "r")
+			case 4:
+				d.set("rrd")
+			case 5:
+				d.set("rld")
+			default:
+				d.set("db", "$ED", fmt.Sprintf("$%02X", op))
+			}
+		}
+	case x == 2 && z <= 3 && y >= 4:
+		d.set(blockOps[y-4][z])
+	default:
+		// Undefined: executes as a two-byte NOP
+		d.set("db", "$ED", fmt.Sprintf("$%02X", op))
+	}
+}
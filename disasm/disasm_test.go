@@ -0,0 +1,94 @@
+package disasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		code []uint8
+		want string
+	}{
+		{[]uint8{0x00}, "nop"},
+		{[]uint8{0x08}, "ex af,af'"},
+		{[]uint8{0x10, 0xFE}, "djnz $0100"},
+		{[]uint8{0x20, 0x05}, "jr nz,$0107"},
+		{[]uint8{0x21, 0x34, 0x12}, "ld hl,$1234"},
+		{[]uint8{0x22, 0x00, 0x40}, "ld ($4000),hl"},
+		{[]uint8{0x3A, 0x00, 0x5C}, "ld a,($5C00)"},
+		{[]uint8{0x36, 0x07}, "ld (hl),$07"},
+		{[]uint8{0x76}, "halt"},
+		{[]uint8{0x78}, "ld a,b"},
+		{[]uint8{0x86}, "add a,(hl)"},
+		{[]uint8{0x96}, "sub (hl)"},
+		{[]uint8{0xFE, 0x20}, "cp $20"},
+		{[]uint8{0xC3, 0x00, 0x80}, "jp $8000"},
+		{[]uint8{0xCD, 0x05, 0x00}, "call $0005"},
+		{[]uint8{0xE9}, "jp (hl)"},
+		{[]uint8{0xEB}, "ex de,hl"},
+		{[]uint8{0xF5}, "push af"},
+		{[]uint8{0xFF}, "rst $38"},
+		{[]uint8{0xD3, 0xFE}, "out ($FE),a"},
+		{[]uint8{0xCB, 0x7E}, "bit 7,(hl)"},
+		{[]uint8{0xCB, 0x30}, "sll b"},
+		{[]uint8{0xED, 0xB0}, "ldir"},
+		{[]uint8{0xED, 0x70}, "in (c)"},
+		{[]uint8{0xED, 0x71}, "out (c),0"},
+		{[]uint8{0xED, 0x4B, 0x00, 0x60}, "ld bc,($6000)"},
+		{[]uint8{0xED, 0x5E}, "im 2"},
+		{[]uint8{0xED, 0x4D}, "reti"},
+		{[]uint8{0xED, 0x00}, "db $ED,$00"},
+		{[]uint8{0xDD, 0x7E, 0x05}, "ld a,(ix+$05)"},
+		{[]uint8{0xFD, 0x75, 0xFE}, "ld (iy-$02),l"},
+		{[]uint8{0xDD, 0x36, 0x03, 0x09}, "ld (ix+$03),$09"},
+		{[]uint8{0xDD, 0x66, 0x01}, "ld h,(ix+$01)"},
+		{[]uint8{0xDD, 0x65}, "ld ixh,ixl"},
+		{[]uint8{0xFD, 0x84}, "add a,iyh"},
+		{[]uint8{0xDD, 0x21, 0x00, 0x50}, "ld ix,$5000"},
+		{[]uint8{0xDD, 0x29}, "add ix,ix"},
+		{[]uint8{0xDD, 0xE9}, "jp (ix)"},
+		{[]uint8{0xFD, 0xE3}, "ex (sp),iy"},
+		{[]uint8{0xDD, 0xEB}, "ex de,hl"},
+		{[]uint8{0xDD, 0x00}, "nop"},
+		{[]uint8{0xDD, 0xDD, 0x00}, "db $DD"},
+		{[]uint8{0xDD, 0xCB, 0x02, 0x46}, "bit 0,(ix+$02)"},
+		{[]uint8{0xFD, 0xCB, 0xFF, 0xC6}, "set 0,(iy-$01)"},
+		{[]uint8{0xDD, 0xCB, 0x04, 0x00}, "rlc (ix+$04),b"},
+		{[]uint8{0xDD, 0xCB, 0x04, 0x87}, "res 0,(ix+$04),a"},
+	}
+	for _, tt := range tests {
+		in := DecodeBytes(tt.code, 0x0100)
+		if got := in.String(); got != tt.want {
+			t.Errorf("% X: got %q, want %q", tt.code, got, tt.want)
+		}
+		if in.Len() != len(tt.code) && tt.want != "db $DD" {
+			t.Errorf("% X (%s): length %d, want %d", tt.code, tt.want, in.Len(), len(tt.code))
+		}
+	}
+}
+
+// Every opcode decodes to something of a sensible length
+func TestDecodeAll(t *testing.T) {
+	for _, prefix := range [][]uint8{nil, {0xCB}, {0xED}, {0xDD}, {0xFD}, {0xDD, 0xCB, 0x01}, {0xFD, 0xCB, 0x01}} {
+		for op := 0; op < 256; op++ {
+			code := append(append([]uint8(nil), prefix...), uint8(op), 0x11, 0x22, 0x33)
+			in := DecodeBytes(code, 0)
+			if in.Mnemonic == "" || in.Len() < 1 || in.Len() > 4 {
+				t.Errorf("% X: %q, length %d", code[:len(prefix)+1], in, in.Len())
+			}
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	mem := map[uint16]uint8{0x8000: 0x3E, 0x8001: 0x05, 0x8002: 0xC9}
+	got := Disassemble(func(a uint16) uint8 { return mem[a] }, 0x8000, 2)
+	want := "8000  3e 05        ld a,$05\n8002  c9           ret\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if !strings.Contains(HexBytes([]uint8{0xDD, 0x7E}), "dd 7e") {
+		t.Error("HexBytes")
+	}
+}
@@ -0,0 +1,468 @@
+// Package gdbstub serves the GDB remote serial protocol for a Z80 machine,
+// so that a gdb built for Z80 targets (as used with SDCC and z88dk) can
+// debug programs running in zen80 with "target remote".
+//
+// Registers are sent in gdb's Z80 layout, 16 bits each: AF BC DE HL SP
+// PC IX IY AF' BC' DE' HL' IR. The layout is also offered as a target
+// description. Software and hardware breakpoints (Z0, Z1), watchpoints
+// (Z2 write, Z3 read, Z4 access), stepping, continuing, Ctrl-C and
+// "monitor" commands are supported; monitor commands the stub does not
+// know itself go to the machine if it is a debug.Commander.
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ha1tch/zen80/debug"
+)
+
+// DefaultAddr is a conventional address for gdb stubs
+const DefaultAddr = "localhost:1234"
+
+// targetXML describes the register layout to gdb
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>z80</architecture>
+<feature name="org.gnu.gdb.z80.cpu">
+<reg name="af" bitsize="16" type="int"/>
+<reg name="bc" bitsize="16" type="data_ptr"/>
+<reg name="de" bitsize="16" type="data_ptr"/>
+<reg name="hl" bitsize="16" type="data_ptr"/>
+<reg name="sp" bitsize="16" type="data_ptr"/>
+<reg name="pc" bitsize="16" type="code_ptr"/>
+<reg name="ix" bitsize="16" type="data_ptr"/>
+<reg name="iy" bitsize="16" type="data_ptr"/>
+<reg name="af'" bitsize="16" type="int"/>
+<reg name="bc'" bitsize="16" type="int"/>
+<reg name="de'" bitsize="16" type="int"/>
+<reg name="hl'" bitsize="16" type="int"/>
+<reg name="ir" bitsize="16" type="int"/>
+</feature>
+</target>
+`
+
+// registerNames are the debug.Debugger names of gdb's registers, in order
+var registerNames = []string{"AF", "BC", "DE", "HL", "SP", "PC", "IX", "IY", "AF'", "BC'", "DE'", "HL'", "IR"}
+
+// interrupt is the byte gdb sends for Ctrl-C
+const interrupt = 0x03
+
+// corrupt stands for a packet whose checksum did not match
+const corrupt = "\x15"
+
+// Server is a gdb stub for one debugger
+type Server struct {
+	d     *debug.Debugger
+	noAck bool
+}
+
+// NewServer creates a stub for a debugger
+func NewServer(d *debug.Debugger) *Server {
+	return &Server{d: d}
+}
+
+// ListenAndServe serves gdb on a TCP address, such as DefaultAddr
+func ListenAndServe(addr string, d *debug.Debugger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return NewServer(d).Serve(l)
+}
+
+// Serve accepts gdb connections one at a time until the listener fails
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(c)
+		c.Close()
+	}
+}
+
+// conn is one gdb session
+type conn struct {
+	w       *bufio.Writer
+	packets chan string // Packet bodies, "\x03" for Ctrl-C or corrupt; closed at EOF
+}
+
+// ServeConn talks to one gdb until it detaches, kills the target or
+// disconnects
+func (s *Server) ServeConn(c io.ReadWriter) error {
+	s.noAck = false
+	cn := &conn{w: bufio.NewWriter(c), packets: make(chan string)}
+	done := make(chan struct{})
+	defer close(done)
+	go cn.read(bufio.NewReader(c), done)
+
+	for {
+		p, ok := <-cn.packets
+		if !ok {
+			return nil
+		}
+		if p == string(rune(interrupt)) {
+			continue // Nothing is running
+		}
+		if p == corrupt {
+			if !s.noAck {
+				cn.w.WriteByte('-') // Ask for it again
+				cn.w.Flush()
+			}
+			continue
+		}
+		if !s.noAck {
+			cn.w.WriteByte('+')
+		}
+		reply, end := s.handle(cn, p)
+		if p == "k" {
+			cn.w.Flush()
+			return nil // Kill has no reply
+		}
+		if err := cn.send(reply); err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+// read splits the stream into packets and verifies their checksums.
+// Acknowledgements from gdb are ignored.
+func (cn *conn) read(r *bufio.Reader, done chan struct{}) {
+	defer close(cn.packets)
+	deliver := func(p string) bool {
+		select {
+		case cn.packets <- p:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case interrupt:
+			if !deliver(string(rune(interrupt))) {
+				return
+			}
+		case '$':
+			body, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			sum := make([]uint8, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return
+			}
+			body = strings.TrimSuffix(body, "#")
+			if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || uint8(want) != checksum(body) {
+				body = corrupt
+			}
+			if !deliver(body) {
+				return
+			}
+		}
+	}
+}
+
+// send writes a packet and flushes it
+func (cn *conn) send(body string) error {
+	fmt.Fprintf(cn.w, "$%s#%02x", body, checksum(body))
+	return cn.w.Flush()
+}
+
+// checksum is the modulo-256 sum of a packet body
+func checksum(body string) uint8 {
+	var sum uint8
+	for i := 0; i < len(body); i++ {
+		sum += body[i]
+	}
+	return sum
+}
+
+// interrupted reports whether gdb has sent Ctrl-C (or gone away) while
+// the machine runs. Packets other than Ctrl-C are not expected then and
+// are dropped.
+func (cn *conn) interrupted() bool {
+	for {
+		select {
+		case p, ok := <-cn.packets:
+			if !ok || p == string(rune(interrupt)) {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+// handle answers one packet; end is true when the session is over
+func (s *Server) handle(cn *conn, p string) (reply string, end bool) {
+	d := s.d
+	if p == "" {
+		return "", false
+	}
+	args := p[1:]
+	switch p[0] {
+	case '?':
+		return "S05", false
+	case 'g':
+		var b strings.Builder
+		for _, name := range registerNames {
+			v := s.register(name)
+			fmt.Fprintf(&b, "%02x%02x", uint8(v), uint8(v>>8))
+		}
+		return b.String(), false
+	case 'G':
+		data, err := hex.DecodeString(args)
+		if err != nil || len(data) < 2*len(registerNames) {
+			return "E01", false
+		}
+		for i, name := range registerNames {
+			s.setRegister(name, uint16(data[2*i])|uint16(data[2*i+1])<<8)
+		}
+		return "OK", false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || int(n) >= len(registerNames) {
+			return "E01", false
+		}
+		v := s.register(registerNames[n])
+		return fmt.Sprintf("%02x%02x", uint8(v), uint8(v>>8)), false
+	case 'P':
+		num, val, ok := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(num, 16, 8)
+		data, herr := hex.DecodeString(val)
+		if !ok || err != nil || herr != nil || int(n) >= len(registerNames) || len(data) < 2 {
+			return "E01", false
+		}
+		s.setRegister(registerNames[n], uint16(data[0])|uint16(data[1])<<8)
+		return "OK", false
+	case 'm':
+		addr, n, err := addrLen(args)
+		if err != nil {
+			return "E01", false
+		}
+		return hex.EncodeToString(d.ReadBlock(addr, n)), false
+	case 'M':
+		head, data, ok := strings.Cut(args, ":")
+		addr, n, err := addrLen(head)
+		bytes, herr := hex.DecodeString(data)
+		if !ok || err != nil || herr != nil || len(bytes) != n {
+			return "E01", false
+		}
+		d.WriteBlock(addr, bytes)
+		return "OK", false
+	case 's':
+		if err := s.resumeAt(args); err != nil {
+			return "E01", false
+		}
+		return stopReply(d.Step()), false
+	case 'c':
+		if err := s.resumeAt(args); err != nil {
+			return "E01", false
+		}
+		return stopReply(d.Continue(cn.interrupted)), false
+	case 'Z', 'z':
+		return s.breakpoint(p[0] == 'Z', args), false
+	case 'H':
+		return "OK", false // There is only one thread
+	case 'T':
+		return "OK", false
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	case 'q', 'Q':
+		return s.query(p), false
+	}
+	return "", false // Unsupported
+}
+
+// resumeAt moves PC to the address given to s or c, if any
+func (s *Server) resumeAt(args string) error {
+	if args == "" {
+		return nil
+	}
+	addr, err := strconv.ParseUint(args, 16, 16)
+	if err != nil {
+		return err
+	}
+	s.d.CPU().PC = uint16(addr)
+	return nil
+}
+
+// stopReply reports why the machine stopped with SIGTRAP, or SIGINT
+// after Ctrl-C
+func stopReply(e debug.Event) string {
+	switch e.Reason {
+	case debug.Interrupted:
+		return "S02"
+	case debug.WatchRead:
+		return fmt.Sprintf("T05rwatch:%x;", e.Addr)
+	case debug.WatchWrite:
+		return fmt.Sprintf("T05watch:%x;", e.Addr)
+	case debug.Breakpoint:
+		return "T05swbreak:;"
+	}
+	return "S05"
+}
+
+// breakpoint handles Z and z packets: type,addr,kind
+func (s *Server) breakpoint(insert bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	n, err := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	d := s.d
+	switch parts[0] {
+	case "0", "1":
+		if insert {
+			d.AddBreakpoint(uint16(addr))
+		} else {
+			d.RemoveBreakpoint(uint16(addr))
+		}
+	case "2", "3", "4":
+		w := debug.Watchpoint{Addr: uint16(addr), Len: int(n), Read: parts[0] != "2", Write: parts[0] != "3"}
+		d.RemoveWatchpoint(w.Addr, w.Len)
+		if insert {
+			d.AddWatchpoint(w)
+		}
+	default:
+		return ""
+	}
+	return "OK"
+}
+
+// query answers q and Q packets
+func (s *Server) query(p string) string {
+	name, args, _ := strings.Cut(p, ":")
+	switch {
+	case name == "qSupported":
+		return "PacketSize=4000;qXfer:features:read+;swbreak+;hwbreak+;QStartNoAckMode+"
+	case name == "QStartNoAckMode":
+		s.noAck = true
+		return "OK"
+	case name == "qAttached":
+		return "1"
+	case name == "qC":
+		return "QC1"
+	case name == "qfThreadInfo":
+		return "m1"
+	case name == "qsThreadInfo":
+		return "l"
+	case name == "qXfer" && strings.HasPrefix(args, "features:read:target.xml:"):
+		return xfer(targetXML, strings.TrimPrefix(args, "features:read:target.xml:"))
+	case strings.HasPrefix(p, "qRcmd,"):
+		cmd, err := hex.DecodeString(strings.TrimPrefix(p, "qRcmd,"))
+		if err != nil {
+			return "E01"
+		}
+		out, err := s.monitor(string(cmd))
+		if err != nil {
+			out = "error: " + err.Error() + "\n"
+		}
+		if out == "" {
+			return "OK"
+		}
+		return hex.EncodeToString([]uint8(out))
+	}
+	return ""
+}
+
+// xfer returns the part of a document asked for as offset,length
+func xfer(doc, args string) string {
+	off, n, ok := strings.Cut(args, ",")
+	o, err1 := strconv.ParseUint(off, 16, 32)
+	l, err2 := strconv.ParseUint(n, 16, 32)
+	if !ok || err1 != nil || err2 != nil {
+		return "E01"
+	}
+	if o >= uint64(len(doc)) {
+		return "l"
+	}
+	part := doc[o:]
+	if uint64(len(part)) > l {
+		return "m" + part[:l]
+	}
+	return "l" + part
+}
+
+// monitor runs a "monitor" command
+func (s *Server) monitor(cmd string) (string, error) {
+	name, _, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	switch name {
+	case "help":
+		out := "reset       reset the machine\nregs        show the registers\n"
+		if _, ok := s.d.Machine().(debug.Commander); ok {
+			out += "other commands are passed to the machine\n"
+		}
+		return out, nil
+	case "reset":
+		return "", s.d.Reset()
+	case "regs":
+		z := s.d.CPU()
+		return fmt.Sprintf("AF=%04X BC=%04X DE=%04X HL=%04X IX=%04X IY=%04X SP=%04X PC=%04X I=%02X R=%02X IM%d IFF1=%t\n",
+			z.AF(), z.BC(), z.DE(), z.HL(), z.IX(), z.IY(), z.SP, z.PC, z.I, z.R, z.IM, z.IFF1), nil
+	}
+	if c, ok := s.d.Machine().(debug.Commander); ok {
+		out, err := c.Command(cmd)
+		if err == nil && out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		return out, err
+	}
+	return "", errors.New("unknown monitor command " + name)
+}
+
+// register reads one of gdb's registers
+func (s *Server) register(name string) uint16 {
+	if name == "IR" {
+		z := s.d.CPU()
+		return uint16(z.I)<<8 | uint16(z.R)
+	}
+	v, _ := s.d.Register(name)
+	return v
+}
+
+func (s *Server) setRegister(name string, v uint16) {
+	if name == "IR" {
+		z := s.d.CPU()
+		z.I, z.R = uint8(v>>8), uint8(v)
+		return
+	}
+	s.d.SetRegister(name, v)
+}
+
+func addrLen(s string) (uint16, int, error) {
+	a, n, ok := strings.Cut(s, ",")
+	addr, err1 := strconv.ParseUint(a, 16, 32)
+	size, err2 := strconv.ParseUint(n, 16, 32)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("bad address and length %q", s)
+	}
+	return uint16(addr), int(min(size, 0x10000)), nil
+}
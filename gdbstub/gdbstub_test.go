@@ -0,0 +1,160 @@
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/debug"
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// program: 8000 call 8006; jr 8000 (loop); 8005 halt; 8006 ld (9000),a; inc a; ret
+var program = []uint8{0xCD, 0x06, 0x80, 0x18, 0xFB, 0x76, 0x32, 0x00, 0x90, 0x3C, 0xC9}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes a packet without waiting for anything
+func (c *client) send(body string) {
+	var sum uint8
+	for i := 0; i < len(body); i++ {
+		sum += body[i]
+	}
+	fmt.Fprintf(c.conn, "$%s#%02x", body, sum)
+}
+
+// reply reads the next packet, skipping acknowledgements
+func (c *client) reply() string {
+	c.t.Helper()
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Fatalf("reading reply: %v", err)
+		}
+		if b != '$' {
+			continue
+		}
+		body, err := c.r.ReadString('#')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		c.r.Discard(2)
+		return strings.TrimSuffix(body, "#")
+	}
+}
+
+func (c *client) do(body string) string {
+	c.t.Helper()
+	c.send(body)
+	return c.reply()
+}
+
+func newClient(t *testing.T) (*client, *z80.Z80) {
+	mem := memory.NewRAM()
+	mem.Load(0x8000, program)
+	cpu := z80.New(mem, zio.NewNullIO())
+	cpu.PC, cpu.SP = 0x8000, 0xFF00
+	server, conn := net.Pipe()
+	go NewServer(debug.New(debug.NewCPU(cpu))).ServeConn(server)
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}, cpu
+}
+
+func TestRegisters(t *testing.T) {
+	c, cpu := newClient(t)
+	if got := c.do("qSupported:swbreak+"); !strings.Contains(got, "qXfer:features:read+") {
+		t.Errorf("qSupported: %q", got)
+	}
+	if got := c.do("QStartNoAckMode"); got != "OK" {
+		t.Errorf("QStartNoAckMode: %q", got)
+	}
+	cpu.SetHL(0x1234)
+	cpu.I, cpu.R = 0x3F, 0x05
+	regs := c.do("g")
+	if len(regs) != 13*4 || regs[12:16] != "3412" || regs[20:24] != "0080" || regs[48:52] != "053f" {
+		t.Errorf("g: %q", regs)
+	}
+	if got := c.do("P3=cdab"); got != "OK" || cpu.HL() != 0xABCD {
+		t.Errorf("P: %q, HL=%04X", got, cpu.HL())
+	}
+	if got := c.do("p4"); got != "00ff" {
+		t.Errorf("p4: %q", got)
+	}
+	if got := c.do("G" + strings.Repeat("0", 9*4) + "1100" + "0000" + "2200" + "3300"); got != "OK" || cpu.C_ != 0x11 || cpu.I != 0x00 || cpu.R != 0x33 {
+		t.Errorf("G: %q", got)
+	}
+	if got := c.do("qXfer:features:read:target.xml:0,fff"); !strings.HasPrefix(got, "l<?xml") || !strings.Contains(got, "<architecture>z80</architecture>") {
+		t.Errorf("target.xml: %q", got)
+	}
+	if got := c.do("vMustReplyEmpty"); got != "" {
+		t.Errorf("unknown packet: %q", got)
+	}
+}
+
+func TestMemoryAndMonitor(t *testing.T) {
+	c, cpu := newClient(t)
+	if got := c.do("m8000,3"); got != "cd0680" {
+		t.Errorf("m: %q", got)
+	}
+	if got := c.do("M4000,2:a0b1"); got != "OK" {
+		t.Errorf("M: %q", got)
+	}
+	if got := c.do("m4000,2"); got != "a0b1" {
+		t.Errorf("after M: %q", got)
+	}
+	cpu.PC = 0x1234
+	if got := c.do("qRcmd," + hex.EncodeToString([]uint8("reset"))); got != "OK" || cpu.PC != 0 {
+		t.Errorf("monitor reset: %q, PC=%04X", got, cpu.PC)
+	}
+	out, _ := hex.DecodeString(c.do("qRcmd," + hex.EncodeToString([]uint8("frobnicate"))))
+	if !strings.HasPrefix(string(out), "error:") {
+		t.Errorf("unknown monitor command: %q", out)
+	}
+}
+
+func TestExecution(t *testing.T) {
+	c, cpu := newClient(t)
+	if got := c.do("s"); got != "S05" || cpu.PC != 0x8006 {
+		t.Fatalf("s: %q, PC=%04X", got, cpu.PC)
+	}
+	c.do("Z0,8009,1")
+	if got := c.do("c"); got != "T05swbreak:;" || cpu.PC != 0x8009 {
+		t.Fatalf("c to breakpoint: %q, PC=%04X", got, cpu.PC)
+	}
+	c.do("z0,8009,1")
+	c.do("Z2,9000,1")
+	if got := c.do("c8000"); got != "T05watch:9000;" || cpu.PC != 0x8009 {
+		t.Fatalf("c to watchpoint: %q, PC=%04X", got, cpu.PC)
+	}
+	c.do("z2,9000,1")
+
+	// With nothing to stop it, continue runs until Ctrl-C
+	c.send("c")
+	c.conn.Write([]uint8{interrupt})
+	if got := c.reply(); got != "S02" {
+		t.Errorf("Ctrl-C: %q", got)
+	}
+	if got := c.do("D"); got != "OK" {
+		t.Errorf("D: %q", got)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	c, _ := newClient(t)
+	fmt.Fprint(c.conn, "$g#00")
+	if b, err := c.r.ReadByte(); err != nil || b != '-' {
+		t.Fatalf("bad checksum answered with %q, %v", b, err)
+	}
+	if got := c.do("?"); got != "S05" {
+		t.Errorf("? after a resend request: %q", got)
+	}
+}
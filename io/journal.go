@@ -0,0 +1,363 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	stdio "io"
+)
+
+// Port is the I/O port interface implemented by every device in this
+// package; it matches z80.IOInterface.
+type Port interface {
+	In(port uint16) uint8
+	Out(port uint16, value uint8)
+}
+
+// interruptController matches z80.InterruptController, so that journal
+// wrappers can record the values an interrupting device supplies
+type interruptController interface {
+	GetInterruptVector() uint8
+	GetMode0Instruction() []uint8
+}
+
+// EventKind identifies the type of a journal event
+type EventKind uint8
+
+// Journal event kinds
+const (
+	EventIn     EventKind = iota // Port read: Port and the Value returned
+	EventINT                     // INT line change: Value is 1 (asserted) or 0
+	EventNMI                     // NMI line change: Value is 1 (asserted) or 0
+	EventKey                     // Key press or release: Port is a machine-defined key code, Value 1 pressed, 0 released
+	EventVector                  // Interrupt vector supplied in mode 2: Value
+	EventMode0                   // Instruction supplied in mode 0: Data
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventIn:
+		return "IN"
+	case EventINT:
+		return "INT"
+	case EventNMI:
+		return "NMI"
+	case EventKey:
+		return "KEY"
+	case EventVector:
+		return "VECTOR"
+	case EventMode0:
+		return "MODE0"
+	}
+	return fmt.Sprintf("EventKind(%d)", uint8(k))
+}
+
+// Event is one entry of an input journal. Cycles counts CPU cycles since
+// recording started.
+type Event struct {
+	Cycles uint64
+	Kind   EventKind
+	Port   uint16
+	Value  uint8
+	Data   []uint8 // Instruction bytes for EventMode0
+}
+
+// Journal is a log of everything that entered a machine from outside the
+// CPU and memory: port reads and injected events. Replaying it from the
+// same starting state reproduces a run exactly.
+type Journal struct {
+	Snapshot []uint8 // Optional machine state the recording starts from
+	Events   []Event
+}
+
+const (
+	journalMagic   = "Z80JRNL\x00"
+	journalVersion = 1
+)
+
+// WriteTo encodes the journal in its binary format: the magic and version,
+// the snapshot, then each event as kind, cycle delta, port, value and
+// (for mode 0 events) data. Varints keep the common case compact.
+func (j *Journal) WriteTo(w stdio.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]uint8
+	uvarint := func(v uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+
+	buf.WriteString(journalMagic)
+	buf.WriteByte(journalVersion)
+	uvarint(uint64(len(j.Snapshot)))
+	buf.Write(j.Snapshot)
+	uvarint(uint64(len(j.Events)))
+
+	var last uint64
+	for i, e := range j.Events {
+		if e.Cycles < last {
+			return 0, fmt.Errorf("journal event %d goes back in time (%d < %d)", i, e.Cycles, last)
+		}
+		buf.WriteByte(uint8(e.Kind))
+		uvarint(e.Cycles - last)
+		uvarint(uint64(e.Port))
+		buf.WriteByte(e.Value)
+		if e.Kind == EventMode0 {
+			uvarint(uint64(len(e.Data)))
+			buf.Write(e.Data)
+		}
+		last = e.Cycles
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ReadJournal decodes a journal written by WriteTo
+func ReadJournal(r stdio.Reader) (*Journal, error) {
+	br := bufio.NewReader(r)
+	magic := make([]uint8, len(journalMagic)+1)
+	if _, err := stdio.ReadFull(br, magic); err != nil || string(magic[:len(journalMagic)]) != journalMagic {
+		return nil, fmt.Errorf("not a journal file")
+	}
+	if v := magic[len(journalMagic)]; v != journalVersion {
+		return nil, fmt.Errorf("unsupported journal version %d", v)
+	}
+
+	var err error
+	uvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(br)
+		return v
+	}
+	readBytes := func(n uint64) []uint8 {
+		if err != nil || n == 0 {
+			return nil
+		}
+		data := make([]uint8, n)
+		_, err = stdio.ReadFull(br, data)
+		return data
+	}
+	readByte := func() uint8 {
+		if err != nil {
+			return 0
+		}
+		var b uint8
+		b, err = br.ReadByte()
+		return b
+	}
+
+	j := &Journal{}
+	j.Snapshot = readBytes(uvarint())
+	count := uvarint()
+	var cycles uint64
+	for i := uint64(0); i < count && err == nil; i++ {
+		e := Event{Kind: EventKind(readByte())}
+		cycles += uvarint()
+		e.Cycles = cycles
+		e.Port = uint16(uvarint())
+		e.Value = readByte()
+		if e.Kind == EventMode0 {
+			e.Data = readBytes(uvarint())
+		}
+		j.Events = append(j.Events, e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("journal truncated: %w", err)
+	}
+	return j, nil
+}
+
+// RecordingIO wraps a device and journals every port read, along with
+// any events the machine reports through Record
+type RecordingIO struct {
+	inner   Port
+	clock   func() uint64
+	start   uint64
+	journal *Journal
+}
+
+// NewRecordingIO starts recording reads from inner. The clock returns the
+// CPU cycle count (z80.Z80.Cycles).
+func NewRecordingIO(inner Port, clock func() uint64) *RecordingIO {
+	return &RecordingIO{
+		inner:   inner,
+		clock:   clock,
+		start:   clock(),
+		journal: &Journal{},
+	}
+}
+
+// In reads from the wrapped device and journals the result
+func (r *RecordingIO) In(port uint16) uint8 {
+	value := r.inner.In(port)
+	r.Record(EventIn, port, value)
+	return value
+}
+
+// Out writes to the wrapped device
+func (r *RecordingIO) Out(port uint16, value uint8) {
+	r.inner.Out(port, value)
+}
+
+// GetInterruptVector forwards to the wrapped device and journals the vector
+func (r *RecordingIO) GetInterruptVector() uint8 {
+	vector := uint8(0xFF)
+	if ic, ok := r.inner.(interruptController); ok {
+		vector = ic.GetInterruptVector()
+	}
+	r.Record(EventVector, 0, vector)
+	return vector
+}
+
+// GetMode0Instruction forwards to the wrapped device and journals the
+// instruction
+func (r *RecordingIO) GetMode0Instruction() []uint8 {
+	var inst []uint8
+	if ic, ok := r.inner.(interruptController); ok {
+		inst = ic.GetMode0Instruction()
+	}
+	r.journal.Events = append(r.journal.Events, Event{
+		Cycles: r.clock() - r.start,
+		Kind:   EventMode0,
+		Data:   append([]uint8(nil), inst...),
+	})
+	return inst
+}
+
+// Record journals an event injected into the machine from outside, such
+// as an interrupt line change or a key press
+func (r *RecordingIO) Record(kind EventKind, port uint16, value uint8) {
+	r.journal.Events = append(r.journal.Events, Event{
+		Cycles: r.clock() - r.start,
+		Kind:   kind,
+		Port:   port,
+		Value:  value,
+	})
+}
+
+// Journal returns the events recorded so far
+func (r *RecordingIO) Journal() *Journal {
+	return r.journal
+}
+
+// Inner returns the wrapped device
+func (r *RecordingIO) Inner() Port {
+	return r.inner
+}
+
+// ReplayIO wraps a device and answers port reads from a journal instead.
+// Writes still reach the device so that output (screen, sound) works.
+// Injected events are handed back to the machine through Due.
+type ReplayIO struct {
+	inner   Port
+	clock   func() uint64
+	start   uint64
+	journal *Journal
+	pos     int
+	err     error
+}
+
+// NewReplayIO starts replaying a journal. The machine must be in the state
+// the recording started from.
+func NewReplayIO(inner Port, clock func() uint64, journal *Journal) *ReplayIO {
+	return &ReplayIO{
+		inner:   inner,
+		clock:   clock,
+		start:   clock(),
+		journal: journal,
+	}
+}
+
+// next returns the next journal entry if it is of the expected kind at the
+// current cycle, recording a divergence otherwise
+func (r *ReplayIO) next(kind EventKind, port uint16) (Event, bool) {
+	if r.err != nil {
+		return Event{}, false
+	}
+	if r.pos >= len(r.journal.Events) {
+		return Event{}, false // Replay over; live inputs take over
+	}
+	now := r.clock() - r.start
+	e := r.journal.Events[r.pos]
+	if e.Kind != kind || e.Cycles != now || (kind == EventIn && e.Port != port) {
+		r.err = fmt.Errorf("diverged at cycle %d: got %s %04X, journal has %s %04X at cycle %d",
+			now, kind, port, e.Kind, e.Port, e.Cycles)
+		return Event{}, false
+	}
+	r.pos++
+	return e, true
+}
+
+// In returns the journaled value for a port read. Once the journal is
+// exhausted, or after a divergence, the live device is read instead.
+func (r *ReplayIO) In(port uint16) uint8 {
+	if e, ok := r.next(EventIn, port); ok {
+		return e.Value
+	}
+	return r.inner.In(port)
+}
+
+// Out writes to the wrapped device
+func (r *ReplayIO) Out(port uint16, value uint8) {
+	r.inner.Out(port, value)
+}
+
+// GetInterruptVector returns the journaled mode 2 vector
+func (r *ReplayIO) GetInterruptVector() uint8 {
+	if e, ok := r.next(EventVector, 0); ok {
+		return e.Value
+	}
+	if ic, ok := r.inner.(interruptController); ok {
+		return ic.GetInterruptVector()
+	}
+	return 0xFF
+}
+
+// GetMode0Instruction returns the journaled mode 0 instruction
+func (r *ReplayIO) GetMode0Instruction() []uint8 {
+	if e, ok := r.next(EventMode0, 0); ok {
+		return e.Data
+	}
+	if ic, ok := r.inner.(interruptController); ok {
+		return ic.GetMode0Instruction()
+	}
+	return nil
+}
+
+// Due returns the injected events (everything except port reads and
+// interrupt acknowledge data) scheduled at or before the current cycle.
+// Machines call it before each instruction and apply the events.
+func (r *ReplayIO) Due() []Event {
+	if r.err != nil {
+		return nil
+	}
+	now := r.clock() - r.start
+	var due []Event
+	for r.pos < len(r.journal.Events) {
+		e := r.journal.Events[r.pos]
+		if e.Cycles > now || e.Kind == EventIn || e.Kind == EventVector || e.Kind == EventMode0 {
+			break
+		}
+		due = append(due, e)
+		r.pos++
+	}
+	return due
+}
+
+// Done reports whether every journal entry has been replayed
+func (r *ReplayIO) Done() bool {
+	return r.pos >= len(r.journal.Events)
+}
+
+// Err returns the divergence that stopped the replay, if any
+func (r *ReplayIO) Err() error {
+	return r.err
+}
+
+// Inner returns the wrapped device
+func (r *ReplayIO) Inner() Port {
+	return r.inner
+}
@@ -0,0 +1,90 @@
+package io
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// counter is a device whose reads return how many reads there have been
+type counter struct{ n uint8 }
+
+func (c *counter) In(port uint16) uint8         { c.n++; return c.n }
+func (c *counter) Out(port uint16, value uint8) {}
+
+// record journals reads of ports 1, 2 and 3, with a key press after the
+// first, at cycles 10, 15, 25 and 35 from the start
+func record(t *testing.T) *Journal {
+	t.Helper()
+	var cycles uint64 = 100
+	r := NewRecordingIO(&counter{}, func() uint64 { return cycles })
+	for port := uint16(1); port <= 3; port++ {
+		cycles += 10
+		r.In(port)
+		if port == 1 {
+			cycles += 5
+			r.Record(EventKey, 7, 1)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := r.Journal().WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	j, err := ReadJournal(&buf)
+	if err != nil {
+		t.Fatalf("ReadJournal: %v", err)
+	}
+	return j
+}
+
+func TestJournalReplay(t *testing.T) {
+	var cycles uint64 = 500
+	live := &counter{n: 0x80}
+	r := NewReplayIO(live, func() uint64 { return cycles }, record(t))
+
+	cycles += 10
+	if v := r.In(1); v != 1 {
+		t.Errorf("first read = %02X, want 01", v)
+	}
+	if due := r.Due(); len(due) != 0 {
+		t.Errorf("key press due early: %v", due)
+	}
+	cycles += 5
+	if due := r.Due(); len(due) != 1 || due[0].Kind != EventKey || due[0].Port != 7 {
+		t.Errorf("due at cycle 15 = %v, want the key press", due)
+	}
+	for port := uint16(2); port <= 3; port++ {
+		cycles += 10
+		if v := r.In(port); v != uint8(port) {
+			t.Errorf("read %d = %02X, want %02X", port, v, port)
+		}
+	}
+	if !r.Done() || r.Err() != nil {
+		t.Fatalf("after the journal: Done %v, Err %v", r.Done(), r.Err())
+	}
+
+	// An exhausted journal hands over to the live device
+	if v := r.In(4); v != 0x81 || r.Err() != nil {
+		t.Errorf("read after the journal = %02X, %v, want the live 81", v, r.Err())
+	}
+}
+
+func TestJournalDiverged(t *testing.T) {
+	for name, read := range map[string]struct {
+		port  uint16
+		cycle uint64
+	}{"port": {2, 10}, "cycle": {1, 11}} {
+		var cycles uint64
+		r := NewReplayIO(&counter{n: 0x80}, func() uint64 { return cycles }, record(t))
+		cycles = read.cycle
+		if v := r.In(read.port); v != 0x81 {
+			t.Errorf("%s: diverging read = %02X, want the live 81", name, v)
+		}
+		if err := r.Err(); err == nil || !strings.Contains(err.Error(), "diverged") {
+			t.Errorf("%s: Err = %v, want a divergence", name, err)
+		}
+		if due := r.Due(); due != nil || r.Done() {
+			t.Errorf("%s: replay carried on after diverging: %v", name, due)
+		}
+	}
+}
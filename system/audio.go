@@ -0,0 +1,92 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// beeperVolume is the peak sample value of the speaker output
+const beeperVolume = 0x2000
+
+// AudioCapture samples the beeper output at a fixed rate. Each sample is the
+// average speaker level over its period, which filters the fast toggling
+// of multi-channel beeper engines the way the speaker itself does. The AY
+// chip is not synthesised.
+type AudioCapture struct {
+	rate    int
+	period  float64 // T-states per sample
+	pos     float64 // T-states into the current sample
+	high    float64 // T-states the speaker was on during the current sample
+	samples []int16
+}
+
+// NewAudioCapture creates a capture producing rate samples per second of a
+// CPU running at clockHz
+func NewAudioCapture(rate int, clockHz float64) *AudioCapture {
+	return &AudioCapture{
+		rate:   rate,
+		period: clockHz / float64(rate),
+	}
+}
+
+// Advance adds tstates of output at the given speaker level
+func (a *AudioCapture) Advance(tstates int, level bool) {
+	t := float64(tstates)
+	for t > 0 {
+		n := min(t, a.period-a.pos)
+		if level {
+			a.high += n
+		}
+		a.pos += n
+		t -= n
+		if a.pos >= a.period {
+			v := (2*a.high/a.period - 1) * beeperVolume
+			a.samples = append(a.samples, int16(v))
+			a.pos, a.high = 0, 0
+		}
+	}
+}
+
+// SampleRate returns the number of samples per second
+func (a *AudioCapture) SampleRate() int {
+	return a.rate
+}
+
+// Samples returns the captured 16-bit mono samples
+func (a *AudioCapture) Samples() []int16 {
+	return a.samples
+}
+
+// Reset discards the captured samples
+func (a *AudioCapture) Reset() {
+	a.samples = a.samples[:0]
+	a.pos, a.high = 0, 0
+}
+
+// WriteWAV writes the captured samples as a 16-bit mono PCM WAV file
+func (a *AudioCapture) WriteWAV(w io.Writer) error {
+	data := make([]uint8, 2*len(a.samples))
+	for i, v := range a.samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(v))
+	}
+	return writeWAVData(w, a.rate, 1, 16, data)
+}
+
+// StartAudio starts capturing the beeper at the given sample rate,
+// discarding any previous capture
+func (s *Spectrum) StartAudio(rate int) error {
+	if rate <= 0 {
+		return fmt.Errorf("invalid audio sample rate %d", rate)
+	}
+	s.audio = NewAudioCapture(rate, s.model.ClockHz())
+	return nil
+}
+
+// StopAudio stops capturing and returns what was captured, or nil if no
+// capture was running
+func (s *Spectrum) StopAudio() *AudioCapture {
+	a := s.audio
+	s.audio = nil
+	return a
+}
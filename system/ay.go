@@ -0,0 +1,63 @@
+package system
+
+// ayRegisterMasks holds the implemented bits of each AY register; unused
+// bits read back as zero
+var ayRegisterMasks = [16]uint8{
+	0xFF, 0x0F, 0xFF, 0x0F, 0xFF, 0x0F, 0x1F, 0xFF,
+	0x1F, 0x1F, 0x1F, 0xFF, 0xFF, 0x0F, 0xFF, 0xFF,
+}
+
+// AY8912 holds the register state of the AY-3-8912 sound chip fitted to
+// 128K models (ports 0xFFFD select/read, 0xBFFD write)
+type AY8912 struct {
+	regs     [16]uint8
+	selected uint8
+}
+
+// NewAY8912 creates a sound chip with all registers cleared
+func NewAY8912() *AY8912 {
+	return &AY8912{}
+}
+
+// Reset clears all registers
+func (a *AY8912) Reset() {
+	a.regs = [16]uint8{}
+	a.selected = 0
+}
+
+// Select latches the register number for subsequent reads and writes
+func (a *AY8912) Select(reg uint8) {
+	a.selected = reg
+}
+
+// Selected returns the currently latched register number
+func (a *AY8912) Selected() uint8 {
+	return a.selected
+}
+
+// Write stores a value in the selected register
+func (a *AY8912) Write(value uint8) {
+	if a.selected < 16 {
+		a.regs[a.selected] = value & ayRegisterMasks[a.selected]
+	}
+}
+
+// Read returns the value of the selected register
+func (a *AY8912) Read() uint8 {
+	if a.selected < 16 {
+		return a.regs[a.selected]
+	}
+	return 0xFF
+}
+
+// Registers returns a copy of all sixteen registers
+func (a *AY8912) Registers() [16]uint8 {
+	return a.regs
+}
+
+// SetRegisters restores all sixteen registers
+func (a *AY8912) SetRegisters(regs [16]uint8) {
+	for i, v := range regs {
+		a.regs[i] = v & ayRegisterMasks[i]
+	}
+}
@@ -0,0 +1,136 @@
+package system
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CSW compression types
+const (
+	cswRLE  = 1
+	cswZRLE = 2
+)
+
+const cswSignature = "Compressed Square Wave\x1A"
+
+// LoadCSW decodes a Compressed Square Wave file (version 1 or 2, RLE or
+// Z-RLE) into a tape
+func LoadCSW(data []uint8) (*PulseTape, error) {
+	if len(data) < 0x20 || string(data[:len(cswSignature)]) != cswSignature {
+		return nil, fmt.Errorf("not a CSW file")
+	}
+
+	major := data[0x17]
+	var rate int
+	var compression uint8
+	var flags uint8
+	var body []uint8
+
+	switch major {
+	case 1:
+		rate = int(binary.LittleEndian.Uint16(data[0x19:]))
+		compression = data[0x1B]
+		flags = data[0x1C]
+		body = data[0x20:]
+	case 2:
+		if len(data) < 0x34 {
+			return nil, fmt.Errorf("CSW v2 header truncated")
+		}
+		rate = int(binary.LittleEndian.Uint32(data[0x19:]))
+		compression = data[0x21]
+		flags = data[0x22]
+		start := 0x34 + int(data[0x23]) // Skip the header extension
+		if start > len(data) {
+			return nil, fmt.Errorf("CSW v2 header extension truncated")
+		}
+		body = data[start:]
+	default:
+		return nil, fmt.Errorf("unsupported CSW version %d.%d", major, data[0x18])
+	}
+
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid CSW sample rate %d", rate)
+	}
+
+	switch compression {
+	case cswRLE:
+	case cswZRLE:
+		if major < 2 {
+			return nil, fmt.Errorf("Z-RLE compression requires CSW v2")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("CSW Z-RLE data: %w", err)
+		}
+		body, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("CSW Z-RLE data: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported CSW compression type %d", compression)
+	}
+
+	pulses, err := decodeCSWRLE(body, flags&0x01 != 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewPulseTape(rate, pulses), nil
+}
+
+// decodeCSWRLE expands CSW run-length data. Each byte is a pulse length in
+// samples; a zero byte introduces a 32-bit length for long pulses. The
+// signal toggles level after every pulse.
+func decodeCSWRLE(body []uint8, level bool) ([]Pulse, error) {
+	var b pulseBuilder
+	for i := 0; i < len(body); {
+		length := uint32(body[i])
+		i++
+		if length == 0 {
+			if i+4 > len(body) {
+				return nil, fmt.Errorf("CSW data truncated in long pulse")
+			}
+			length = binary.LittleEndian.Uint32(body[i:])
+			i += 4
+		}
+		b.add(length, level)
+		level = !level
+	}
+	return b.pulses, nil
+}
+
+// WriteCSW writes a tape as a CSW v2 file with Z-RLE compression
+func WriteCSW(w io.Writer, tape *PulseTape) error {
+	pulses := tape.Pulses()
+	var rle bytes.Buffer
+	for _, p := range pulses {
+		if p.Length < 256 {
+			rle.WriteByte(uint8(p.Length))
+			continue
+		}
+		var long [5]uint8
+		binary.LittleEndian.PutUint32(long[1:], p.Length)
+		rle.Write(long[:])
+	}
+
+	hdr := make([]uint8, 0x34)
+	copy(hdr, cswSignature)
+	hdr[0x17], hdr[0x18] = 2, 0
+	binary.LittleEndian.PutUint32(hdr[0x19:], uint32(tape.SampleRate()))
+	binary.LittleEndian.PutUint32(hdr[0x1D:], uint32(len(pulses)))
+	hdr[0x21] = cswZRLE
+	if len(pulses) > 0 && pulses[0].Level {
+		hdr[0x22] = 0x01
+	}
+	copy(hdr[0x24:], "zen80")
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(w)
+	if _, err := zw.Write(rle.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,284 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	zio "github.com/ha1tch/zen80/io"
+)
+
+// History keeps a Spectrum's recent past so that it can be rewound. Every
+// few frames it takes a keyframe: the machine state without RAM, the RAM
+// in 1K blocks shared with the previous keyframe wherever they are
+// unchanged, and the input journal from there to the next keyframe.
+// Going back restores the keyframe before the target and replays its
+// inputs up to the target, so any instruction in the window can be
+// reached exactly. Memory use is bounded by the number of keyframes kept.
+//
+// History records inputs with the machine's journal, so it cannot run
+// alongside StartJournal, ReplayJournal or RZX recording and playback.
+type History struct {
+	s         *Spectrum
+	opts      HistoryOptions
+	keyframes []*keyframe // Oldest first
+	frameEnds []uint64    // CPU cycles at each frame boundary since the oldest keyframe
+	frames    int         // Frames since the last keyframe
+}
+
+// HistoryOptions controls how much history is kept
+type HistoryOptions struct {
+	Interval  int // Frames between keyframes (default 50, a second)
+	Keyframes int // Keyframes kept (default 60)
+}
+
+// historyBlock is the granularity at which keyframes share RAM
+const historyBlock = 1024
+
+type keyframe struct {
+	cycles    uint64
+	state     []uint8   // SZX snapshot without the RAM pages
+	ram       [][]uint8 // 8 banks of 16K in historyBlock pieces, shared where unchanged
+	intRemain int
+	midFrame  bool
+	journal   *zio.Journal // Inputs from this keyframe to the next
+}
+
+// NewHistory starts recording a machine's history
+func NewHistory(s *Spectrum, opts HistoryOptions) (*History, error) {
+	if s.journal != nil || s.replay != nil || s.rzxPlay != nil || s.rzxRecord != nil {
+		return nil, fmt.Errorf("history cannot be recorded while a journal or RZX file is in use")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 50
+	}
+	if opts.Keyframes <= 0 {
+		opts.Keyframes = 60
+	}
+	h := &History{s: s, opts: opts}
+	if !s.midFrame {
+		h.frameEnds = append(h.frameEnds, s.CPU.Cycles)
+	}
+	h.keyframe()
+	s.AddFrameRecorder(h)
+	return h, nil
+}
+
+// Stop ends recording and releases the history
+func (h *History) Stop() {
+	h.s.RemoveFrameRecorder(h)
+	h.s.StopJournal()
+	h.keyframes, h.frameEnds = nil, nil
+}
+
+// RecordFrame notes the end of a frame and takes a keyframe when one is due
+func (h *History) RecordFrame(s *Spectrum) {
+	h.frameEnds = append(h.frameEnds, s.CPU.Cycles)
+	h.frames++
+	if h.frames >= h.opts.Interval {
+		h.keyframe()
+	}
+}
+
+// keyframe saves the machine state and starts a new input journal
+func (h *History) keyframe() {
+	s := h.s
+	var state bytes.Buffer
+	s.saveSZX(&state, false)
+	kf := &keyframe{
+		cycles:    s.CPU.Cycles,
+		state:     state.Bytes(),
+		ram:       make([][]uint8, 8*16384/historyBlock),
+		intRemain: s.intRemain,
+		midFrame:  s.midFrame,
+	}
+	var prev *keyframe
+	if n := len(h.keyframes); n > 0 {
+		prev = h.keyframes[n-1]
+	}
+	for i := range kf.ram {
+		bank, off := i/(16384/historyBlock), i%(16384/historyBlock)*historyBlock
+		block := s.memory.ram[bank][off : off+historyBlock]
+		if prev != nil && bytes.Equal(prev.ram[i], block) {
+			kf.ram[i] = prev.ram[i]
+		} else {
+			kf.ram[i] = append([]uint8(nil), block...)
+		}
+	}
+
+	s.journal = zio.NewRecordingIO(s.io, s.clock)
+	s.CPU.IO = s.journal
+	if s.CPU.INT {
+		s.journal.Record(zio.EventINT, 0, 1)
+	}
+	kf.journal = s.journal.Journal()
+
+	h.keyframes = append(h.keyframes, kf)
+	h.frames = 0
+	if len(h.keyframes) > h.opts.Keyframes {
+		h.keyframes = h.keyframes[1:]
+		oldest := h.keyframes[0].cycles
+		for len(h.frameEnds) > 0 && h.frameEnds[0] < oldest {
+			h.frameEnds = h.frameEnds[1:]
+		}
+	}
+}
+
+// Span returns the CPU cycle counts of the oldest point the history can
+// go back to and of the present
+func (h *History) Span() (oldest, now uint64) {
+	if len(h.keyframes) == 0 {
+		return h.s.CPU.Cycles, h.s.CPU.Cycles
+	}
+	return h.keyframes[0].cycles, h.s.CPU.Cycles
+}
+
+// Bytes returns the memory held by the history, counting shared RAM
+// blocks once
+func (h *History) Bytes() int {
+	seen := make(map[*uint8]bool)
+	n := 8 * len(h.frameEnds)
+	for _, kf := range h.keyframes {
+		n += len(kf.state) + 16*len(kf.journal.Events)
+		for _, b := range kf.ram {
+			if !seen[&b[0]] {
+				seen[&b[0]] = true
+				n += len(b)
+			}
+		}
+	}
+	return n
+}
+
+// Seek takes the machine back to the first instruction boundary at or
+// after the given CPU cycle count. Everything recorded after that point
+// is discarded and recording carries on from there.
+func (h *History) Seek(cycles uint64) error {
+	oldest, now := h.Span()
+	if cycles < oldest || cycles > now {
+		return fmt.Errorf("cycle %d is outside the history (%d to %d)", cycles, oldest, now)
+	}
+	i := len(h.keyframes) - 1
+	for i > 0 && h.keyframes[i].cycles > cycles {
+		i--
+	}
+	if err := h.replay(i, cycles, nil); err != nil {
+		return err
+	}
+	// The keyframe replayed from now ends here, where a new one starts
+	kf := h.keyframes[i]
+	rel := h.s.CPU.Cycles - kf.cycles
+	events := kf.journal.Events
+	for len(events) > 0 && events[len(events)-1].Cycles >= rel {
+		events = events[:len(events)-1]
+	}
+	kf.journal.Events = events
+	if rel == 0 {
+		i--
+	}
+	h.keyframes = h.keyframes[:i+1]
+	for n := len(h.frameEnds); n > 0 && h.frameEnds[n-1] > h.s.CPU.Cycles; n-- {
+		h.frameEnds = h.frameEnds[:n-1]
+	}
+	h.keyframe()
+	return nil
+}
+
+// StepBack goes back one instruction
+func (h *History) StepBack() error {
+	now := h.s.CPU.Cycles
+	i := len(h.keyframes) - 1
+	for i >= 0 && h.keyframes[i].cycles >= now {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("no history before cycle %d", now)
+	}
+	// Find the start of the last instruction before now, then go there
+	last := h.keyframes[i].cycles
+	if err := h.replay(i, now, func() {
+		if h.s.CPU.Cycles < now {
+			last = h.s.CPU.Cycles
+		}
+	}); err != nil {
+		return err
+	}
+	return h.Seek(last)
+}
+
+// FrameBack goes back n frames. Part way through a frame, the first one
+// goes back to the start of the current frame.
+func (h *History) FrameBack(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	starts := h.frameStarts()
+	if n > len(starts) {
+		return fmt.Errorf("only %d frames of history", len(starts))
+	}
+	return h.Seek(starts[len(starts)-n])
+}
+
+// Rewind goes back by an amount of emulated time to the start of a frame,
+// or as far as the history reaches
+func (h *History) Rewind(d time.Duration) error {
+	cfg := h.s.model.config()
+	frames := int(d.Seconds()*cfg.clockHz/float64(h.s.model.FrameCycles()) + 0.5)
+	return h.FrameBack(min(frames, len(h.frameStarts())))
+}
+
+// frameStarts returns the cycle counts at which the frames before the
+// present started
+func (h *History) frameStarts() []uint64 {
+	ends := h.frameEnds
+	for len(ends) > 0 && ends[len(ends)-1] >= h.s.CPU.Cycles {
+		ends = ends[:len(ends)-1]
+	}
+	return ends
+}
+
+// replay restores keyframe i and runs the machine on its journal until
+// the CPU cycle count reaches target, calling each after every instruction
+func (h *History) replay(i int, target uint64, each func()) error {
+	s := h.s
+	kf := h.keyframes[i]
+
+	// Nothing outside the machine may see or affect the replay
+	recorders, audio, unlimited := s.recorders, s.audio, s.timing.unlimited
+	typeQueue, typeHeld, typeWait := s.typeQueue, s.typeHeld, s.typeWait
+	s.recorders, s.audio, s.typeQueue, s.typeHeld, s.typeWait = nil, nil, nil, nil, 0
+	s.timing.unlimited = true
+	defer func() {
+		s.recorders, s.audio, s.timing.unlimited = recorders, audio, unlimited
+		s.typeQueue, s.typeHeld, s.typeWait = typeQueue, typeHeld, typeWait
+	}()
+
+	s.StopJournal()
+	if err := s.LoadSZX(kf.state); err != nil {
+		return fmt.Errorf("history keyframe: %w", err)
+	}
+	for j, b := range kf.ram {
+		bank, off := j/(16384/historyBlock), j%(16384/historyBlock)*historyBlock
+		copy(s.memory.ram[bank][off:], b)
+	}
+	s.CPU.Cycles = kf.cycles
+	s.intRemain, s.midFrame = kf.intRemain, kf.midFrame
+
+	s.replay = zio.NewReplayIO(s.io, s.clock, kf.journal)
+	s.CPU.IO = s.replay
+	stop := func() bool {
+		if each != nil {
+			each()
+		}
+		return s.CPU.Cycles >= target
+	}
+	for s.CPU.Cycles < target {
+		s.RunFrameUntil(stop)
+	}
+	err := s.replay.Err()
+	s.StopJournal()
+	if err != nil {
+		return fmt.Errorf("history replay: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func snapshotSZX(t *testing.T, s *Spectrum) []uint8 {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := s.SaveSZX(&buf); err != nil {
+		t.Fatalf("SaveSZX: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHistoryRewind(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	h, err := NewHistory(s, HistoryOptions{Interval: 10, Keyframes: 4})
+	if err != nil {
+		t.Fatalf("NewHistory: %v", err)
+	}
+	defer h.Stop()
+
+	// Type into the editor so the history has inputs to replay
+	var saved []uint8
+	var savedCycles uint64
+	for i := 0; i < 35; i++ {
+		switch i {
+		case 3:
+			s.PressKey(2, 3) // R
+		case 6:
+			s.ReleaseKey(2, 3)
+		case 12:
+			saved, savedCycles = snapshotSZX(t, s), s.CPU.Cycles
+		}
+		s.RunFrame()
+	}
+	if len(h.keyframes) > 4 {
+		t.Errorf("%d keyframes kept, want at most 4", len(h.keyframes))
+	}
+	if full := 4 * 3 * 16384; h.Bytes() >= full {
+		t.Errorf("history holds %d bytes, RAM is not being shared", h.Bytes())
+	}
+
+	if err := h.FrameBack(35 - 12); err != nil {
+		t.Fatalf("FrameBack: %v", err)
+	}
+	if s.CPU.Cycles != savedCycles {
+		t.Fatalf("at cycle %d, want %d", s.CPU.Cycles, savedCycles)
+	}
+	if !bytes.Equal(snapshotSZX(t, s), saved) {
+		t.Error("machine state after FrameBack differs from the one saved")
+	}
+	if err := h.FrameBack(100); err == nil {
+		t.Error("FrameBack past the start of the history succeeded")
+	}
+
+	// Recording carries on from the new present
+	for i := 0; i < 5; i++ {
+		s.RunFrame()
+	}
+	if err := h.Rewind(time.Hour); err != nil {
+		t.Fatalf("Rewind: %v", err)
+	}
+	if oldest, now := h.Span(); now != oldest {
+		t.Errorf("Rewind stopped at %d, history starts at %d", now, oldest)
+	}
+}
+
+func TestHistoryStepBack(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 100; i++ {
+		s.RunFrame()
+	}
+	h, err := NewHistory(s, HistoryOptions{Interval: 2})
+	if err != nil {
+		t.Fatalf("NewHistory: %v", err)
+	}
+	defer h.Stop()
+	s.RunFrame()
+
+	type state struct {
+		cycles         uint64
+		pc, sp, af, hl uint16
+	}
+	capture := func() state {
+		c := s.CPU
+		return state{c.Cycles, c.PC, c.SP, c.AF(), c.HL()}
+	}
+	var states []state
+	s.RunFrameUntil(func() bool {
+		states = append(states, capture())
+		return len(states) == 5000
+	})
+
+	for back := 1; back <= 3; back++ {
+		if err := h.StepBack(); err != nil {
+			t.Fatalf("StepBack: %v", err)
+		}
+		if got, want := capture(), states[len(states)-1-back]; got != want {
+			t.Fatalf("after %d steps back: %+v, want %+v", back, got, want)
+		}
+	}
+	if err := h.Seek(states[100].cycles); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got := capture(); got != states[100] {
+		t.Errorf("Seek: %+v, want %+v", got, states[100])
+	}
+}
@@ -0,0 +1,222 @@
+package system
+
+import "fmt"
+
+// InputDevice is a peripheral that answers port reads: a joystick
+// interface, a mouse, or anything else plugged into the expansion port.
+type InputDevice interface {
+	// In returns the value the device drives for a port read and whether
+	// it decodes the port at all. On ULA reads (even ports) the value is
+	// combined with the keyboard, so keyboard-mapped devices return 0xFF
+	// with the bits of their pressed keys cleared.
+	In(port uint16) (uint8, bool)
+}
+
+// AttachDevice plugs an input device into the machine
+func (s *Spectrum) AttachDevice(d InputDevice) {
+	s.io.devices = append(s.io.devices, d)
+}
+
+// DetachDevice unplugs an input device
+func (s *Spectrum) DetachDevice(d InputDevice) {
+	for i, dev := range s.io.devices {
+		if dev == d {
+			s.io.devices = append(s.io.devices[:i], s.io.devices[i+1:]...)
+			return
+		}
+	}
+}
+
+// Devices returns the attached input devices
+func (s *Spectrum) Devices() []InputDevice {
+	return s.io.devices
+}
+
+// JoystickType selects how a joystick is wired to the machine
+type JoystickType int
+
+const (
+	JoystickKempston      JoystickType = iota // Port 0x1F, active high
+	JoystickSinclairLeft                      // Interface 2 left socket: keys 1-5
+	JoystickSinclairRight                     // Interface 2 right socket: keys 6-0
+	JoystickCursor                            // Cursor/Protek/AGF: keys 5-8 and 0
+	JoystickFuller                            // Fuller Box port 0x7F, active low
+)
+
+var joystickNames = map[JoystickType]string{
+	JoystickKempston:      "Kempston",
+	JoystickSinclairLeft:  "Sinclair left",
+	JoystickSinclairRight: "Sinclair right",
+	JoystickCursor:        "Cursor",
+	JoystickFuller:        "Fuller",
+}
+
+// String returns the joystick interface name
+func (t JoystickType) String() string {
+	if name, ok := joystickNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("JoystickType(%d)", int(t))
+}
+
+// JoystickButtons is a set of joystick directions and the fire button
+type JoystickButtons uint8
+
+const (
+	JoyRight JoystickButtons = 1 << iota
+	JoyLeft
+	JoyDown
+	JoyUp
+	JoyFire
+)
+
+// joystickKeys gives the keys a keyboard-mapped joystick presses, in
+// right, left, down, up, fire order
+var joystickKeys = map[JoystickType][5]Key{
+	JoystickSinclairLeft:  {Key2, Key1, Key3, Key4, Key5},
+	JoystickSinclairRight: {Key7, Key6, Key8, Key9, Key0},
+	JoystickCursor:        {Key8, Key5, Key6, Key7, Key0},
+}
+
+// Joystick is a joystick on one of the supported interfaces
+type Joystick struct {
+	kind    JoystickType
+	buttons JoystickButtons
+}
+
+// NewJoystick creates a joystick wired to the given interface
+func NewJoystick(kind JoystickType) *Joystick {
+	return &Joystick{kind: kind}
+}
+
+// AttachJoystick creates a joystick of the given type and plugs it in
+func (s *Spectrum) AttachJoystick(kind JoystickType) *Joystick {
+	j := NewJoystick(kind)
+	s.AttachDevice(j)
+	return j
+}
+
+// Type returns the interface the joystick is wired to
+func (j *Joystick) Type() JoystickType {
+	return j.kind
+}
+
+// Set replaces the joystick state
+func (j *Joystick) Set(buttons JoystickButtons) {
+	j.buttons = buttons
+}
+
+// Press holds the given directions or fire
+func (j *Joystick) Press(buttons JoystickButtons) {
+	j.buttons |= buttons
+}
+
+// Release lets go of the given directions or fire
+func (j *Joystick) Release(buttons JoystickButtons) {
+	j.buttons &^= buttons
+}
+
+// Buttons returns what is currently held
+func (j *Joystick) Buttons() JoystickButtons {
+	return j.buttons
+}
+
+// In implements InputDevice
+func (j *Joystick) In(port uint16) (uint8, bool) {
+	switch j.kind {
+	case JoystickKempston:
+		if port&0xFF == 0x1F {
+			return uint8(j.buttons), true
+		}
+	case JoystickFuller:
+		if port&0xFF == 0x7F {
+			var v uint8 = 0xFF
+			if j.buttons&JoyUp != 0 {
+				v &^= 0x01
+			}
+			if j.buttons&JoyDown != 0 {
+				v &^= 0x02
+			}
+			if j.buttons&JoyLeft != 0 {
+				v &^= 0x04
+			}
+			if j.buttons&JoyRight != 0 {
+				v &^= 0x08
+			}
+			if j.buttons&JoyFire != 0 {
+				v &^= 0x80
+			}
+			return v, true
+		}
+	default:
+		if port&0x01 != 0 {
+			return 0, false
+		}
+		var v uint8 = 0xFF
+		for i, k := range joystickKeys[j.kind] {
+			if j.buttons&(1<<i) != 0 && port&(1<<(k.Row()+8)) == 0 {
+				v &^= 1 << k.Col()
+			}
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+// KempstonMouse is a Kempston mouse interface. The position counters wrap
+// at 8 bits; software tracks movement from the change between reads.
+type KempstonMouse struct {
+	x, y        uint8
+	left, right bool
+}
+
+// NewKempstonMouse creates a Kempston mouse with both buttons released
+func NewKempstonMouse() *KempstonMouse {
+	return &KempstonMouse{}
+}
+
+// AttachKempstonMouse creates a Kempston mouse and plugs it in
+func (s *Spectrum) AttachKempstonMouse() *KempstonMouse {
+	m := NewKempstonMouse()
+	s.AttachDevice(m)
+	return m
+}
+
+// Move moves the mouse by dx, dy. Positive dy moves up, as the interface
+// counts.
+func (m *KempstonMouse) Move(dx, dy int) {
+	m.x += uint8(dx)
+	m.y += uint8(dy)
+}
+
+// Position returns the raw X and Y counters
+func (m *KempstonMouse) Position() (x, y uint8) {
+	return m.x, m.y
+}
+
+// SetButtons sets the state of the mouse buttons
+func (m *KempstonMouse) SetButtons(left, right bool) {
+	m.left, m.right = left, right
+}
+
+// In implements InputDevice for ports 0xFBDF (X), 0xFFDF (Y) and 0xFADF
+// (buttons, active low). A7 is decoded too, so that a Kempston joystick
+// on 0x1F can share the bus.
+func (m *KempstonMouse) In(port uint16) (uint8, bool) {
+	switch {
+	case port&0x05A1 == 0x0181:
+		return m.x, true
+	case port&0x05A1 == 0x0581:
+		return m.y, true
+	case port&0x01A1 == 0x0081:
+		var v uint8 = 0xFF
+		if m.right {
+			v &^= 0x01
+		}
+		if m.left {
+			v &^= 0x02
+		}
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package system
+
+import "testing"
+
+func TestJoystickInterfaces(t *testing.T) {
+	s := NewSpectrum()
+	if v := s.io.In(0x001F); v != 0xFF {
+		t.Errorf("port 0x1F without a Kempston = %02X, want FF", v)
+	}
+
+	kempston := s.AttachJoystick(JoystickKempston)
+	kempston.Press(JoyUp | JoyFire)
+	if v := s.io.In(0x001F); v != 0x18 {
+		t.Errorf("Kempston = %02X, want 18", v)
+	}
+
+	fuller := s.AttachJoystick(JoystickFuller)
+	fuller.Set(JoyLeft | JoyFire)
+	if v := s.io.In(0x007F); v != 0x7B {
+		t.Errorf("Fuller = %02X, want 7B", v)
+	}
+
+	// Sinclair left fire is key 5 on half-row 0xF7FE; right fire is 0 on 0xEFFE
+	left := s.AttachJoystick(JoystickSinclairLeft)
+	right := s.AttachJoystick(JoystickSinclairRight)
+	left.Press(JoyFire)
+	if v := s.io.In(0xF7FE) & 0x1F; v != 0x0F {
+		t.Errorf("Sinclair left fire row = %02X, want 0F", v)
+	}
+	if v := s.io.In(0xEFFE) & 0x1F; v != 0x1F {
+		t.Errorf("Sinclair left fire leaked into 6-0 row: %02X", v)
+	}
+	right.Press(JoyUp)
+	if v := s.io.In(0xEFFE) & 0x1F; v != 0x1D {
+		t.Errorf("Sinclair right up row = %02X, want 1D", v)
+	}
+
+	cursor := s.AttachJoystick(JoystickCursor)
+	cursor.Press(JoyLeft)
+	if v := s.io.In(0xF7FE) & 0x1F; v != 0x0F {
+		t.Errorf("Cursor left row = %02X, want 0F", v)
+	}
+	s.DetachDevice(left)
+	if v := s.io.In(0xF7FE) & 0x1F; v != 0x0F {
+		t.Errorf("row after detaching Sinclair = %02X, want 0F (cursor left)", v)
+	}
+}
+
+func TestKempstonMouse(t *testing.T) {
+	s := NewSpectrum()
+	m := s.AttachKempstonMouse()
+	m.Move(10, -3)
+	m.SetButtons(true, false)
+	if x, y := s.io.In(0xFBDF), s.io.In(0xFFDF); x != 10 || y != 253 {
+		t.Errorf("mouse position = %d,%d, want 10,253", x, y)
+	}
+	if b := s.io.In(0xFADF); b != 0xFD {
+		t.Errorf("mouse buttons = %02X, want FD", b)
+	}
+}
+
+func TestKempstonMouseAndJoystick(t *testing.T) {
+	s := NewSpectrum()
+	s.AttachKempstonMouse().SetButtons(false, true)
+	s.AttachJoystick(JoystickKempston).Press(JoyFire)
+	for _, port := range []uint16{0x001F, 0xFA1F, 0xFF1F} {
+		if v := s.io.In(port); v != 0x10 {
+			t.Errorf("Kempston joystick on %04X = %02X, want 10", port, v)
+		}
+	}
+	if b := s.io.In(0xFADF); b != 0xFE {
+		t.Errorf("mouse buttons = %02X, want FE", b)
+	}
+
+	if chunks := saveSZXMouse(s); len(chunks) != 1 || len(chunks[0]) != 7 {
+		t.Errorf("AMXM chunk = %v, want one 7-byte body", chunks)
+	}
+}
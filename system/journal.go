@@ -0,0 +1,119 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+
+	zio "github.com/ha1tch/zen80/io"
+)
+
+// StartJournal starts recording an input journal: every port read, the
+// INT line and key presses, timestamped in CPU cycles. The journal starts
+// with an SZX snapshot so it can be replayed on a fresh machine.
+func (s *Spectrum) StartJournal() error {
+	var snap bytes.Buffer
+	if err := s.SaveSZX(&snap); err != nil {
+		return err
+	}
+	s.StopJournal()
+	s.journal = zio.NewRecordingIO(s.io, s.clock)
+	s.journal.Journal().Snapshot = snap.Bytes()
+	s.CPU.IO = s.journal
+	if s.CPU.INT {
+		s.journal.Record(zio.EventINT, 0, 1)
+	}
+	return nil
+}
+
+// StopJournal ends journal recording or replay. It returns the recorded
+// journal, or nil if none was being recorded.
+func (s *Spectrum) StopJournal() *zio.Journal {
+	var j *zio.Journal
+	if s.journal != nil {
+		j = s.journal.Journal()
+	}
+	s.journal = nil
+	s.replay = nil
+	s.CPU.IO = s.io
+	return j
+}
+
+// ReplayJournal restores the journal's snapshot and replays its inputs.
+// Progress and divergence are reported by JournalReplaying and
+// JournalError.
+func (s *Spectrum) ReplayJournal(j *zio.Journal) error {
+	s.StopJournal()
+	if len(j.Snapshot) > 0 {
+		if err := s.LoadSZX(j.Snapshot); err != nil {
+			return fmt.Errorf("journal snapshot: %w", err)
+		}
+	}
+	s.replay = zio.NewReplayIO(s.io, s.clock, j)
+	s.CPU.IO = s.replay
+	return nil
+}
+
+// JournalReplaying reports whether a journal replay still has entries
+// left and has not diverged
+func (s *Spectrum) JournalReplaying() bool {
+	return s.replay != nil && !s.replay.Done() && s.replay.Err() == nil
+}
+
+// JournalError returns the divergence that interrupted the current replay
+func (s *Spectrum) JournalError() error {
+	if s.replay == nil {
+		return nil
+	}
+	return s.replay.Err()
+}
+
+// clock returns the CPU cycle count used to timestamp journal events
+func (s *Spectrum) clock() uint64 {
+	return s.CPU.Cycles
+}
+
+// setINT drives the CPU's INT line, journaling changes
+func (s *Spectrum) setINT(level bool) {
+	if s.journal != nil && s.CPU.INT != level {
+		var v uint8
+		if level {
+			v = 1
+		}
+		s.journal.Record(zio.EventINT, 0, v)
+	}
+	s.CPU.INT = level
+}
+
+// journalKey records a key matrix change; the key code is row<<8 | column
+func (s *Spectrum) journalKey(row, col uint8, pressed bool) {
+	if s.journal == nil {
+		return
+	}
+	var v uint8
+	if pressed {
+		v = 1
+	}
+	s.journal.Record(zio.EventKey, uint16(row)<<8|uint16(col), v)
+}
+
+// applyJournalEvents applies the injected events due before the next
+// instruction of a replay
+func (s *Spectrum) applyJournalEvents() {
+	for _, e := range s.replay.Due() {
+		switch e.Kind {
+		case zio.EventINT:
+			s.CPU.INT = e.Value != 0
+		case zio.EventNMI:
+			s.CPU.NMI = e.Value != 0
+		case zio.EventKey:
+			row, col := uint8(e.Port>>8), uint8(e.Port)
+			if row < 8 && col < 5 {
+				if e.Value != 0 {
+					s.io.keyboard[row] &^= 1 << col
+				} else {
+					s.io.keyboard[row] |= 1 << col
+				}
+			}
+		}
+	}
+}
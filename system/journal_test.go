@@ -0,0 +1,69 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+
+	zio "github.com/ha1tch/zen80/io"
+)
+
+func TestJournalReplay(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+
+	if err := s.StartJournal(); err != nil {
+		t.Fatalf("StartJournal: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		switch i {
+		case 5:
+			s.PressKey(2, 3) // R
+		case 10:
+			s.ReleaseKey(2, 3)
+		}
+		s.RunFrame()
+	}
+	j := s.StopJournal()
+
+	var buf bytes.Buffer
+	if _, err := j.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	parsed, err := zio.ReadJournal(&buf)
+	if err != nil {
+		t.Fatalf("ReadJournal: %v", err)
+	}
+	if len(parsed.Events) != len(j.Events) || !bytes.Equal(parsed.Snapshot, j.Snapshot) {
+		t.Fatalf("journal changed in encoding: %d events, want %d", len(parsed.Events), len(j.Events))
+	}
+	var keys int
+	for _, e := range parsed.Events {
+		if e.Kind == zio.EventKey {
+			keys++
+		}
+	}
+	if keys != 2 {
+		t.Errorf("journal has %d key events, want 2", keys)
+	}
+
+	p := newTestSpectrum(t)
+	if err := p.ReplayJournal(parsed); err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+	for i := 0; i < 60 && p.JournalReplaying(); i++ {
+		p.RunFrame()
+	}
+	if err := p.JournalError(); err != nil {
+		t.Fatalf("replay diverged: %v", err)
+	}
+	if p.JournalReplaying() {
+		t.Fatalf("replay did not finish")
+	}
+
+	eline := uint16(s.memory.Read(23641)) | uint16(s.memory.Read(23642))<<8
+	if got, want := p.memory.Read(eline), s.memory.Read(eline); want != 0xF7 || got != want {
+		t.Errorf("edit line starts with %02X, want %02X (RUN)", got, want)
+	}
+}
@@ -0,0 +1,394 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Key is a key on the Spectrum keyboard, numbered by its position in the
+// matrix: half-row * 5 + bit
+type Key uint8
+
+// Keys in matrix order. Half-row n is read with address line A(8+n) low.
+const (
+	KeyCapsShift Key = iota // Half-row 0 (0xFEFE)
+	KeyZ
+	KeyX
+	KeyC
+	KeyV
+	KeyA // Half-row 1 (0xFDFE)
+	KeyS
+	KeyD
+	KeyF
+	KeyG
+	KeyQ // Half-row 2 (0xFBFE)
+	KeyW
+	KeyE
+	KeyR
+	KeyT
+	Key1 // Half-row 3 (0xF7FE)
+	Key2
+	Key3
+	Key4
+	Key5
+	Key0 // Half-row 4 (0xEFFE)
+	Key9
+	Key8
+	Key7
+	Key6
+	KeyP // Half-row 5 (0xDFFE)
+	KeyO
+	KeyI
+	KeyU
+	KeyY
+	KeyEnter // Half-row 6 (0xBFFE)
+	KeyL
+	KeyK
+	KeyJ
+	KeyH
+	KeySpace // Half-row 7 (0x7FFE)
+	KeySymbolShift
+	KeyM
+	KeyN
+	KeyB
+
+	NumKeys = 40
+)
+
+var keyNames = [NumKeys]string{
+	"CapsShift", "Z", "X", "C", "V",
+	"A", "S", "D", "F", "G",
+	"Q", "W", "E", "R", "T",
+	"1", "2", "3", "4", "5",
+	"0", "9", "8", "7", "6",
+	"P", "O", "I", "U", "Y",
+	"Enter", "L", "K", "J", "H",
+	"Space", "SymbolShift", "M", "N", "B",
+}
+
+// Row returns the keyboard half-row holding the key
+func (k Key) Row() uint8 {
+	return uint8(k) / 5
+}
+
+// Col returns the key's bit within its half-row
+func (k Key) Col() uint8 {
+	return uint8(k) % 5
+}
+
+// String returns the key's name
+func (k Key) String() string {
+	if k < NumKeys {
+		return keyNames[k]
+	}
+	return fmt.Sprintf("Key(%d)", uint8(k))
+}
+
+// ParseKey returns the key with the given name (case-insensitive)
+func ParseKey(name string) (Key, bool) {
+	for i, n := range keyNames {
+		if strings.EqualFold(n, name) {
+			return Key(i), true
+		}
+	}
+	return 0, false
+}
+
+// KeyDown presses a key
+func (s *Spectrum) KeyDown(k Key) {
+	s.PressKey(k.Row(), k.Col())
+}
+
+// KeyUp releases a key
+func (s *Spectrum) KeyUp(k Key) {
+	s.ReleaseKey(k.Row(), k.Col())
+}
+
+// ReleaseAllKeys releases every key on the keyboard
+func (s *Spectrum) ReleaseAllKeys() {
+	for k := Key(0); k < NumKeys; k++ {
+		s.KeyUp(k)
+	}
+}
+
+// symbolShiftKeys maps characters typed with Symbol Shift to their key
+var symbolShiftKeys = map[rune]Key{
+	'!': Key1, '@': Key2, '#': Key3, '$': Key4, '%': Key5,
+	'&': Key6, '\'': Key7, '(': Key8, ')': Key9, '_': Key0,
+	'<': KeyR, '>': KeyT, ';': KeyO, '"': KeyP, '=': KeyL,
+	'+': KeyK, '-': KeyJ, '^': KeyH, ':': KeyZ, '£': KeyX,
+	'?': KeyC, '/': KeyV, '*': KeyB, ',': KeyN, '.': KeyM,
+}
+
+// KeysForRune returns the key combination that types a character:
+// letters and digits directly, capitals with Caps Shift and punctuation
+// with Symbol Shift. Newline is Enter and backspace is DELETE.
+func KeysForRune(r rune) ([]Key, bool) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		k, _ := ParseKey(string(unicode.ToUpper(r)))
+		return []Key{k}, true
+	case r >= 'A' && r <= 'Z':
+		k, _ := ParseKey(string(r))
+		return []Key{KeyCapsShift, k}, true
+	case r >= '0' && r <= '9':
+		k, _ := ParseKey(string(r))
+		return []Key{k}, true
+	case r == ' ':
+		return []Key{KeySpace}, true
+	case r == '\n' || r == '\r':
+		return []Key{KeyEnter}, true
+	case r == '\b' || r == 0x7F:
+		return []Key{KeyCapsShift, Key0}, true
+	}
+	if k, ok := symbolShiftKeys[r]; ok {
+		return []Key{KeySymbolShift, k}, true
+	}
+	return nil, false
+}
+
+// hostKeys maps host keyboard keys without a character to Spectrum
+// combinations
+var hostKeys = map[string][]Key{
+	"backspace": {KeyCapsShift, Key0},
+	"delete":    {KeyCapsShift, Key0},
+	"left":      {KeyCapsShift, Key5},
+	"down":      {KeyCapsShift, Key6},
+	"up":        {KeyCapsShift, Key7},
+	"right":     {KeyCapsShift, Key8},
+	"escape":    {KeyCapsShift, KeySpace}, // BREAK
+	"tab":       {KeyCapsShift, KeySymbolShift},
+	"capslock":  {KeyCapsShift, Key2},
+	"edit":      {KeyCapsShift, Key1},
+	"graphics":  {KeyCapsShift, Key9},
+	"enter":     {KeyEnter},
+	"return":    {KeyEnter},
+	"shift":     {KeyCapsShift},
+	"ctrl":      {KeySymbolShift},
+	"alt":       {KeySymbolShift},
+}
+
+// KeysForHostKey returns the combination for a named host key such as
+// "backspace", "left" or "escape"
+func KeysForHostKey(name string) ([]Key, bool) {
+	keys, ok := hostKeys[strings.ToLower(name)]
+	return keys, ok
+}
+
+// Timing for TypeText, in frames. The ROM registers a key on the first
+// scan that sees it, but only frees its slot for the same key again after
+// five interrupts without it.
+const (
+	typeHoldFrames    = 2
+	typeReleaseFrames = 6
+)
+
+// Keywords 48 BASIC enters with single keys. Statement keywords take one
+// key in K mode; the rest take Symbol Shift, or a key in extended mode (E,
+// reached with Caps Shift and Symbol Shift together) with or without
+// Symbol Shift.
+var (
+	keywordKeys = map[string]Key{
+		"NEW": KeyA, "BORDER": KeyB, "CONTINUE": KeyC, "DIM": KeyD, "REM": KeyE,
+		"FOR": KeyF, "GO TO": KeyG, "GO SUB": KeyH, "INPUT": KeyI, "LOAD": KeyJ,
+		"LIST": KeyK, "LET": KeyL, "PAUSE": KeyM, "NEXT": KeyN, "POKE": KeyO,
+		"PRINT": KeyP, "PLOT": KeyQ, "RUN": KeyR, "SAVE": KeyS, "RANDOMIZE": KeyT,
+		"IF": KeyU, "CLS": KeyV, "DRAW": KeyW, "CLEAR": KeyX, "RETURN": KeyY,
+		"COPY": KeyZ,
+	}
+	symbolKeywords = map[string]Key{
+		"STOP": KeyA, "STEP": KeyD, ">=": KeyE, "TO": KeyF, "THEN": KeyG,
+		"AT": KeyI, "<=": KeyQ, "NOT": KeyS, "OR": KeyU, "<>": KeyW, "AND": KeyY,
+	}
+	extendedKeywords = map[string]Key{
+		"READ": KeyA, "BIN": KeyB, "LPRINT": KeyC, "DATA": KeyD, "TAN": KeyE,
+		"SGN": KeyF, "ABS": KeyG, "SQR": KeyH, "CODE": KeyI, "VAL": KeyJ,
+		"LEN": KeyK, "USR": KeyL, "PI": KeyM, "INKEY$": KeyN, "PEEK": KeyO,
+		"TAB": KeyP, "SIN": KeyQ, "INT": KeyR, "RESTORE": KeyS, "RND": KeyT,
+		"CHR$": KeyU, "LLIST": KeyV, "COS": KeyW, "EXP": KeyX, "STR$": KeyY,
+		"LN": KeyZ,
+	}
+	extendedSymbolKeywords = map[string]Key{
+		"BRIGHT": KeyB, "PAPER": KeyC, "ATN": KeyE, "CIRCLE": KeyH, "IN": KeyI,
+		"VAL$": KeyJ, "SCREEN$": KeyK, "ATTR": KeyL, "INVERSE": KeyM, "OVER": KeyN,
+		"OUT": KeyO, "ASN": KeyQ, "VERIFY": KeyR, "MERGE": KeyT, "FLASH": KeyV,
+		"ACS": KeyW, "INK": KeyX, "BEEP": KeyZ,
+		"FORMAT": Key0, "DEF FN": Key1, "FN": Key2, "LINE": Key3, "OPEN #": Key4,
+		"CLOSE #": Key5, "MOVE": Key6, "ERASE": Key7, "POINT": Key8, "CAT": Key9,
+	}
+)
+
+// extendedSymbolChars maps the characters typed in E mode with Symbol
+// Shift to their key
+var extendedSymbolChars = map[rune]Key{
+	'~': KeyA, '\\': KeyD, '{': KeyF, '}': KeyG, '©': KeyP, '|': KeyS,
+	']': KeyU, '[': KeyY,
+}
+
+// extendedMode is the key combination that enters E mode
+var extendedMode = []Key{KeyCapsShift, KeySymbolShift}
+
+// typedKeyword is a 48 BASIC keyword and the key strokes that enter it
+type typedKeyword struct {
+	text      string
+	strokes   [][]Key
+	statement bool // Entered in K mode, at the start of a statement
+}
+
+// typedKeywords lists every keyword, longest first so that "INKEY$" wins
+// over "INK" and "<=" over "<"
+var typedKeywords = func() []typedKeyword {
+	var list []typedKeyword
+	for kw, k := range keywordKeys {
+		list = append(list, typedKeyword{kw, [][]Key{{k}}, true})
+	}
+	for kw, k := range symbolKeywords {
+		list = append(list, typedKeyword{kw, [][]Key{{KeySymbolShift, k}}, false})
+	}
+	for kw, k := range extendedKeywords {
+		list = append(list, typedKeyword{kw, [][]Key{extendedMode, {k}}, false})
+	}
+	for kw, k := range extendedSymbolKeywords {
+		list = append(list, typedKeyword{kw, [][]Key{extendedMode, {KeySymbolShift, k}}, false})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].text) != len(list[j].text) {
+			return len(list[i].text) > len(list[j].text)
+		}
+		return list[i].text < list[j].text
+	})
+	return list
+}()
+
+// TypeText queues text to be typed on the keyboard, one key combination
+// every few frames while the machine runs. When 48 BASIC is paged in,
+// keywords outside strings and REM are entered the way 48 BASIC takes
+// them: statement keywords at the start of a statement ("LOAD", "PRINT",
+// ...) with their single K-mode key, the rest ("TO", "<=", "BEEP", ...)
+// with Symbol Shift or in extended mode. So TypeText("LOAD \"\"\n") works
+// as it reads. Characters with no key are reported as an error and
+// nothing is queued.
+func (s *Spectrum) TypeText(text string) error {
+	var strokes [][]Key
+	keywords := s.memory.romPage() == s.model.config().romPages-1
+	statement := true // At a position where 48 BASIC is in K mode
+	inString, rem := false, false
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if keywords && !inString && !rem {
+			if r == ' ' {
+				if statement {
+					continue // The ROM lays out statements itself
+				}
+				j := i
+				for j < len(runes) && runes[j] == ' ' {
+					j++
+				}
+				if kw, n := matchKeyword(runes, j, false); n > 0 && !kw.statement {
+					i = j - 1
+					continue // Keywords are printed with their own spaces
+				}
+			}
+			if kw, n := matchKeyword(runes, i, statement); n > 0 {
+				strokes = append(strokes, kw.strokes...)
+				i += n - 1
+				if i+1 < len(runes) && runes[i+1] == ' ' {
+					i++ // The ROM prints the space after a keyword itself
+				}
+				statement = kw.text == "THEN"
+				rem = kw.text == "REM"
+				continue
+			}
+			if k, ok := extendedSymbolChars[r]; ok {
+				strokes = append(strokes, extendedMode, []Key{KeySymbolShift, k})
+				statement = false
+				continue
+			}
+		}
+		keys, ok := KeysForRune(r)
+		if !ok {
+			return fmt.Errorf("no key for %q", r)
+		}
+		strokes = append(strokes, keys)
+		switch {
+		case r == '\n' || r == '\r':
+			statement, inString, rem = true, false, false
+		case r == '"' && !rem:
+			inString = !inString
+			statement = false
+		case r == ':' && !inString && !rem:
+			statement = true
+		case r >= '0' && r <= '9' || r == ' ':
+			// Line numbers and spaces leave the cursor in K mode
+		default:
+			statement = false
+		}
+	}
+	s.typeQueue = append(s.typeQueue, strokes...)
+	return nil
+}
+
+// QueueKeys queues one key combination to be pressed and released with
+// the same timing as a character typed by TypeText
+func (s *Spectrum) QueueKeys(keys ...Key) {
+	if len(keys) > 0 {
+		s.typeQueue = append(s.typeQueue, keys)
+	}
+}
+
+// matchKeyword returns the keyword at position i and its length.
+// Statement keywords only match where statement is set. A keyword may
+// follow a digit, as in FOR i=1TO 3, but not be part of a longer name.
+func matchKeyword(text []rune, i int, statement bool) (typedKeyword, int) {
+	for _, kw := range typedKeywords {
+		if kw.statement && !statement {
+			continue
+		}
+		n := len([]rune(kw.text))
+		if i+n > len(text) || !strings.EqualFold(string(text[i:i+n]), kw.text) {
+			continue
+		}
+		if unicode.IsLetter(rune(kw.text[0])) && i > 0 && unicode.IsLetter(text[i-1]) {
+			continue
+		}
+		last := rune(kw.text[len(kw.text)-1])
+		if unicode.IsLetter(last) && i+n < len(text) && (unicode.IsLetter(text[i+n]) || unicode.IsDigit(text[i+n])) {
+			continue // Part of a longer word, e.g. "LETTER"
+		}
+		return kw, n
+	}
+	return typedKeyword{}, 0
+}
+
+// Typing reports whether queued text is still being typed
+func (s *Spectrum) Typing() bool {
+	return len(s.typeQueue) > 0 || s.typeHeld != nil || s.typeWait > 0
+}
+
+// advanceTyping presses and releases queued keys, called once per frame
+func (s *Spectrum) advanceTyping() {
+	if s.typeWait > 0 {
+		s.typeWait--
+		return
+	}
+	if s.typeHeld != nil {
+		for _, k := range s.typeHeld {
+			s.KeyUp(k)
+		}
+		s.typeHeld = nil
+		s.typeWait = typeReleaseFrames - 1
+		return
+	}
+	if len(s.typeQueue) == 0 {
+		return
+	}
+	s.typeHeld = s.typeQueue[0]
+	s.typeQueue = s.typeQueue[1:]
+	for _, k := range s.typeHeld {
+		s.KeyDown(k)
+	}
+	s.typeWait = typeHoldFrames - 1
+}
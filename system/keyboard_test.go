@@ -0,0 +1,104 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyMatrixPositions(t *testing.T) {
+	tests := []struct {
+		key      Key
+		row, col uint8
+	}{
+		{KeyCapsShift, 0, 0}, {KeyA, 1, 0}, {KeyT, 2, 4}, {Key5, 3, 4},
+		{Key6, 4, 4}, {KeyP, 5, 0}, {KeyEnter, 6, 0}, {KeySymbolShift, 7, 1}, {KeyB, 7, 4},
+	}
+	for _, tt := range tests {
+		if tt.key.Row() != tt.row || tt.key.Col() != tt.col {
+			t.Errorf("%v at %d/%d, want %d/%d", tt.key, tt.key.Row(), tt.key.Col(), tt.row, tt.col)
+		}
+	}
+
+	keys, ok := KeysForRune('"')
+	if !ok || len(keys) != 2 || keys[0] != KeySymbolShift || keys[1] != KeyP {
+		t.Errorf("KeysForRune('\"') = %v", keys)
+	}
+	keys, ok = KeysForRune('Q')
+	if !ok || len(keys) != 2 || keys[0] != KeyCapsShift || keys[1] != KeyQ {
+		t.Errorf("KeysForRune('Q') = %v", keys)
+	}
+}
+
+func TestTypeTextEntersBASIC(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+
+	if err := s.TypeText("10 PRINT \"Hi\":GO TO 10\n"); err != nil {
+		t.Fatalf("TypeText: %v", err)
+	}
+	for i := 0; i < 1000 && s.Typing(); i++ {
+		s.RunFrame()
+	}
+	for i := 0; i < 10; i++ {
+		s.RunFrame()
+	}
+
+	prog := uint16(s.memory.Read(23635)) | uint16(s.memory.Read(23636))<<8
+	want := []uint8{
+		0x00, 0x0A, // Line 10
+		0, 0, // Length, not checked
+		0xF5, '"', 'H', 'i', '"', ':', 0xEC, '1', '0',
+	}
+	got := make([]uint8, len(want))
+	for i := range got {
+		got[i] = s.memory.Read(prog + uint16(i))
+	}
+	got[2], got[3] = 0, 0
+	if !bytes.Equal(got, want) {
+		t.Errorf("program = % X\nwant      % X", got, want)
+	}
+}
+
+func TestTypeTextKeywords(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+
+	text := "10 IF a <= 1 THEN BEEP 1,INT PI: PRINT AT 1,0;\"TO:\": REM OR\n"
+	if err := s.TypeText(text); err != nil {
+		t.Fatalf("TypeText: %v", err)
+	}
+	for i := 0; i < 2000 && s.Typing(); i++ {
+		s.RunFrame()
+	}
+	for i := 0; i < 10; i++ {
+		s.RunFrame()
+	}
+
+	// Read line 10 without the hidden forms of its numbers
+	prog := uint16(s.memory.Read(23635)) | uint16(s.memory.Read(23636))<<8
+	var got []uint8
+	for a := prog + 4; s.memory.Read(a) != 0x0D && len(got) < 64; a++ {
+		if c := s.memory.Read(a); c == 0x0E {
+			a += 5
+		} else {
+			got = append(got, c)
+		}
+	}
+	want := []uint8{
+		0xFA, 'a', 0xC7, '1', 0xCB, // IF a<=1 THEN
+		0xD7, '1', ',', 0xBA, 0xA7, ':', // BEEP 1,INT PI:
+		0xF5, 0xAC, '1', ',', '0', ';', '"', 'T', 'O', ':', '"', ':', // PRINT AT 1,0;"TO:":
+		0xEA, 'O', 'R', // REM OR
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("line = % X\nwant   % X", got, want)
+	}
+
+	if err := s.TypeText("PRINT \"é\""); err == nil {
+		t.Errorf("TypeText accepted a character with no key")
+	}
+}
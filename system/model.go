@@ -0,0 +1,176 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Model identifies the Spectrum hardware being emulated
+type Model int
+
+const (
+	Model48K      Model = iota // 48K Spectrum (also used for 16K/Spectrum+)
+	Model128K                  // Spectrum 128 with 0x7FFD paging
+	ModelPlus2                 // Grey +2: 128K hardware with a different ROM
+	ModelPlus2A                // +2A: +3 hardware without the disk drive
+	ModelPlus3                 // +3 with 0x1FFD paging and four ROM pages
+	ModelPentagon              // Pentagon 128 clone
+)
+
+// modelConfig holds the hardware parameters that differ between models
+type modelConfig struct {
+	name          string
+	clockHz       float64
+	cyclesPerLine int
+	linesPerFrame int
+	intLength     int  // T-states the frame interrupt is held for
+	romPages      int  // Number of 16K ROM pages
+	paging128     bool // 0x7FFD memory paging present
+	pagingPlus3   bool // 0x1FFD paging and +3 port decoding
+}
+
+var modelConfigs = map[Model]modelConfig{
+	Model48K: {
+		name:          "48K",
+		clockHz:       3500000,
+		cyclesPerLine: 224,
+		linesPerFrame: 312,
+		intLength:     32,
+		romPages:      1,
+	},
+	Model128K: {
+		name:          "128K",
+		clockHz:       3546900,
+		cyclesPerLine: 228,
+		linesPerFrame: 311,
+		intLength:     36,
+		romPages:      2,
+		paging128:     true,
+	},
+	ModelPlus2: {
+		name:          "+2",
+		clockHz:       3546900,
+		cyclesPerLine: 228,
+		linesPerFrame: 311,
+		intLength:     36,
+		romPages:      2,
+		paging128:     true,
+	},
+	ModelPlus2A: {
+		name:          "+2A",
+		clockHz:       3546900,
+		cyclesPerLine: 228,
+		linesPerFrame: 311,
+		intLength:     32,
+		romPages:      4,
+		paging128:     true,
+		pagingPlus3:   true,
+	},
+	ModelPlus3: {
+		name:          "+3",
+		clockHz:       3546900,
+		cyclesPerLine: 228,
+		linesPerFrame: 311,
+		intLength:     32,
+		romPages:      4,
+		paging128:     true,
+		pagingPlus3:   true,
+	},
+	ModelPentagon: {
+		name:          "Pentagon",
+		clockHz:       3500000,
+		cyclesPerLine: 224,
+		linesPerFrame: 320,
+		intLength:     32,
+		romPages:      2,
+		paging128:     true,
+	},
+}
+
+// String returns the model name
+func (m Model) String() string {
+	if cfg, ok := modelConfigs[m]; ok {
+		return cfg.name
+	}
+	return "unknown"
+}
+
+// config returns the hardware parameters for the model
+func (m Model) config() modelConfig {
+	if cfg, ok := modelConfigs[m]; ok {
+		return cfg
+	}
+	return modelConfigs[Model48K]
+}
+
+// ClockHz returns the CPU clock frequency of the model
+func (m Model) ClockHz() float64 {
+	return m.config().clockHz
+}
+
+// FrameCycles returns the number of T-states in one video frame
+func (m Model) FrameCycles() int {
+	cfg := m.config()
+	return cfg.cyclesPerLine * cfg.linesPerFrame
+}
+
+// modelNames maps the names ParseModel accepts to models
+var modelNames = map[string]Model{
+	"48":       Model48K,
+	"48k":      Model48K,
+	"128":      Model128K,
+	"128k":     Model128K,
+	"plus2":    ModelPlus2,
+	"+2":       ModelPlus2,
+	"plus2a":   ModelPlus2A,
+	"+2a":      ModelPlus2A,
+	"plus3":    ModelPlus3,
+	"+3":       ModelPlus3,
+	"pentagon": ModelPentagon,
+}
+
+// ParseModel returns the model with the given name: 48k, 128k, plus2,
+// plus2a, plus3 or pentagon, or 48, 128, +2, +2a or +3 (case-insensitive)
+func ParseModel(name string) (Model, error) {
+	m, ok := modelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown model %q", name)
+	}
+	return m, nil
+}
+
+// romFiles lists the ROM images each model needs, in page order
+var romFiles = map[Model][]string{
+	Model48K:      {"48.rom"},
+	Model128K:     {"128-0.rom", "128-1.rom"},
+	ModelPlus2:    {"plus2-0.rom", "plus2-1.rom"},
+	ModelPlus2A:   {"plus3-0.rom", "plus3-1.rom", "plus3-2.rom", "plus3-3.rom"},
+	ModelPlus3:    {"plus3-0.rom", "plus3-1.rom", "plus3-2.rom", "plus3-3.rom"},
+	ModelPentagon: {"128-0.rom", "128-1.rom"},
+}
+
+// ROMFiles returns the names of the ROM images the model needs, in page
+// order
+func (m Model) ROMFiles() []string {
+	return romFiles[m]
+}
+
+// NewSpectrumROMDir creates a machine of the given model with its ROM
+// images read from dir
+func NewSpectrumROMDir(model Model, dir string) (*Spectrum, error) {
+	var rom []uint8
+	for _, name := range model.ROMFiles() {
+		page, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		rom = append(rom, page...)
+	}
+	s := NewSpectrumModel(model)
+	if err := s.LoadROM(rom); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,446 @@
+package system
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RZX block IDs
+const (
+	rzxCreator      = 0x10
+	rzxSecurityInfo = 0x20
+	rzxSecuritySig  = 0x21
+	rzxSnapshot     = 0x30
+	rzxInput        = 0x80
+)
+
+// RZX block flags
+const (
+	rzxSnapshotExternal   = 0x01
+	rzxSnapshotCompressed = 0x02
+	rzxInputProtected     = 0x01
+	rzxInputCompressed    = 0x02
+)
+
+// rzxRepeatInputs in a frame's IN counter means "same values as the
+// previous frame"
+const rzxRepeatInputs = 0xFFFF
+
+// RZXFrame is the input recorded between two frame interrupts: the number
+// of opcode fetches executed and the value returned by every port read.
+type RZXFrame struct {
+	Fetches uint16
+	Inputs  []uint8
+}
+
+// RZXSegment is a run of frames, optionally preceded by the snapshot the
+// machine is restored from before playing them
+type RZXSegment struct {
+	SnapshotFormat string  // "z80", "sna" or "szx"; empty when there is no snapshot
+	Snapshot       []uint8 // Snapshot file contents
+	Tstates        uint32  // Frame T-state counter when the first frame starts
+	Frames         []RZXFrame
+}
+
+// RZX is an input recording
+type RZX struct {
+	Creator  string
+	Segments []RZXSegment
+}
+
+// ParseRZX decodes an RZX file. Security blocks are skipped; encrypted
+// input blocks are rejected.
+func ParseRZX(data []uint8) (*RZX, error) {
+	if len(data) < 10 || string(data[:4]) != "RZX!" {
+		return nil, fmt.Errorf("not an RZX file")
+	}
+
+	r := &RZX{}
+	for pos := 10; pos < len(data); {
+		if pos+5 > len(data) {
+			return nil, fmt.Errorf("RZX block header truncated at offset %d", pos)
+		}
+		id := data[pos]
+		length := int(binary.LittleEndian.Uint32(data[pos+1:]))
+		if length < 5 || length > len(data)-pos {
+			return nil, fmt.Errorf("RZX block %02X at offset %d has invalid length %d", id, pos, length)
+		}
+		body := data[pos+5 : pos+length]
+		pos += length
+
+		switch id {
+		case rzxCreator:
+			if len(body) >= 20 {
+				r.Creator = strings.TrimRight(string(body[:20]), "\x00")
+			}
+		case rzxSecurityInfo, rzxSecuritySig:
+			// Signatures are not verified
+		case rzxSnapshot:
+			seg, err := parseRZXSnapshot(body)
+			if err != nil {
+				return nil, err
+			}
+			r.Segments = append(r.Segments, seg)
+		case rzxInput:
+			tstates, frames, err := parseRZXInput(body)
+			if err != nil {
+				return nil, err
+			}
+			n := len(r.Segments)
+			if n == 0 || r.Segments[n-1].Frames != nil {
+				r.Segments = append(r.Segments, RZXSegment{})
+				n++
+			}
+			r.Segments[n-1].Tstates = tstates
+			r.Segments[n-1].Frames = frames
+		}
+	}
+	return r, nil
+}
+
+func parseRZXSnapshot(body []uint8) (RZXSegment, error) {
+	if len(body) < 12 {
+		return RZXSegment{}, fmt.Errorf("RZX snapshot block truncated")
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	format := strings.ToLower(strings.TrimRight(string(body[4:8]), "\x00"))
+	size := int(binary.LittleEndian.Uint32(body[8:]))
+	if flags&rzxSnapshotExternal != 0 {
+		return RZXSegment{}, fmt.Errorf("RZX external snapshot references are not supported")
+	}
+	snap := body[12:]
+	if flags&rzxSnapshotCompressed != 0 {
+		var err error
+		if snap, err = inflate(snap); err != nil {
+			return RZXSegment{}, fmt.Errorf("RZX snapshot: %w", err)
+		}
+	}
+	if len(snap) != size {
+		return RZXSegment{}, fmt.Errorf("RZX snapshot is %d bytes, header says %d", len(snap), size)
+	}
+	return RZXSegment{SnapshotFormat: format, Snapshot: snap}, nil
+}
+
+func parseRZXInput(body []uint8) (uint32, []RZXFrame, error) {
+	if len(body) < 13 {
+		return 0, nil, fmt.Errorf("RZX input block truncated")
+	}
+	count := int(binary.LittleEndian.Uint32(body))
+	tstates := binary.LittleEndian.Uint32(body[5:])
+	flags := binary.LittleEndian.Uint32(body[9:])
+	if flags&rzxInputProtected != 0 {
+		return 0, nil, fmt.Errorf("RZX input block is encrypted")
+	}
+	data := body[13:]
+	if flags&rzxInputCompressed != 0 {
+		var err error
+		if data, err = inflate(data); err != nil {
+			return 0, nil, fmt.Errorf("RZX input block: %w", err)
+		}
+	}
+
+	frames := make([]RZXFrame, 0, count)
+	var last []uint8
+	pos := 0
+	for i := 0; i < count; i++ {
+		if pos+4 > len(data) {
+			return 0, nil, fmt.Errorf("RZX frame %d truncated", i)
+		}
+		fetches := binary.LittleEndian.Uint16(data[pos:])
+		n := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		pos += 4
+		if n == rzxRepeatInputs {
+			frames = append(frames, RZXFrame{Fetches: fetches, Inputs: last})
+			continue
+		}
+		if pos+n > len(data) {
+			return 0, nil, fmt.Errorf("RZX frame %d inputs truncated", i)
+		}
+		last = append([]uint8(nil), data[pos:pos+n]...)
+		pos += n
+		frames = append(frames, RZXFrame{Fetches: fetches, Inputs: last})
+	}
+	return tstates, frames, nil
+}
+
+// inflate decompresses a zlib stream
+func inflate(data []uint8) ([]uint8, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// deflate compresses data as a zlib stream
+func deflate(data []uint8) []uint8 {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// Write encodes the recording as an RZX 0.13 file with compressed
+// snapshot and input blocks
+func (r *RZX) Write(w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString("RZX!")
+	out.Write([]uint8{0, 13, 0, 0, 0, 0})
+
+	block := func(id uint8, body []uint8) {
+		var hdr [5]uint8
+		hdr[0] = id
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(len(body)+5))
+		out.Write(hdr[:])
+		out.Write(body)
+	}
+
+	creator := make([]uint8, 24)
+	copy(creator[:19], r.Creator)
+	block(rzxCreator, creator)
+
+	for _, seg := range r.Segments {
+		if seg.SnapshotFormat != "" {
+			body := make([]uint8, 12)
+			binary.LittleEndian.PutUint32(body, rzxSnapshotCompressed)
+			copy(body[4:8], seg.SnapshotFormat)
+			binary.LittleEndian.PutUint32(body[8:], uint32(len(seg.Snapshot)))
+			block(rzxSnapshot, append(body, deflate(seg.Snapshot)...))
+		}
+
+		var frames bytes.Buffer
+		var last []uint8
+		for i, f := range seg.Frames {
+			var hdr [4]uint8
+			binary.LittleEndian.PutUint16(hdr[:], f.Fetches)
+			if i > 0 && bytes.Equal(f.Inputs, last) {
+				binary.LittleEndian.PutUint16(hdr[2:], rzxRepeatInputs)
+				frames.Write(hdr[:])
+				continue
+			}
+			if len(f.Inputs) >= rzxRepeatInputs {
+				return fmt.Errorf("RZX frame %d has too many port reads (%d)", i, len(f.Inputs))
+			}
+			binary.LittleEndian.PutUint16(hdr[2:], uint16(len(f.Inputs)))
+			frames.Write(hdr[:])
+			frames.Write(f.Inputs)
+			last = f.Inputs
+		}
+		body := make([]uint8, 13)
+		binary.LittleEndian.PutUint32(body, uint32(len(seg.Frames)))
+		binary.LittleEndian.PutUint32(body[5:], seg.Tstates)
+		binary.LittleEndian.PutUint32(body[9:], rzxInputCompressed)
+		block(rzxInput, append(body, deflate(frames.Bytes())...))
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// LoadSnapshotFormat restores a snapshot given its file extension
+// ("sna", "z80" or "szx")
+func (s *Spectrum) LoadSnapshotFormat(format string, data []uint8) error {
+	switch strings.ToLower(format) {
+	case "sna":
+		return s.LoadSNA(data)
+	case "z80":
+		return s.LoadZ80(data)
+	case "szx":
+		return s.LoadSZX(data)
+	}
+	return fmt.Errorf("unsupported snapshot format %q", format)
+}
+
+// rzxPlayer feeds a recording back into the machine. Frames end after the
+// recorded number of opcode fetches, and port reads return recorded values.
+type rzxPlayer struct {
+	rzx        *RZX
+	segment    int
+	frame      int
+	input      int
+	overReads  int    // Port reads past the end of the frame's inputs
+	frameStart uint64 // CPU.Fetches at the start of the current frame
+	err        error
+}
+
+// rzxRecorder captures the fetch count and port reads of every frame
+type rzxRecorder struct {
+	rzx        *RZX
+	current    RZXFrame
+	frameStart uint64
+}
+
+// PlayRZX starts replaying a recording, restoring its first snapshot.
+// Playback stops at the end of the recording or at the end of a frame in
+// which the machine read more or fewer ports than were recorded (see
+// RZXError).
+func (s *Spectrum) PlayRZX(r *RZX) error {
+	s.rzxRecord = nil
+	s.rzxErr = nil
+	s.rzxPlay = &rzxPlayer{rzx: r}
+	if err := s.rzxPlay.startSegment(s); err != nil {
+		s.rzxPlay = nil
+		return err
+	}
+	s.io.inFilter = s.rzxPlay.in
+	return nil
+}
+
+// RZXPlaying reports whether an RZX recording is being replayed
+func (s *Spectrum) RZXPlaying() bool {
+	return s.rzxPlay != nil
+}
+
+// RZXError returns the error that ended the last playback, if any
+func (s *Spectrum) RZXError() error {
+	return s.rzxErr
+}
+
+// StopRZX ends RZX playback and returns control to the live inputs
+func (s *Spectrum) StopRZX() {
+	s.rzxPlay = nil
+	s.io.inFilter = nil
+}
+
+// StartRZXRecording embeds an SZX snapshot of the current state and starts
+// recording input frames
+func (s *Spectrum) StartRZXRecording() error {
+	var snap bytes.Buffer
+	if err := s.SaveSZX(&snap); err != nil {
+		return err
+	}
+	s.StopRZX()
+	s.rzxRecord = &rzxRecorder{
+		rzx: &RZX{
+			Creator: "zen80",
+			Segments: []RZXSegment{{
+				SnapshotFormat: "szx",
+				Snapshot:       snap.Bytes(),
+				Tstates:        uint32(s.FrameTstates()),
+			}},
+		},
+		frameStart: s.CPU.Fetches,
+	}
+	s.io.inFilter = s.rzxRecord.in
+	return nil
+}
+
+// StopRZXRecording ends recording and returns the recording, or nil if
+// none was in progress. The frame in progress is kept.
+func (s *Spectrum) StopRZXRecording() *RZX {
+	rec := s.rzxRecord
+	if rec == nil {
+		return nil
+	}
+	rec.endFrame(s.CPU.Fetches)
+	s.rzxRecord = nil
+	s.io.inFilter = nil
+	return rec.rzx
+}
+
+// rzxInterrupt is called after every instruction with whether the beam
+// has reached the interrupt line. It reports whether the frame interrupt
+// should be raised now, moving RZX frames on when it is.
+func (s *Spectrum) rzxInterrupt(beam bool) bool {
+	if p := s.rzxPlay; p != nil {
+		// Playback places interrupts by fetch count rather than by the beam
+		frame := p.rzx.Segments[p.segment].Frames[p.frame]
+		if s.CPU.Fetches-p.frameStart < uint64(frame.Fetches) {
+			return false
+		}
+		s.SetFrameTstates(0)
+		return p.nextFrame(s)
+	}
+	if beam && s.rzxRecord != nil {
+		s.rzxRecord.endFrame(s.CPU.Fetches)
+	}
+	return beam
+}
+
+func (p *rzxPlayer) startSegment(s *Spectrum) error {
+	for p.segment < len(p.rzx.Segments) {
+		seg := &p.rzx.Segments[p.segment]
+		if seg.SnapshotFormat != "" {
+			if err := s.LoadSnapshotFormat(seg.SnapshotFormat, seg.Snapshot); err != nil {
+				return err
+			}
+			s.SetFrameTstates(int(seg.Tstates))
+		}
+		if len(seg.Frames) > 0 {
+			p.frame, p.input, p.overReads = 0, 0, 0
+			p.frameStart = s.CPU.Fetches
+			return nil
+		}
+		p.segment++
+	}
+	return fmt.Errorf("RZX recording has no input frames")
+}
+
+// nextFrame moves playback on once the current frame's fetches have all
+// executed. It reports whether the interrupt should be raised, which is
+// not the case when a new segment has just restored its snapshot.
+func (p *rzxPlayer) nextFrame(s *Spectrum) bool {
+	frame := p.rzx.Segments[p.segment].Frames[p.frame]
+	if p.overReads > 0 {
+		p.fail(s, fmt.Errorf("RZX frame %d: %d port reads past the %d recorded", p.frame, p.overReads, len(frame.Inputs)))
+		return true
+	}
+	if p.input != len(frame.Inputs) {
+		p.fail(s, fmt.Errorf("RZX frame %d: %d of %d port reads used", p.frame, p.input, len(frame.Inputs)))
+		return true
+	}
+
+	p.frame++
+	p.input, p.overReads = 0, 0
+	p.frameStart = s.CPU.Fetches
+	if p.frame < len(p.rzx.Segments[p.segment].Frames) {
+		return true
+	}
+	p.segment++
+	if p.segment == len(p.rzx.Segments) {
+		// A recording ends wherever it was stopped, not at an interrupt
+		s.StopRZX()
+		return false
+	}
+	snapshot := p.rzx.Segments[p.segment].SnapshotFormat != ""
+	if err := p.startSegment(s); err != nil {
+		p.fail(s, err)
+	}
+	return !snapshot
+}
+
+func (p *rzxPlayer) in(port uint16, value uint8) uint8 {
+	frame := p.rzx.Segments[p.segment].Frames[p.frame]
+	if p.input >= len(frame.Inputs) {
+		// The machine has diverged from the recording: keep the live value
+		// and report it when the frame ends
+		p.overReads++
+		return value
+	}
+	value = frame.Inputs[p.input]
+	p.input++
+	return value
+}
+
+func (p *rzxPlayer) fail(s *Spectrum, err error) {
+	s.rzxErr = err
+	s.StopRZX()
+}
+
+func (r *rzxRecorder) in(port uint16, value uint8) uint8 {
+	r.current.Inputs = append(r.current.Inputs, value)
+	return value
+}
+
+func (r *rzxRecorder) endFrame(fetches uint64) {
+	r.current.Fetches = uint16(fetches - r.frameStart)
+	seg := &r.rzx.Segments[len(r.rzx.Segments)-1]
+	seg.Frames = append(seg.Frames, r.current)
+	r.current = RZXFrame{}
+	r.frameStart = fetches
+}
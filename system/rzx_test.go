@@ -0,0 +1,163 @@
+package system
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRZXRecordPlayback(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+
+	if err := s.StartRZXRecording(); err != nil {
+		t.Fatalf("StartRZXRecording: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		switch i {
+		case 5:
+			s.PressKey(5, 0) // P
+		case 10:
+			s.ReleaseKey(5, 0)
+		}
+		s.RunFrame()
+	}
+	rec := s.StopRZXRecording()
+	if rec == nil || len(rec.Segments) != 1 || len(rec.Segments[0].Frames) < 40 {
+		t.Fatalf("unexpected recording %+v", rec)
+	}
+
+	var buf bytes.Buffer
+	if err := rec.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	parsed, err := ParseRZX(buf.Bytes())
+	if err != nil {
+		t.Fatalf("ParseRZX: %v", err)
+	}
+	if parsed.Creator != "zen80" || len(parsed.Segments[0].Frames) != len(rec.Segments[0].Frames) {
+		t.Fatalf("parsed recording does not match: creator %q, %d frames",
+			parsed.Creator, len(parsed.Segments[0].Frames))
+	}
+
+	// Replay on a fresh machine without pressing any keys
+	p := newTestSpectrum(t)
+	if err := p.PlayRZX(parsed); err != nil {
+		t.Fatalf("PlayRZX: %v", err)
+	}
+	for i := 0; i < 100 && p.RZXPlaying(); i++ {
+		p.RunFrame()
+	}
+	if p.RZXPlaying() {
+		t.Fatalf("playback did not finish")
+	}
+	if err := p.RZXError(); err != nil {
+		t.Fatalf("playback diverged: %v", err)
+	}
+
+	// The key press reaches the replayed ROM only through recorded port reads
+	eline := uint16(s.memory.Read(23641)) | uint16(s.memory.Read(23642))<<8
+	if s.memory.Read(eline) != 0xF5 {
+		t.Fatalf("recording machine did not type PRINT (got %02X)", s.memory.Read(eline))
+	}
+	if got := p.memory.Read(eline); got != 0xF5 {
+		t.Errorf("replayed edit line starts with %02X, want PRINT", got)
+	}
+}
+
+func TestRZXSkipsSecurityBlocks(t *testing.T) {
+	rec := &RZX{Creator: "test", Segments: []RZXSegment{{
+		Frames: []RZXFrame{{Fetches: 100, Inputs: []uint8{1, 2}}, {Fetches: 50, Inputs: []uint8{1, 2}}},
+	}}}
+	var buf bytes.Buffer
+	if err := rec.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Append a security signature block after the input block
+	data := append(buf.Bytes(), rzxSecuritySig, 9, 0, 0, 0, 0xDE, 0xAD, 0xBE, 0xEF)
+	parsed, err := ParseRZX(data)
+	if err != nil {
+		t.Fatalf("ParseRZX: %v", err)
+	}
+	frames := parsed.Segments[0].Frames
+	if len(frames) != 2 || frames[1].Fetches != 50 || !bytes.Equal(frames[1].Inputs, []uint8{1, 2}) {
+		t.Errorf("repeated frame not decoded: %+v", frames)
+	}
+}
+
+// TestRZXBlockRepeatFetches replays frames whose fetch counts follow the
+// hardware rule other emulators record by: a repeating LDIR costs two M1
+// cycles per iteration, so LDIR with BC=4 is 8 fetches. If it cost more,
+// the IN would run in the second frame and playback would fail.
+func TestRZXBlockRepeatFetches(t *testing.T) {
+	s := newTestSpectrum(t)
+	// 8000 ldir; in a,($FE); ld ($9000),a; jr $
+	program := []uint8{0xED, 0xB0, 0xDB, 0xFE, 0x32, 0x00, 0x90, 0x18, 0xFE}
+	for i, b := range program {
+		s.memory.Write(0x8000+uint16(i), b)
+	}
+	cpu := s.CPU
+	cpu.PC, cpu.SP = 0x8000, 0xFF00
+	cpu.SetHL(0xA000)
+	cpu.SetDE(0xA100)
+	cpu.SetBC(4)
+	cpu.IFF1, cpu.IFF2 = false, false
+	var snap bytes.Buffer
+	if err := s.SaveSZX(&snap); err != nil {
+		t.Fatalf("SaveSZX: %v", err)
+	}
+
+	rec := &RZX{Creator: "external", Segments: []RZXSegment{{
+		SnapshotFormat: "szx",
+		Snapshot:       snap.Bytes(),
+		Frames: []RZXFrame{
+			{Fetches: 8 + 1 + 1, Inputs: []uint8{0x42}}, // ldir, in, ld
+			{Fetches: 5}, // jr $
+		},
+	}}}
+	p := newTestSpectrum(t)
+	if err := p.PlayRZX(rec); err != nil {
+		t.Fatalf("PlayRZX: %v", err)
+	}
+	for i := 0; i < 10 && p.RZXPlaying(); i++ {
+		p.RunFrame()
+	}
+	if err := p.RZXError(); err != nil {
+		t.Fatalf("playback diverged: %v", err)
+	}
+	if got := p.memory.Read(0x9000); got != 0x42 {
+		t.Errorf("recorded input not stored: %02X", got)
+	}
+}
+
+func TestRZXReportsOverReads(t *testing.T) {
+	s := newTestSpectrum(t)
+	// 8000 in a,($FE); in a,($FE); jr $
+	for i, b := range []uint8{0xDB, 0xFE, 0xDB, 0xFE, 0x18, 0xFE} {
+		s.memory.Write(0x8000+uint16(i), b)
+	}
+	s.CPU.PC, s.CPU.SP = 0x8000, 0xFF00
+	s.CPU.IFF1, s.CPU.IFF2 = false, false
+	var snap bytes.Buffer
+	if err := s.SaveSZX(&snap); err != nil {
+		t.Fatalf("SaveSZX: %v", err)
+	}
+	rec := &RZX{Segments: []RZXSegment{{
+		SnapshotFormat: "szx",
+		Snapshot:       snap.Bytes(),
+		Frames:         []RZXFrame{{Fetches: 4, Inputs: []uint8{0x42}}, {Fetches: 4}},
+	}}}
+	p := newTestSpectrum(t)
+	if err := p.PlayRZX(rec); err != nil {
+		t.Fatalf("PlayRZX: %v", err)
+	}
+	for i := 0; i < 10 && p.RZXPlaying(); i++ {
+		p.RunFrame()
+	}
+	if err := p.RZXError(); err == nil || !strings.Contains(err.Error(), "past the 1 recorded") {
+		t.Errorf("over-read not reported: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package system
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// SCR file sizes: the standard display file, and the Timex hi-colour
+// (8×1 attributes) and hi-res (512×192) screens
+const (
+	SCRSize         = 6912
+	SCRHiColourSize = 12288
+	SCRHiResSize    = 12289
+)
+
+// ScreenshotOptions controls Screenshot and WritePNG
+type ScreenshotOptions struct {
+	NoBorder bool // Crop to the 256×192 display
+	Scale    int  // Pixel magnification, 1 if zero
+}
+
+// Screenshot returns the last displayed frame
+func (s *Spectrum) Screenshot(opts ScreenshotOptions) *image.RGBA {
+	frame := s.Render()
+	if opts.NoBorder {
+		frame = frame.SubImage(image.Rect(BorderWidth, BorderHeight,
+			BorderWidth+ScreenWidth, BorderHeight+ScreenHeight)).(*image.RGBA)
+	}
+	n := max(opts.Scale, 1)
+	b := frame.Bounds()
+	if n == 1 && b.Min == (image.Point{}) {
+		return frame
+	}
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx()*n, b.Dy()*n))
+	Scale(out, frame, n)
+	return out
+}
+
+// WritePNG writes the last displayed frame as a PNG image
+func (s *Spectrum) WritePNG(w io.Writer, opts ScreenshotOptions) error {
+	return png.Encode(w, s.Screenshot(opts))
+}
+
+// SaveSCR writes the display file being shown (the shadow screen in bank
+// 7 when a 128K machine has it selected) as a 6912-byte SCR file
+func (s *Spectrum) SaveSCR(w io.Writer) error {
+	return s.SaveSCRBank(w, s.memory.ScreenBank())
+}
+
+// SaveSCRBank writes the display file held in a RAM bank: 5 for the
+// normal screen, 7 for the 128K shadow screen
+func (s *Spectrum) SaveSCRBank(w io.Writer, bank int) error {
+	if bank != 5 && bank != 7 {
+		return fmt.Errorf("bank %d does not hold a screen", bank)
+	}
+	_, err := w.Write(s.memory.Bank(bank)[:SCRSize])
+	return err
+}
+
+// LoadSCR copies a 6912-byte SCR file into the display file being shown
+func (s *Spectrum) LoadSCR(data []uint8) error {
+	return s.LoadSCRBank(data, s.memory.ScreenBank())
+}
+
+// LoadSCRBank copies a 6912-byte SCR file into the screen in a RAM bank.
+// Timex hi-colour and hi-res screens can be viewed with DecodeSCR but not
+// loaded, as no Timex model is emulated.
+func (s *Spectrum) LoadSCRBank(data []uint8, bank int) error {
+	if bank != 5 && bank != 7 {
+		return fmt.Errorf("bank %d does not hold a screen", bank)
+	}
+	switch len(data) {
+	case SCRSize:
+	case SCRHiColourSize, SCRHiResSize:
+		return fmt.Errorf("screens in the Timex modes are not emulated")
+	default:
+		return fmt.Errorf("SCR file must be %d bytes, got %d", SCRSize, len(data))
+	}
+	copy(s.memory.Bank(bank)[:], data)
+	return nil
+}
+
+// DecodeSCR renders an SCR file without border: a standard screen or a
+// Timex hi-colour screen as 256×192, a Timex hi-res screen as 512×192.
+// FLASH is shown in its normal phase.
+func DecodeSCR(data []uint8) (*image.RGBA, error) {
+	switch len(data) {
+	case SCRSize, SCRHiColourSize:
+		img := image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight))
+		for y := 0; y < ScreenHeight; y++ {
+			offset := displayOffset(y)
+			attrs := data[0x1800+(y>>3)*32:] // One attribute per 8×8 cell
+			if len(data) == SCRHiColourSize {
+				attrs = data[0x1800+offset:] // One per 8×1 cell
+			}
+			for col := 0; col < 32; col++ {
+				ink, paper := attrColours(attrs[col], false)
+				drawByte(img, col*8, y, data[offset+col], ink, paper)
+			}
+		}
+		return img, nil
+	case SCRHiResSize:
+		img := image.NewRGBA(image.Rect(0, 0, 2*ScreenWidth, ScreenHeight))
+		ink := (data[SCRHiColourSize] >> 3) & 0x07
+		fg, bg := Palette[ink], Palette[7-ink]
+		for y := 0; y < ScreenHeight; y++ {
+			offset := displayOffset(y)
+			for col := 0; col < 32; col++ {
+				drawByte(img, col*16, y, data[offset+col], fg, bg)
+				drawByte(img, col*16+8, y, data[0x1800+offset+col], fg, bg)
+			}
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("unrecognised SCR size %d", len(data))
+}
+
+// displayOffset returns the offset of a pixel line in the display file
+func displayOffset(line int) int {
+	return (line&0xC0)<<5 | (line&0x07)<<8 | (line&0x38)<<2
+}
+
+// drawByte draws 8 pixels of a display byte
+func drawByte(img *image.RGBA, x, y int, bits uint8, ink, paper color.RGBA) {
+	px := img.Pix[img.PixOffset(x, y):]
+	for bit := 0; bit < 8; bit++ {
+		c := paper
+		if bits&(0x80>>bit) != 0 {
+			c = ink
+		}
+		px[bit*4], px[bit*4+1], px[bit*4+2], px[bit*4+3] = c.R, c.G, c.B, c.A
+	}
+}
+
+// Scale magnifies src n times into dst, from dst's origin, by replicating
+// pixels. dst must be at least n times the size of src.
+func Scale(dst, src *image.RGBA, n int) {
+	b := src.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		srow := src.Pix[y*src.Stride:]
+		drow := dst.Pix[y*n*dst.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			px := srow[x*4 : x*4+4]
+			for i := 0; i < n; i++ {
+				copy(drow[(x*n+i)*4:], px)
+			}
+		}
+		for i := 1; i < n; i++ {
+			copy(dst.Pix[(y*n+i)*dst.Stride:], drow[:b.Dx()*n*4])
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package system
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestSCRRoundTrip(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	var buf bytes.Buffer
+	if err := s.SaveSCR(&buf); err != nil || buf.Len() != SCRSize {
+		t.Fatalf("SaveSCR wrote %d bytes, %v", buf.Len(), err)
+	}
+	scr := bytes.Clone(buf.Bytes())
+
+	want := s.ScreenText()
+	s.LoadSCR(make([]uint8, SCRSize))
+	if err := s.LoadSCR(scr); err != nil {
+		t.Fatalf("LoadSCR: %v", err)
+	}
+	if got := s.ScreenText(); got != want {
+		t.Errorf("loaded screen reads\n%s\nwant\n%s", got, want)
+	}
+
+	img, err := DecodeSCR(scr)
+	if err != nil {
+		t.Fatalf("DecodeSCR: %v", err)
+	}
+	shot := s.Screenshot(ScreenshotOptions{NoBorder: true})
+	if !bytes.Equal(img.Pix, shot.Pix) {
+		t.Error("decoded SCR differs from the screenshot")
+	}
+
+	if err := s.LoadSCR(make([]uint8, SCRHiColourSize)); err == nil {
+		t.Error("LoadSCR accepted a Timex screen")
+	}
+	if err := s.SaveSCRBank(&buf, 7); err != nil {
+		t.Errorf("SaveSCRBank(7): %v", err)
+	}
+	if err := s.SaveSCRBank(&buf, 2); err == nil {
+		t.Error("SaveSCRBank accepted bank 2")
+	}
+}
+
+func TestShadowScreen(t *testing.T) {
+	s := NewSpectrumModel(Model128K)
+	scr := make([]uint8, SCRSize)
+	scr[0x1800] = 0x3A // Red ink on white paper
+	if err := s.LoadSCRBank(scr, 7); err != nil {
+		t.Fatal(err)
+	}
+	s.memory.Write7FFD(0x08) // Show the shadow screen
+	var buf bytes.Buffer
+	s.SaveSCR(&buf)
+	if buf.Bytes()[0x1800] != 0x3A {
+		t.Error("SaveSCR did not write the shadow screen")
+	}
+}
+
+func TestDecodeTimexSCR(t *testing.T) {
+	hicolour := make([]uint8, SCRHiColourSize)
+	hicolour[0] = 0xF0
+	hicolour[0x1800] = 0x02     // Red ink on the top pixel line only
+	hicolour[0x1800+256] = 0x08 // Blue paper on the line below
+	img, err := DecodeSCR(hicolour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.RGBAAt(0, 0) != Palette[2] || img.RGBAAt(7, 0) != Palette[0] || img.RGBAAt(7, 1) != Palette[1] {
+		t.Errorf("hi-colour pixels = %v %v %v", img.RGBAAt(0, 0), img.RGBAAt(7, 0), img.RGBAAt(7, 1))
+	}
+
+	hires := make([]uint8, SCRHiResSize)
+	hires[0x1800] = 0x80
+	hires[SCRHiColourSize] = 0x08 // Blue ink, yellow paper
+	img, err = DecodeSCR(hires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 512 || img.RGBAAt(8, 0) != Palette[1] || img.RGBAAt(0, 0) != Palette[6] {
+		t.Errorf("hi-res image %v, pixels %v %v", img.Bounds(), img.RGBAAt(8, 0), img.RGBAAt(0, 0))
+	}
+
+	if _, err := DecodeSCR(make([]uint8, 100)); err == nil {
+		t.Error("DecodeSCR accepted a 100-byte file")
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	s := NewSpectrum()
+	var buf bytes.Buffer
+	if err := s.WritePNG(&buf, ScreenshotOptions{Scale: 2}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2*FrameWidth || b.Dy() != 2*FrameHeight {
+		t.Errorf("PNG is %v", b)
+	}
+	if b := s.Screenshot(ScreenshotOptions{NoBorder: true}).Bounds(); b.Min.X != 0 || b.Dx() != ScreenWidth {
+		t.Errorf("borderless screenshot is %v", b)
+	}
+}
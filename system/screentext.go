@@ -0,0 +1,200 @@
+package system
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Screen text geometry, in character cells
+const (
+	TextColumns = 32
+	TextRows    = 24
+)
+
+// UDGBase is the rune returned for the first user-defined graphic (the
+// one shown for "A" in graphics mode). UDGs have no Unicode equivalent, so
+// they are reported in the Private Use Area as UDGBase+0 to UDGBase+20.
+const UDGBase rune = 0xE090
+
+// Runes that differ from ASCII in the Spectrum character set
+var spectrumRunes = map[int]rune{
+	0x5E: '↑',
+	0x60: '£',
+	0x7F: '©',
+}
+
+// Block graphics 128-143, indexed by their quadrant bits
+var blockGraphicRunes = [16]rune{
+	' ', '▝', '▘', '▀', '▗', '▐', '▚', '▜',
+	'▖', '▞', '▌', '▛', '▄', '▟', '▙', '█',
+}
+
+// CharRune returns the rune ScreenText reports for a character code from
+// 0x20 to 0x8F, the ASCII range and the block graphics
+func CharRune(c uint8) (rune, bool) {
+	switch {
+	case c >= 0x80 && c < 0x90:
+		return blockGraphicRunes[c-0x80], true
+	case c >= 0x20 && c < 0x80:
+		if r, ok := spectrumRunes[int(c)]; ok {
+			return r, true
+		}
+		return rune(c), true
+	}
+	return 0, false
+}
+
+// RuneChar is the inverse of CharRune. A space is 0x20, not the empty
+// block graphic.
+func RuneChar(r rune) (uint8, bool) {
+	if r >= 0x20 && r < 0x80 {
+		if _, ok := spectrumRunes[int(r)]; !ok {
+			return uint8(r), true
+		}
+	}
+	for c, sr := range spectrumRunes {
+		if sr == r {
+			return uint8(c), true
+		}
+	}
+	for i, br := range blockGraphicRunes[1:] {
+		if br == r {
+			return uint8(0x81 + i), true
+		}
+	}
+	return 0, false
+}
+
+// ScreenCell is one 8×8 character cell of the display
+type ScreenCell struct {
+	Rune    rune // Recognised character, or unicode.ReplacementChar
+	Known   bool // The cell matched a glyph
+	Inverse bool // The glyph was drawn in inverse video
+	Ink     uint8
+	Paper   uint8
+	Bright  bool
+	Flash   bool
+}
+
+type glyph struct {
+	bitmap [8]uint8
+	r      rune
+}
+
+// ScreenCells reads the display file and recognises the character in each
+// cell by comparing it against the ROM character set (at 0x3D00 in the 48
+// BASIC ROM), the font CHARS points to if it has been redefined, block
+// graphics and the user-defined graphics.
+func (s *Spectrum) ScreenCells() [TextRows][TextColumns]ScreenCell {
+	glyphs := s.glyphs()
+	screen := s.memory.Bank(s.memory.ScreenBank())
+
+	var cells [TextRows][TextColumns]ScreenCell
+	for row := 0; row < TextRows; row++ {
+		for col := 0; col < TextColumns; col++ {
+			var bitmap [8]uint8
+			for line := 0; line < 8; line++ {
+				offset := (row&0x18)<<8 | line<<8 | (row&0x07)<<5 | col
+				bitmap[line] = screen[offset]
+			}
+			attr := screen[0x1800+row*TextColumns+col]
+			cell := ScreenCell{
+				Ink:    attr & 0x07,
+				Paper:  (attr >> 3) & 0x07,
+				Bright: attr&0x40 != 0,
+				Flash:  attr&0x80 != 0,
+			}
+			cell.Rune, cell.Inverse, cell.Known = matchGlyph(glyphs, bitmap)
+			cells[row][col] = cell
+		}
+	}
+	return cells
+}
+
+// ScreenText returns the screen as 24 lines of text, with trailing spaces
+// removed and unrecognised cells shown as unicode.ReplacementChar
+func (s *Spectrum) ScreenText() string {
+	cells := s.ScreenCells()
+	lines := make([]string, TextRows)
+	for row := range cells {
+		var b strings.Builder
+		for _, cell := range cells[row] {
+			b.WriteRune(cell.Rune)
+		}
+		lines[row] = strings.TrimRight(b.String(), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// glyphs builds the list of bitmaps to match against, in priority order
+func (s *Spectrum) glyphs() []glyph {
+	var glyphs []glyph
+	font := func(read func(i int) uint8) {
+		for c := 0x20; c < 0x80; c++ {
+			g := glyph{r: rune(c)}
+			if r, ok := spectrumRunes[c]; ok {
+				g.r = r
+			}
+			for line := 0; line < 8; line++ {
+				g.bitmap[line] = read((c-0x20)*8 + line)
+			}
+			glyphs = append(glyphs, g)
+		}
+	}
+
+	rom := s.memory.ROMPage(s.model.config().romPages - 1)
+	font(func(i int) uint8 { return rom[0x3D00+i] })
+	chars := uint16(s.memory.Read(23606)) | uint16(s.memory.Read(23607))<<8
+	if chars != 0x3C00 && chars != 0 {
+		font(func(i int) uint8 { return s.memory.Read(chars + 0x100 + uint16(i)) })
+	}
+
+	for c, r := range blockGraphicRunes {
+		g := glyph{r: r}
+		for line := 0; line < 8; line++ {
+			var bits uint8
+			quadrant := c >> 2 // Bottom half
+			if line < 4 {
+				quadrant = c // Top half
+			}
+			if quadrant&0x02 != 0 {
+				bits |= 0xF0
+			}
+			if quadrant&0x01 != 0 {
+				bits |= 0x0F
+			}
+			g.bitmap[line] = bits
+		}
+		glyphs = append(glyphs, g)
+	}
+
+	udg := uint16(s.memory.Read(23675)) | uint16(s.memory.Read(23676))<<8
+	for i := 0; i < 21; i++ {
+		g := glyph{r: UDGBase + rune(i)}
+		for line := 0; line < 8; line++ {
+			g.bitmap[line] = s.memory.Read(udg + uint16(i*8+line))
+		}
+		glyphs = append(glyphs, g)
+	}
+	return glyphs
+}
+
+// matchGlyph finds the glyph drawn in a cell, first in normal video and
+// then in inverse video
+func matchGlyph(glyphs []glyph, bitmap [8]uint8) (rune, bool, bool) {
+	for _, g := range glyphs {
+		if g.bitmap == bitmap {
+			return g.r, false, true
+		}
+	}
+	inverse := bitmap
+	for i := range inverse {
+		inverse[i] = ^inverse[i]
+	}
+	for _, g := range glyphs {
+		if g.bitmap == inverse {
+			return g.r, true, true
+		}
+	}
+	return unicode.ReplacementChar, false, false
+}
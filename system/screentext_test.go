@@ -0,0 +1,61 @@
+package system
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScreenTextAfterBoot(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	text := s.ScreenText()
+	if !strings.Contains(text, "© 1982 Sinclair Research Ltd") {
+		t.Errorf("copyright message not found on screen:\n%s", text)
+	}
+}
+
+func TestScreenCellsInverseAndBlocks(t *testing.T) {
+	s := newTestSpectrum(t)
+	screen := s.memory.Bank(5)
+	for line := 0; line < 8; line++ {
+		// Row 0, column 0: inverse "A"
+		screen[line<<8] = ^s.memory.ROMPage(0)[0x3D00+('A'-0x20)*8+line]
+		// Row 0, column 1: top-left quadrant block graphic
+		if line < 4 {
+			screen[line<<8|1] = 0xF0
+		}
+	}
+	screen[0x1800] = 0x47 // BRIGHT 1, PAPER 0, INK 7
+
+	cells := s.ScreenCells()
+	if c := cells[0][0]; c.Rune != 'A' || !c.Inverse || c.Ink != 7 || !c.Bright {
+		t.Errorf("cell 0,0 = %+v, want inverse bright white A", c)
+	}
+	if c := cells[0][1]; c.Rune != '▘' || c.Inverse {
+		t.Errorf("cell 0,1 = %q, want ▘", c.Rune)
+	}
+}
+
+func TestCharRune(t *testing.T) {
+	for c := 0x20; c < 0x90; c++ {
+		r, ok := CharRune(uint8(c))
+		if !ok {
+			t.Fatalf("CharRune(%02X) not printable", c)
+		}
+		want := uint8(c)
+		if c == 0x80 {
+			want = 0x20 // The empty block graphic reads back as a space
+		}
+		if got, ok := RuneChar(r); !ok || got != want {
+			t.Errorf("RuneChar(%q) = %02X, %v, want %02X", r, got, ok, want)
+		}
+	}
+	if _, ok := CharRune(0x1F); ok {
+		t.Error("CharRune(1F) printable")
+	}
+	if r, _ := CharRune(0x60); r != '£' {
+		t.Errorf("CharRune(60) = %q, want '£'", r)
+	}
+}
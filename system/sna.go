@@ -0,0 +1,181 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SNA file sizes
+const (
+	snaHeaderSize = 27
+	sna48KSize    = snaHeaderSize + 3*16384
+	sna128KSize   = sna48KSize + 4 + 5*16384
+	sna128KLarge  = sna128KSize + 16384 // Paged bank was 2 or 5, so it is stored twice
+)
+
+// LoadSNA restores the machine from a .sna snapshot. 48K snapshots can be
+// loaded on any model (128K models are locked into 48K mode); 128K
+// snapshots need a model with 128K paging.
+func (s *Spectrum) LoadSNA(data []uint8) error {
+	switch len(data) {
+	case sna48KSize:
+	case sna128KSize, sna128KLarge:
+		if !s.memory.paging {
+			return fmt.Errorf("128K snapshot cannot be loaded on a %s model", s.model)
+		}
+	default:
+		return fmt.Errorf("invalid SNA size %d bytes", len(data))
+	}
+
+	s.Reset()
+	s.readSNAHeader(data[:snaHeaderSize])
+	mem := s.memory
+
+	if len(data) == sna48KSize {
+		copy(mem.ram[5][:], data[27:])
+		copy(mem.ram[2][:], data[27+16384:])
+		copy(mem.ram[0][:], data[27+2*16384:])
+		if mem.paging {
+			// 48K BASIC ROM paged in and paging locked
+			mem.port7FFD = 0x30
+			if mem.plus3 {
+				mem.port1FFD = 0x04
+			}
+			mem.locked = true
+			mem.updateSlots()
+		}
+		// 48K snapshots resume with a RETN: PC is on the stack
+		s.CPU.PC = uint16(mem.Read(s.CPU.SP)) | uint16(mem.Read(s.CPU.SP+1))<<8
+		s.CPU.SP += 2
+		return nil
+	}
+
+	ext := data[sna48KSize:]
+	s.CPU.PC = binary.LittleEndian.Uint16(ext[0:])
+	port := ext[2]
+	mem.port7FFD = port
+	mem.locked = port&0x20 != 0
+	mem.updateSlots()
+	paged := int(port & 0x07)
+
+	copy(mem.ram[5][:], data[27:])
+	copy(mem.ram[2][:], data[27+16384:])
+	copy(mem.ram[paged][:], data[27+2*16384:])
+	pos := sna48KSize + 4
+	for bank := 0; bank < 8; bank++ {
+		if bank == 5 || bank == 2 || bank == paged {
+			continue
+		}
+		if pos+16384 > len(data) {
+			return fmt.Errorf("SNA truncated at bank %d", bank)
+		}
+		copy(mem.ram[bank][:], data[pos:])
+		pos += 16384
+	}
+	return nil
+}
+
+// SaveSNA writes the machine state as a .sna snapshot: the 48K layout on
+// the 48K model and the extended 128K layout on models with paging
+func (s *Spectrum) SaveSNA(w io.Writer) error {
+	mem := s.memory
+	pc := s.snapshotPC()
+
+	if !mem.paging {
+		out := make([]uint8, sna48KSize)
+		s.writeSNAHeader(out)
+		copy(out[27:], mem.ram[5][:])
+		copy(out[27+16384:], mem.ram[2][:])
+		copy(out[27+2*16384:], mem.ram[0][:])
+		// Push PC onto the saved stack; the live machine is not modified
+		sp := s.CPU.SP - 2
+		for i, v := range []uint8{uint8(pc), uint8(pc >> 8)} {
+			if addr := sp + uint16(i); addr >= 0x4000 {
+				out[27+int(addr-0x4000)] = v
+			}
+		}
+		binary.LittleEndian.PutUint16(out[23:], sp)
+		_, err := w.Write(out)
+		return err
+	}
+
+	paged := int(mem.port7FFD & 0x07)
+	size := sna128KSize
+	if paged == 2 || paged == 5 {
+		size = sna128KLarge
+	}
+	out := make([]uint8, 0, size)
+	hdr := make([]uint8, snaHeaderSize)
+	s.writeSNAHeader(hdr)
+	out = append(out, hdr...)
+	out = append(out, mem.ram[5][:]...)
+	out = append(out, mem.ram[2][:]...)
+	out = append(out, mem.ram[paged][:]...)
+	out = append(out, uint8(pc), uint8(pc>>8), mem.port7FFD, 0)
+	for bank := 0; bank < 8; bank++ {
+		if bank == 5 || bank == 2 || bank == paged {
+			continue
+		}
+		out = append(out, mem.ram[bank][:]...)
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// snapshotPC returns the PC to store in a snapshot. Formats without a halt
+// flag point PC back at the HALT so the restored machine halts again.
+func (s *Spectrum) snapshotPC() uint16 {
+	if s.CPU.Halted {
+		return s.CPU.PC - 1
+	}
+	return s.CPU.PC
+}
+
+func (s *Spectrum) readSNAHeader(h []uint8) {
+	cpu := s.CPU
+	word := func(off int) uint16 { return binary.LittleEndian.Uint16(h[off:]) }
+
+	cpu.I = h[0]
+	cpu.L_, cpu.H_ = h[1], h[2]
+	cpu.E_, cpu.D_ = h[3], h[4]
+	cpu.C_, cpu.B_ = h[5], h[6]
+	cpu.F_, cpu.A_ = h[7], h[8]
+	cpu.SetHL(word(9))
+	cpu.SetDE(word(11))
+	cpu.SetBC(word(13))
+	cpu.SetIY(word(15))
+	cpu.SetIX(word(17))
+	cpu.IFF2 = h[19]&0x04 != 0
+	cpu.IFF1 = cpu.IFF2
+	cpu.R = h[20]
+	cpu.SetAF(word(21))
+	cpu.SP = word(23)
+	cpu.IM = h[25] & 0x03
+	s.border = h[26] & 0x07
+}
+
+func (s *Spectrum) writeSNAHeader(h []uint8) {
+	cpu := s.CPU
+	put := func(off int, v uint16) { binary.LittleEndian.PutUint16(h[off:], v) }
+
+	h[0] = cpu.I
+	h[1], h[2] = cpu.L_, cpu.H_
+	h[3], h[4] = cpu.E_, cpu.D_
+	h[5], h[6] = cpu.C_, cpu.B_
+	h[7], h[8] = cpu.F_, cpu.A_
+	put(9, cpu.HL())
+	put(11, cpu.DE())
+	put(13, cpu.BC())
+	put(15, cpu.IY())
+	put(17, cpu.IX())
+	h[19] = 0
+	if cpu.IFF2 {
+		h[19] = 0x04
+	}
+	h[20] = cpu.R
+	put(21, cpu.AF())
+	put(23, cpu.SP)
+	h[25] = cpu.IM
+	h[26] = s.border
+}
@@ -0,0 +1,134 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+)
+
+// setTestRegisters fills the CPU with distinct register values
+func setTestRegisters(s *Spectrum) {
+	cpu := s.CPU
+	cpu.SetAF(0x1234)
+	cpu.SetBC(0x2345)
+	cpu.SetDE(0x3456)
+	cpu.SetHL(0x4567)
+	cpu.A_, cpu.F_ = 0x56, 0x78
+	cpu.B_, cpu.C_ = 0x67, 0x89
+	cpu.D_, cpu.E_ = 0x78, 0x9A
+	cpu.H_, cpu.L_ = 0x89, 0xAB
+	cpu.SetIX(0x9ABC)
+	cpu.SetIY(0xABCD)
+	cpu.I = 0x3F
+	cpu.R = 0x42
+	cpu.IM = 2
+	cpu.IFF1, cpu.IFF2 = true, true
+	cpu.SP = 0xFF00
+	cpu.PC = 0x8123
+	s.border = 3
+}
+
+// compareRegisters reports any register that differs between two machines
+func compareRegisters(t *testing.T, got, want *Spectrum) {
+	t.Helper()
+	g, w := got.CPU, want.CPU
+	pairs := []struct {
+		name     string
+		got, exp uint16
+	}{
+		{"AF", g.AF(), w.AF()}, {"BC", g.BC(), w.BC()}, {"DE", g.DE(), w.DE()}, {"HL", g.HL(), w.HL()},
+		{"AF'", uint16(g.A_)<<8 | uint16(g.F_), uint16(w.A_)<<8 | uint16(w.F_)},
+		{"BC'", uint16(g.B_)<<8 | uint16(g.C_), uint16(w.B_)<<8 | uint16(w.C_)},
+		{"DE'", uint16(g.D_)<<8 | uint16(g.E_), uint16(w.D_)<<8 | uint16(w.E_)},
+		{"HL'", uint16(g.H_)<<8 | uint16(g.L_), uint16(w.H_)<<8 | uint16(w.L_)},
+		{"IX", g.IX(), w.IX()}, {"IY", g.IY(), w.IY()}, {"SP", g.SP, w.SP}, {"PC", g.PC, w.PC},
+		{"I", uint16(g.I), uint16(w.I)}, {"R", uint16(g.R), uint16(w.R)}, {"IM", uint16(g.IM), uint16(w.IM)},
+		{"border", uint16(got.border), uint16(want.border)},
+	}
+	for _, p := range pairs {
+		if p.got != p.exp {
+			t.Errorf("%s = %04X, want %04X", p.name, p.got, p.exp)
+		}
+	}
+	if g.IFF1 != w.IFF1 || g.IFF2 != w.IFF2 {
+		t.Errorf("IFF = %v/%v, want %v/%v", g.IFF1, g.IFF2, w.IFF1, w.IFF2)
+	}
+}
+
+func TestSNA48KRoundTrip(t *testing.T) {
+	src := NewSpectrum()
+	setTestRegisters(src)
+	src.memory.Write(0x4000, 0xAA)
+	src.memory.Write(0xFFFF, 0x55)
+
+	var buf bytes.Buffer
+	if err := src.SaveSNA(&buf); err != nil {
+		t.Fatalf("SaveSNA: %v", err)
+	}
+	if buf.Len() != sna48KSize {
+		t.Fatalf("SNA size = %d, want %d", buf.Len(), sna48KSize)
+	}
+	if src.memory.Read(0xFEFE) != 0 || src.CPU.SP != 0xFF00 {
+		t.Errorf("saving must not push PC onto the live stack")
+	}
+
+	dst := NewSpectrum()
+	if err := dst.LoadSNA(buf.Bytes()); err != nil {
+		t.Fatalf("LoadSNA: %v", err)
+	}
+	compareRegisters(t, dst, src)
+	if dst.memory.Read(0x4000) != 0xAA || dst.memory.Read(0xFFFF) != 0x55 {
+		t.Errorf("memory not restored")
+	}
+
+	// A 48K snapshot on a 128K machine runs with the 48K ROM and paging locked
+	dst128 := NewSpectrumModel(Model128K)
+	if err := dst128.LoadSNA(buf.Bytes()); err != nil {
+		t.Fatalf("LoadSNA on 128K: %v", err)
+	}
+	compareRegisters(t, dst128, src)
+	dst128.memory.Write7FFD(0x07)
+	if dst128.memory.Port7FFD() != 0x30 {
+		t.Errorf("paging should be locked after loading a 48K snapshot")
+	}
+}
+
+func TestSNA128KRoundTrip(t *testing.T) {
+	for _, paged := range []uint8{0, 5} {
+		src := NewSpectrumModel(Model128K)
+		setTestRegisters(src)
+		for bank := 0; bank < 8; bank++ {
+			src.memory.Bank(bank)[100] = uint8(0xB0 + bank)
+		}
+		src.memory.Write7FFD(0x18 | paged) // ROM 1, shadow screen
+
+		var buf bytes.Buffer
+		if err := src.SaveSNA(&buf); err != nil {
+			t.Fatalf("SaveSNA: %v", err)
+		}
+		want := sna128KSize
+		if paged == 5 {
+			want = sna128KLarge
+		}
+		if buf.Len() != want {
+			t.Fatalf("bank %d: SNA size = %d, want %d", paged, buf.Len(), want)
+		}
+
+		dst := NewSpectrumModel(Model128K)
+		if err := dst.LoadSNA(buf.Bytes()); err != nil {
+			t.Fatalf("LoadSNA: %v", err)
+		}
+		compareRegisters(t, dst, src)
+		if dst.memory.Port7FFD() != 0x18|paged {
+			t.Errorf("0x7FFD = %02X, want %02X", dst.memory.Port7FFD(), 0x18|paged)
+		}
+		for bank := 0; bank < 8; bank++ {
+			if got := dst.memory.Bank(bank)[100]; got != uint8(0xB0+bank) {
+				t.Errorf("bank %d marker = %02X, want %02X", bank, got, 0xB0+bank)
+			}
+		}
+
+		if err := NewSpectrum().LoadSNA(buf.Bytes()); err == nil {
+			t.Errorf("loading a 128K snapshot on a 48K model should fail")
+		}
+	}
+}
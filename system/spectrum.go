@@ -4,52 +4,213 @@ import (
 	"fmt"
 	"time"
 
+	zio "github.com/ha1tch/zen80/io"
 	"github.com/ha1tch/zen80/z80"
 )
 
+// interruptLine is the scanline at which the frame interrupt is raised
+const interruptLine = 192
+
 // Spectrum represents a ZX Spectrum system
 type Spectrum struct {
 	CPU         *z80.Z80  // Exported for testing
+	model       Model
 	memory      *SpectrumMemory
 	io          *SpectrumIO
 	timing      *TimingController
 	frameTimer  *FrameTimer
+	tape        *TapePlayer
+	recorder    *TapeRecorder
+	rzxPlay     *rzxPlayer      // RZX playback in progress
+	rzxRecord   *rzxRecorder    // RZX recording in progress
+	rzxErr      error           // Why the last RZX playback stopped early
+	journal     *zio.RecordingIO // Input journal being recorded
+	replay      *zio.ReplayIO    // Input journal being replayed
 	
 	// Video state
-	screen      [192][256]uint8  // Screen pixels (attribute-less for simplicity)
+	ula         *ulaFrame        // Scanlines drawn so far (Render)
 	border      uint8            // Border color
+	audio       *AudioCapture    // Beeper capture, nil when not capturing
+	recorders   []FrameRecorder  // Called at the end of every frame
 	
 	// System state
 	running     bool
 	paused      bool
+	intRemain   int  // T-states left before INT is released
+	midFrame    bool // RunFrameUntil stopped part way through a frame
+	
+	// Keyboard typing queue (TypeText)
+	typeQueue   [][]Key
+	typeHeld    []Key
+	typeWait    int
+	
+	// Snapshot state for hardware zen80 does not emulate, kept so that
+	// it survives a load/save round trip (SZX chunks by ID)
+	preserved   map[string][]uint8
 }
 
-// SpectrumMemory implements ZX Spectrum memory layout
+// SpectrumMemory implements ZX Spectrum memory layout. RAM is held as eight
+// 16K banks; the 48K machine maps banks 5, 2 and 0 above the ROM, which is
+// also the 128K power-on layout.
 type SpectrumMemory struct {
-	rom  [16384]uint8  // 16K ROM
-	ram  [49152]uint8  // 48K RAM
+	rom      [4][16384]uint8   // ROM pages
+	ram      [8][16384]uint8   // RAM banks
+	paging   bool              // 128K paging via port 0x7FFD
+	plus3    bool              // +2A/+3 paging via port 0x1FFD
+	port7FFD uint8             // Last value written to 0x7FFD
+	port1FFD uint8             // Last value written to 0x1FFD
+	locked   bool              // Paging disabled until reset (bit 5 of 0x7FFD)
+	slots    [4]*[16384]uint8  // Pages mapped at 0x0000, 0x4000, 0x8000, 0xC000
+	romSlot0 bool              // Slot 0 holds ROM (false in +3 all-RAM modes)
 }
 
+// plus3Special lists the RAM banks mapped in each +3 all-RAM configuration
+var plus3Special = [4][4]int{
+	{0, 1, 2, 3},
+	{4, 5, 6, 7},
+	{4, 5, 6, 3},
+	{4, 7, 6, 3},
+}
+
+// NewSpectrumMemory creates 48K Spectrum memory
 func NewSpectrumMemory() *SpectrumMemory {
-	return &SpectrumMemory{}
+	return newSpectrumMemory(Model48K.config())
 }
 
-func (m *SpectrumMemory) Read(address uint16) uint8 {
-	if address < 0x4000 {
-		return m.rom[address]
+func newSpectrumMemory(cfg modelConfig) *SpectrumMemory {
+	m := &SpectrumMemory{
+		paging: cfg.paging128,
+		plus3:  cfg.pagingPlus3,
+	}
+	m.reset()
+	return m
+}
+
+// reset restores the power-on memory map
+func (m *SpectrumMemory) reset() {
+	m.port7FFD = 0
+	m.port1FFD = 0
+	m.locked = false
+	m.updateSlots()
+}
+
+// updateSlots maps ROM and RAM pages according to the paging registers
+func (m *SpectrumMemory) updateSlots() {
+	if m.plus3 && m.port1FFD&0x01 != 0 {
+		// All-RAM configuration
+		banks := plus3Special[(m.port1FFD>>1)&0x03]
+		for i, bank := range banks {
+			m.slots[i] = &m.ram[bank]
+		}
+		m.romSlot0 = false
+		return
+	}
+	m.slots[0] = &m.rom[m.romPage()]
+	m.slots[1] = &m.ram[5]
+	m.slots[2] = &m.ram[2]
+	m.slots[3] = &m.ram[m.port7FFD&0x07]
+	m.romSlot0 = true
+}
+
+// romPage returns the ROM page selected by the paging registers
+func (m *SpectrumMemory) romPage() int {
+	page := int(m.port7FFD>>4) & 0x01
+	if m.plus3 {
+		page |= int(m.port1FFD>>1) & 0x02
+	}
+	return page
+}
+
+// Slot reports what is mapped in a 16K slot (0 to 3): a ROM page, or a
+// RAM bank if rom is false
+func (m *SpectrumMemory) Slot(n int) (rom bool, page int) {
+	n &= 3
+	if n == 0 && m.romSlot0 {
+		return true, m.romPage()
 	}
-	return m.ram[address-0x4000]
+	for i := range m.ram {
+		if m.slots[n] == &m.ram[i] {
+			return false, i
+		}
+	}
+	return false, -1
+}
+
+func (m *SpectrumMemory) Read(address uint16) uint8 {
+	return m.slots[address>>14][address&0x3FFF]
 }
 
 func (m *SpectrumMemory) Write(address uint16, value uint8) {
-	if address >= 0x4000 {
-		m.ram[address-0x4000] = value
+	if address < 0x4000 && m.romSlot0 {
+		return // Writes to ROM are ignored
 	}
-	// Writes to ROM are ignored
+	m.slots[address>>14][address&0x3FFF] = value
 }
 
 func (m *SpectrumMemory) LoadROM(data []uint8) {
-	copy(m.rom[:], data)
+	for page := 0; page < len(m.rom) && page*16384 < len(data); page++ {
+		copy(m.rom[page][:], data[page*16384:])
+	}
+}
+
+// Out decodes writes to the paging ports for the model
+func (m *SpectrumMemory) Out(port uint16, value uint8) {
+	switch {
+	case m.plus3 && port&0xC002 == 0x4000:
+		m.Write7FFD(value)
+	case m.plus3 && port&0xF002 == 0x1000:
+		m.Write1FFD(value)
+	case m.paging && !m.plus3 && port&0x8002 == 0:
+		m.Write7FFD(value)
+	}
+}
+
+// Write7FFD handles a write to the 128K paging port
+func (m *SpectrumMemory) Write7FFD(value uint8) {
+	if !m.paging || m.locked {
+		return
+	}
+	m.port7FFD = value
+	m.locked = value&0x20 != 0
+	m.updateSlots()
+}
+
+// Write1FFD handles a write to the +2A/+3 paging port
+func (m *SpectrumMemory) Write1FFD(value uint8) {
+	if !m.plus3 || m.locked {
+		return
+	}
+	m.port1FFD = value
+	m.updateSlots()
+}
+
+// Port7FFD returns the last value written to the 128K paging port
+func (m *SpectrumMemory) Port7FFD() uint8 {
+	return m.port7FFD
+}
+
+// Port1FFD returns the last value written to the +2A/+3 paging port
+func (m *SpectrumMemory) Port1FFD() uint8 {
+	return m.port1FFD
+}
+
+// ROMPage returns ROM page n (0-3) for direct access
+func (m *SpectrumMemory) ROMPage(n int) *[16384]uint8 {
+	return &m.rom[n&0x03]
+}
+
+// Bank returns RAM bank n (0-7) for direct access
+func (m *SpectrumMemory) Bank(n int) *[16384]uint8 {
+	return &m.ram[n&0x07]
+}
+
+// ScreenBank returns the RAM bank the ULA is displaying (5, or 7 when the
+// 128K shadow screen is selected)
+func (m *SpectrumMemory) ScreenBank() int {
+	if m.paging && m.port7FFD&0x08 != 0 {
+		return 7
+	}
+	return 5
 }
 
 // SpectrumIO implements ZX Spectrum I/O ports
@@ -58,6 +219,14 @@ type SpectrumIO struct {
 	keyboard    [8]uint8  // Keyboard matrix
 	tapeIn      bool
 	speaker     bool
+	mic         bool
+	lastOut     uint8           // Last value written to the ULA port
+	memory      *SpectrumMemory
+	ay          *AY8912         // Sound chip on 128K models, nil on 48K
+	devices     []InputDevice   // Joysticks, mice and other port devices
+	recorder    *TapeRecorder   // Captures MIC edges while recording
+	clock       func() uint64   // Current T-state, for timestamping edges
+	inFilter    func(port uint16, value uint8) uint8 // Replaces or records port reads (RZX)
 }
 
 func NewSpectrumIO(border *uint8) *SpectrumIO {
@@ -72,6 +241,15 @@ func NewSpectrumIO(border *uint8) *SpectrumIO {
 }
 
 func (io *SpectrumIO) In(port uint16) uint8 {
+	value := io.read(port)
+	if io.inFilter != nil {
+		value = io.inFilter(port, value)
+	}
+	return value
+}
+
+// read returns the live value of an input port
+func (io *SpectrumIO) read(port uint16) uint8 {
 	// ULA port (keyboard and tape)
 	if port&0x01 == 0 {
 		// Keyboard read
@@ -81,6 +259,12 @@ func (io *SpectrumIO) In(port uint16) uint8 {
 				result &= io.keyboard[i]
 			}
 		}
+		// Keyboard-mapped joysticks pull matrix bits low
+		for _, d := range io.devices {
+			if v, ok := d.In(port); ok {
+				result &= v
+			}
+		}
 		// Bit 6 = tape input
 		if io.tapeIn {
 			result |= 0x40
@@ -88,46 +272,134 @@ func (io *SpectrumIO) In(port uint16) uint8 {
 		return result
 	}
 	
-	// Kempston joystick
-	if port&0xFF == 0x1F {
-		return 0x00 // No joystick input
+	// Joystick and mouse interfaces
+	for _, d := range io.devices {
+		if v, ok := d.In(port); ok {
+			return v
+		}
+	}
+	
+	// AY register read
+	if io.ay != nil && port&0xC002 == 0xC000 {
+		return io.ay.Read()
 	}
 	
 	return 0xFF
 }
 
 func (io *SpectrumIO) Out(port uint16, value uint8) {
+	// Memory paging
+	if io.memory != nil {
+		io.memory.Out(port, value)
+	}
+	
+	// AY sound chip register select and write
+	if io.ay != nil {
+		switch port & 0xC002 {
+		case 0xC000:
+			io.ay.Select(value)
+		case 0x8000:
+			io.ay.Write(value)
+		}
+	}
+	
 	// ULA port (border and speaker)
 	if port&0x01 == 0 {
+		io.lastOut = value
 		*io.border = value & 0x07     // Border color (bits 0-2)
 		io.speaker = (value & 0x10) != 0  // Speaker (bit 4)
+		
+		// MIC (bit 3)
+		mic := (value & 0x08) != 0
+		if mic != io.mic && io.recorder != nil && io.clock != nil {
+			io.recorder.Edge(io.clock(), mic)
+		}
+		io.mic = mic
 	}
 }
 
-// NewSpectrum creates a new ZX Spectrum emulator
+// NewSpectrum creates a new 48K ZX Spectrum emulator
 func NewSpectrum() *Spectrum {
+	return NewSpectrumModel(Model48K)
+}
+
+// NewSpectrumModel creates a ZX Spectrum emulator for the given model
+func NewSpectrumModel(model Model) *Spectrum {
+	cfg := model.config()
+	frameRate := cfg.clockHz / float64(model.FrameCycles())
 	spec := &Spectrum{
-		memory:     NewSpectrumMemory(),
-		timing:     NewSpectrumTiming(),
-		frameTimer: NewSpectrumFrameTimer(),
+		model:      model,
+		memory:     newSpectrumMemory(cfg),
+		timing:     NewTimingController(cfg.clockHz, frameRate),
+		frameTimer: NewFrameTimer(cfg.cyclesPerLine, cfg.linesPerFrame),
+		tape:       NewTapePlayer(cfg.clockHz),
+		recorder:   NewTapeRecorder(cfg.clockHz),
+		ula:        newULAFrame(cfg.linesPerFrame),
 		running:    true,  // Set running to true by default
 	}
 	
 	spec.io = NewSpectrumIO(&spec.border)
+	spec.io.memory = spec.memory
+	if cfg.paging128 {
+		spec.io.ay = NewAY8912()
+	}
+	spec.io.recorder = spec.recorder
+	spec.io.clock = func() uint64 { return spec.CPU.Cycles }
 	spec.CPU = z80.New(spec.memory, spec.io)
 	
 	return spec
 }
 
-// LoadROM loads the Spectrum ROM
+// Model returns the hardware model being emulated
+func (s *Spectrum) Model() Model {
+	return s.model
+}
+
+// Memory returns the machine's memory
+func (s *Spectrum) Memory() *SpectrumMemory {
+	return s.memory
+}
+
+// AY returns the AY sound chip, or nil on models without one
+func (s *Spectrum) AY() *AY8912 {
+	return s.io.ay
+}
+
+// Border returns the current border colour
+func (s *Spectrum) Border() uint8 {
+	return s.border
+}
+
+// SetBorder sets the border colour
+func (s *Spectrum) SetBorder(color uint8) {
+	s.border = color & 0x07
+}
+
+// LoadROM loads the Spectrum ROM. Models with several ROM pages take them
+// concatenated in page order.
 func (s *Spectrum) LoadROM(data []uint8) error {
-	if len(data) != 16384 {
-		return fmt.Errorf("ROM must be exactly 16384 bytes, got %d", len(data))
+	size := 16384 * s.model.config().romPages
+	if len(data) != size {
+		return fmt.Errorf("ROM must be exactly %d bytes, got %d", size, len(data))
 	}
 	s.memory.LoadROM(data)
 	return nil
 }
 
+// FrameTstates returns the number of T-states since the last frame
+// interrupt, as stored in snapshot formats
+func (s *Spectrum) FrameTstates() int {
+	frame := s.model.FrameCycles()
+	pos := s.frameTimer.Position() - interruptLine*s.model.config().cyclesPerLine
+	return ((pos % frame) + frame) % frame
+}
+
+// SetFrameTstates moves the frame position to the given number of T-states
+// after the frame interrupt
+func (s *Spectrum) SetFrameTstates(tstates int) {
+	s.frameTimer.SetPosition(tstates + interruptLine*s.model.config().cyclesPerLine)
+}
+
 // LoadSnapshot loads a program into memory
 func (s *Spectrum) LoadSnapshot(address uint16, data []uint8) {
 	for i, b := range data {
@@ -138,34 +410,69 @@ func (s *Spectrum) LoadSnapshot(address uint16, data []uint8) {
 // Reset resets the system
 func (s *Spectrum) Reset() {
 	s.CPU.Reset()
+	s.memory.reset()
+	if s.io.ay != nil {
+		s.io.ay.Reset()
+	}
 	s.border = 0
-	s.frameTimer = NewSpectrumFrameTimer()
+	s.intRemain = 0
+	cfg := s.model.config()
+	s.frameTimer = NewFrameTimer(cfg.cyclesPerLine, cfg.linesPerFrame)
+	s.ula.line = 0
 }
 
 // RunFrame executes one frame worth of CPU cycles
 func (s *Spectrum) RunFrame() {
-	frameDone := false
+	s.RunFrameUntil(nil)
+}
+
+// RunFrameUntil executes the rest of the frame, stopping early after the
+// first instruction for which stop returns true. It reports whether stop
+// returned true, which may be for the instruction that ends the frame;
+// after an early stop the next call carries on with the same frame.
+func (s *Spectrum) RunFrameUntil(stop func() bool) bool {
+	frameDone, stopped := false, false
+	if !s.midFrame {
+		s.advanceTyping()
+	}
+	s.midFrame = false
 	
 	for !frameDone && s.running {
+		// Apply injected events from a journal being replayed
+		if s.replay != nil {
+			s.applyJournalEvents()
+		}
+		
 		// Execute one instruction
 		cycles := s.CPU.Step()
 		
+		// Feed the tape signal into the EAR input
+		s.tape.Advance(cycles)
+		s.io.tapeIn = s.tape.Level()
+		
 		// Update frame timing
 		frameEvent := s.frameTimer.AddCycles(cycles)
 		
-		// Handle video events
-		if frameEvent.VisibleLine {
-			// In a real emulator, we'd render the scanline here
-			// For now, just track that we're in visible area
+		// Latch the scanlines the beam has finished and sample the speaker
+		s.ula.advance(s, s.frameTimer.currentLine)
+		if s.audio != nil {
+			s.audio.Advance(cycles, s.io.speaker)
 		}
 		
+		if s.rzxPlay != nil || s.rzxRecord != nil {
+			frameEvent.VBlankStart = s.rzxInterrupt(frameEvent.VBlankStart)
+		}
+		
+		// The ULA holds INT for a few T-states at the start of vertical
+		// blank; instructions ending inside that window see it
 		if frameEvent.VBlankStart {
-			// Generate interrupt at start of vertical blank
-			s.CPU.INT = true
+			s.intRemain = s.model.config().intLength - s.FrameTstates()
+		} else if s.intRemain > 0 {
+			s.intRemain -= cycles
 		}
+		s.setINT(s.intRemain > 0)
 		
 		if frameEvent.FrameComplete {
-			s.CPU.INT = false // Clear interrupt
 			frameDone = true
 		}
 		
@@ -174,10 +481,23 @@ func (s *Spectrum) RunFrame() {
 			// Frame boundary according to cycle count
 			// (should align with frameEvent.FrameComplete)
 		}
+		
+		if stop != nil && stop() {
+			if !frameDone {
+				s.midFrame = true
+				return true
+			}
+			stopped = true
+		}
+	}
+	
+	for _, r := range s.recorders {
+		r.RecordFrame(s)
 	}
 	
 	// Synchronize to real time
 	s.timing.SyncFrame()
+	return stopped
 }
 
 // Run starts the emulation
@@ -213,10 +533,16 @@ func (s *Spectrum) SetSpeed(multiplier float64) {
 	s.timing.SetSpeedMultiplier(multiplier)
 }
 
+// SetUnlimited runs frames as fast as possible instead of in real time
+func (s *Spectrum) SetUnlimited(unlimited bool) {
+	s.timing.SetUnlimited(unlimited)
+}
+
 // PressKey simulates a key press
 func (s *Spectrum) PressKey(row, col uint8) {
 	if row < 8 && col < 5 {
 		s.io.keyboard[row] &^= (1 << col)
+		s.journalKey(row, col, true)
 	}
 }
 
@@ -224,5 +550,57 @@ func (s *Spectrum) PressKey(row, col uint8) {
 func (s *Spectrum) ReleaseKey(row, col uint8) {
 	if row < 8 && col < 5 {
 		s.io.keyboard[row] |= (1 << col)
+		s.journalKey(row, col, false)
 	}
-}
\ No newline at end of file
+}
+
+// InsertTape loads a tape into the tape player, stopped and rewound
+func (s *Spectrum) InsertTape(source TapeSource) {
+	s.tape.Insert(source)
+	s.io.tapeIn = false
+}
+
+// EjectTape removes the tape from the tape player
+func (s *Spectrum) EjectTape() {
+	s.tape.Eject()
+	s.io.tapeIn = false
+}
+
+// PlayTape starts or resumes tape playback
+func (s *Spectrum) PlayTape() {
+	s.tape.Play()
+}
+
+// StopTape pauses tape playback
+func (s *Spectrum) StopTape() {
+	s.tape.Stop()
+}
+
+// RewindTape moves the tape back to the start
+func (s *Spectrum) RewindTape() {
+	s.tape.Rewind()
+}
+
+// TapePlaying reports whether the tape is running
+func (s *Spectrum) TapePlaying() bool {
+	return s.tape.Playing()
+}
+
+// StartTapeRecording discards any previous recording and starts capturing
+// the MIC output
+func (s *Spectrum) StartTapeRecording() {
+	s.recorder.Reset()
+	s.recorder.Start(s.CPU.Cycles, s.io.mic)
+}
+
+// StopTapeRecording stops capturing the MIC output and returns the recorder
+// holding what was saved
+func (s *Spectrum) StopTapeRecording() *TapeRecorder {
+	s.recorder.Stop(s.CPU.Cycles)
+	return s.recorder
+}
+
+// TapeRecorder returns the recorder capturing the MIC output
+func (s *Spectrum) TapeRecorder() *TapeRecorder {
+	return s.recorder
+}
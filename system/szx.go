@@ -0,0 +1,533 @@
+package system
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SZX version written by SaveSZX
+const (
+	szxMajor = 1
+	szxMinor = 4
+)
+
+// SZX machine IDs
+var szxMachineModels = map[uint8]Model{
+	0: Model48K, // 16K, loaded as a 48K
+	1: Model48K,
+	2: Model128K,
+	3: ModelPlus2,
+	4: ModelPlus2A,
+	5: ModelPlus3,
+	7: ModelPentagon,
+}
+
+var szxMachineIDs = map[Model]uint8{
+	Model48K: 1, Model128K: 2, ModelPlus2: 3, ModelPlus2A: 4, ModelPlus3: 5, ModelPentagon: 7,
+}
+
+// SZXChunk handles one chunk type of the SZX (zx-state) format. Peripherals
+// add support for their own state by registering a chunk with
+// RegisterSZXChunk.
+type SZXChunk struct {
+	ID string // Four-character chunk ID, padded with NULs (e.g. "AY\x00\x00")
+
+	// Load restores state from one chunk. It may be called several times
+	// for chunks that repeat (such as RAMP).
+	Load func(s *Spectrum, data []uint8) error
+
+	// Save returns the bodies of the chunks to write, or nil when the
+	// machine has nothing to save for this ID.
+	Save func(s *Spectrum) [][]uint8
+}
+
+var (
+	szxChunks     = map[string]SZXChunk{}
+	szxChunkOrder []string
+)
+
+// RegisterSZXChunk adds or replaces the handler for a chunk ID. Chunks are
+// written in the order they were first registered.
+func RegisterSZXChunk(c SZXChunk) {
+	if len(c.ID) != 4 {
+		panic(fmt.Sprintf("SZX chunk ID %q must be four bytes", c.ID))
+	}
+	if _, exists := szxChunks[c.ID]; !exists {
+		szxChunkOrder = append(szxChunkOrder, c.ID)
+	}
+	szxChunks[c.ID] = c
+}
+
+// preservedSZXChunk creates a handler that keeps a chunk's raw body on the
+// machine and writes it back unchanged, for hardware zen80 does not emulate
+func preservedSZXChunk(id string) SZXChunk {
+	return SZXChunk{
+		ID: id,
+		Load: func(s *Spectrum, data []uint8) error {
+			if s.preserved == nil {
+				s.preserved = make(map[string][]uint8)
+			}
+			s.preserved[id] = append([]uint8(nil), data...)
+			return nil
+		},
+		Save: func(s *Spectrum) [][]uint8 {
+			if data, ok := s.preserved[id]; ok {
+				return [][]uint8{data}
+			}
+			return nil
+		},
+	}
+}
+
+func init() {
+	RegisterSZXChunk(SZXChunk{ID: "CRTR", Load: loadSZXCreator, Save: saveSZXCreator})
+	RegisterSZXChunk(SZXChunk{ID: "Z80R", Load: loadSZXZ80Regs, Save: saveSZXZ80Regs})
+	RegisterSZXChunk(SZXChunk{ID: "SPCR", Load: loadSZXSpecRegs, Save: saveSZXSpecRegs})
+	RegisterSZXChunk(SZXChunk{ID: "RAMP", Load: loadSZXRAMPage, Save: saveSZXRAMPages})
+	RegisterSZXChunk(SZXChunk{ID: "AY\x00\x00", Load: loadSZXAY, Save: saveSZXAY})
+	RegisterSZXChunk(preservedSZXChunk("KEYB"))
+	RegisterSZXChunk(SZXChunk{ID: "JOY\x00", Load: loadSZXJoystick, Save: saveSZXJoystick})
+	RegisterSZXChunk(SZXChunk{ID: "AMXM", Load: loadSZXMouse, Save: saveSZXMouse})
+	RegisterSZXChunk(preservedSZXChunk("B128"))
+	RegisterSZXChunk(SZXChunk{ID: "TAPE", Load: loadSZXTape, Save: saveSZXTape})
+}
+
+// SZXSnapshotModel returns the model an SZX snapshot was saved from
+func SZXSnapshotModel(data []uint8) (Model, error) {
+	if len(data) < 8 || string(data[:4]) != "ZXST" {
+		return 0, fmt.Errorf("not an SZX file")
+	}
+	model, ok := szxMachineModels[data[6]]
+	if !ok {
+		return 0, fmt.Errorf("unsupported SZX machine ID %d", data[6])
+	}
+	return model, nil
+}
+
+// LoadSZX restores the machine from an SZX snapshot. Chunks without a
+// registered handler are skipped.
+func (s *Spectrum) LoadSZX(data []uint8) error {
+	model, err := SZXSnapshotModel(data)
+	if err != nil {
+		return err
+	}
+	if model != Model48K && !s.memory.paging {
+		return fmt.Errorf("%s snapshot cannot be loaded on a %s model", model, s.model)
+	}
+
+	s.Reset()
+	s.preserved = nil
+	if model == Model48K && s.memory.paging {
+		s.memory.port7FFD = 0x30
+		if s.memory.plus3 {
+			s.memory.port1FFD = 0x04
+		}
+		s.memory.locked = true
+		s.memory.updateSlots()
+	}
+
+	for pos := 8; pos < len(data); {
+		if pos+8 > len(data) {
+			return fmt.Errorf("SZX chunk header truncated at offset %d", pos)
+		}
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if size > len(data)-pos {
+			return fmt.Errorf("SZX chunk %q truncated", strings.TrimRight(id, "\x00"))
+		}
+		body := data[pos : pos+size]
+		pos += size
+
+		chunk, ok := szxChunks[id]
+		if !ok || chunk.Load == nil {
+			continue
+		}
+		if err := chunk.Load(s, body); err != nil {
+			return fmt.Errorf("SZX chunk %q: %w", strings.TrimRight(id, "\x00"), err)
+		}
+	}
+	return nil
+}
+
+// SaveSZX writes the machine state as an SZX snapshot
+func (s *Spectrum) SaveSZX(w io.Writer) error {
+	return s.saveSZX(w, true)
+}
+
+// saveSZX writes an SZX snapshot, leaving out the RAM pages if withRAM is
+// false for callers that keep memory themselves
+func (s *Spectrum) saveSZX(w io.Writer, withRAM bool) error {
+	var out bytes.Buffer
+	out.WriteString("ZXST")
+	out.Write([]uint8{szxMajor, szxMinor, szxMachineIDs[s.model], 0})
+
+	for _, id := range szxChunkOrder {
+		chunk := szxChunks[id]
+		if chunk.Save == nil || (id == "RAMP" && !withRAM) {
+			continue
+		}
+		for _, body := range chunk.Save(s) {
+			var hdr [8]uint8
+			copy(hdr[:], id)
+			binary.LittleEndian.PutUint32(hdr[4:], uint32(len(body)))
+			out.Write(hdr[:])
+			out.Write(body)
+		}
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func loadSZXCreator(s *Spectrum, data []uint8) error {
+	return nil // Informational only
+}
+
+func saveSZXCreator(s *Spectrum) [][]uint8 {
+	body := make([]uint8, 36)
+	copy(body, "zen80")
+	return [][]uint8{body}
+}
+
+// Z80R flags
+const (
+	szxZ80LastEI = 0x01
+	szxZ80Halted = 0x02
+)
+
+func loadSZXZ80Regs(s *Spectrum, data []uint8) error {
+	if len(data) < 37 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	cpu := s.CPU
+	word := func(off int) uint16 { return binary.LittleEndian.Uint16(data[off:]) }
+
+	cpu.SetAF(word(0))
+	cpu.SetBC(word(2))
+	cpu.SetDE(word(4))
+	cpu.SetHL(word(6))
+	cpu.A_, cpu.F_ = uint8(word(8)>>8), uint8(word(8))
+	cpu.B_, cpu.C_ = uint8(word(10)>>8), uint8(word(10))
+	cpu.D_, cpu.E_ = uint8(word(12)>>8), uint8(word(12))
+	cpu.H_, cpu.L_ = uint8(word(14)>>8), uint8(word(14))
+	cpu.SetIX(word(16))
+	cpu.SetIY(word(18))
+	cpu.SP = word(20)
+	cpu.PC = word(22)
+	cpu.I = data[24]
+	cpu.R = data[25]
+	cpu.IFF1 = data[26] != 0
+	cpu.IFF2 = data[27] != 0
+	cpu.IM = data[28] & 0x03
+	s.SetFrameTstates(int(binary.LittleEndian.Uint32(data[29:])))
+	cpu.SetPendingEI(data[34]&szxZ80LastEI != 0)
+	if data[34]&szxZ80Halted != 0 {
+		// SZX points PC at the HALT; the core keeps it on the next instruction
+		cpu.Halted = true
+		cpu.PC++
+	}
+	cpu.WZ = word(35)
+	return nil
+}
+
+func saveSZXZ80Regs(s *Spectrum) [][]uint8 {
+	cpu := s.CPU
+	body := make([]uint8, 37)
+	put := func(off int, v uint16) { binary.LittleEndian.PutUint16(body[off:], v) }
+
+	put(0, cpu.AF())
+	put(2, cpu.BC())
+	put(4, cpu.DE())
+	put(6, cpu.HL())
+	put(8, uint16(cpu.A_)<<8|uint16(cpu.F_))
+	put(10, uint16(cpu.B_)<<8|uint16(cpu.C_))
+	put(12, uint16(cpu.D_)<<8|uint16(cpu.E_))
+	put(14, uint16(cpu.H_)<<8|uint16(cpu.L_))
+	put(16, cpu.IX())
+	put(18, cpu.IY())
+	put(20, cpu.SP)
+	put(22, s.snapshotPC())
+	body[24] = cpu.I
+	body[25] = cpu.R
+	if cpu.IFF1 {
+		body[26] = 1
+	}
+	if cpu.IFF2 {
+		body[27] = 1
+	}
+	body[28] = cpu.IM
+	binary.LittleEndian.PutUint32(body[29:], uint32(s.FrameTstates()))
+	body[33] = uint8(s.model.config().intLength)
+	if cpu.PendingEI() {
+		body[34] |= szxZ80LastEI
+	}
+	if cpu.Halted {
+		body[34] |= szxZ80Halted
+	}
+	put(35, cpu.WZ)
+	return [][]uint8{body}
+}
+
+func loadSZXSpecRegs(s *Spectrum, data []uint8) error {
+	if len(data) < 4 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	s.border = data[0] & 0x07
+	s.io.lastOut = data[3]
+	s.io.mic = data[3]&0x08 != 0
+	s.io.speaker = data[3]&0x10 != 0
+	mem := s.memory
+	if mem.paging && !mem.locked {
+		mem.port7FFD = data[1]
+		mem.locked = data[1]&0x20 != 0
+		if mem.plus3 {
+			mem.port1FFD = data[2]
+		}
+		mem.updateSlots()
+	}
+	return nil
+}
+
+func saveSZXSpecRegs(s *Spectrum) [][]uint8 {
+	body := make([]uint8, 8)
+	body[0] = s.border
+	body[1] = s.memory.port7FFD
+	body[2] = s.memory.port1FFD
+	body[3] = s.io.lastOut
+	return [][]uint8{body}
+}
+
+// RAMP flags
+const szxRAMPCompressed = 0x0001
+
+func loadSZXRAMPage(s *Spectrum, data []uint8) error {
+	if len(data) < 3 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	flags := binary.LittleEndian.Uint16(data)
+	page := int(data[2])
+	if page > 7 {
+		return nil // Pages beyond 128K belong to larger machines
+	}
+	body := data[3:]
+	if flags&szxRAMPCompressed != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+	}
+	if len(body) != 16384 {
+		return fmt.Errorf("page %d has %d bytes, want 16384", page, len(body))
+	}
+	copy(s.memory.ram[page][:], body)
+	return nil
+}
+
+func saveSZXRAMPages(s *Spectrum) [][]uint8 {
+	pages := []int{5, 2, 0}
+	if s.memory.paging {
+		pages = []int{0, 1, 2, 3, 4, 5, 6, 7}
+	}
+	var bodies [][]uint8
+	for _, page := range pages {
+		var z bytes.Buffer
+		z.Write([]uint8{uint8(szxRAMPCompressed), 0, uint8(page)})
+		zw := zlib.NewWriter(&z)
+		zw.Write(s.memory.ram[page][:])
+		zw.Close()
+		bodies = append(bodies, z.Bytes())
+	}
+	return bodies
+}
+
+func loadSZXAY(s *Spectrum, data []uint8) error {
+	if len(data) < 18 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	ay := s.io.ay
+	if ay == nil {
+		return nil // 48K machine without an AY interface
+	}
+	var regs [16]uint8
+	copy(regs[:], data[2:18])
+	ay.SetRegisters(regs)
+	ay.Select(data[1])
+	return nil
+}
+
+func saveSZXAY(s *Spectrum) [][]uint8 {
+	ay := s.io.ay
+	if ay == nil {
+		return nil
+	}
+	body := make([]uint8, 18)
+	body[0] = 0x02 // ZXSTAYF_128AY
+	body[1] = ay.Selected()
+	regs := ay.Registers()
+	copy(body[2:], regs[:])
+	return [][]uint8{body}
+}
+
+// SZX joystick types
+var szxJoystickTypes = map[uint8]JoystickType{
+	0: JoystickKempston,
+	1: JoystickFuller,
+	2: JoystickCursor,
+	3: JoystickSinclairRight, // Sinclair 1
+	4: JoystickSinclairLeft,  // Sinclair 2
+}
+
+const szxJoystickNone = 8
+
+func loadSZXJoystick(s *Spectrum, data []uint8) error {
+	if len(data) < 6 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	for _, d := range append([]InputDevice(nil), s.Devices()...) {
+		if j, ok := d.(*Joystick); ok {
+			s.DetachDevice(j)
+		}
+	}
+	for _, t := range data[4:6] {
+		if kind, ok := szxJoystickTypes[t]; ok {
+			s.AttachJoystick(kind)
+		}
+	}
+	return nil
+}
+
+func saveSZXJoystick(s *Spectrum) [][]uint8 {
+	body := []uint8{0, 0, 0, 0, szxJoystickNone, szxJoystickNone}
+	player := 4
+	for _, d := range s.Devices() {
+		j, ok := d.(*Joystick)
+		if !ok || player == len(body) {
+			continue
+		}
+		for id, kind := range szxJoystickTypes {
+			if kind == j.Type() {
+				body[player] = id
+				player++
+				break
+			}
+		}
+	}
+	if player == 4 {
+		return nil
+	}
+	return [][]uint8{body}
+}
+
+// AMXM mouse types
+const szxMouseKempston = 2
+
+func loadSZXMouse(s *Spectrum, data []uint8) error {
+	if len(data) < 1 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	for _, d := range append([]InputDevice(nil), s.Devices()...) {
+		if m, ok := d.(*KempstonMouse); ok {
+			s.DetachDevice(m)
+		}
+	}
+	if data[0] == szxMouseKempston {
+		s.AttachKempstonMouse()
+	}
+	return nil
+}
+
+func saveSZXMouse(s *Spectrum) [][]uint8 {
+	for _, d := range s.Devices() {
+		if _, ok := d.(*KempstonMouse); ok {
+			body := make([]uint8, 7) // Type, then the AMX CTRLA and CTRLB registers
+			body[0] = szxMouseKempston
+			return [][]uint8{body}
+		}
+	}
+	return nil
+}
+
+// TAPE flags
+const (
+	szxTapeEmbedded   = 0x0001
+	szxTapeCompressed = 0x0002
+)
+
+func loadSZXTape(s *Spectrum, data []uint8) error {
+	if len(data) < 28 {
+		return fmt.Errorf("chunk too short (%d bytes)", len(data))
+	}
+	block := int(binary.LittleEndian.Uint16(data[0:]))
+	flags := binary.LittleEndian.Uint16(data[2:])
+	ext := strings.ToLower(strings.TrimRight(string(data[12:28]), "\x00"))
+	if flags&szxTapeEmbedded == 0 {
+		return nil // Only a file name is stored; nothing to load
+	}
+	body := data[28:]
+	if flags&szxTapeCompressed != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+
+	var tape *PulseTape
+	var err error
+	switch ext {
+	case "tap":
+		tape, err = LoadTAP(body)
+	case "csw":
+		tape, err = LoadCSW(body)
+	case "wav":
+		tape, err = LoadWAV(body, DefaultWAVOptions())
+	default:
+		return nil // Embedded format zen80 cannot play (e.g. TZX)
+	}
+	if err != nil {
+		return err
+	}
+	s.InsertTape(tape)
+	tape.SeekBlock(block)
+	return nil
+}
+
+func saveSZXTape(s *Spectrum) [][]uint8 {
+	tape, ok := s.tape.Source().(*PulseTape)
+	if !ok || tape == nil {
+		return nil
+	}
+
+	var file bytes.Buffer
+	ext := "tap"
+	if err := WriteTAP(&file, tape.Blocks()); err != nil || tape.Blocks() == nil {
+		file.Reset()
+		ext = "csw"
+		if err := WriteCSW(&file, tape); err != nil {
+			return nil
+		}
+	}
+
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(file.Bytes())
+	zw.Close()
+
+	body := make([]uint8, 28, 28+z.Len())
+	binary.LittleEndian.PutUint16(body[0:], uint16(tape.CurrentBlock()))
+	binary.LittleEndian.PutUint16(body[2:], szxTapeEmbedded|szxTapeCompressed)
+	binary.LittleEndian.PutUint32(body[4:], uint32(file.Len()))
+	binary.LittleEndian.PutUint32(body[8:], uint32(z.Len()))
+	copy(body[12:], ext)
+	return [][]uint8{append(body, z.Bytes()...)}
+}
@@ -0,0 +1,92 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSZXRoundTrip(t *testing.T) {
+	for _, model := range []Model{Model48K, Model128K, ModelPlus3} {
+		t.Run(model.String(), func(t *testing.T) {
+			src := NewSpectrumModel(model)
+			setTestRegisters(src)
+			src.CPU.WZ = 0x1357
+			src.memory.Write(0x4000, 0xAA)
+			src.memory.Write(0xFFFF, 0x55)
+			if ay := src.AY(); ay != nil {
+				ay.Select(7)
+				ay.Write(0x38)
+			}
+			src.InsertTape(BlocksToTape([]TapeBlock{
+				{Data: []uint8{0x00, 1, 2, 3}, Standard: true, Pause: StandardPause},
+				{Data: []uint8{0xFF, 4, 5, 6}, Standard: true, Pause: StandardPause},
+			}))
+			src.tape.Source().(*PulseTape).SeekBlock(1)
+
+			var buf bytes.Buffer
+			if err := src.SaveSZX(&buf); err != nil {
+				t.Fatalf("SaveSZX: %v", err)
+			}
+			if got, err := SZXSnapshotModel(buf.Bytes()); err != nil || got != model {
+				t.Fatalf("SZXSnapshotModel = %v, %v; want %v", got, err, model)
+			}
+
+			dst := NewSpectrumModel(model)
+			if err := dst.LoadSZX(buf.Bytes()); err != nil {
+				t.Fatalf("LoadSZX: %v", err)
+			}
+			compareRegisters(t, dst, src)
+			if dst.CPU.WZ != 0x1357 {
+				t.Errorf("WZ = %04X, want 1357", dst.CPU.WZ)
+			}
+			if dst.memory.Read(0x4000) != 0xAA || dst.memory.Read(0xFFFF) != 0x55 {
+				t.Errorf("memory not restored")
+			}
+			if ay := dst.AY(); ay != nil && (ay.Selected() != 7 || ay.Registers()[7] != 0x38) {
+				t.Errorf("AY state not restored")
+			}
+			tape, ok := dst.tape.Source().(*PulseTape)
+			if !ok || len(tape.Blocks()) != 2 || tape.CurrentBlock() != 1 {
+				t.Errorf("tape not restored at block 1")
+			}
+		})
+	}
+}
+
+func TestSZXSkipsUnknownChunks(t *testing.T) {
+	src := NewSpectrum()
+	setTestRegisters(src)
+	var buf bytes.Buffer
+	if err := src.SaveSZX(&buf); err != nil {
+		t.Fatalf("SaveSZX: %v", err)
+	}
+
+	// Insert an unknown chunk straight after the file header
+	data := buf.Bytes()
+	var chunk [12]uint8
+	copy(chunk[:], "XYZ?")
+	binary.LittleEndian.PutUint32(chunk[4:], 4)
+	patched := append(append(append([]uint8{}, data[:8]...), chunk[:]...), data[8:]...)
+
+	// Preserved chunks for unemulated hardware survive a reload
+	keyb := []uint8{0x08, 0, 0, 0, 1}
+	var hdr [8]uint8
+	copy(hdr[:], "KEYB")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(keyb)))
+	patched = append(append(patched, hdr[:]...), keyb...)
+
+	dst := NewSpectrum()
+	if err := dst.LoadSZX(patched); err != nil {
+		t.Fatalf("LoadSZX: %v", err)
+	}
+	compareRegisters(t, dst, src)
+
+	buf.Reset()
+	if err := dst.SaveSZX(&buf); err != nil {
+		t.Fatalf("SaveSZX: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), append(hdr[:], keyb...)) {
+		t.Errorf("KEYB chunk not preserved on save")
+	}
+}
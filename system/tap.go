@@ -0,0 +1,153 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Standard ROM loader timings, in T-states at 3.5 MHz
+const (
+	PilotPulse       = 2168
+	Sync1Pulse       = 667
+	Sync2Pulse       = 735
+	ZeroPulse        = 855
+	OnePulse         = 1710
+	HeaderPilotCount = 8063 // Pilot pulses before a header block (flag < 0x80)
+	DataPilotCount   = 3223 // Pilot pulses before a data block
+	StandardPause    = 1000 // Milliseconds of silence after a block
+	StandardClock    = 3500000
+)
+
+// TapeBlock is one block of a tape image. Standard blocks hold the bytes
+// saved by the ROM (flag, payload and checksum). Non-standard blocks hold
+// the raw signal instead, in T-states at StandardClock.
+type TapeBlock struct {
+	Data     []uint8
+	Standard bool
+	Pulses   []Pulse // Raw signal for non-standard blocks
+	Pause    int     // Milliseconds of silence after the block
+}
+
+// ParseTAP splits a TAP file into its blocks
+func ParseTAP(data []uint8) ([]TapeBlock, error) {
+	var blocks []TapeBlock
+	for pos := 0; pos < len(data); {
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("TAP block header truncated at offset %d", pos)
+		}
+		length := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+length > len(data) {
+			return nil, fmt.Errorf("TAP block at offset %d truncated (%d of %d bytes)", pos-2, len(data)-pos, length)
+		}
+		block := make([]uint8, length)
+		copy(block, data[pos:pos+length])
+		blocks = append(blocks, TapeBlock{
+			Data:     block,
+			Standard: true,
+			Pause:    StandardPause,
+		})
+		pos += length
+	}
+	return blocks, nil
+}
+
+// WriteTAP writes standard blocks as a TAP file. Non-standard blocks
+// cannot be represented in TAP and cause an error.
+func WriteTAP(w io.Writer, blocks []TapeBlock) error {
+	for i, b := range blocks {
+		if !b.Standard {
+			return fmt.Errorf("block %d is not a standard ROM block", i)
+		}
+		if len(b.Data) > 0xFFFF {
+			return fmt.Errorf("block %d too long for TAP (%d bytes)", i, len(b.Data))
+		}
+		var hdr [2]uint8
+		binary.LittleEndian.PutUint16(hdr[:], uint16(len(b.Data)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadTAP decodes a TAP file into a tape playing the blocks with standard
+// ROM timings
+func LoadTAP(data []uint8) (*PulseTape, error) {
+	blocks, err := ParseTAP(data)
+	if err != nil {
+		return nil, err
+	}
+	return BlocksToTape(blocks), nil
+}
+
+// BlocksToTape renders tape blocks into a pulse tape at StandardClock
+func BlocksToTape(blocks []TapeBlock) *PulseTape {
+	var b pulseBuilder
+	starts := make([]int, len(blocks))
+	for i, block := range blocks {
+		starts[i] = len(b.pulses)
+		if block.Standard {
+			appendStandardBlock(&b, block.Data)
+		} else {
+			for _, p := range block.Pulses {
+				b.add(p.Length, p.Level)
+			}
+		}
+		appendPause(&b, block.Pause)
+	}
+	tape := NewPulseTape(StandardClock, b.pulses)
+	tape.blocks = blocks
+	tape.starts = starts
+	return tape
+}
+
+// appendStandardBlock encodes a block with the ROM saving routine's timings
+func appendStandardBlock(b *pulseBuilder, data []uint8) {
+	level := true
+	if n := len(b.pulses); n > 0 {
+		level = !b.pulses[n-1].Level
+	}
+	pulse := func(length uint32) {
+		b.add(length, level)
+		level = !level
+	}
+
+	pilots := HeaderPilotCount
+	if len(data) > 0 && data[0] >= 0x80 {
+		pilots = DataPilotCount
+	}
+	for i := 0; i < pilots; i++ {
+		pulse(PilotPulse)
+	}
+	pulse(Sync1Pulse)
+	pulse(Sync2Pulse)
+	for _, v := range data {
+		for bit := 7; bit >= 0; bit-- {
+			length := uint32(ZeroPulse)
+			if v&(1<<bit) != 0 {
+				length = OnePulse
+			}
+			pulse(length)
+			pulse(length)
+		}
+	}
+}
+
+// appendPause adds silence after a block. The line first flips for 1ms so
+// that the final pulse of the block is terminated by an edge, then rests low.
+func appendPause(b *pulseBuilder, ms int) {
+	if ms <= 0 {
+		return
+	}
+	perMs := uint32(StandardClock / 1000)
+	if n := len(b.pulses); n > 0 {
+		b.add(perMs, !b.pulses[n-1].Level)
+		ms--
+	}
+	b.add(uint32(ms)*perMs, false)
+}
@@ -0,0 +1,207 @@
+package system
+
+// Pulse is one segment of a tape signal: the EAR line held at Level for
+// Length samples of the owning source's sample rate.
+type Pulse struct {
+	Length uint32
+	Level  bool
+}
+
+// TapeSource supplies a tape signal as a sequence of pulses. All tape
+// formats (TAP, WAV, CSW, ...) are played through the same TapePlayer by
+// implementing this interface.
+type TapeSource interface {
+	// SampleRate returns the number of samples per second that pulse
+	// lengths are expressed in.
+	SampleRate() int
+	// NextPulse returns the next pulse, or ok=false at the end of the tape.
+	NextPulse() (pulse Pulse, ok bool)
+	// Rewind moves back to the start of the tape.
+	Rewind()
+}
+
+// PulseTape is a TapeSource backed by an in-memory list of pulses. The
+// WAV, CSW and TAP loaders all decode into a PulseTape.
+type PulseTape struct {
+	rate   int
+	pulses []Pulse
+	pos    int
+	blocks []TapeBlock // Source blocks, when the tape was built from blocks
+	starts []int       // Index of the first pulse of each block
+}
+
+// NewPulseTape creates a tape from a list of pulses at the given sample rate
+func NewPulseTape(rate int, pulses []Pulse) *PulseTape {
+	return &PulseTape{
+		rate:   rate,
+		pulses: pulses,
+	}
+}
+
+// SampleRate returns the sample rate pulse lengths are measured in
+func (t *PulseTape) SampleRate() int {
+	return t.rate
+}
+
+// NextPulse returns the next pulse on the tape
+func (t *PulseTape) NextPulse() (Pulse, bool) {
+	if t.pos >= len(t.pulses) {
+		return Pulse{}, false
+	}
+	p := t.pulses[t.pos]
+	t.pos++
+	return p, true
+}
+
+// Rewind moves back to the start of the tape
+func (t *PulseTape) Rewind() {
+	t.pos = 0
+}
+
+// Pulses returns the decoded pulse list
+func (t *PulseTape) Pulses() []Pulse {
+	return t.pulses
+}
+
+// Blocks returns the blocks the tape was built from, or nil for sampled
+// recordings such as WAV and CSW
+func (t *PulseTape) Blocks() []TapeBlock {
+	return t.blocks
+}
+
+// CurrentBlock returns the index of the block being played
+func (t *PulseTape) CurrentBlock() int {
+	block := 0
+	for i, start := range t.starts {
+		if t.pos >= start {
+			block = i
+		}
+	}
+	return block
+}
+
+// SeekBlock moves to the start of block n
+func (t *PulseTape) SeekBlock(n int) {
+	if n >= 0 && n < len(t.starts) {
+		t.pos = t.starts[n]
+	}
+}
+
+// Duration returns the total length of the tape in seconds
+func (t *PulseTape) Duration() float64 {
+	var samples uint64
+	for _, p := range t.pulses {
+		samples += uint64(p.Length)
+	}
+	return float64(samples) / float64(t.rate)
+}
+
+// pulseBuilder accumulates pulses, merging consecutive runs at the same level
+type pulseBuilder struct {
+	pulses []Pulse
+}
+
+func (b *pulseBuilder) add(length uint32, level bool) {
+	if length == 0 {
+		return
+	}
+	if n := len(b.pulses); n > 0 && b.pulses[n-1].Level == level {
+		b.pulses[n-1].Length += length
+		return
+	}
+	b.pulses = append(b.pulses, Pulse{Length: length, Level: level})
+}
+
+// TapePlayer replays a TapeSource into the EAR input, converting pulse
+// lengths from the source sample rate to CPU T-states.
+type TapePlayer struct {
+	source  TapeSource
+	clockHz float64
+
+	playing bool
+	level   bool
+	remain  float64 // T-states left in the current pulse
+	scale   float64 // T-states per source sample
+}
+
+// NewTapePlayer creates a tape player for a CPU running at clockHz
+func NewTapePlayer(clockHz float64) *TapePlayer {
+	return &TapePlayer{
+		clockHz: clockHz,
+	}
+}
+
+// Insert loads a tape into the player, stopped and rewound
+func (p *TapePlayer) Insert(source TapeSource) {
+	p.source = source
+	p.playing = false
+	p.level = false
+	p.remain = 0
+	p.scale = 0
+	if source != nil {
+		source.Rewind()
+		p.scale = p.clockHz / float64(source.SampleRate())
+	}
+}
+
+// Source returns the inserted tape, or nil when the player is empty
+func (p *TapePlayer) Source() TapeSource {
+	return p.source
+}
+
+// Eject removes the tape from the player
+func (p *TapePlayer) Eject() {
+	p.Insert(nil)
+}
+
+// Play starts (or resumes) playback
+func (p *TapePlayer) Play() {
+	if p.source != nil {
+		p.playing = true
+	}
+}
+
+// Stop pauses playback at the current position
+func (p *TapePlayer) Stop() {
+	p.playing = false
+}
+
+// Rewind moves the tape back to the start without changing play state
+func (p *TapePlayer) Rewind() {
+	if p.source == nil {
+		return
+	}
+	p.source.Rewind()
+	p.level = false
+	p.remain = 0
+}
+
+// Playing reports whether the tape is currently running
+func (p *TapePlayer) Playing() bool {
+	return p.playing
+}
+
+// Level returns the current EAR level
+func (p *TapePlayer) Level() bool {
+	return p.level
+}
+
+// Advance moves the tape forward by the given number of T-states
+func (p *TapePlayer) Advance(tstates int) {
+	if !p.playing {
+		return
+	}
+	p.remain -= float64(tstates)
+	for p.remain <= 0 {
+		pulse, ok := p.source.NextPulse()
+		if !ok {
+			// End of tape: stop the motor and let the line settle low
+			p.playing = false
+			p.level = false
+			p.remain = 0
+			return
+		}
+		p.level = pulse.Level
+		p.remain += float64(pulse.Length) * p.scale
+	}
+}
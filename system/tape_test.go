@@ -0,0 +1,149 @@
+package system
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// buildWAV assembles a minimal PCM WAV file around the given sample data
+func buildWAV(rate, channels, bits int, samples []uint8) []uint8 {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+len(samples)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	binary.Write(&b, binary.LittleEndian, uint16(channels))
+	binary.Write(&b, binary.LittleEndian, uint32(rate))
+	binary.Write(&b, binary.LittleEndian, uint32(rate*channels*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(channels*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(bits))
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(samples)))
+	b.Write(samples)
+	return b.Bytes()
+}
+
+func TestLoadWAV8BitMono(t *testing.T) {
+	// 3 low, 2 high, 4 low samples
+	samples := []uint8{0x10, 0x10, 0x10, 0xF0, 0xF0, 0x10, 0x10, 0x10, 0x10}
+	tape, err := LoadWAV(buildWAV(44100, 1, 8, samples), DefaultWAVOptions())
+	if err != nil {
+		t.Fatalf("LoadWAV: %v", err)
+	}
+	want := []Pulse{{3, false}, {2, true}, {4, false}}
+	got := tape.Pulses()
+	if len(got) != len(want) {
+		t.Fatalf("pulses = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pulse %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if tape.SampleRate() != 44100 {
+		t.Errorf("rate = %d, want 44100", tape.SampleRate())
+	}
+}
+
+func TestLoadWAV16BitStereoHysteresis(t *testing.T) {
+	var samples []uint8
+	// Right channel carries the signal; left stays silent.
+	// Values hover around zero inside the hysteresis band and must not toggle.
+	for _, v := range []int16{-8000, 500, -500, 8000, 500, -500, -8000} {
+		frame := make([]uint8, 4)
+		binary.LittleEndian.PutUint16(frame[2:], uint16(v))
+		samples = append(samples, frame...)
+	}
+	opts := DefaultWAVOptions()
+	opts.Channel = WAVChannelRight
+	opts.Hysteresis = 0.1
+	tape, err := LoadWAV(buildWAV(22050, 2, 16, samples), opts)
+	if err != nil {
+		t.Fatalf("LoadWAV: %v", err)
+	}
+	want := []Pulse{{3, false}, {3, true}, {1, false}}
+	got := tape.Pulses()
+	if len(got) != len(want) {
+		t.Fatalf("pulses = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pulse %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadCSW(t *testing.T) {
+	rle := []uint8{10, 20, 0, 0x00, 0x01, 0x00, 0x00, 30}
+
+	// Version 1, RLE, initial polarity high
+	v1 := make([]uint8, 0x20)
+	copy(v1, cswSignature)
+	v1[0x17], v1[0x18] = 1, 1
+	binary.LittleEndian.PutUint16(v1[0x19:], 44100)
+	v1[0x1B] = cswRLE
+	v1[0x1C] = 0x01
+	v1 = append(v1, rle...)
+
+	// Version 2, Z-RLE, initial polarity high
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(rle)
+	zw.Close()
+	v2 := make([]uint8, 0x34)
+	copy(v2, cswSignature)
+	v2[0x17], v2[0x18] = 2, 0
+	binary.LittleEndian.PutUint32(v2[0x19:], 44100)
+	binary.LittleEndian.PutUint32(v2[0x1D:], 4)
+	v2[0x21] = cswZRLE
+	v2[0x22] = 0x01
+	v2 = append(v2, z.Bytes()...)
+
+	want := []Pulse{{10, true}, {20, false}, {256, true}, {30, false}}
+	for name, data := range map[string][]uint8{"v1": v1, "v2": v2} {
+		tape, err := LoadCSW(data)
+		if err != nil {
+			t.Fatalf("%s: LoadCSW: %v", name, err)
+		}
+		got := tape.Pulses()
+		if len(got) != len(want) {
+			t.Fatalf("%s: pulses = %v, want %v", name, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: pulse %d = %v, want %v", name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestTapePlayerTiming(t *testing.T) {
+	// 1000 Hz source on a 3.5 MHz clock: each sample is 3500 T-states
+	p := NewTapePlayer(3500000)
+	p.Insert(NewPulseTape(1000, []Pulse{{1, true}, {2, false}, {1, true}}))
+	p.Play()
+
+	p.Advance(1)
+	if !p.Level() {
+		t.Fatalf("expected high level at start of first pulse")
+	}
+	p.Advance(3499)
+	if p.Level() {
+		t.Fatalf("expected low level after 3500 T-states")
+	}
+	p.Advance(6999)
+	if p.Level() {
+		t.Fatalf("expected low level just before 10500 T-states")
+	}
+	p.Advance(1)
+	if !p.Level() {
+		t.Fatalf("expected high level at 10500 T-states")
+	}
+	p.Advance(3500)
+	if p.Playing() {
+		t.Errorf("player should stop at end of tape")
+	}
+}
@@ -0,0 +1,222 @@
+package system
+
+import (
+	"fmt"
+	"io"
+)
+
+// Decoder tolerances, in T-states at StandardClock
+const (
+	recorderGap      = 10000 // Pulses longer than this separate blocks
+	recorderMinPilot = 256   // The ROM loader needs at least this many pilot pulses
+	pilotMin         = 1700
+	pilotMax         = 2700
+	syncMin          = 400
+	syncMax          = 1100
+	zeroMin          = 600
+	zeroMax          = 1250
+	oneMin           = 1300
+	oneMax           = 2200
+)
+
+// TapeRecorder captures the MIC output with T-state timing so that programs
+// saving to tape can be written out as TAP, TZX or WAV files.
+type TapeRecorder struct {
+	clockHz   float64
+	recording bool
+	level     bool
+	lastEdge  uint64
+	pulses    pulseBuilder // Pulse lengths in machine T-states
+}
+
+// NewTapeRecorder creates a recorder for a CPU running at clockHz
+func NewTapeRecorder(clockHz float64) *TapeRecorder {
+	return &TapeRecorder{
+		clockHz: clockHz,
+	}
+}
+
+// Start begins recording at T-state now with the MIC line at level
+func (r *TapeRecorder) Start(now uint64, level bool) {
+	r.recording = true
+	r.level = level
+	r.lastEdge = now
+}
+
+// Stop ends recording at T-state now, closing the final pulse
+func (r *TapeRecorder) Stop(now uint64) {
+	if !r.recording {
+		return
+	}
+	r.Edge(now, !r.level)
+	r.recording = false
+}
+
+// Recording reports whether the recorder is running
+func (r *TapeRecorder) Recording() bool {
+	return r.recording
+}
+
+// Reset discards everything recorded so far
+func (r *TapeRecorder) Reset() {
+	r.pulses = pulseBuilder{}
+}
+
+// Edge notes the MIC line changing to level at T-state now
+func (r *TapeRecorder) Edge(now uint64, level bool) {
+	if !r.recording || level == r.level {
+		return
+	}
+	if now > r.lastEdge {
+		r.pulses.add(uint32(now-r.lastEdge), r.level)
+	}
+	r.level = level
+	r.lastEdge = now
+}
+
+// Tape returns the recorded signal as a tape at the machine clock rate
+func (r *TapeRecorder) Tape() *PulseTape {
+	pulses := make([]Pulse, len(r.pulses.pulses))
+	copy(pulses, r.pulses.pulses)
+	return NewPulseTape(int(r.clockHz), pulses)
+}
+
+// Blocks decodes the recording into tape blocks. Stretches of signal that
+// follow the ROM saving routine's encoding and carry a valid checksum
+// become standard blocks; anything else is kept as a raw recording.
+func (r *TapeRecorder) Blocks() []TapeBlock {
+	// Normalise to standard T-states so the ROM timings apply on any model
+	scale := StandardClock / r.clockHz
+	var blocks []TapeBlock
+	var segment []Pulse
+	flush := func(gap uint32) {
+		if len(segment) > 0 {
+			block := decodeSegment(segment)
+			block.Pause = int(uint64(gap) * 1000 / StandardClock)
+			blocks = append(blocks, block)
+		}
+		segment = nil
+	}
+
+	for _, p := range r.pulses.pulses {
+		length := uint32(float64(p.Length)*scale + 0.5)
+		if length > recorderGap {
+			flush(length)
+			continue
+		}
+		segment = append(segment, Pulse{Length: length, Level: p.Level})
+	}
+	flush(StandardClock / 1000 * StandardPause)
+	return blocks
+}
+
+// Standard reports whether every recorded block decoded as a standard ROM
+// block, i.e. whether the recording can be saved as a TAP file
+func (r *TapeRecorder) Standard() bool {
+	for _, b := range r.Blocks() {
+		if !b.Standard {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTAP writes the recording as a TAP file
+func (r *TapeRecorder) WriteTAP(w io.Writer) error {
+	return WriteTAP(w, r.Blocks())
+}
+
+// WriteTZX writes the recording as a TZX file
+func (r *TapeRecorder) WriteTZX(w io.Writer) error {
+	return WriteTZX(w, r.Blocks())
+}
+
+// Save writes a TAP file when every block is standard and a TZX file with
+// direct recording blocks otherwise. It returns the format written.
+func (r *TapeRecorder) Save(w io.Writer) (string, error) {
+	blocks := r.Blocks()
+	for _, b := range blocks {
+		if !b.Standard {
+			return "tzx", WriteTZX(w, blocks)
+		}
+	}
+	return "tap", WriteTAP(w, blocks)
+}
+
+// decodeSegment tries to decode one gap-delimited stretch of signal as a
+// standard ROM block
+func decodeSegment(segment []Pulse) TapeBlock {
+	if data, err := decodeStandard(segment); err == nil {
+		return TapeBlock{Data: data, Standard: true}
+	}
+	raw := make([]Pulse, len(segment))
+	copy(raw, segment)
+	return TapeBlock{Pulses: raw}
+}
+
+func decodeStandard(segment []Pulse) ([]uint8, error) {
+	within := func(p Pulse, lo, hi uint32) bool {
+		return p.Length >= lo && p.Length <= hi
+	}
+
+	// The first edge written by the ROM can be short; allow it to be skipped
+	i := 0
+	if len(segment) > 0 && !within(segment[0], pilotMin, pilotMax) {
+		i++
+	}
+	start := i
+	for i < len(segment) && within(segment[i], pilotMin, pilotMax) {
+		i++
+	}
+	if i-start < recorderMinPilot {
+		return nil, fmt.Errorf("pilot tone too short (%d pulses)", i-start)
+	}
+	if i+2 > len(segment) || !within(segment[i], syncMin, syncMax) || !within(segment[i+1], syncMin, syncMax) {
+		return nil, fmt.Errorf("missing sync pulses")
+	}
+	i += 2
+
+	var data []uint8
+	var cur uint8
+	bits := 0
+	for ; i+1 < len(segment); i += 2 {
+		a, b := segment[i], segment[i+1]
+		switch {
+		case within(a, zeroMin, zeroMax) && within(b, zeroMin, zeroMax):
+			cur <<= 1
+		case within(a, oneMin, oneMax) && within(b, oneMin, oneMax):
+			cur = cur<<1 | 1
+		default:
+			return nil, fmt.Errorf("unrecognised bit pulses %d,%d", a.Length, b.Length)
+		}
+		bits++
+		if bits == 8 {
+			data = append(data, cur)
+			cur, bits = 0, 0
+		}
+	}
+	// The final pulse may have run into the following gap; if so the first
+	// half of the last bit is enough to tell its value
+	if i < len(segment) && bits == 7 {
+		switch {
+		case within(segment[i], zeroMin, zeroMax):
+			data = append(data, cur<<1)
+			bits = 0
+		case within(segment[i], oneMin, oneMax):
+			data = append(data, cur<<1|1)
+			bits = 0
+		}
+	}
+	if bits != 0 || len(data) < 2 {
+		return nil, fmt.Errorf("incomplete block (%d bytes, %d bits)", len(data), bits)
+	}
+
+	var sum uint8
+	for _, v := range data {
+		sum ^= v
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return data, nil
+}
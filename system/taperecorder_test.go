@@ -0,0 +1,133 @@
+package system
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSpectrum creates a free-running 48K Spectrum with the real ROM,
+// skipping the test when the ROM is not available
+func newTestSpectrum(t *testing.T) *Spectrum {
+	t.Helper()
+	rom, err := os.ReadFile(filepath.Join("..", "rom", "48.rom"))
+	if err != nil {
+		t.Skipf("missing 48.rom in ../rom directory: %v", err)
+	}
+	s := NewSpectrum()
+	if err := s.LoadROM(rom); err != nil {
+		t.Fatalf("LoadROM: %v", err)
+	}
+	s.timing.SetUnlimited(true)
+	return s
+}
+
+// callROM runs a ROM routine until it returns to a DI; JR $ loop at 0x8000
+func callROM(t *testing.T, s *Spectrum, addr uint16, maxFrames int) {
+	t.Helper()
+	s.memory.Write(0x8000, 0xF3) // DI
+	s.memory.Write(0x8001, 0x18) // JR $
+	s.memory.Write(0x8002, 0xFE)
+	s.CPU.SP = 0xFF00
+	s.CPU.SP -= 2
+	s.memory.Write(s.CPU.SP, 0x00)
+	s.memory.Write(s.CPU.SP+1, 0x80)
+	s.CPU.PC = addr
+	for i := 0; i < maxFrames; i++ {
+		s.RunFrame()
+		if s.CPU.PC == 0x8001 {
+			return
+		}
+	}
+	t.Fatalf("ROM routine at %04X did not return (PC=%04X)", addr, s.CPU.PC)
+}
+
+func TestTapeSaveLoadRoundTrip(t *testing.T) {
+	s := newTestSpectrum(t)
+	s.CPU.SetIY(0x5C3A)
+	s.CPU.IM = 1
+
+	payload := []uint8("zen80 tape round trip")
+	s.LoadSnapshot(0x9000, payload)
+
+	// SA-BYTES: IX=start, DE=length, A=flag
+	s.StartTapeRecording()
+	s.CPU.SetIX(0x9000)
+	s.CPU.SetDE(uint16(len(payload)))
+	s.CPU.A = 0xFF
+	callROM(t, s, 0x04C2, 500)
+	rec := s.StopTapeRecording()
+
+	blocks := rec.Blocks()
+	if len(blocks) != 1 || !blocks[0].Standard {
+		t.Fatalf("expected one standard block, got %d blocks (standard=%v)", len(blocks), len(blocks) > 0 && blocks[0].Standard)
+	}
+	want := append([]uint8{0xFF}, payload...)
+	var sum uint8
+	for _, v := range want {
+		sum ^= v
+	}
+	want = append(want, sum)
+	if !bytes.Equal(blocks[0].Data, want) {
+		t.Fatalf("decoded block = % X, want % X", blocks[0].Data, want)
+	}
+
+	var tap bytes.Buffer
+	if format, err := rec.Save(&tap); err != nil || format != "tap" {
+		t.Fatalf("Save = %q, %v; want tap", format, err)
+	}
+	var wav bytes.Buffer
+	if err := WriteWAV(&wav, rec.Tape(), 44100); err != nil {
+		t.Fatalf("WriteWAV: %v", err)
+	}
+
+	// Load the recording back from the rendered WAV with LD-BYTES
+	tape, err := LoadWAV(wav.Bytes(), DefaultWAVOptions())
+	if err != nil {
+		t.Fatalf("LoadWAV: %v", err)
+	}
+	s.InsertTape(tape)
+	s.PlayTape()
+	s.CPU.SetIX(0xA000)
+	s.CPU.SetDE(uint16(len(payload)))
+	s.CPU.A = 0xFF
+	s.CPU.F |= 0x01 // Carry set: LOAD rather than VERIFY
+	callROM(t, s, 0x0556, 500)
+	if s.CPU.F&0x01 == 0 {
+		t.Fatalf("LD-BYTES reported a loading error")
+	}
+	for i, v := range payload {
+		if got := s.memory.Read(0xA000 + uint16(i)); got != v {
+			t.Fatalf("loaded byte %d = %02X, want %02X", i, got, v)
+		}
+	}
+}
+
+func TestTapeRecorderNonStandardFallsBackToTZX(t *testing.T) {
+	r := NewTapeRecorder(3500000)
+	r.Start(0, false)
+	now := uint64(0)
+	level := false
+	for i := 0; i < 50; i++ {
+		now += 3000
+		level = !level
+		r.Edge(now, level)
+	}
+	r.Stop(now + 3000)
+
+	if r.Standard() {
+		t.Fatalf("a bare square wave should not decode as a standard block")
+	}
+	var out bytes.Buffer
+	format, err := r.Save(&out)
+	if err != nil || format != "tzx" {
+		t.Fatalf("Save = %q, %v; want tzx", format, err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []uint8("ZXTape!\x1A")) {
+		t.Errorf("missing TZX signature")
+	}
+	if out.Bytes()[10] != tzxDirectRecording {
+		t.Errorf("first block ID = %02X, want %02X", out.Bytes()[10], tzxDirectRecording)
+	}
+}
@@ -134,9 +134,17 @@ type FrameTimer struct {
 
 // NewSpectrumFrameTimer creates a frame timer for ZX Spectrum
 func NewSpectrumFrameTimer() *FrameTimer {
+	return NewFrameTimer(
+		224,  // 224 T-states per scanline
+		312,  // 312 lines (192 visible + 120 border/retrace)
+	)
+}
+
+// NewFrameTimer creates a frame timer with the given scanline geometry
+func NewFrameTimer(cyclesPerLine, linesPerFrame int) *FrameTimer {
 	return &FrameTimer{
-		cyclesPerLine: 224,  // 224 T-states per scanline
-		linesPerFrame: 312,  // 312 lines (192 visible + 120 border/retrace)
+		cyclesPerLine: cyclesPerLine,
+		linesPerFrame: linesPerFrame,
 		currentLine:   0,
 		lineCycles:    0,
 	}
@@ -170,6 +178,19 @@ func (ft *FrameTimer) AddCycles(cycles int) FrameEvent {
 	return event
 }
 
+// Position returns the number of T-states since the start of the frame
+func (ft *FrameTimer) Position() int {
+	return ft.currentLine*ft.cyclesPerLine + ft.lineCycles
+}
+
+// SetPosition moves the beam to the given T-state within the frame
+func (ft *FrameTimer) SetPosition(tstates int) {
+	frame := ft.cyclesPerLine * ft.linesPerFrame
+	tstates = ((tstates % frame) + frame) % frame
+	ft.currentLine = tstates / ft.cyclesPerLine
+	ft.lineCycles = tstates % ft.cyclesPerLine
+}
+
 // GetBeamPosition returns current beam position for effects
 func (ft *FrameTimer) GetBeamPosition() (line, column int) {
 	column = (ft.lineCycles * 256) / ft.cyclesPerLine // Approximate
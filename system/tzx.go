@@ -0,0 +1,98 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// TZX block IDs written by WriteTZX
+const (
+	tzxStandardSpeed   = 0x10
+	tzxDirectRecording = 0x15
+)
+
+// tzxSampleTStates is the sample period used for direct recording blocks
+// (79 T-states is roughly 44.1 kHz at 3.5 MHz)
+const tzxSampleTStates = 79
+
+// WriteTZX writes tape blocks as a TZX 1.20 file. Standard blocks become
+// standard speed data blocks (ID 0x10); non-standard blocks are stored as
+// direct recordings (ID 0x15) of their raw signal.
+func WriteTZX(w io.Writer, blocks []TapeBlock) error {
+	if _, err := w.Write([]uint8{'Z', 'X', 'T', 'a', 'p', 'e', '!', 0x1A, 1, 20}); err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		pause := b.Pause
+		if pause < 0 || pause > 0xFFFF {
+			pause = StandardPause
+		}
+		var err error
+		if b.Standard {
+			err = writeTZXStandard(w, b.Data, uint16(pause))
+		} else {
+			err = writeTZXDirect(w, b.Pulses, uint16(pause))
+		}
+		if err != nil {
+			return fmt.Errorf("TZX block %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func writeTZXStandard(w io.Writer, data []uint8, pause uint16) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("block too long (%d bytes)", len(data))
+	}
+	hdr := make([]uint8, 5)
+	hdr[0] = tzxStandardSpeed
+	binary.LittleEndian.PutUint16(hdr[1:], pause)
+	binary.LittleEndian.PutUint16(hdr[3:], uint16(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writeTZXDirect(w io.Writer, pulses []Pulse, pause uint16) error {
+	// Sample the signal into one bit per period, most significant bit first
+	var bits []uint8
+	count := 0
+	var carry uint64
+	for _, p := range pulses {
+		carry += uint64(p.Length)
+		for carry >= tzxSampleTStates {
+			carry -= tzxSampleTStates
+			if count%8 == 0 {
+				bits = append(bits, 0)
+			}
+			if p.Level {
+				bits[len(bits)-1] |= 0x80 >> (count % 8)
+			}
+			count++
+		}
+	}
+	if len(bits) > 0xFFFFFF {
+		return fmt.Errorf("direct recording too long (%d bytes)", len(bits))
+	}
+
+	used := count % 8
+	if used == 0 {
+		used = 8
+	}
+	hdr := make([]uint8, 9)
+	hdr[0] = tzxDirectRecording
+	binary.LittleEndian.PutUint16(hdr[1:], tzxSampleTStates)
+	binary.LittleEndian.PutUint16(hdr[3:], pause)
+	hdr[5] = uint8(used)
+	hdr[6] = uint8(len(bits))
+	hdr[7] = uint8(len(bits) >> 8)
+	hdr[8] = uint8(len(bits) >> 16)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(bits)
+	return err
+}
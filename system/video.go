@@ -0,0 +1,157 @@
+package system
+
+import (
+	"image"
+	"image/color"
+)
+
+// Rendered frame geometry, in pixels
+const (
+	ScreenWidth  = 256
+	ScreenHeight = 192
+	BorderWidth  = 32 // Left and right border
+	BorderHeight = 24 // Top and bottom border
+	FrameWidth   = ScreenWidth + 2*BorderWidth
+	FrameHeight  = ScreenHeight + 2*BorderHeight
+)
+
+// flashFrames is the number of frames between FLASH inversions
+const flashFrames = 16
+
+// Palette holds the Spectrum colours: 0-7 normal, 8-15 bright
+var Palette = [16]color.RGBA{
+	{0x00, 0x00, 0x00, 0xFF}, {0x00, 0x00, 0xD7, 0xFF},
+	{0xD7, 0x00, 0x00, 0xFF}, {0xD7, 0x00, 0xD7, 0xFF},
+	{0x00, 0xD7, 0x00, 0xFF}, {0x00, 0xD7, 0xD7, 0xFF},
+	{0xD7, 0xD7, 0x00, 0xFF}, {0xD7, 0xD7, 0xD7, 0xFF},
+	{0x00, 0x00, 0x00, 0xFF}, {0x00, 0x00, 0xFF, 0xFF},
+	{0xFF, 0x00, 0x00, 0xFF}, {0xFF, 0x00, 0xFF, 0xFF},
+	{0x00, 0xFF, 0x00, 0xFF}, {0x00, 0xFF, 0xFF, 0xFF},
+	{0xFF, 0xFF, 0x00, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF},
+}
+
+// ulaFrame holds what the ULA has drawn so far. Each scanline is latched
+// as the beam finishes it, so border stripes and mid-frame screen changes
+// show up the way they would on a television.
+type ulaFrame struct {
+	pixels [ScreenHeight][32]uint8
+	attrs  [ScreenHeight][32]uint8
+	border []uint8 // Border colour of every scanline in the frame
+	line   int     // Next scanline to latch
+	frames uint64  // Completed frames, for FLASH
+}
+
+func newULAFrame(linesPerFrame int) *ulaFrame {
+	return &ulaFrame{border: make([]uint8, linesPerFrame)}
+}
+
+// advance latches every scanline the beam has finished before line
+func (u *ulaFrame) advance(s *Spectrum, line int) {
+	for u.line != line {
+		u.latch(s, u.line)
+		u.line++
+		if u.line == len(u.border) {
+			u.line = 0
+			u.frames++
+		}
+	}
+}
+
+// latch copies one scanline of the display file and the border colour
+func (u *ulaFrame) latch(s *Spectrum, line int) {
+	u.border[line] = s.border
+	if line >= ScreenHeight {
+		return
+	}
+	screen := s.memory.Bank(s.memory.ScreenBank())
+	offset := displayOffset(line)
+	copy(u.pixels[line][:], screen[offset:offset+32])
+	copy(u.attrs[line][:], screen[0x1800+(line>>3)*32:])
+}
+
+// LatchScreen redraws the whole display from memory as it is now, when
+// RunFrameUntil stopped part way through a frame, so that Render shows
+// the screen at the stopping point without running the CPU on
+func (s *Spectrum) LatchScreen() {
+	if !s.midFrame {
+		return
+	}
+	for line := range s.ula.border {
+		s.ula.latch(s, line)
+	}
+}
+
+// Render draws the last frame the ULA displayed, with border, as a
+// FrameWidth×FrameHeight image
+func (s *Spectrum) Render() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, FrameWidth, FrameHeight))
+	s.RenderTo(img)
+	return img
+}
+
+// RenderTo draws the last displayed frame into img, which must be at least
+// FrameWidth×FrameHeight
+func (s *Spectrum) RenderTo(img *image.RGBA) {
+	u := s.ula
+	lines := len(u.border)
+	flash := (u.frames/flashFrames)&1 != 0
+
+	for y := 0; y < FrameHeight; y++ {
+		// The top border comes from the end of the previous frame
+		line := y - BorderHeight
+		if line < 0 {
+			line += lines
+		}
+		row := img.Pix[y*img.Stride : y*img.Stride+FrameWidth*4]
+		border := Palette[u.border[line]&0x07]
+		if line >= ScreenHeight {
+			fillPixels(row, border)
+			continue
+		}
+		fillPixels(row[:BorderWidth*4], border)
+		fillPixels(row[(BorderWidth+ScreenWidth)*4:], border)
+		for col := 0; col < 32; col++ {
+			bits, attr := u.pixels[line][col], u.attrs[line][col]
+			ink, paper := attrColours(attr, flash)
+			drawByte(img, BorderWidth+col*8, y, bits, ink, paper)
+		}
+	}
+}
+
+// FrameRecorder receives every completed frame, for video capture
+type FrameRecorder interface {
+	// RecordFrame is called by RunFrame after each frame; Render returns
+	// the frame just displayed
+	RecordFrame(s *Spectrum)
+}
+
+// AddFrameRecorder starts passing completed frames to r
+func (s *Spectrum) AddFrameRecorder(r FrameRecorder) {
+	s.recorders = append(s.recorders, r)
+}
+
+// RemoveFrameRecorder stops passing frames to r
+func (s *Spectrum) RemoveFrameRecorder(r FrameRecorder) {
+	for i, rec := range s.recorders {
+		if rec == r {
+			s.recorders = append(s.recorders[:i], s.recorders[i+1:]...)
+			return
+		}
+	}
+}
+
+// attrColours returns the ink and paper colours of an attribute byte
+func attrColours(attr uint8, flash bool) (ink, paper color.RGBA) {
+	bright := (attr & 0x40) >> 3
+	i, p := attr&0x07|bright, (attr>>3)&0x07|bright
+	if attr&0x80 != 0 && flash {
+		i, p = p, i
+	}
+	return Palette[i], Palette[p]
+}
+
+func fillPixels(row []uint8, c color.RGBA) {
+	for i := 0; i+3 < len(row); i += 4 {
+		row[i], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+	}
+}
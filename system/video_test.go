@@ -0,0 +1,109 @@
+package system
+
+import "testing"
+
+func TestRenderBootScreen(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	img := s.Render()
+	if b := img.Bounds(); b.Dx() != FrameWidth || b.Dy() != FrameHeight {
+		t.Fatalf("frame is %v", b)
+	}
+	white := Palette[7]
+	for _, p := range [][2]int{{0, 0}, {FrameWidth - 1, FrameHeight - 1}, {BorderWidth, BorderHeight}} {
+		if c := img.RGBAAt(p[0], p[1]); c != white {
+			t.Errorf("pixel %v = %v, want white", p, c)
+		}
+	}
+
+	// The copyright message sits on the bottom text row in black ink
+	black := 0
+	for y := FrameHeight - BorderHeight - 8; y < FrameHeight-BorderHeight; y++ {
+		for x := BorderWidth; x < BorderWidth+ScreenWidth; x++ {
+			if img.RGBAAt(x, y) == Palette[0] {
+				black++
+			}
+		}
+	}
+	if black == 0 {
+		t.Error("no ink on the bottom text row")
+	}
+}
+
+func TestRenderBorderStripes(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	// Wait for the frame interrupt, then change the border half way down
+	// the bottom border
+	s.RunFrameUntil(func() bool { return s.FrameTstates() < 100 })
+	s.SetBorder(2)
+	s.RunFrameUntil(func() bool { return s.FrameTstates() >= 12*s.model.config().cyclesPerLine })
+	s.SetBorder(5)
+	s.RunFrame()
+
+	img := s.Render()
+	top := img.RGBAAt(0, FrameHeight-BorderHeight+2)
+	bottom := img.RGBAAt(0, FrameHeight-2)
+	if top != Palette[2] || bottom != Palette[5] {
+		t.Errorf("border stripes = %v, %v; want red, cyan", top, bottom)
+	}
+}
+
+func TestRunFrameUntil(t *testing.T) {
+	s := newTestSpectrum(t)
+	if !s.RunFrameUntil(func() bool { return s.CPU.PC == 0x11CB }) {
+		t.Fatal("RunFrameUntil did not stop at START/NEW")
+	}
+	if s.CPU.PC != 0x11CB {
+		t.Errorf("PC = %04X", s.CPU.PC)
+	}
+
+	// The instruction that ends a frame is checked too
+	frames := s.ula.frames
+	if !s.RunFrameUntil(func() bool { return s.ula.frames != frames }) || s.midFrame {
+		t.Errorf("RunFrameUntil did not stop at the end of the frame")
+	}
+}
+
+func TestLatchScreen(t *testing.T) {
+	s := newTestSpectrum(t)
+	for i := 0; i < 150; i++ {
+		s.RunFrame()
+	}
+	s.RunFrameUntil(func() bool { return s.FrameTstates() >= 100*s.model.config().cyclesPerLine })
+	s.memory.Write(0x4000, 0xFF)
+	s.memory.Write(0x5800, 0x38)
+	if got := s.Render().RGBAAt(BorderWidth, BorderHeight); got != Palette[7] {
+		t.Fatalf("line 0 redrawn before LatchScreen: %v", got)
+	}
+	cycles := s.CPU.Cycles
+	s.LatchScreen()
+	if got := s.Render().RGBAAt(BorderWidth, BorderHeight); got != Palette[0] {
+		t.Errorf("line 0 after LatchScreen = %v, want black ink", got)
+	}
+	if s.CPU.Cycles != cycles {
+		t.Errorf("LatchScreen ran the CPU")
+	}
+}
+
+func TestAudioCapture(t *testing.T) {
+	a := NewAudioCapture(1000, 100000) // 100 T-states per sample
+	a.Advance(100, true)
+	a.Advance(50, false)
+	a.Advance(50, true)
+	a.Advance(100, false)
+	want := []int16{beeperVolume, 0, -beeperVolume}
+	got := a.Samples()
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("sample %d = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
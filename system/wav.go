@@ -0,0 +1,233 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// WAV channel selection for multi-channel recordings
+const (
+	WAVChannelMix   = 0 // Average all channels
+	WAVChannelLeft  = 1 // Use the first channel only
+	WAVChannelRight = 2 // Use the second channel only
+)
+
+// WAVOptions controls how PCM samples are turned into EAR levels.
+//
+// Samples are normalised to the range -1..1 and passed through a schmitt
+// trigger: the level goes high once a sample rises above
+// Threshold+Hysteresis/2 and low once it falls below Threshold-Hysteresis/2.
+// A zero Hysteresis gives a plain threshold comparator.
+type WAVOptions struct {
+	Threshold  float64
+	Hysteresis float64
+	Channel    int
+	Invert     bool // Swap high and low (for recordings with reversed polarity)
+}
+
+// DefaultWAVOptions returns settings suitable for most tape recordings
+func DefaultWAVOptions() WAVOptions {
+	return WAVOptions{
+		Threshold:  0,
+		Hysteresis: 0.05,
+		Channel:    WAVChannelMix,
+	}
+}
+
+// wavFormat holds the fields of the fmt chunk we care about
+type wavFormat struct {
+	channels      int
+	sampleRate    int
+	bitsPerSample int
+	blockAlign    int
+}
+
+// LoadWAV decodes a PCM WAV file (8 or 16 bit, any channel count and
+// sample rate) into a tape
+func LoadWAV(data []uint8, opts WAVOptions) (*PulseTape, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a RIFF/WAVE file")
+	}
+
+	var format *wavFormat
+	var samples []uint8
+	pos := 12
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size > len(body) {
+			// Truncated recordings are common; use what is there
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			f, err := parseWAVFormat(body)
+			if err != nil {
+				return nil, err
+			}
+			format = f
+		case "data":
+			samples = body
+		}
+
+		pos += 8 + size
+		if size&1 != 0 {
+			pos++ // Chunks are word aligned
+		}
+	}
+
+	if format == nil {
+		return nil, fmt.Errorf("WAV file has no fmt chunk")
+	}
+	if samples == nil {
+		return nil, fmt.Errorf("WAV file has no data chunk")
+	}
+
+	channel := 0
+	switch opts.Channel {
+	case WAVChannelMix:
+		channel = -1
+	case WAVChannelLeft:
+		channel = 0
+	case WAVChannelRight:
+		if format.channels < 2 {
+			return nil, fmt.Errorf("WAV file has no right channel")
+		}
+		channel = 1
+	default:
+		return nil, fmt.Errorf("invalid WAV channel selection %d", opts.Channel)
+	}
+
+	high := opts.Threshold + opts.Hysteresis/2
+	low := opts.Threshold - opts.Hysteresis/2
+
+	var b pulseBuilder
+	level := false
+	frames := len(samples) / format.blockAlign
+	for i := 0; i < frames; i++ {
+		frame := samples[i*format.blockAlign:]
+		var v float64
+		if channel < 0 {
+			for c := 0; c < format.channels; c++ {
+				v += wavSample(frame, c, format.bitsPerSample)
+			}
+			v /= float64(format.channels)
+		} else {
+			v = wavSample(frame, channel, format.bitsPerSample)
+		}
+
+		if v > high {
+			level = true
+		} else if v < low {
+			level = false
+		}
+		b.add(1, level != opts.Invert)
+	}
+
+	return NewPulseTape(format.sampleRate, b.pulses), nil
+}
+
+func parseWAVFormat(body []uint8) (*wavFormat, error) {
+	if len(body) < 16 {
+		return nil, fmt.Errorf("WAV fmt chunk too short")
+	}
+	tag := binary.LittleEndian.Uint16(body[0:])
+	f := &wavFormat{
+		channels:      int(binary.LittleEndian.Uint16(body[2:])),
+		sampleRate:    int(binary.LittleEndian.Uint32(body[4:])),
+		blockAlign:    int(binary.LittleEndian.Uint16(body[12:])),
+		bitsPerSample: int(binary.LittleEndian.Uint16(body[14:])),
+	}
+
+	// WAVE_FORMAT_EXTENSIBLE carries the real format tag in its sub-format GUID
+	if tag == 0xFFFE && len(body) >= 26 {
+		tag = binary.LittleEndian.Uint16(body[24:])
+	}
+	if tag != 1 {
+		return nil, fmt.Errorf("unsupported WAV encoding %d (only PCM is supported)", tag)
+	}
+	if f.bitsPerSample != 8 && f.bitsPerSample != 16 {
+		return nil, fmt.Errorf("unsupported WAV sample size %d bits", f.bitsPerSample)
+	}
+	if f.channels < 1 || f.sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid WAV format (%d channels, %d Hz)", f.channels, f.sampleRate)
+	}
+	if f.blockAlign < f.channels*f.bitsPerSample/8 {
+		f.blockAlign = f.channels * f.bitsPerSample / 8
+	}
+	return f, nil
+}
+
+// wavSample returns one channel of a sample frame normalised to -1..1
+func wavSample(frame []uint8, channel, bits int) float64 {
+	if bits == 8 {
+		// 8-bit WAV samples are unsigned
+		return (float64(frame[channel]) - 128) / 128
+	}
+	v := int16(binary.LittleEndian.Uint16(frame[channel*2:]))
+	return float64(v) / 32768
+}
+
+// WriteWAV renders a tape as an 8-bit mono PCM WAV file at the given
+// sample rate
+func WriteWAV(w io.Writer, source TapeSource, rate int) error {
+	if rate <= 0 {
+		return fmt.Errorf("invalid WAV sample rate %d", rate)
+	}
+	source.Rewind()
+	defer source.Rewind()
+
+	// Resample pulse boundaries onto the output rate, carrying the
+	// fractional part so long recordings don't drift
+	var samples []uint8
+	step := float64(rate) / float64(source.SampleRate())
+	var pos, written float64
+	for {
+		p, ok := source.NextPulse()
+		if !ok {
+			break
+		}
+		pos += float64(p.Length) * step
+		v := uint8(0x40)
+		if p.Level {
+			v = 0xC0
+		}
+		for ; written+0.5 <= pos; written++ {
+			samples = append(samples, v)
+		}
+	}
+	return writeWAVData(w, rate, 1, 8, samples)
+}
+
+// writeWAVData writes a PCM WAV header followed by raw sample data
+func writeWAVData(w io.Writer, rate, channels, bits int, data []uint8) error {
+	pad := len(data) & 1 // Chunks are word aligned
+	hdr := make([]uint8, 44)
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(36+len(data)+pad))
+	copy(hdr[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(hdr[16:], 16)
+	binary.LittleEndian.PutUint16(hdr[20:], 1)
+	binary.LittleEndian.PutUint16(hdr[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(rate*channels*bits/8))
+	binary.LittleEndian.PutUint16(hdr[32:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(hdr[34:], uint16(bits))
+	copy(hdr[36:], "data")
+	binary.LittleEndian.PutUint32(hdr[40:], uint32(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if pad != 0 {
+		_, err := w.Write([]uint8{0})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// .z80 header sizes
+const (
+	z80V1HeaderSize = 30
+	z80V2ExtraSize  = 23
+	z80V3ExtraSize  = 54
+	z80V3ExtraLarge = 55 // v3 header that also stores the last write to 0x1FFD
+)
+
+// z80HardwareV2 and z80HardwareV3 map the hardware mode byte to a model.
+// Modes that zen80 does not emulate (SamRam, Timex, Scorpion, ...) are absent.
+var z80HardwareV2 = map[uint8]Model{
+	0: Model48K, 1: Model48K, 3: Model128K, 4: Model128K,
+	7: ModelPlus3, 8: ModelPlus3, 9: ModelPentagon, 12: ModelPlus2, 13: ModelPlus2A,
+}
+
+var z80HardwareV3 = map[uint8]Model{
+	0: Model48K, 1: Model48K, 3: Model48K, 4: Model128K, 5: Model128K, 6: Model128K,
+	7: ModelPlus3, 8: ModelPlus3, 9: ModelPentagon, 12: ModelPlus2, 13: ModelPlus2A,
+}
+
+// z80HardwareCode is the v3 hardware mode byte written for each model
+var z80HardwareCode = map[Model]uint8{
+	Model48K: 0, Model128K: 4, ModelPlus2: 12, ModelPlus2A: 13, ModelPlus3: 7, ModelPentagon: 9,
+}
+
+// z80Snapshot is a parsed .z80 file
+type z80Snapshot struct {
+	version  int
+	model    Model
+	header   []uint8         // 30-byte v1 header
+	extra    []uint8         // Additional v2/v3 header, nil for v1
+	pages    map[int][]uint8 // 16K pages by .z80 page number
+	port7FFD uint8
+	port1FFD uint8
+}
+
+// Z80SnapshotModel returns the model a .z80 snapshot was saved from, so
+// callers can construct a matching machine before loading it
+func Z80SnapshotModel(data []uint8) (Model, error) {
+	snap, err := parseZ80(data)
+	if err != nil {
+		return 0, err
+	}
+	return snap.model, nil
+}
+
+// LoadZ80 restores the machine from a .z80 snapshot (versions 1, 2 and 3).
+// 48K snapshots can be loaded on any model; 128K, +2A/+3 and Pentagon
+// snapshots need a model with 128K paging.
+func (s *Spectrum) LoadZ80(data []uint8) error {
+	snap, err := parseZ80(data)
+	if err != nil {
+		return err
+	}
+	if snap.model != Model48K && !s.memory.paging {
+		return fmt.Errorf("%s snapshot cannot be loaded on a %s model", snap.model, s.model)
+	}
+
+	s.Reset()
+	mem := s.memory
+	h := snap.header
+	cpu := s.CPU
+	word := func(b []uint8, off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+
+	cpu.A, cpu.F = h[0], h[1]
+	cpu.SetBC(word(h, 2))
+	cpu.SetHL(word(h, 4))
+	cpu.PC = word(h, 6)
+	cpu.SP = word(h, 8)
+	cpu.I = h[10]
+	flags := h[12]
+	if flags == 0xFF {
+		flags = 0x01 // Compatibility with old files
+	}
+	cpu.R = h[11]&0x7F | (flags&0x01)<<7
+	s.border = (flags >> 1) & 0x07
+	cpu.SetDE(word(h, 13))
+	cpu.C_, cpu.B_ = h[15], h[16]
+	cpu.E_, cpu.D_ = h[17], h[18]
+	cpu.L_, cpu.H_ = h[19], h[20]
+	cpu.A_, cpu.F_ = h[21], h[22]
+	cpu.SetIY(word(h, 23))
+	cpu.SetIX(word(h, 25))
+	cpu.IFF1 = h[27] != 0
+	cpu.IFF2 = h[28] != 0
+	cpu.IM = h[29] & 0x03
+
+	if snap.extra != nil {
+		x := snap.extra
+		cpu.PC = word(x, 0)
+		if ay := s.io.ay; ay != nil {
+			var regs [16]uint8
+			copy(regs[:], x[7:23])
+			ay.SetRegisters(regs)
+			ay.Select(x[6])
+		}
+		if snap.version == 3 {
+			lowT := int(word(x, 23))
+			hiT := int(x[25])
+			quarter := s.model.FrameCycles() / 4
+			s.SetFrameTstates(((hiT+1)%4)*quarter + (quarter - 1 - lowT))
+		}
+	}
+
+	if snap.model == Model48K {
+		// 48K pages: 8 = 0x4000, 4 = 0x8000, 5 = 0xC000
+		for page, bank := range map[int]int{8: 5, 4: 2, 5: 0} {
+			if data, ok := snap.pages[page]; ok {
+				copy(mem.ram[bank][:], data)
+			}
+		}
+		if mem.paging {
+			mem.port7FFD = 0x30
+			if mem.plus3 {
+				mem.port1FFD = 0x04
+			}
+			mem.locked = true
+		}
+	} else {
+		// 128K pages 3-10 hold RAM banks 0-7
+		for bank := 0; bank < 8; bank++ {
+			if data, ok := snap.pages[bank+3]; ok {
+				copy(mem.ram[bank][:], data)
+			}
+		}
+		mem.port7FFD = snap.port7FFD
+		mem.port1FFD = 0
+		if mem.plus3 {
+			mem.port1FFD = snap.port1FFD
+		}
+		mem.locked = snap.port7FFD&0x20 != 0
+	}
+	mem.updateSlots()
+	return nil
+}
+
+// parseZ80 decodes the headers and memory pages of a .z80 file
+func parseZ80(data []uint8) (*z80Snapshot, error) {
+	if len(data) < z80V1HeaderSize {
+		return nil, fmt.Errorf("z80 snapshot too short (%d bytes)", len(data))
+	}
+	snap := &z80Snapshot{
+		version: 1,
+		model:   Model48K,
+		header:  data[:z80V1HeaderSize],
+		pages:   make(map[int][]uint8),
+	}
+
+	pc := binary.LittleEndian.Uint16(data[6:])
+	if pc != 0 {
+		// Version 1: a single 48K block, optionally compressed
+		body := data[z80V1HeaderSize:]
+		flags := data[12]
+		if flags == 0xFF {
+			flags = 0x01
+		}
+		var mem []uint8
+		if flags&0x20 != 0 {
+			// Strip the 00 ED ED 00 end marker before expanding
+			if n := len(body); n >= 4 && body[n-4] == 0x00 && body[n-3] == 0xED && body[n-2] == 0xED && body[n-1] == 0x00 {
+				body = body[:n-4]
+			}
+			var err error
+			if mem, err = decompressZ80(body, 49152); err != nil {
+				return nil, err
+			}
+		} else {
+			if len(body) < 49152 {
+				return nil, fmt.Errorf("z80 v1 snapshot truncated")
+			}
+			mem = body[:49152]
+		}
+		snap.pages[8] = mem[0:16384]
+		snap.pages[4] = mem[16384:32768]
+		snap.pages[5] = mem[32768:49152]
+		return snap, nil
+	}
+
+	if len(data) < z80V1HeaderSize+2 {
+		return nil, fmt.Errorf("z80 snapshot header truncated")
+	}
+	extraLen := int(binary.LittleEndian.Uint16(data[30:]))
+	hardware := z80HardwareV3
+	switch extraLen {
+	case z80V2ExtraSize:
+		snap.version = 2
+		hardware = z80HardwareV2
+	case z80V3ExtraSize, z80V3ExtraLarge:
+		snap.version = 3
+	default:
+		return nil, fmt.Errorf("unknown z80 header length %d", extraLen)
+	}
+	start := z80V1HeaderSize + 2
+	if len(data) < start+extraLen {
+		return nil, fmt.Errorf("z80 additional header truncated")
+	}
+	snap.extra = data[start : start+extraLen]
+	x := snap.extra
+
+	model, ok := hardware[x[2]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported z80 hardware mode %d", x[2])
+	}
+	// The "modify hardware" flag turns 128K into +2 and +3 into +2A
+	if x[5]&0x80 != 0 {
+		switch model {
+		case Model128K:
+			model = ModelPlus2
+		case ModelPlus3:
+			model = ModelPlus2A
+		}
+	}
+	snap.model = model
+	snap.port7FFD = x[3]
+	if extraLen == z80V3ExtraLarge {
+		snap.port1FFD = x[54]
+	}
+
+	for pos := start + extraLen; pos < len(data); {
+		if pos+3 > len(data) {
+			return nil, fmt.Errorf("z80 page header truncated at offset %d", pos)
+		}
+		length := int(binary.LittleEndian.Uint16(data[pos:]))
+		page := int(data[pos+2])
+		pos += 3
+		var block []uint8
+		if length == 0xFFFF {
+			if pos+16384 > len(data) {
+				return nil, fmt.Errorf("z80 page %d truncated", page)
+			}
+			block = data[pos : pos+16384]
+			pos += 16384
+		} else {
+			if pos+length > len(data) {
+				return nil, fmt.Errorf("z80 page %d truncated", page)
+			}
+			var err error
+			if block, err = decompressZ80(data[pos:pos+length], 16384); err != nil {
+				return nil, fmt.Errorf("z80 page %d: %w", page, err)
+			}
+			pos += length
+		}
+		snap.pages[page] = block
+	}
+	return snap, nil
+}
+
+// SaveZ80 writes the machine state as a version 3 .z80 snapshot with
+// compressed memory pages
+func (s *Spectrum) SaveZ80(w io.Writer) error {
+	cpu := s.CPU
+	mem := s.memory
+	put := func(b []uint8, off int, v uint16) { binary.LittleEndian.PutUint16(b[off:], v) }
+
+	h := make([]uint8, z80V1HeaderSize)
+	h[0], h[1] = cpu.A, cpu.F
+	put(h, 2, cpu.BC())
+	put(h, 4, cpu.HL())
+	put(h, 6, 0) // PC lives in the additional header
+	put(h, 8, cpu.SP)
+	h[10] = cpu.I
+	h[11] = cpu.R & 0x7F
+	h[12] = cpu.R>>7 | (s.border&0x07)<<1
+	put(h, 13, cpu.DE())
+	h[15], h[16] = cpu.C_, cpu.B_
+	h[17], h[18] = cpu.E_, cpu.D_
+	h[19], h[20] = cpu.L_, cpu.H_
+	h[21], h[22] = cpu.A_, cpu.F_
+	put(h, 23, cpu.IY())
+	put(h, 25, cpu.IX())
+	if cpu.IFF1 {
+		h[27] = 1
+	}
+	if cpu.IFF2 {
+		h[28] = 1
+	}
+	h[29] = cpu.IM & 0x03
+
+	extraLen := z80V3ExtraSize
+	if mem.plus3 {
+		extraLen = z80V3ExtraLarge
+	}
+	x := make([]uint8, extraLen)
+	put(x, 0, s.snapshotPC())
+	x[2] = z80HardwareCode[s.model]
+	if mem.paging {
+		x[3] = mem.port7FFD
+	}
+	if ay := s.io.ay; ay != nil {
+		x[5] |= 0x04
+		x[6] = ay.Selected()
+		regs := ay.Registers()
+		copy(x[7:23], regs[:])
+	}
+	quarter := s.model.FrameCycles() / 4
+	t := s.FrameTstates()
+	put(x, 23, uint16(quarter-1-t%quarter))
+	x[25] = uint8((3 + t/quarter) % 4)
+	x[29] = 0xFF // 0x0000-0x1FFF is ROM
+	x[30] = 0xFF // 0x2000-0x3FFF is ROM
+	if mem.plus3 {
+		x[54] = mem.port1FFD
+	}
+
+	out := append([]uint8{}, h...)
+	out = append(out, uint8(extraLen), uint8(extraLen>>8))
+	out = append(out, x...)
+
+	writePage := func(page int, data []uint8) {
+		packed := compressZ80(data)
+		if len(packed) >= len(data) {
+			out = append(out, 0xFF, 0xFF, uint8(page))
+			out = append(out, data...)
+			return
+		}
+		out = append(out, uint8(len(packed)), uint8(len(packed)>>8), uint8(page))
+		out = append(out, packed...)
+	}
+	if mem.paging {
+		for bank := 0; bank < 8; bank++ {
+			writePage(bank+3, mem.ram[bank][:])
+		}
+	} else {
+		writePage(8, mem.ram[5][:])
+		writePage(4, mem.ram[2][:])
+		writePage(5, mem.ram[0][:])
+	}
+
+	_, err := w.Write(out)
+	return err
+}
+
+// decompressZ80 expands .z80 run-length data, where ED ED nn bb stands for
+// nn copies of bb
+func decompressZ80(in []uint8, size int) ([]uint8, error) {
+	out := make([]uint8, 0, size)
+	for i := 0; i < len(in); {
+		if i+3 < len(in) && in[i] == 0xED && in[i+1] == 0xED {
+			for n := 0; n < int(in[i+2]); n++ {
+				out = append(out, in[i+3])
+			}
+			i += 4
+			continue
+		}
+		out = append(out, in[i])
+		i++
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("decompressed to %d bytes, want %d", len(out), size)
+	}
+	return out, nil
+}
+
+// compressZ80 applies .z80 run-length compression. Runs of five or more
+// bytes (two or more for ED) become ED ED nn bb; the byte after a lone ED is
+// never used to start a run so the output stays unambiguous.
+func compressZ80(in []uint8) []uint8 {
+	var out []uint8
+	for i := 0; i < len(in); {
+		b := in[i]
+		run := 1
+		for i+run < len(in) && in[i+run] == b && run < 255 {
+			run++
+		}
+		if run >= 5 || (b == 0xED && run >= 2) {
+			out = append(out, 0xED, 0xED, uint8(run), b)
+			i += run
+			continue
+		}
+		out = append(out, b)
+		i++
+		if b == 0xED && i < len(in) {
+			out = append(out, in[i])
+			i++
+		}
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZ80Compression(t *testing.T) {
+	cases := [][]uint8{
+		{1, 2, 3},
+		{0, 0, 0, 0, 0, 0, 0, 7},
+		{0xED, 0xED, 1},
+		{0xED, 0, 0, 0, 0, 0, 0},
+		bytes.Repeat([]uint8{0xAA}, 600),
+	}
+	for _, in := range cases {
+		out, err := decompressZ80(compressZ80(in), len(in))
+		if err != nil {
+			t.Fatalf("% X: %v", in, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("round trip of % X gave % X", in, out)
+		}
+	}
+	if got := compressZ80([]uint8{0xED, 0xED}); !bytes.Equal(got, []uint8{0xED, 0xED, 2, 0xED}) {
+		t.Errorf("ED pair should always be encoded as a run, got % X", got)
+	}
+}
+
+func TestZ80V1Load(t *testing.T) {
+	hdr := make([]uint8, z80V1HeaderSize)
+	hdr[0] = 0x12                // A
+	hdr[6], hdr[7] = 0x00, 0x80  // PC
+	hdr[8], hdr[9] = 0x00, 0xFF  // SP
+	hdr[11] = 0x05               // R
+	hdr[12] = 0x20 | 0x04 | 0x01 // compressed, border 2, R bit 7
+	hdr[29] = 0x01               // IM 1
+	mem := make([]uint8, 49152)
+	mem[0] = 0x3C
+	mem[49151] = 0x99
+	data := append(hdr, compressZ80(mem)...)
+	data = append(data, 0x00, 0xED, 0xED, 0x00)
+
+	s := NewSpectrum()
+	if err := s.LoadZ80(data); err != nil {
+		t.Fatalf("LoadZ80: %v", err)
+	}
+	if s.CPU.A != 0x12 || s.CPU.PC != 0x8000 || s.CPU.SP != 0xFF00 || s.CPU.R != 0x85 || s.CPU.IM != 1 || s.border != 2 {
+		t.Errorf("registers not restored: A=%02X PC=%04X SP=%04X R=%02X IM=%d border=%d",
+			s.CPU.A, s.CPU.PC, s.CPU.SP, s.CPU.R, s.CPU.IM, s.border)
+	}
+	if s.memory.Read(0x4000) != 0x3C || s.memory.Read(0xFFFF) != 0x99 {
+		t.Errorf("memory not restored")
+	}
+}
+
+func TestZ80V3RoundTrip(t *testing.T) {
+	for _, model := range []Model{Model48K, Model128K, ModelPlus3, ModelPentagon} {
+		src := NewSpectrumModel(model)
+		setTestRegisters(src)
+		src.SetFrameTstates(12345)
+		if model != Model48K {
+			for bank := 0; bank < 8; bank++ {
+				src.memory.Bank(bank)[200] = uint8(0xC0 + bank)
+			}
+			src.memory.Write7FFD(0x13)
+			src.AY().Select(7)
+			src.AY().Write(0x38)
+			src.AY().Select(2)
+		} else {
+			src.memory.Write(0xC000, 0x77)
+		}
+		if model == ModelPlus3 {
+			src.memory.Write1FFD(0x04)
+		}
+
+		var buf bytes.Buffer
+		if err := src.SaveZ80(&buf); err != nil {
+			t.Fatalf("%s: SaveZ80: %v", model, err)
+		}
+		if got, err := Z80SnapshotModel(buf.Bytes()); err != nil || got != model {
+			t.Fatalf("%s: snapshot model = %v, %v", model, got, err)
+		}
+
+		dst := NewSpectrumModel(model)
+		if err := dst.LoadZ80(buf.Bytes()); err != nil {
+			t.Fatalf("%s: LoadZ80: %v", model, err)
+		}
+		compareRegisters(t, dst, src)
+		if dst.FrameTstates() != 12345 {
+			t.Errorf("%s: frame T-states = %d, want 12345", model, dst.FrameTstates())
+		}
+		if model == Model48K {
+			if dst.memory.Read(0xC000) != 0x77 {
+				t.Errorf("48K memory not restored")
+			}
+			continue
+		}
+		for bank := 0; bank < 8; bank++ {
+			if got := dst.memory.Bank(bank)[200]; got != uint8(0xC0+bank) {
+				t.Errorf("%s: bank %d marker = %02X", model, bank, got)
+			}
+		}
+		if dst.memory.Port7FFD() != 0x13 {
+			t.Errorf("%s: 0x7FFD = %02X, want 13", model, dst.memory.Port7FFD())
+		}
+		if dst.AY().Selected() != 2 || dst.AY().Registers()[7] != 0x38 {
+			t.Errorf("%s: AY state not restored", model)
+		}
+		if model == ModelPlus3 && dst.memory.Port1FFD() != 0x04 {
+			t.Errorf("+3: 0x1FFD = %02X, want 04", dst.memory.Port1FFD())
+		}
+	}
+}
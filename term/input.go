@@ -0,0 +1,85 @@
+package term
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+// Control bytes with a meaning of their own in raw mode
+const (
+	ctrlC  = 0x03 // Quit
+	escape = 0x1B
+	tab    = 0x09
+)
+
+// escapeKeys maps the final byte of cursor key sequences (ESC [ x or
+// ESC O x) to host key names
+var escapeKeys = map[uint8]string{
+	'A': "up",
+	'B': "down",
+	'C': "right",
+	'D': "left",
+}
+
+// DecodeKeys turns bytes read from a terminal in raw mode into Spectrum
+// key combinations. Characters map as system.KeysForRune does, cursor
+// keys to Caps Shift and 5-8, a lone Escape to BREAK and Tab to extended
+// mode. quit reports a Ctrl-C. Terminals send no key releases, so each
+// combination is meant to be pressed and released (Spectrum.QueueKeys).
+func DecodeKeys(data []uint8) (strokes [][]system.Key, quit bool) {
+	for len(data) > 0 {
+		c := data[0]
+		switch {
+		case c == ctrlC:
+			return strokes, true
+		case c == escape:
+			if len(data) >= 3 && (data[1] == '[' || data[1] == 'O') {
+				if name, ok := escapeKeys[data[2]]; ok {
+					keys, _ := system.KeysForHostKey(name)
+					strokes = append(strokes, keys)
+				}
+				data = data[3:]
+				continue
+			}
+			keys, _ := system.KeysForHostKey("escape")
+			strokes = append(strokes, keys)
+			data = data[1:]
+			continue
+		case c == tab:
+			keys, _ := system.KeysForHostKey("tab")
+			strokes = append(strokes, keys)
+			data = data[1:]
+			continue
+		}
+		r, n := utf8.DecodeRune(data)
+		if keys, ok := system.KeysForRune(r); ok {
+			strokes = append(strokes, keys)
+		}
+		data = data[n:]
+	}
+	return strokes, false
+}
+
+// MakeRaw puts the terminal on f into raw mode with echo off, using stty,
+// and returns a function that restores the previous settings
+func MakeRaw(f *os.File) (restore func(), err error) {
+	saved, err := stty(f, "-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty(f, "raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(f, strings.TrimSpace(saved)) }, nil
+}
+
+func stty(f *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = f
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,126 @@
+// Package term draws emulator frames on ANSI terminals and turns raw
+// terminal input into Spectrum key presses, so the machine can be watched
+// and used over SSH without a graphical display.
+//
+// Frames are drawn with 24-bit colour escape sequences and the upper half
+// block character, giving two pixels per character cell vertically.
+package term
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// cell is one character cell: the colours of its upper and lower halves
+type cell struct {
+	top, bottom color.RGBA
+}
+
+// Renderer draws successive frames, redrawing only the cells that changed
+// since the previous frame
+type Renderer struct {
+	scale int
+	prev  []cell
+	cols  int
+}
+
+// NewRenderer creates a renderer that shrinks frames by scale in both
+// directions, averaging each scale×scale block of pixels. A 320×240 frame
+// at scale 2 needs a 160×60 terminal.
+func NewRenderer(scale int) *Renderer {
+	return &Renderer{scale: max(scale, 1)}
+}
+
+// Reset makes the next Draw redraw every cell, e.g. after the terminal
+// has been cleared or resized
+func (r *Renderer) Reset() {
+	r.prev = nil
+}
+
+// Draw draws img with its top left corner at the top left of the terminal
+func (r *Renderer) Draw(w io.Writer, img image.Image) error {
+	cells, cols := r.cells(img)
+	full := len(r.prev) != len(cells) || r.cols != cols
+
+	bw := bufio.NewWriter(w)
+	var fg, bg color.RGBA
+	colours := false // fg and bg hold the colours last sent
+	cursor := -1     // Cell the cursor is on
+	for i, c := range cells {
+		if !full && r.prev[i] == c {
+			continue
+		}
+		if i != cursor || i%cols == 0 {
+			fmt.Fprintf(bw, "\x1b[%d;%dH", i/cols+1, i%cols+1)
+		}
+		cursor = i + 1
+		if !colours || c.top != fg {
+			fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm", c.top.R, c.top.G, c.top.B)
+		}
+		if !colours || c.bottom != bg {
+			fmt.Fprintf(bw, "\x1b[48;2;%d;%d;%dm", c.bottom.R, c.bottom.G, c.bottom.B)
+		}
+		fg, bg, colours = c.top, c.bottom, true
+		bw.WriteString("▀")
+	}
+	bw.WriteString("\x1b[0m")
+	r.prev, r.cols = cells, cols
+	return bw.Flush()
+}
+
+// cells scales img down and pairs up pixel rows
+func (r *Renderer) cells(img image.Image) ([]cell, int) {
+	b := img.Bounds()
+	cols := b.Dx() / r.scale
+	rows := b.Dy() / r.scale / 2
+	cells := make([]cell, 0, cols*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			x := b.Min.X + col*r.scale
+			y := b.Min.Y + row*2*r.scale
+			cells = append(cells, cell{
+				top:    average(img, x, y, r.scale),
+				bottom: average(img, x, y+r.scale, r.scale),
+			})
+		}
+	}
+	return cells, cols
+}
+
+// average returns the mean colour of the n×n block at x, y
+func average(img image.Image, x, y, n int) color.RGBA {
+	if n == 1 {
+		return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+	var sr, sg, sb uint32
+	for dy := 0; dy < n; dy++ {
+		for dx := 0; dx < n; dx++ {
+			c := color.RGBAModel.Convert(img.At(x+dx, y+dy)).(color.RGBA)
+			sr += uint32(c.R)
+			sg += uint32(c.G)
+			sb += uint32(c.B)
+		}
+	}
+	d := uint32(n * n)
+	return color.RGBA{uint8(sr / d), uint8(sg / d), uint8(sb / d), 0xFF}
+}
+
+// Render returns img as lines of ANSI text, for printing a single frame
+// into a scrolling terminal or a log
+func Render(img image.Image, scale int) string {
+	r := NewRenderer(scale)
+	cells, cols := r.cells(img)
+	var b strings.Builder
+	for i, c := range cells {
+		fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀",
+			c.top.R, c.top.G, c.top.B, c.bottom.R, c.bottom.G, c.bottom.B)
+		if i%cols == cols-1 {
+			b.WriteString("\x1b[0m\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package term
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetRGBA(x, y, system.Palette[7])
+		}
+	}
+	img.SetRGBA(0, 1, system.Palette[2])
+	return img
+}
+
+func TestRender(t *testing.T) {
+	out := Render(testImage(), 1)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	if n := strings.Count(lines[0], "▀"); n != 4 {
+		t.Errorf("got %d cells in the first row, want 4", n)
+	}
+	if !strings.HasPrefix(lines[0], "\x1b[38;2;215;215;215m\x1b[48;2;215;0;0m▀") {
+		t.Errorf("first cell = %q", lines[0])
+	}
+}
+
+func TestRendererScaleAndRedraw(t *testing.T) {
+	img := testImage()
+	r := NewRenderer(2)
+	var buf bytes.Buffer
+	if err := r.Draw(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "▀"); n != 2 {
+		t.Errorf("first draw wrote %d cells, want 2", n)
+	}
+	// The red pixel is averaged with three white ones
+	if !strings.Contains(buf.String(), "38;2;215;161;161m") {
+		t.Errorf("scaled colour missing from %q", buf.String())
+	}
+
+	buf.Reset()
+	r.Draw(&buf, img)
+	if strings.Contains(buf.String(), "▀") {
+		t.Errorf("unchanged frame was redrawn: %q", buf.String())
+	}
+
+	img.SetRGBA(3, 3, color.RGBA{A: 0xFF})
+	buf.Reset()
+	r.Draw(&buf, img)
+	if n := strings.Count(buf.String(), "▀"); n != 1 || !strings.HasPrefix(buf.String(), "\x1b[1;2H") {
+		t.Errorf("changed frame redrew %d cells: %q", n, buf.String())
+	}
+}
+
+func TestDecodeKeys(t *testing.T) {
+	strokes, quit := DecodeKeys([]uint8("aB\r\x1b[D\x1b\x7F"))
+	want := [][]system.Key{
+		{system.KeyA},
+		{system.KeyCapsShift, system.KeyB},
+		{system.KeyEnter},
+		{system.KeyCapsShift, system.Key5},
+		{system.KeyCapsShift, system.KeySpace},
+		{system.KeyCapsShift, system.Key0},
+	}
+	if quit || !reflect.DeepEqual(strokes, want) {
+		t.Errorf("DecodeKeys = %v, %v; want %v", strokes, quit, want)
+	}
+	if _, quit := DecodeKeys([]uint8{'x', ctrlC}); !quit {
+		t.Error("Ctrl-C did not quit")
+	}
+}
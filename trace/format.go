@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ha1tch/zen80/disasm"
+)
+
+// binaryMagic starts a binary trace
+const binaryMagic = "Z80TRC1\n"
+
+// WriteRecord writes one record in a format. Binary records are written
+// without the header a binary trace starts with.
+func WriteRecord(w io.Writer, rec Record, format Format) error {
+	var err error
+	switch format {
+	case FormatMAME:
+		_, err = fmt.Fprintf(w, "%04X: %s\n", rec.Regs.PC, mameText(rec.Text))
+	case FormatBinary:
+		_, err = w.Write(appendBinary(nil, rec))
+	default:
+		_, err = io.WriteString(w, FormatLine(rec)+"\n")
+	}
+	return err
+}
+
+// mameText pads the mnemonic as MAME's disassembler does
+func mameText(text string) string {
+	mnemonic, operands, ok := strings.Cut(text, " ")
+	if !ok {
+		return mnemonic
+	}
+	return fmt.Sprintf("%-4s %s", mnemonic, operands)
+}
+
+// FormatLine formats a record as a line of the text format:
+//
+//	cycles PC bytes disassembly registers flags IM/IFF accesses
+func FormatLine(rec Record) string {
+	g := rec.Regs
+	var b strings.Builder
+	fmt.Fprintf(&b, "%10d %04X  %-11s  %-20s", rec.Cycles, g.PC, disasm.HexBytes(rec.Bytes), rec.Text)
+	fmt.Fprintf(&b, " AF=%04X BC=%04X DE=%04X HL=%04X IX=%04X IY=%04X SP=%04X", g.AF, g.BC, g.DE, g.HL, g.IX, g.IY, g.SP)
+	fmt.Fprintf(&b, " AF'=%04X BC'=%04X DE'=%04X HL'=%04X", g.AF_, g.BC_, g.DE_, g.HL_)
+	fmt.Fprintf(&b, " I=%02X R=%02X WZ=%04X F=%s IM%d IFF=%d%d", g.I, g.R, g.WZ, Flags(uint8(g.AF)), g.IM, bit(g.IFF1), bit(g.IFF2))
+	for _, a := range rec.Accesses {
+		fmt.Fprintf(&b, " %s:%04X=%02X", a.Kind, a.Addr, a.Value)
+	}
+	return b.String()
+}
+
+// Flags formats the F register as "SZ5H3PNC", with "-" for clear bits
+func Flags(f uint8) string {
+	const names = "SZ5H3PNC"
+	out := []uint8("--------")
+	for i := 0; i < 8; i++ {
+		if f&(0x80>>i) != 0 {
+			out[i] = names[i]
+		}
+	}
+	return string(out)
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Binary records are little-endian: the cycle count (8 bytes), AF BC DE
+// HL AF' BC' DE' HL' IX IY SP PC WZ (2 bytes each), I, R, IM, the IFFs
+// (bit 0 IFF1, bit 1 IFF2, bit 2 set for an NMI), the instruction length
+// (0 for an interrupt) and bytes, the number of accesses and 4 bytes for
+// each: kind, address and value.
+func appendBinary(buf []uint8, rec Record) []uint8 {
+	g := rec.Regs
+	buf = binary.LittleEndian.AppendUint64(buf, rec.Cycles)
+	for _, v := range [...]uint16{g.AF, g.BC, g.DE, g.HL, g.AF_, g.BC_, g.DE_, g.HL_, g.IX, g.IY, g.SP, g.PC, g.WZ} {
+		buf = binary.LittleEndian.AppendUint16(buf, v)
+	}
+	buf = append(buf, g.I, g.R, g.IM, uint8(bit(g.IFF1)|bit(g.IFF2)<<1|bit(rec.Text == "nmi")<<2))
+	buf = append(buf, uint8(len(rec.Bytes)))
+	buf = append(buf, rec.Bytes...)
+	n := min(len(rec.Accesses), 255)
+	buf = append(buf, uint8(n))
+	for _, a := range rec.Accesses[:n] {
+		buf = append(buf, uint8(a.Kind))
+		buf = binary.LittleEndian.AppendUint16(buf, a.Addr)
+		buf = append(buf, a.Value)
+	}
+	return buf
+}
+
+// Reader reads a binary trace
+type Reader struct {
+	r      *bufio.Reader
+	header bool
+}
+
+// NewReader creates a reader for a binary trace
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF at the end of the trace
+func (t *Reader) Next() (Record, error) {
+	if !t.header {
+		magic := make([]uint8, len(binaryMagic))
+		if _, err := io.ReadFull(t.r, magic); err != nil || string(magic) != binaryMagic {
+			return Record{}, fmt.Errorf("trace: not a binary trace")
+		}
+		t.header = true
+	}
+	fixed := make([]uint8, 8+13*2+4+1)
+	if _, err := io.ReadFull(t.r, fixed); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, fmt.Errorf("trace: truncated record")
+		}
+		return Record{}, err // io.EOF between records
+	}
+	var rec Record
+	rec.Cycles = binary.LittleEndian.Uint64(fixed)
+	regs := make([]uint16, 13)
+	for i := range regs {
+		regs[i] = binary.LittleEndian.Uint16(fixed[8+2*i:])
+	}
+	g := &rec.Regs
+	g.AF, g.BC, g.DE, g.HL = regs[0], regs[1], regs[2], regs[3]
+	g.AF_, g.BC_, g.DE_, g.HL_ = regs[4], regs[5], regs[6], regs[7]
+	g.IX, g.IY, g.SP, g.PC, g.WZ = regs[8], regs[9], regs[10], regs[11], regs[12]
+	tail := fixed[34:]
+	g.I, g.R, g.IM = tail[0], tail[1], tail[2]
+	g.IFF1, g.IFF2 = tail[3]&1 != 0, tail[3]&2 != 0
+
+	rec.Bytes = make([]uint8, tail[4])
+	if _, err := io.ReadFull(t.r, rec.Bytes); err != nil {
+		return Record{}, fmt.Errorf("trace: truncated record")
+	}
+	n, err := t.r.ReadByte()
+	if err != nil {
+		return Record{}, fmt.Errorf("trace: truncated record")
+	}
+	acc := make([]uint8, 4*int(n))
+	if _, err := io.ReadFull(t.r, acc); err != nil {
+		return Record{}, fmt.Errorf("trace: truncated record")
+	}
+	for i := 0; i < int(n); i++ {
+		a := acc[4*i:]
+		rec.Accesses = append(rec.Accesses, Access{AccessKind(a[0]), binary.LittleEndian.Uint16(a[1:]), a[3]})
+	}
+	switch {
+	case len(rec.Bytes) > 0:
+		rec.Text = disasm.DecodeBytes(rec.Bytes, g.PC).String()
+	case tail[3]&4 != 0:
+		rec.Text = "nmi"
+	default:
+		rec.Text = "interrupt"
+	}
+	return rec, nil
+}
@@ -0,0 +1,384 @@
+// Package trace records a Z80's execution one instruction at a time: the
+// cycle count, the registers before the instruction, its bytes and
+// disassembly, and the memory and I/O accesses it made.
+//
+// A Recorder attaches to a CPU through its M1Hook and by wrapping its
+// Memory and IO, so it works with any machine built on the z80 package
+// without changing how that machine steps the CPU. z80.DEBUG_M1 must be
+// true, as it is by default. Records can be written as they happen, in a
+// line format meant for diffing, a MAME-compatible format or a compact
+// binary one, or kept in a ring of the last N instructions to be dumped
+// when something goes wrong.
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ha1tch/zen80/disasm"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// AccessKind says what kind of bus access an Access is
+type AccessKind uint8
+
+const (
+	MemRead AccessKind = iota
+	MemWrite
+	IORead
+	IOWrite
+)
+
+var accessNames = [...]string{"r", "w", "in", "out"}
+
+func (k AccessKind) String() string {
+	if int(k) < len(accessNames) {
+		return accessNames[k]
+	}
+	return "?"
+}
+
+// Access is one memory or I/O access
+type Access struct {
+	Kind  AccessKind
+	Addr  uint16
+	Value uint8
+}
+
+// Registers is the register file of a Z80
+type Registers struct {
+	AF, BC, DE, HL     uint16
+	AF_, BC_, DE_, HL_ uint16
+	IX, IY, SP, PC, WZ uint16
+	I, R, IM           uint8
+	IFF1, IFF2         bool
+}
+
+// capture reads the registers of a CPU
+func capture(z *z80.Z80) Registers {
+	return Registers{
+		AF: z.AF(), BC: z.BC(), DE: z.DE(), HL: z.HL(),
+		AF_: uint16(z.A_)<<8 | uint16(z.F_), BC_: uint16(z.B_)<<8 | uint16(z.C_),
+		DE_: uint16(z.D_)<<8 | uint16(z.E_), HL_: uint16(z.H_)<<8 | uint16(z.L_),
+		IX: z.IX(), IY: z.IY(), SP: z.SP, PC: z.PC, WZ: z.WZ,
+		I: z.I, R: z.R, IM: z.IM, IFF1: z.IFF1, IFF2: z.IFF2,
+	}
+}
+
+// Record is one executed instruction, or the CPU accepting an interrupt
+type Record struct {
+	Cycles   uint64    // CPU cycle count when the instruction started
+	Regs     Registers // Before the instruction
+	Bytes    []uint8   // Empty for an interrupt
+	Text     string    // Disassembly, or "interrupt" or "nmi"
+	Accesses []Access  // Memory and I/O accesses, not counting instruction fetches
+}
+
+// Interrupt reports whether the record is an interrupt being accepted
+// rather than an instruction. Its accesses are the pushed return address
+// and, in IM2, the vector read; a Mode 0 interrupt's record also holds
+// those of the instruction the device supplied.
+func (rec Record) Interrupt() bool {
+	return len(rec.Bytes) == 0
+}
+
+// Format is a trace output format
+type Format int
+
+const (
+	// FormatText is one line per instruction with every register and
+	// access, in fixed columns so that traces diff cleanly
+	FormatText Format = iota
+	// FormatMAME is "PC: disassembly", as written by MAME's trace command
+	FormatMAME
+	// FormatBinary is a compact record per instruction, read back with
+	// NewReader
+	FormatBinary
+)
+
+// ParseFormat returns the format called name: "text", "mame" or "binary"
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "text":
+		return FormatText, nil
+	case "mame":
+		return FormatMAME, nil
+	case "binary", "bin":
+		return FormatBinary, nil
+	}
+	return 0, fmt.Errorf("trace: unknown format %q", name)
+}
+
+// Range is an inclusive range of addresses
+type Range struct {
+	Start, End uint16
+}
+
+// ParseRange parses "8000-80FF" or a single address "8000" (hex, with an
+// optional 0x or $ prefix)
+func ParseRange(s string) (Range, error) {
+	parse := func(v string) (uint16, error) {
+		v = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "0x"), "$")
+		n, err := strconv.ParseUint(v, 16, 16)
+		return uint16(n), err
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := parse(from)
+	if err != nil {
+		return Range{}, fmt.Errorf("trace: bad address range %q", s)
+	}
+	end := start
+	if isRange {
+		if end, err = parse(to); err != nil || end < start {
+			return Range{}, fmt.Errorf("trace: bad address range %q", s)
+		}
+	}
+	return Range{start, end}, nil
+}
+
+// Options controls a Recorder
+type Options struct {
+	Format Format
+	Ring   int     // Keep only the last Ring records, written out by Dump or Stop
+	PC     []Range // Record only instructions starting in these ranges, all if empty
+}
+
+// Recorder traces a CPU
+type Recorder struct {
+	cpu  *z80.Z80
+	w    *bufio.Writer
+	opts Options
+	err  error
+
+	mem    z80.MemoryInterface
+	io     z80.IOInterface
+	m1Hook func(pc uint16, opcode uint8, context string)
+
+	current  *Record // Instruction in progress
+	accesses []Access
+	ring     []Record
+	ringNext int
+	started  bool // The binary header has been written
+}
+
+// New attaches a recorder to a CPU. Records are written to w, or kept in
+// a ring if opts.Ring is set; w may then be nil if only Last is used.
+func New(cpu *z80.Z80, w io.Writer, opts Options) *Recorder {
+	r := &Recorder{cpu: cpu, opts: opts, mem: cpu.Memory, io: cpu.IO, m1Hook: cpu.M1Hook}
+	if w != nil {
+		r.w = bufio.NewWriter(w)
+	}
+	cpu.Memory = &busMemory{r}
+	if ic, ok := cpu.IO.(z80.InterruptController); ok {
+		cpu.IO = &busInterrupts{busIO{r}, ic}
+	} else {
+		cpu.IO = &busIO{r}
+	}
+	cpu.M1Hook = r.hook
+	return r
+}
+
+// Stop detaches the recorder, finishes the last instruction and writes
+// out the ring if there is one
+func (r *Recorder) Stop() error {
+	r.finish(len(r.accesses))
+	r.cpu.Memory, r.cpu.IO, r.cpu.M1Hook = r.mem, r.io, r.m1Hook
+	if r.opts.Ring > 0 && r.w != nil {
+		r.Dump(r.w)
+	}
+	return r.flush()
+}
+
+// Err returns the first error writing the trace
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+// Last returns the records in the ring, oldest first
+func (r *Recorder) Last() []Record {
+	if len(r.ring) < r.opts.Ring {
+		return append([]Record(nil), r.ring...)
+	}
+	return append(append([]Record(nil), r.ring[r.ringNext:]...), r.ring[:r.ringNext]...)
+}
+
+// Dump writes the records in the ring, oldest first
+func (r *Recorder) Dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if r.opts.Format == FormatBinary {
+		if _, err := bw.WriteString(binaryMagic); err != nil {
+			return err
+		}
+	}
+	for _, rec := range r.Last() {
+		if err := WriteRecord(bw, rec, r.opts.Format); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// interruptAccesses is how many accesses the CPU makes accepting each
+// kind of interrupt before it calls the M1 hook: the pushed return
+// address, and in IM2 the vector. In IM0 the hook comes before the
+// supplied instruction runs.
+var interruptAccesses = map[string]int{"NMI": 2, "IM0-fallback": 2, "IM1": 2, "IM2": 4, "IM0": 0}
+
+// hook is called by the CPU after fetching each opcode
+func (r *Recorder) hook(pc uint16, opcode uint8, context string) {
+	if r.m1Hook != nil {
+		r.m1Hook(pc, opcode, context)
+	}
+	if n, ok := interruptAccesses[context]; ok {
+		r.interrupt(context, n)
+		return
+	}
+	if context != "normal" {
+		return // The fetch after a prefix is part of the same instruction
+	}
+	// The last access is the fetch of this opcode
+	r.finish(len(r.accesses) - 1)
+	if !r.wanted(pc) {
+		return
+	}
+	regs := capture(r.cpu)
+	regs.PC = pc
+	regs.R = regs.R&0x80 | (regs.R-1)&0x7F // Before this fetch
+	in := disasm.Decode(r.mem.Read, pc)
+	r.current = &Record{Cycles: r.cpu.Cycles, Regs: regs, Bytes: in.Bytes, Text: in.String()}
+}
+
+// interrupt ends the instruction in progress before the n accesses made
+// accepting an interrupt, and starts a record of the interrupt with them
+func (r *Recorder) interrupt(context string, n int) {
+	n = min(n, len(r.accesses))
+	accesses := append([]Access(nil), r.accesses[len(r.accesses)-n:]...)
+	r.finish(len(r.accesses) - n)
+
+	regs := capture(r.cpu)
+	regs.R = regs.R&0x80 | (regs.R-1)&0x7F // Before the acknowledge cycle
+	text := "interrupt"
+	if context == "NMI" {
+		text, regs.IFF1 = "nmi", regs.IFF2
+	} else {
+		regs.IFF1, regs.IFF2 = true, true
+	}
+	if context != "IM0" {
+		// Undo the push of the return address
+		regs.PC = uint16(r.mem.Read(regs.SP)) | uint16(r.mem.Read(regs.SP+1))<<8
+		regs.SP += 2
+	}
+	if !r.wanted(regs.PC) {
+		return
+	}
+	r.accesses = append(r.accesses, accesses...)
+	r.current = &Record{Cycles: r.cpu.Cycles, Regs: regs, Text: text}
+}
+
+func (r *Recorder) wanted(pc uint16) bool {
+	if len(r.opts.PC) == 0 {
+		return true
+	}
+	for _, rg := range r.opts.PC {
+		if pc >= rg.Start && pc <= rg.End {
+			return true
+		}
+	}
+	return false
+}
+
+// finish completes the instruction in progress with the first n of the
+// accesses made since it started, leaving out its own fetches
+func (r *Recorder) finish(n int) {
+	rec := r.current
+	r.current = nil
+	if rec != nil {
+		start, end := rec.Regs.PC, rec.Regs.PC+uint16(len(rec.Bytes))
+		for _, a := range r.accesses[:max(n, 0)] {
+			inside := a.Addr-start < end-start
+			if a.Kind != MemRead || !inside {
+				rec.Accesses = append(rec.Accesses, a)
+			}
+		}
+		r.emit(*rec)
+	}
+	r.accesses = r.accesses[:0]
+}
+
+func (r *Recorder) emit(rec Record) {
+	if r.opts.Ring > 0 {
+		if len(r.ring) < r.opts.Ring {
+			r.ring = append(r.ring, rec)
+		} else {
+			r.ring[r.ringNext] = rec
+		}
+		r.ringNext = (r.ringNext + 1) % r.opts.Ring
+		return
+	}
+	if r.w == nil || r.err != nil {
+		return
+	}
+	if r.opts.Format == FormatBinary && !r.started {
+		r.started = true
+		if _, r.err = r.w.WriteString(binaryMagic); r.err != nil {
+			return
+		}
+	}
+	r.err = WriteRecord(r.w, rec, r.opts.Format)
+}
+
+func (r *Recorder) flush() error {
+	if r.w != nil && r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+func (r *Recorder) record(kind AccessKind, addr uint16, value uint8) {
+	r.accesses = append(r.accesses, Access{kind, addr, value})
+}
+
+// busMemory passes memory accesses through, recording them
+type busMemory struct{ r *Recorder }
+
+func (b *busMemory) Read(addr uint16) uint8 {
+	v := b.r.mem.Read(addr)
+	b.r.record(MemRead, addr, v)
+	return v
+}
+
+func (b *busMemory) Write(addr uint16, value uint8) {
+	b.r.record(MemWrite, addr, value)
+	b.r.mem.Write(addr, value)
+}
+
+// busIO passes port accesses through, recording them
+type busIO struct{ r *Recorder }
+
+func (b *busIO) In(port uint16) uint8 {
+	v := b.r.io.In(port)
+	b.r.record(IORead, port, v)
+	return v
+}
+
+func (b *busIO) Out(port uint16, value uint8) {
+	b.r.record(IOWrite, port, value)
+	b.r.io.Out(port, value)
+}
+
+// busInterrupts is a busIO for devices that also supply interrupt vectors
+type busInterrupts struct {
+	busIO
+	ic z80.InterruptController
+}
+
+func (b *busInterrupts) GetInterruptVector() uint8 {
+	return b.ic.GetInterruptVector()
+}
+
+func (b *busInterrupts) GetMode0Instruction() []uint8 {
+	return b.ic.GetMode0Instruction()
+}
@@ -0,0 +1,169 @@
+package trace
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// program: ld a,$05; ld ($8000),a; out ($FE),a; ld hl,$8000; ld b,(hl); halt
+var program = []uint8{0x3E, 0x05, 0x32, 0x00, 0x80, 0xD3, 0xFE, 0x21, 0x00, 0x80, 0x46, 0x76}
+
+func newCPU() *z80.Z80 {
+	mem := memory.NewRAM()
+	mem.Load(0, program)
+	cpu := z80.New(mem, zio.NewNullIO())
+	cpu.SP = 0xFF00
+	return cpu
+}
+
+func run(cpu *z80.Z80, steps int) {
+	for i := 0; i < steps; i++ {
+		cpu.Step()
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	cpu := newCPU()
+	var out bytes.Buffer
+	r := New(cpu, &out, Options{})
+	run(cpu, 6)
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("%d lines:\n%s", len(lines), out.String())
+	}
+	checks := []string{
+		"0000  3e 05        ld a,$05",
+		"0002  32 00 80     ld ($8000),a         AF=05",
+		"out ($FE),a",
+		"ld hl,$8000",
+		"ld b,(hl)",
+		"halt",
+	}
+	for i, want := range checks {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %d %q does not contain %q", i, lines[i], want)
+		}
+	}
+	if !strings.HasSuffix(lines[1], " w:8000=05") {
+		t.Errorf("write not recorded: %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], " out:05FE=05") {
+		t.Errorf("OUT not recorded: %q", lines[2])
+	}
+	if !strings.HasSuffix(lines[4], " r:8000=05") || strings.Contains(lines[3], " r:") {
+		t.Errorf("reads recorded wrongly:\n%s\n%s", lines[3], lines[4])
+	}
+	if cpu.M1Hook != nil {
+		t.Error("Stop left the hook installed")
+	}
+	if _, ok := cpu.Memory.(*memory.RAM); !ok {
+		t.Error("Stop left the memory wrapped")
+	}
+}
+
+func TestRingAndFilter(t *testing.T) {
+	cpu := newCPU()
+	r := New(cpu, nil, Options{Ring: 2})
+	run(cpu, 5)
+	r.Stop()
+	last := r.Last()
+	if len(last) != 2 || last[0].Text != "ld hl,$8000" || last[1].Text != "ld b,(hl)" {
+		t.Errorf("ring holds %+v", last)
+	}
+
+	cpu = newCPU()
+	var out bytes.Buffer
+	r = New(cpu, &out, Options{Format: FormatMAME, PC: []Range{{0x0005, 0x0007}}})
+	run(cpu, 6)
+	r.Stop()
+	if got := out.String(); got != "0005: out  ($FE),a\n0007: ld   hl,$8000\n" {
+		t.Errorf("filtered MAME trace:\n%s", got)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	cpu := newCPU()
+	var out bytes.Buffer
+	r := New(cpu, &out, Options{Format: FormatBinary})
+	run(cpu, 6)
+	r.Stop()
+
+	cpu = newCPU()
+	var want bytes.Buffer
+	r = New(cpu, &want, Options{})
+	run(cpu, 6)
+	r.Stop()
+
+	var got bytes.Buffer
+	tr := NewReader(&out)
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		WriteRecord(&got, rec, FormatText)
+	}
+	if got.String() != want.String() {
+		t.Errorf("binary round trip:\n%s\nwant\n%s", got.String(), want.String())
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for s, want := range map[string]Range{"8000-80ff": {0x8000, 0x80FF}, "$38": {0x38, 0x38}, "0x100-0x1FF": {0x100, 0x1FF}} {
+		if got, err := ParseRange(s); err != nil || got != want {
+			t.Errorf("ParseRange(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseRange("9000-8000"); err == nil {
+		t.Error("backwards range accepted")
+	}
+	if got := Flags(0xC1); got != "SZ-----C" {
+		t.Errorf("Flags(C1) = %q", got)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	cpu := newCPU()
+	cpu.Memory.Write(0x0038, 0xC9) // ret
+	cpu.IM, cpu.IFF1, cpu.IFF2 = 1, true, true
+	var out bytes.Buffer
+	r := New(cpu, &out, Options{})
+	run(cpu, 2)
+	cpu.INT = true
+	run(cpu, 1)
+	cpu.INT = false
+	run(cpu, 2)
+	r.Stop()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("%d lines:\n%s", len(lines), out.String())
+	}
+	if !strings.HasSuffix(lines[1], " w:8000=05") {
+		t.Errorf("interrupt pushes given to the instruction before: %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "0005               interrupt") || !strings.Contains(lines[2], "SP=FF00") ||
+		!strings.HasSuffix(lines[2], " w:FEFF=00 w:FEFE=05") {
+		t.Errorf("interrupt recorded as %q", lines[2])
+	}
+	if !strings.Contains(lines[3], "0038  c9           ret") || !strings.HasSuffix(lines[3], " r:FEFE=05 r:FEFF=00") {
+		t.Errorf("handler recorded as %q", lines[3])
+	}
+
+	bin := bytes.NewBufferString(binaryMagic)
+	bin.Write(appendBinary(nil, Record{Regs: Registers{PC: 0x1234}, Text: "nmi"}))
+	if got, err := NewReader(bin).Next(); err != nil || got.Text != "nmi" || !got.Interrupt() {
+		t.Errorf("binary NMI read as %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,127 @@
+package video
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+// gifPalette holds the 15 distinct Spectrum colours (black is the same
+// with and without BRIGHT)
+var gifPalette = func() color.Palette {
+	var p color.Palette
+	seen := map[color.RGBA]bool{}
+	for _, c := range system.Palette {
+		if !seen[c] {
+			seen[c] = true
+			p = append(p, c)
+		}
+	}
+	return p
+}()
+
+// GIFEncoder writes an animated GIF. Only the part of each frame that
+// changed is stored, and unchanged frames lengthen the previous one, so
+// long recordings of mostly static screens stay small. The file is
+// written by Close.
+type GIFEncoder struct {
+	w      io.Writer
+	delay  float64 // Hundredths of a second per frame
+	anim   gif.GIF
+	prev   *image.Paletted
+	frames int     // Frames written
+	start  float64 // Time the last stored frame starts, in hundredths
+	index  map[color.RGBA]uint8
+}
+
+// NewGIFEncoder creates an encoder for frames delay hundredths of a second
+// apart
+func NewGIFEncoder(w io.Writer, delay float64) *GIFEncoder {
+	index := map[color.RGBA]uint8{}
+	for i, c := range gifPalette {
+		index[c.(color.RGBA)] = uint8(i)
+	}
+	return &GIFEncoder{w: w, delay: delay, index: index}
+}
+
+// WriteFrame implements Encoder
+func (e *GIFEncoder) WriteFrame(img *image.RGBA) error {
+	frame := e.paletted(img)
+	now := float64(e.frames) * e.delay
+	e.frames++
+
+	rect := frame.Bounds()
+	if e.prev != nil {
+		if rect = changed(e.prev, frame); rect.Empty() {
+			return nil
+		}
+		e.endFrame(now)
+	}
+	sub := image.NewPaletted(rect, gifPalette)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		copy(sub.Pix[sub.PixOffset(rect.Min.X, y):], frame.Pix[frame.PixOffset(rect.Min.X, y):frame.PixOffset(rect.Max.X, y)])
+	}
+	e.anim.Image = append(e.anim.Image, sub)
+	e.anim.Delay = append(e.anim.Delay, 0)
+	e.anim.Disposal = append(e.anim.Disposal, gif.DisposalNone)
+	e.start = now
+	e.prev = frame
+	return nil
+}
+
+// endFrame sets the delay of the last stored frame so that the next one
+// starts at now
+func (e *GIFEncoder) endFrame(now float64) {
+	d := int(math.Round(now) - math.Round(e.start))
+	e.anim.Delay[len(e.anim.Delay)-1] = max(d, 1)
+}
+
+// Close implements Encoder
+func (e *GIFEncoder) Close() error {
+	if len(e.anim.Image) == 0 {
+		return nil
+	}
+	e.endFrame(float64(e.frames) * e.delay)
+	e.anim.Config = image.Config{
+		ColorModel: gifPalette,
+		Width:      e.prev.Bounds().Dx(),
+		Height:     e.prev.Bounds().Dy(),
+	}
+	return gif.EncodeAll(e.w, &e.anim)
+}
+
+// paletted converts a frame to the Spectrum palette
+func (e *GIFEncoder) paletted(img *image.RGBA) *image.Paletted {
+	b := img.Bounds()
+	p := image.NewPaletted(b, gifPalette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			i, ok := e.index[c]
+			if !ok {
+				i = uint8(gifPalette.Index(c))
+			}
+			p.Pix[p.PixOffset(x, y)] = i
+		}
+	}
+	return p
+}
+
+// changed returns the smallest rectangle holding every pixel that differs
+func changed(a, b *image.Paletted) image.Rectangle {
+	r := image.Rectangle{}
+	bounds := b.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := b.PixOffset(x, y)
+			if a.Pix[i] != b.Pix[i] {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
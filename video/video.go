@@ -0,0 +1,113 @@
+// Package video records emulator output as animated GIF or Y4M video.
+//
+// A Recorder is attached to a Spectrum and captures the rendered frame at
+// the end of every RunFrame, optionally dropping frames and scaling the
+// image up. Beeper audio is captured separately with Spectrum.StartAudio
+// and written as a WAV file alongside the video.
+package video
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+// Options controls which frames are captured and at what size
+type Options struct {
+	Skip  int // Frames dropped after each captured frame
+	Scale int // Pixel magnification, 1 if zero
+}
+
+// Encoder writes a sequence of frames to a video file
+type Encoder interface {
+	WriteFrame(img *image.RGBA) error
+	Close() error // Finishes the file; does not close the underlying writer
+}
+
+// Recorder captures frames from a Spectrum into an Encoder
+type Recorder struct {
+	spec   *system.Spectrum
+	enc    Encoder
+	opts   Options
+	count  int         // Frames seen
+	frame  *image.RGBA // Rendered frame, reused
+	scaled *image.RGBA // Frame at the output scale
+	err    error
+}
+
+// CheckFormat returns an error unless Record can write format
+func CheckFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "gif", "y4m":
+		return nil
+	}
+	return fmt.Errorf("unsupported video format %q", format)
+}
+
+// Record starts recording spec's output to w in the given format ("gif"
+// or "y4m")
+func Record(spec *system.Spectrum, w io.Writer, format string, opts Options) (*Recorder, error) {
+	opts.Scale = max(opts.Scale, 1)
+	opts.Skip = max(opts.Skip, 0)
+	width, height := system.FrameWidth*opts.Scale, system.FrameHeight*opts.Scale
+	model := spec.Model()
+
+	var enc Encoder
+	switch strings.ToLower(format) {
+	case "gif":
+		// GIF delays are in hundredths of a second
+		enc = NewGIFEncoder(w, float64(100*model.FrameCycles()*(opts.Skip+1))/model.ClockHz())
+	case "y4m":
+		enc = NewY4MEncoder(w, width, height, int(model.ClockHz()), model.FrameCycles()*(opts.Skip+1))
+	default:
+		return nil, CheckFormat(format)
+	}
+
+	r := &Recorder{
+		spec:  spec,
+		enc:   enc,
+		opts:  opts,
+		frame: image.NewRGBA(image.Rect(0, 0, system.FrameWidth, system.FrameHeight)),
+	}
+	if opts.Scale > 1 {
+		r.scaled = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	spec.AddFrameRecorder(r)
+	return r, nil
+}
+
+// RecordFrame implements system.FrameRecorder
+func (r *Recorder) RecordFrame(s *system.Spectrum) {
+	n := r.count
+	r.count++
+	if r.err != nil || n%(r.opts.Skip+1) != 0 {
+		return
+	}
+	s.RenderTo(r.frame)
+	img := r.frame
+	if r.scaled != nil {
+		system.Scale(r.scaled, r.frame, r.opts.Scale)
+		img = r.scaled
+	}
+	r.err = r.enc.WriteFrame(img)
+}
+
+// Frames returns the number of frames seen since recording started,
+// including skipped ones
+func (r *Recorder) Frames() int {
+	return r.count
+}
+
+// Stop detaches the recorder and finishes the video. It returns the first
+// error met while recording.
+func (r *Recorder) Stop() error {
+	r.spec.RemoveFrameRecorder(r)
+	err := r.enc.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package video
+
+import (
+	"bytes"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/system"
+)
+
+func newTestSpectrum(t *testing.T) *system.Spectrum {
+	t.Helper()
+	rom, err := os.ReadFile(filepath.Join("..", "rom", "48.rom"))
+	if err != nil {
+		t.Skipf("missing 48.rom in ../rom directory: %v", err)
+	}
+	s := system.NewSpectrum()
+	if err := s.LoadROM(rom); err != nil {
+		t.Fatalf("LoadROM: %v", err)
+	}
+	s.SetUnlimited(true)
+	return s
+}
+
+func TestRecordGIF(t *testing.T) {
+	s := newTestSpectrum(t)
+	var buf bytes.Buffer
+	r, err := Record(s, &buf, "gif", Options{Skip: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.RunFrame()
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	s.RunFrame() // No longer recorded
+	if r.Frames() != 100 {
+		t.Errorf("recorder saw %d frames, want 100", r.Frames())
+	}
+
+	anim, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if anim.Config.Width != system.FrameWidth || anim.Config.Height != system.FrameHeight {
+		t.Errorf("GIF is %dx%d", anim.Config.Width, anim.Config.Height)
+	}
+	if len(anim.Image) < 2 || len(anim.Image) > 50 {
+		t.Errorf("GIF has %d frames", len(anim.Image))
+	}
+	total := 0
+	for _, d := range anim.Delay {
+		total += d
+	}
+	if total < 198 || total > 202 {
+		t.Errorf("GIF lasts %d hundredths, want about 200", total)
+	}
+}
+
+func TestRecordY4M(t *testing.T) {
+	s := newTestSpectrum(t)
+	var buf bytes.Buffer
+	r, err := Record(s, &buf, "y4m", Options{Scale: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.RunFrame()
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	header, _, _ := strings.Cut(buf.String(), "\n")
+	if header != "YUV4MPEG2 W640 H480 F3500000:69888 Ip A1:1 C420jpeg XCOLORRANGE=FULL" {
+		t.Errorf("header = %q", header)
+	}
+	frame := len("FRAME\n") + 640*480*3/2
+	if want := len(header) + 1 + 3*frame; buf.Len() != want {
+		t.Errorf("file is %d bytes, want %d", buf.Len(), want)
+	}
+}
+
+func TestRecordUnknownFormat(t *testing.T) {
+	if _, err := Record(system.NewSpectrum(), &bytes.Buffer{}, "avi", Options{}); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,75 @@
+package video
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Y4MEncoder writes uncompressed YUV4MPEG2 video with 4:2:0 chroma, which
+// ffmpeg and most encoders read directly. Samples use the full JPEG
+// range.
+type Y4MEncoder struct {
+	w             *bufio.Writer
+	width, height int
+	rateNum       int
+	rateDen       int
+	header        bool
+	y, cb, cr     []uint8
+}
+
+// NewY4MEncoder creates an encoder for width×height frames at
+// rateNum/rateDen frames per second. Width and height must be even.
+func NewY4MEncoder(w io.Writer, width, height, rateNum, rateDen int) *Y4MEncoder {
+	return &Y4MEncoder{
+		w:       bufio.NewWriter(w),
+		width:   width,
+		height:  height,
+		rateNum: rateNum,
+		rateDen: rateDen,
+		y:       make([]uint8, width*height),
+		cb:      make([]uint8, width*height/4),
+		cr:      make([]uint8, width*height/4),
+	}
+}
+
+// WriteFrame implements Encoder
+func (e *Y4MEncoder) WriteFrame(img *image.RGBA) error {
+	if b := img.Bounds(); b.Dx() != e.width || b.Dy() != e.height {
+		return fmt.Errorf("frame is %dx%d, video is %dx%d", b.Dx(), b.Dy(), e.width, e.height)
+	}
+	if !e.header {
+		fmt.Fprintf(e.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420jpeg XCOLORRANGE=FULL\n",
+			e.width, e.height, e.rateNum, e.rateDen)
+		e.header = true
+	}
+
+	for y := 0; y < e.height; y += 2 {
+		for x := 0; x < e.width; x += 2 {
+			var sumCb, sumCr int
+			for _, p := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				c := img.RGBAAt(x+p[0], y+p[1])
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				e.y[(y+p[1])*e.width+x+p[0]] = yy
+				sumCb += int(cb)
+				sumCr += int(cr)
+			}
+			i := y/2*e.width/2 + x/2
+			e.cb[i] = uint8((sumCb + 2) / 4)
+			e.cr[i] = uint8((sumCr + 2) / 4)
+		}
+	}
+
+	e.w.WriteString("FRAME\n")
+	e.w.Write(e.y)
+	e.w.Write(e.cb)
+	_, err := e.w.Write(e.cr)
+	return err
+}
+
+// Close implements Encoder
+func (e *Y4MEncoder) Close() error {
+	return e.w.Flush()
+}
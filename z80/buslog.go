@@ -0,0 +1,225 @@
+package z80
+
+import "fmt"
+
+// BusKind says what kind of bus cycle a BusEvent is
+type BusKind uint8
+
+const (
+	BusFetch BusKind = iota // Opcode fetch (M1)
+	BusRead                 // Memory read
+	BusWrite                // Memory write
+	BusIn                   // I/O read
+	BusOut                  // I/O write
+)
+
+var busKindNames = [...]string{"fetch", "read", "write", "in", "out"}
+
+func (k BusKind) String() string {
+	if int(k) < len(busKindNames) {
+		return busKindNames[k]
+	}
+	return "?"
+}
+
+// busLengths are the T-state lengths of each kind of bus cycle
+var busLengths = [...]int{4, 3, 3, 4, 4}
+
+// IsIO reports whether the event is a port access
+func (k BusKind) IsIO() bool { return k == BusIn || k == BusOut }
+
+// IsWrite reports whether the CPU drove the data bus
+func (k BusKind) IsWrite() bool { return k == BusWrite || k == BusOut }
+
+// BusEvent is one memory or I/O access made during a Step
+type BusEvent struct {
+	T    int // T-state within the step at which the access starts
+	Addr uint16
+	Data uint8
+	Kind BusKind
+}
+
+func (e BusEvent) String() string {
+	return fmt.Sprintf("%d:%s %04X=%02X", e.T, e.Kind, e.Addr, e.Data)
+}
+
+// BusLog records the bus events of a step. Set Z80.BusLog to one and each
+// Step replaces Events with the accesses it made, in order.
+//
+// The core executes an instruction at a time, so T is worked out after
+// the step from the machine cycles of the instruction: 4 T-states for
+// fetches and I/O, 3 for memory, and the internal cycles the instruction
+// adds between them, such as the extra one of INC (HL) or the
+// displacement add of (IX+d). Interrupts and Mode 0 instructions have no
+// fetch to decode, so their accesses are placed at the end of the step.
+// Fetches are told apart from other reads by the refresh counter, so the
+// bytes after a DD CB prefix are reads as on a real Z80.
+type BusLog struct {
+	Events []BusEvent
+
+	z       *Z80
+	mem     MemoryInterface
+	io      IOInterface
+	fetches uint64
+}
+
+// step runs one Step with the CPU's memory and I/O routed through the log
+func (l *BusLog) step(z *Z80) int {
+	l.z, l.mem, l.io, l.fetches = z, z.Memory, z.IO, z.Fetches
+	// Whatever the step does first decides whether it fetches an opcode
+	special := z.mode0Buffer != nil && z.mode0Index < len(z.mode0Buffer) ||
+		z.NMI && !z.nmiEdge || z.INT && z.IFF1 && !z.pendingEI && !z.pendingDI
+	l.Events = l.Events[:0]
+	z.Memory = busLogMemory{l}
+	if ic, ok := l.io.(InterruptController); ok {
+		z.IO = busLogInterrupts{busLogIO{l}, ic}
+	} else {
+		z.IO = busLogIO{l}
+	}
+	cycles := z.step()
+	z.Memory, z.IO = l.mem, l.io
+	if special {
+		// The acknowledge cycle moves the refresh counter without a fetch
+		l.fetches = z.Fetches
+		l.timeFromEnd(cycles)
+	} else {
+		l.sync()
+		l.time()
+	}
+	return cycles
+}
+
+// time sets T for an instruction's events from the machine cycles of its
+// opcode
+func (l *BusLog) time() {
+	ev := l.Events
+	extra := make([]int, len(ev)+4) // Internal T-states after each event
+	after := func(i, n int) { extra[i] += n }
+
+	// Find the opcode after any prefixes
+	k, indexed := 0, false
+	for k+1 < len(ev) && ev[k].Kind == BusFetch && (ev[k].Data == 0xDD || ev[k].Data == 0xFD) && ev[k+1].Kind == BusFetch {
+		k, indexed = k+1, true
+	}
+	switch {
+	case k >= len(ev) || ev[k].Kind != BusFetch:
+	case ev[k].Data == 0xED && k+1 < len(ev):
+		k++
+		timeED(ev[k].Data, k, after)
+	case ev[k].Data == 0xCB && indexed:
+		// DD CB d op: the opcode is read, not fetched
+		after(k+2, 2)
+		after(k+3, 1)
+	case ev[k].Data == 0xCB && k+1 < len(ev):
+		k++
+		if ev[k].Data&7 == 6 {
+			after(k+1, 1) // (HL) read, then write
+		}
+	default:
+		timeBase(ev[k].Data, k, indexed, after)
+	}
+
+	t := 0
+	for i := range ev {
+		ev[i].T = t
+		t += busLengths[ev[i].Kind] + extra[i]
+	}
+}
+
+// timeBase adds the internal cycles of an unprefixed instruction, or one
+// after DD or FD, whose opcode was fetched by event k
+func timeBase(op uint8, k int, indexed bool, after func(i, n int)) {
+	switch {
+	case op == 0x10 || op&0xCF == 0xC5 || op&0xC7 == 0xC7 || op&0xC7 == 0xC0:
+		after(k, 1) // DJNZ, PUSH, RST and RET cc have a 5 T-state M1
+	case op&0xC7 == 0x03 || op == 0xF9:
+		after(k, 2) // INC rr, DEC rr and LD SP,HL
+	case op == 0xCD || op&0xC7 == 0xC4 || op == 0xE3:
+		after(k+2, 1) // CALL and EX (SP),HL after the second read
+	case op == 0x34 || op == 0x35:
+		if indexed {
+			after(k+1, 5)
+			after(k+2, 1)
+		} else {
+			after(k+1, 1)
+		}
+	case op == 0x36:
+		if indexed {
+			after(k+2, 2) // The add overlaps the read of n
+		}
+	case indexed && (op&0xC7 == 0x46 && op != 0x76 || op&0xF8 == 0x70 && op != 0x76 || op&0xC7 == 0x86):
+		after(k+1, 5) // Adding the displacement
+	}
+}
+
+// timeED adds the internal cycles of an ED instruction whose second
+// opcode was fetched by event k
+func timeED(op uint8, k int, after func(i, n int)) {
+	switch {
+	case op&0xE6 == 0xA2:
+		after(k, 1) // INI, OUTI and their repeats have a 5 T-state M1
+	case op == 0x67 || op == 0x6F:
+		after(k+1, 4) // RRD and RLD between the read and the write
+	}
+}
+
+// timeFromEnd places the events of an interrupt or Mode 0 instruction at
+// the end of a step taking cycles, which is where its bus cycles fall
+func (l *BusLog) timeFromEnd(cycles int) {
+	t := cycles
+	for i := len(l.Events) - 1; i >= 0; i-- {
+		t -= busLengths[l.Events[i].Kind]
+		l.Events[i].T = t
+	}
+}
+
+// sync marks the last read as a fetch if the refresh counter moved since
+func (l *BusLog) sync() {
+	if l.z.Fetches == l.fetches {
+		return
+	}
+	l.fetches = l.z.Fetches
+	if n := len(l.Events); n > 0 && l.Events[n-1].Kind == BusRead {
+		l.Events[n-1].Kind = BusFetch
+	}
+}
+
+func (l *BusLog) add(kind BusKind, addr uint16, data uint8) {
+	l.sync()
+	l.Events = append(l.Events, BusEvent{0, addr, data, kind})
+}
+
+type busLogMemory struct{ l *BusLog }
+
+func (b busLogMemory) Read(addr uint16) uint8 {
+	v := b.l.mem.Read(addr)
+	b.l.add(BusRead, addr, v)
+	return v
+}
+
+func (b busLogMemory) Write(addr uint16, value uint8) {
+	b.l.add(BusWrite, addr, value)
+	b.l.mem.Write(addr, value)
+}
+
+type busLogIO struct{ l *BusLog }
+
+func (b busLogIO) In(port uint16) uint8 {
+	v := b.l.io.In(port)
+	b.l.add(BusIn, port, v)
+	return v
+}
+
+func (b busLogIO) Out(port uint16, value uint8) {
+	b.l.add(BusOut, port, value)
+	b.l.io.Out(port, value)
+}
+
+// busLogInterrupts keeps the interrupt controller visible to the CPU
+type busLogInterrupts struct {
+	busLogIO
+	ic InterruptController
+}
+
+func (b busLogInterrupts) GetInterruptVector() uint8    { return b.ic.GetInterruptVector() }
+func (b busLogInterrupts) GetMode0Instruction() []uint8 { return b.ic.GetMode0Instruction() }
@@ -406,7 +406,7 @@ func (cpu *Z80) executeBlock3(opcode uint8, y, z, p, q uint8) int {
 			port := cpu.fetchByte()
 			addr := uint16(port) | (uint16(cpu.A) << 8)
 			cpu.IO.Out(addr, cpu.A)
-			cpu.WZ = addr
+			cpu.WZ = uint16(cpu.A)<<8 | uint16(port+1) // Low byte wraps without carrying into A
 			return 11
 		case 3: // IN A,(n)
 			port := cpu.fetchByte()
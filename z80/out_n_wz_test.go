@@ -0,0 +1,27 @@
+package z80
+
+import "testing"
+
+// OUT (n),A leaves WZ = A:(n+1), with the low byte wrapping without
+// carrying into the high byte
+func TestOUT_n_A_WZ(t *testing.T) {
+	for _, tt := range []struct {
+		a, n uint8
+		wz   uint16
+	}{
+		{0x34, 0x56, 0x3457},
+		{0x12, 0xFF, 0x1200},
+	} {
+		cpu, mem, io := testCPU()
+		cpu.A = tt.a
+		loadProgram(cpu, mem, 0x0000, 0xD3, tt.n)
+		mustStep(t, cpu)
+		port := uint16(tt.a)<<8 | uint16(tt.n)
+		if v, ok := io.lastOut[port]; !ok || v != tt.a {
+			t.Errorf("OUT (%02X),A with A=%02X did not write %04X", tt.n, tt.a, port)
+		}
+		if cpu.WZ != tt.wz {
+			t.Errorf("OUT (%02X),A with A=%02X: WZ=%04X, want %04X", tt.n, tt.a, cpu.WZ, tt.wz)
+		}
+	}
+}
@@ -4,7 +4,7 @@ package z80
 func (z *Z80) executeCB() int {
 	opcode := z.fetchByte()
 	// Increment R for the post-prefix opcode fetch (M1)
-	z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+	z.incrementR()
 	
 	// Debug M1 trace for post-prefix fetch
 	if DEBUG_M1 && z.M1Hook != nil {
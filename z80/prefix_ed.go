@@ -4,7 +4,7 @@ package z80
 func (z *Z80) executeED() int {
 	opcode := z.fetchByte()
 	// Increment R for the post-prefix opcode fetch (M1)
-	z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+	z.incrementR()
 	
 	// Debug M1 trace for post-prefix fetch
 	if DEBUG_M1 && z.M1Hook != nil {
@@ -349,8 +349,6 @@ func (z *Z80) ldir() int {
 	if z.BC() != 0 {
 		z.PC -= 2 // Repeat instruction
 		z.WZ = z.PC + 1
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -361,8 +359,6 @@ func (z *Z80) lddr() int {
 	if z.BC() != 0 {
 		z.PC -= 2 // Repeat instruction
 		z.WZ = z.PC + 1
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -419,8 +415,6 @@ func (z *Z80) cpir() int {
 	if z.BC() != 0 && !z.getFlag(FlagZ) {
 		z.PC -= 2 // Repeat instruction
 		z.WZ = z.PC + 1
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -431,8 +425,6 @@ func (z *Z80) cpdr() int {
 	if z.BC() != 0 && !z.getFlag(FlagZ) {
 		z.PC -= 2 // Repeat instruction
 		z.WZ = z.PC + 1
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -492,8 +484,6 @@ func (z *Z80) inir() int {
 	z.ini()
 	if z.B != 0 {
 		z.PC -= 2 // Repeat instruction
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -503,8 +493,6 @@ func (z *Z80) indr() int {
 	z.ind()
 	if z.B != 0 {
 		z.PC -= 2 // Repeat instruction
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -564,8 +552,6 @@ func (z *Z80) otir() int {
 	z.outi()
 	if z.B != 0 {
 		z.PC -= 2 // Repeat instruction
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
@@ -575,8 +561,6 @@ func (z *Z80) otdr() int {
 	z.outd()
 	if z.B != 0 {
 		z.PC -= 2 // Repeat instruction
-		// Increment R for the extra M1 cycle when repeating
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
 		return 21
 	}
 	return 16
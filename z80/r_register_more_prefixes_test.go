@@ -30,3 +30,22 @@ func TestR_Increments_On_DD_DD_Nop(t *testing.T) {
 		t.Fatalf("R should increment by 2 on DD DD, got %d", int((r1-r0)&0x7F))
 	}
 }
+
+func TestR_And_Fetches_On_LDIR_Repeat(t *testing.T) {
+	cpu, mem, _ := testCPU()
+	loadProgram(cpu, mem, 0x0000, 0xED, 0xB0) // LDIR
+	cpu.SetHL(0x8000)
+	cpu.SetDE(0x9000)
+	cpu.SetBC(4)
+	cpu.R = 0
+	for i := 0; i < 4; i++ {
+		mustStep(t, cpu)
+	}
+	// Each iteration refetches ED B0: two M1 cycles, no more
+	if cpu.BC() != 0 || cpu.PC != 0x0002 {
+		t.Fatalf("LDIR did not finish: BC=%04X PC=%04X", cpu.BC(), cpu.PC)
+	}
+	if cpu.R != 8 || cpu.Fetches != 8 {
+		t.Fatalf("after LDIR with BC=4: R=%d Fetches=%d, want 8 and 8", cpu.R, cpu.Fetches)
+	}
+}
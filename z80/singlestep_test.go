@@ -0,0 +1,372 @@
+package z80
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Test vectors in the SingleStepTests JSON format: one file per opcode,
+// each a list of tests giving the state before and after one instruction
+// and what was on the bus in each T-state. Fetch them with
+//
+//	git clone https://github.com/SingleStepTests/z80 ../testdata/singlestep
+//
+// or point Z80_SST_DIR at a copy (the v1 directory). Files may be gzipped.
+
+type sstState struct {
+	PC   uint16   `json:"pc"`
+	SP   uint16   `json:"sp"`
+	A    uint8    `json:"a"`
+	B    uint8    `json:"b"`
+	C    uint8    `json:"c"`
+	D    uint8    `json:"d"`
+	E    uint8    `json:"e"`
+	F    uint8    `json:"f"`
+	H    uint8    `json:"h"`
+	L    uint8    `json:"l"`
+	I    uint8    `json:"i"`
+	R    uint8    `json:"r"`
+	EI   int      `json:"ei"`
+	WZ   uint16   `json:"wz"`
+	IX   uint16   `json:"ix"`
+	IY   uint16   `json:"iy"`
+	AF_  uint16   `json:"af_"`
+	BC_  uint16   `json:"bc_"`
+	DE_  uint16   `json:"de_"`
+	HL_  uint16   `json:"hl_"`
+	IM   uint8    `json:"im"`
+	IFF1 int      `json:"iff1"`
+	IFF2 int      `json:"iff2"`
+	RAM  [][2]int `json:"ram"`
+}
+
+type sstTest struct {
+	Name    string   `json:"name"`
+	Initial sstState `json:"initial"`
+	Final   sstState `json:"final"`
+	Cycles  [][]any  `json:"cycles"` // [address, data or null, "rwmi" pins]
+	Ports   [][]any  `json:"ports"`  // [port, value, "r" or "w"]
+}
+
+// sstIO answers port reads with the values a test lists, in order
+type sstIO struct{ reads []uint8 }
+
+func (p *sstIO) In(port uint16) uint8 {
+	if len(p.reads) == 0 {
+		return 0xFF
+	}
+	v := p.reads[0]
+	p.reads = p.reads[1:]
+	return v
+}
+
+func (p *sstIO) Out(port uint16, value uint8) {}
+
+func (s sstState) load(z *Z80, mem *ram64) {
+	z.PC, z.SP = s.PC, s.SP
+	z.A, z.F, z.B, z.C, z.D, z.E, z.H, z.L = s.A, s.F, s.B, s.C, s.D, s.E, s.H, s.L
+	z.I, z.R, z.WZ, z.IM = s.I, s.R, s.WZ, s.IM
+	z.SetIX(s.IX)
+	z.SetIY(s.IY)
+	z.A_, z.F_ = uint8(s.AF_>>8), uint8(s.AF_)
+	z.B_, z.C_ = uint8(s.BC_>>8), uint8(s.BC_)
+	z.D_, z.E_ = uint8(s.DE_>>8), uint8(s.DE_)
+	z.H_, z.L_ = uint8(s.HL_>>8), uint8(s.HL_)
+	z.IFF1, z.IFF2 = s.IFF1 != 0, s.IFF2 != 0
+	z.SetPendingEI(s.EI != 0)
+	for _, b := range s.RAM {
+		mem.data[uint16(b[0])] = uint8(b[1])
+	}
+}
+
+// diff lists the registers and memory that differ from the expected state
+func (s sstState) diff(z *Z80, mem *ram64) []string {
+	var out []string
+	check := func(name string, got, want int) {
+		if got != want {
+			out = append(out, fmt.Sprintf("%s=%X want %X", name, got, want))
+		}
+	}
+	b := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	check("PC", int(z.PC), int(s.PC))
+	check("SP", int(z.SP), int(s.SP))
+	check("AF", int(z.AF()), int(s.A)<<8|int(s.F))
+	check("BC", int(z.BC()), int(s.B)<<8|int(s.C))
+	check("DE", int(z.DE()), int(s.D)<<8|int(s.E))
+	check("HL", int(z.HL()), int(s.H)<<8|int(s.L))
+	check("IX", int(z.IX()), int(s.IX))
+	check("IY", int(z.IY()), int(s.IY))
+	check("AF'", int(z.A_)<<8|int(z.F_), int(s.AF_))
+	check("BC'", int(z.B_)<<8|int(z.C_), int(s.BC_))
+	check("DE'", int(z.D_)<<8|int(z.E_), int(s.DE_))
+	check("HL'", int(z.H_)<<8|int(z.L_), int(s.HL_))
+	check("I", int(z.I), int(s.I))
+	check("R", int(z.R), int(s.R))
+	check("WZ", int(z.WZ), int(s.WZ))
+	check("IM", int(z.IM), int(s.IM))
+	check("IFF1", b(z.IFF1), s.IFF1)
+	check("IFF2", b(z.IFF2), s.IFF2)
+	check("EI", b(z.PendingEI()), s.EI)
+	for _, m := range s.RAM {
+		check(fmt.Sprintf("(%04X)", m[0]), int(mem.data[uint16(m[0])]), m[1])
+	}
+	return out
+}
+
+// busEvents turns the per-T-state pins into one line per access, with
+// the T-state the access starts at. A value held on the bus over several
+// T-states counts once. The pins show data a T-state into a memory cycle
+// and two into an I/O read, after its wait state.
+func (t *sstTest) busEvents() []string {
+	var out []string
+	last := ""
+	for i, c := range t.Cycles {
+		if len(c) < 3 || c[1] == nil {
+			last = ""
+			continue
+		}
+		addr, _ := c[0].(float64)
+		data, _ := c[1].(float64)
+		pins, _ := c[2].(string)
+		pins += "----"
+		kind, start := "", i-1
+		switch {
+		case pins[0] == 'r' && pins[3] == 'i':
+			kind, start = "in", i-2
+		case pins[1] == 'w' && pins[3] == 'i':
+			kind = "out"
+		case pins[0] == 'r':
+			kind = "read"
+		case pins[1] == 'w':
+			kind = "write"
+		default:
+			last = ""
+			continue
+		}
+		e := fmt.Sprintf("%s %04X=%02X", kind, int(addr), int(data))
+		if e != last {
+			out = append(out, fmt.Sprintf("%d:%s", start, e))
+		}
+		last = e
+	}
+	return out
+}
+
+func logEvents(events []BusEvent) []string {
+	out := make([]string, len(events))
+	for i, e := range events {
+		kind := e.Kind
+		if kind == BusFetch {
+			kind = BusRead
+		}
+		out[i] = fmt.Sprintf("%d:%s %04X=%02X", e.T, kind, e.Addr, e.Data)
+	}
+	return out
+}
+
+// run executes one vector and returns what differed
+func (t *sstTest) run(checkBus bool) []string {
+	mem := &ram64{}
+	ports := &sstIO{}
+	for _, p := range t.Ports {
+		if len(p) == 3 && p[2] == "r" {
+			v, _ := p[1].(float64)
+			ports.reads = append(ports.reads, uint8(v))
+		}
+	}
+	z := New(mem, ports)
+	t.Initial.load(z, mem)
+	z.BusLog = &BusLog{}
+	cycles := z.Step()
+
+	problems := t.Final.diff(z, mem)
+	if cycles != len(t.Cycles) {
+		problems = append(problems, fmt.Sprintf("cycles=%d want %d", cycles, len(t.Cycles)))
+	}
+	if checkBus {
+		got, want := logEvents(z.BusLog.Events), t.busEvents()
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			problems = append(problems, fmt.Sprintf("bus [%s] want [%s]", strings.Join(got, ", "), strings.Join(want, ", ")))
+		}
+	}
+	return problems
+}
+
+func readVectors(path string) ([]sstTest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+	var tests []sstTest
+	if err := json.NewDecoder(r).Decode(&tests); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tests, nil
+}
+
+// TestSingleStep runs every vector file in Z80_SST_DIR. Z80_SST_BUS=0
+// skips the bus comparison and Z80_SST_SHOW sets how many failures to
+// print per file.
+func TestSingleStep(t *testing.T) {
+	dir := os.Getenv("Z80_SST_DIR")
+	if dir == "" {
+		dir = filepath.Join("..", "testdata", "singlestep", "v1")
+		if _, err := os.Stat(dir); err != nil {
+			dir = filepath.Dir(dir)
+		}
+	}
+	var files []string
+	for _, pattern := range []string{"*.json", "*.json.gz"} {
+		m, _ := filepath.Glob(filepath.Join(dir, pattern))
+		files = append(files, m...)
+	}
+	if len(files) == 0 {
+		t.Skipf("no SingleStepTests vectors in %s", dir)
+	}
+	sort.Strings(files)
+	checkBus := getenvBool("Z80_SST_BUS", true)
+	show := getenvInt("Z80_SST_SHOW", 3)
+
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".json")
+		t.Run(name, func(t *testing.T) {
+			tests, err := readVectors(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed := 0
+			for i := range tests {
+				problems := tests[i].run(checkBus)
+				if len(problems) == 0 {
+					continue
+				}
+				if failed < show {
+					t.Errorf("%s: %s", tests[i].Name, strings.Join(problems, "; "))
+				}
+				failed++
+			}
+			if failed > 0 {
+				t.Errorf("%d of %d vectors failed", failed, len(tests))
+			}
+		})
+	}
+}
+
+// A few hand-written vectors keep the runner itself tested when the
+// suite is not present
+const sampleVectors = `[
+{"name": "d3 out (n),a",
+ "initial": {"pc": 256, "sp": 0, "a": 18, "f": 0, "b": 0, "c": 0, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 5,
+  "ei": 0, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[256, 211], [257, 254]]},
+ "final": {"pc": 258, "sp": 0, "a": 18, "f": 0, "b": 0, "c": 0, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 6,
+  "ei": 0, "wz": 4863, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[256, 211], [257, 254]]},
+ "cycles": [[256, null, "----"], [256, 211, "r-m-"], [5, null, "----"], [5, null, "----"],
+  [257, null, "----"], [257, 254, "r-m-"], [257, null, "----"],
+  [4862, null, "----"], [4862, 18, "-w-i"], [4862, 18, "-w-i"], [4862, null, "----"]],
+ "ports": [[4862, 18, "w"]]},
+{"name": "ed 78 in a,(c)",
+ "initial": {"pc": 4096, "sp": 0, "a": 0, "f": 1, "b": 16, "c": 32, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 127,
+  "ei": 0, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[4096, 237], [4097, 120]]},
+ "final": {"pc": 4098, "sp": 0, "a": 128, "f": 129, "b": 16, "c": 32, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 1,
+  "ei": 0, "wz": 4129, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[4096, 237], [4097, 120]]},
+ "cycles": [[4096, null, "----"], [4096, 237, "r-m-"], [127, null, "----"], [127, null, "----"],
+  [4097, null, "----"], [4097, 120, "r-m-"], [0, null, "----"], [0, null, "----"],
+  [4128, null, "----"], [4128, null, "----"], [4128, 128, "r--i"], [4128, null, "----"]],
+ "ports": [[4128, 128, "r"]]},
+{"name": "c5 push bc",
+ "initial": {"pc": 0, "sp": 32768, "a": 0, "f": 0, "b": 18, "c": 52, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 0,
+  "ei": 1, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 1, "iff1": 1, "iff2": 1,
+  "ram": [[0, 197]]},
+ "final": {"pc": 1, "sp": 32766, "a": 0, "f": 0, "b": 18, "c": 52, "d": 0, "e": 0, "h": 0, "l": 0, "i": 0, "r": 1,
+  "ei": 0, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 1, "iff1": 1, "iff2": 1,
+  "ram": [[0, 197], [32767, 18], [32766, 52]]},
+ "cycles": [[0, null, "----"], [0, 197, "r-m-"], [0, null, "----"], [0, null, "----"], [0, null, "----"],
+  [32767, null, "----"], [32767, 18, "-wm-"], [32767, 18, "-wm-"],
+  [32766, null, "----"], [32766, 52, "-wm-"], [32766, 52, "-wm-"]]},
+{"name": "34 inc (hl)",
+ "initial": {"pc": 0, "sp": 0, "a": 0, "f": 0, "b": 0, "c": 0, "d": 0, "e": 0, "h": 128, "l": 0, "i": 0, "r": 0,
+  "ei": 0, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[0, 52], [32768, 65]]},
+ "final": {"pc": 1, "sp": 0, "a": 0, "f": 0, "b": 0, "c": 0, "d": 0, "e": 0, "h": 128, "l": 0, "i": 0, "r": 1,
+  "ei": 0, "wz": 0, "ix": 0, "iy": 0, "af_": 0, "bc_": 0, "de_": 0, "hl_": 0, "im": 0, "iff1": 0, "iff2": 0,
+  "ram": [[0, 52], [32768, 66]]},
+ "cycles": [[0, null, "----"], [0, 52, "r-m-"], [0, null, "----"], [0, null, "----"],
+  [32768, null, "----"], [32768, 65, "r-m-"], [32768, null, "----"], [32768, null, "----"],
+  [32768, null, "----"], [32768, 66, "-wm-"], [32768, 66, "-wm-"]]}
+]`
+
+func TestSingleStepSamples(t *testing.T) {
+	var tests []sstTest
+	if err := json.Unmarshal([]byte(sampleVectors), &tests); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tests {
+		if problems := tests[i].run(true); len(problems) > 0 {
+			t.Errorf("%s: %s", tests[i].Name, strings.Join(problems, "; "))
+		}
+	}
+}
+
+func TestBusLog(t *testing.T) {
+	mem := &ram64{}
+	// ld (ix+2),$55; inc (hl) at $8000; out ($FE),a
+	copy(mem.data[:], []uint8{0xDD, 0x36, 0x02, 0x55, 0x34, 0xD3, 0xFE})
+	z := New(mem, &dummyIO{})
+	z.SetIX(0x4000)
+	z.SetHL(0x8000)
+	z.A = 0x07
+	mem.data[0x8000] = 0x41
+	z.BusLog = &BusLog{}
+
+	steps := [][]string{
+		{"0:fetch 0000=DD", "4:fetch 0001=36", "8:read 0002=02", "11:read 0003=55", "16:write 4002=55"},
+		{"0:fetch 0004=34", "4:read 8000=41", "8:write 8000=42"},
+		{"0:fetch 0005=D3", "4:read 0006=FE", "7:out 07FE=07"},
+	}
+	for i, want := range steps {
+		z.Step()
+		var got []string
+		for _, e := range z.BusLog.Events {
+			got = append(got, e.String())
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("step %d: %v, want %v", i, got, want)
+		}
+	}
+	if _, ok := z.Memory.(*ram64); !ok {
+		t.Error("Step left the memory wrapped")
+	}
+
+	// IM2: the pushes follow the 7 T-state acknowledge, then the vector
+	z.SP, z.I, z.IM, z.IFF1, z.INT = 0x9000, 0x40, 2, true, true
+	z.Step()
+	want := "7:write 8FFF=00 10:write 8FFE=07 13:read 40FE=00 16:read 40FF=00"
+	if got := fmt.Sprint(z.BusLog.Events); got != "["+want+"]" {
+		t.Errorf("IM2 acknowledge: %s, want [%s]", got, want)
+	}
+}
@@ -44,6 +44,7 @@ type Z80 struct {
 	// State tracking
 	Halted     bool   // CPU is halted
 	Cycles     uint64 // Total cycles executed
+	Fetches    uint64 // Total opcode fetches (M1 cycles), counted with R
 	pendingEI  bool   // EI instruction just executed
 	pendingDI  bool   // DI instruction just executed
 	lastPrefix uint8  // Last prefix for cycle verification (0=none, 0xCB, 0xDD, 0xED, 0xFD)
@@ -51,6 +52,7 @@ type Z80 struct {
 
 	// Debug hooks
 	M1Hook func(pc uint16, opcode uint8, context string) // Called on M1 cycles when DEBUG_M1 is true
+	BusLog *BusLog                                       // When set, Step records its memory and I/O accesses here
 
 	// Memory interface
 	Memory MemoryInterface
@@ -151,6 +153,13 @@ func (z *Z80) Reset() {
 
 // Step executes one instruction and returns the number of cycles taken.
 func (z *Z80) Step() int {
+	if z.BusLog != nil {
+		return z.BusLog.step(z)
+	}
+	return z.step()
+}
+
+func (z *Z80) step() int {
 	// Check if we're in the middle of executing a Mode 0 interrupt instruction
 	if z.mode0Buffer != nil && z.mode0Index < len(z.mode0Buffer) {
 		cycles := z.executeMode0Instruction()
@@ -166,8 +175,9 @@ func (z *Z80) Step() int {
 		return cycles
 	}
 
-	// If halted, just count cycles
+	// If halted, the CPU executes NOPs: count cycles and the refresh fetch
 	if z.Halted {
+		z.incrementR()
 		z.lastCycles = 4
 		z.Cycles += 4
 		return 4
@@ -194,7 +204,7 @@ func (z *Z80) Step() int {
 
 	// Increment R register immediately after M1 cycle (opcode fetch)
 	// This ensures LD A,R sees the post-increment value
-	z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+	z.incrementR()
 
 	// Debug M1 trace
 	if DEBUG_M1 && z.M1Hook != nil {
@@ -231,6 +241,25 @@ func (z *Z80) Run(condition func() bool) {
 	}
 }
 
+// PendingEI reports whether an EI has executed whose effect is still
+// delayed by one instruction. Snapshot formats save this state.
+func (z *Z80) PendingEI() bool {
+	return z.pendingEI
+}
+
+// SetPendingEI restores the delayed-EI state saved in a snapshot
+func (z *Z80) SetPendingEI(pending bool) {
+	z.pendingEI = pending
+}
+
+// incrementR advances the 7-bit refresh counter for one M1 cycle. Every
+// opcode fetch passes through here, so Fetches counts them for input
+// recorders such as RZX.
+func (z *Z80) incrementR() {
+	z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+	z.Fetches++
+}
+
 // Register pair getters
 func (z *Z80) AF() uint16 { return uint16(z.A)<<8 | uint16(z.F) }
 func (z *Z80) BC() uint16 { return uint16(z.B)<<8 | uint16(z.C) }
@@ -349,7 +378,7 @@ func (z *Z80) handleInterrupts() (int, bool) {
 		z.PC = 0x0066
 		z.WZ = z.PC
 		// Increment R for the NMI acknowledge M1 cycle
-		z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+		z.incrementR()
 		// Debug M1 trace
 		if DEBUG_M1 && z.M1Hook != nil {
 			z.M1Hook(0x0066, 0x00, "NMI")
@@ -393,7 +422,7 @@ func (z *Z80) handleInterrupts() (int, bool) {
 			z.PC = 0x0038
 			z.WZ = z.PC
 			// Increment R for the interrupt acknowledge M1 cycle
-			z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+			z.incrementR()
 			// Debug M1 trace
 			if DEBUG_M1 && z.M1Hook != nil {
 				z.M1Hook(0x0038, 0xFF, "IM0-fallback")
@@ -406,7 +435,7 @@ func (z *Z80) handleInterrupts() (int, bool) {
 			z.PC = 0x0038
 			z.WZ = z.PC
 			// Increment R for the interrupt acknowledge M1 cycle
-			z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+			z.incrementR()
 			// Debug M1 trace
 			if DEBUG_M1 && z.M1Hook != nil {
 				z.M1Hook(0x0038, 0xFF, "IM1")
@@ -427,7 +456,7 @@ func (z *Z80) handleInterrupts() (int, bool) {
 			z.PC = z.readWord(addr)
 			z.WZ = z.PC
 			// Increment R for the interrupt acknowledge M1 cycle
-			z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+			z.incrementR()
 			// Debug M1 trace
 			if DEBUG_M1 && z.M1Hook != nil {
 				z.M1Hook(z.PC, vector, "IM2")
@@ -458,7 +487,7 @@ func (z *Z80) executeMode0Instruction() int {
 
 	// Increment R register for the Mode 0 instruction's M1 cycle (opcode fetch)
 	// This is the only R increment for the entire instruction, regardless of length
-	z.R = (z.R & 0x80) | ((z.R + 1) & 0x7F)
+	z.incrementR()
 
 	// Debug M1 trace
 	if DEBUG_M1 && z.M1Hook != nil {
@@ -0,0 +1,212 @@
+// Package zex runs the ZEXALL and ZEXDOC instruction exercisers one test
+// group at a time, so that the groups can run in parallel.
+//
+// Both programs walk a table of test descriptors at 0x013A, ended by a
+// zero word. Patching the table to hold a single descriptor makes the
+// program run just that group, print its result and exit. Each group runs
+// on its own CP/M machine from the cpm package.
+package zex
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ha1tch/zen80/cpm"
+)
+
+// Layout of the exerciser programs
+const (
+	tableAddr      = 0x013A // Test table: descriptor addresses, then 0
+	descCRC        = 61     // Offset of the expected CRC in a descriptor
+	descName       = 65     // Offset of the '$'-terminated test name
+	descNameLength = 30
+)
+
+// Test is one test group of an exerciser
+type Test struct {
+	Index    int    // Position in the test table
+	Name     string // As printed, such as "add hl,<bc,de,hl,sp>"
+	Addr     uint16 // Address of the descriptor
+	Expected uint32 // CRC of a real Z80
+}
+
+// Result is the outcome of running one test group
+type Result struct {
+	Test
+	Found    uint32 // CRC computed by the emulator
+	Passed   bool
+	Steps    uint64 // Instructions executed
+	Duration time.Duration
+	Output   string // Console output of the run
+	Err      error  // Set if the test could not be run to completion
+}
+
+// Options controls Run
+type Options struct {
+	Workers  int            // Tests run at once, runtime.NumCPU() if zero
+	Match    *regexp.Regexp // Run only tests whose names match, all if nil
+	MaxSteps uint64         // Give up on a test after this many instructions, no limit if zero
+	Progress func(Result)   // Called as each test finishes, from one goroutine at a time
+}
+
+// Tests lists the test groups of an exerciser program
+func Tests(program []uint8) ([]Test, error) {
+	byteAt := func(addr int) (uint8, error) {
+		if addr < cpm.TPA || addr-cpm.TPA >= len(program) {
+			return 0, fmt.Errorf("zex: address %04X is outside the program", addr)
+		}
+		return program[addr-cpm.TPA], nil
+	}
+	wordAt := func(addr int) (uint16, error) {
+		lo, err := byteAt(addr)
+		if err != nil {
+			return 0, err
+		}
+		hi, err := byteAt(addr + 1)
+		return uint16(lo) | uint16(hi)<<8, err
+	}
+
+	var tests []Test
+	for i := 0; ; i++ {
+		addr, err := wordAt(tableAddr + 2*i)
+		if err != nil {
+			return nil, fmt.Errorf("zex: not an exerciser: %w", err)
+		}
+		if addr == 0 {
+			break
+		}
+		t := Test{Index: i, Addr: addr}
+		for j := 0; j < 4; j++ {
+			b, err := byteAt(int(addr) + descCRC + j)
+			if err != nil {
+				return nil, err
+			}
+			t.Expected = t.Expected<<8 | uint32(b)
+		}
+		var name []uint8
+		for j := 0; j < descNameLength; j++ {
+			b, err := byteAt(int(addr) + descName + j)
+			if err != nil {
+				return nil, err
+			}
+			if b == '$' {
+				break
+			}
+			name = append(name, b)
+		}
+		t.Name = strings.TrimRight(string(name), ".")
+		tests = append(tests, t)
+	}
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("zex: the test table is empty")
+	}
+	return tests, nil
+}
+
+// RunTest runs a single test group of an exerciser program
+func RunTest(program []uint8, t Test, maxSteps uint64) (r Result) {
+	r.Test = t
+	start := time.Now()
+	defer func() { r.Duration = time.Since(start) }()
+
+	var out bytes.Buffer
+	m := cpm.New(cpm.NewStreamConsole(strings.NewReader(""), &out), "")
+	if err := m.LoadCOM(program, nil); err != nil {
+		r.Err = err
+		return r
+	}
+	m.Memory.Load(tableAddr, []uint8{uint8(t.Addr), uint8(t.Addr >> 8), 0, 0})
+
+	for {
+		exited, err := m.Step()
+		if err != nil {
+			r.Err = err
+			break
+		}
+		if exited {
+			break
+		}
+		r.Steps++
+		if maxSteps != 0 && r.Steps >= maxSteps {
+			r.Err = fmt.Errorf("zex: no result after %d instructions", r.Steps)
+			break
+		}
+	}
+	r.Output = out.String()
+	if r.Err == nil {
+		r.Found, r.Passed, r.Err = parseResult(r.Output, t.Expected)
+	}
+	return r
+}
+
+// parseResult reads the outcome from the output of a test: "OK", or
+// "ERROR **** crc expected:xxxxxxxx found:xxxxxxxx"
+func parseResult(output string, expected uint32) (found uint32, passed bool, err error) {
+	if _, after, ok := strings.Cut(output, "found:"); ok {
+		if len(after) < 8 {
+			return 0, false, fmt.Errorf("zex: truncated result %q", after)
+		}
+		v, err := strconv.ParseUint(after[:8], 16, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("zex: bad CRC %q", after[:8])
+		}
+		return uint32(v), uint32(v) == expected, nil
+	}
+	if strings.Contains(output, "OK") {
+		return expected, true, nil
+	}
+	return 0, false, fmt.Errorf("zex: no result in the output")
+}
+
+// Run runs the test groups of an exerciser program in parallel and
+// returns their results in table order
+func Run(program []uint8, opts Options) ([]Result, error) {
+	tests, err := Tests(program)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Match != nil {
+		var matched []Test
+		for _, t := range tests {
+			if opts.Match.MatchString(t.Name) {
+				matched = append(matched, t)
+			}
+		}
+		tests = matched
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	results := make([]Result, len(tests))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = RunTest(program, tests[i], opts.MaxSteps)
+				if opts.Progress != nil {
+					mu.Lock()
+					opts.Progress(results[i])
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range tests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,76 @@
+package zex
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func loadZEXALL(t *testing.T) []uint8 {
+	t.Helper()
+	program, err := os.ReadFile(filepath.Join("..", "rom", "zexall.com"))
+	if err != nil {
+		t.Skipf("missing zexall.com in ../rom directory: %v", err)
+	}
+	return program
+}
+
+func TestTests(t *testing.T) {
+	tests, err := Tests(loadZEXALL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 67 {
+		t.Errorf("%d tests, want 67", len(tests))
+	}
+	first := tests[0]
+	if first.Name != "<adc,sbc> hl,<bc,de,hl,sp>" || first.Expected != 0xd48ad519 {
+		t.Errorf("first test %q with CRC %08x", first.Name, first.Expected)
+	}
+	if _, err := Tests(make([]uint8, 16)); err == nil {
+		t.Error("a short program was taken for an exerciser")
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	found, passed, err := parseResult("neg......  ERROR **** crc expected:d638dd6a found:12345678\r\n", 0xd638dd6a)
+	if err != nil || passed || found != 0x12345678 {
+		t.Errorf("error result parsed as %08x, %v, %v", found, passed, err)
+	}
+	found, passed, err = parseResult("neg......  OK\r\n", 0xd638dd6a)
+	if err != nil || !passed || found != 0xd638dd6a {
+		t.Errorf("OK result parsed as %08x, %v, %v", found, passed, err)
+	}
+	if _, _, err := parseResult("Z80all instruction exerciser\r\n", 0); err == nil {
+		t.Error("missing result not reported")
+	}
+}
+
+func TestRun(t *testing.T) {
+	program := loadZEXALL(t)
+	results, err := Run(program, Options{Match: regexp.MustCompile(`^(neg|<inc,dec> a)$`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if !r.Passed || r.Err != nil || r.Found != r.Expected {
+			t.Errorf("%s: crc %08x, expected %08x, err %v\n%s", r.Name, r.Found, r.Expected, r.Err, r.Output)
+		}
+	}
+
+	// A wrong expected CRC makes the group fail with the CRC it computed
+	neg := results[1].Test
+	bad := append([]uint8(nil), program...)
+	bad[int(neg.Addr)-0x100+descCRC] ^= 0xFF
+	tests, _ := Tests(bad)
+	if r := RunTest(bad, tests[neg.Index], 0); r.Passed || r.Found != neg.Expected {
+		t.Errorf("corrupted neg: passed %v, crc %08x", r.Passed, r.Found)
+	}
+	if r := RunTest(program, neg, 1000); r.Err == nil {
+		t.Error("step limit not enforced")
+	}
+}
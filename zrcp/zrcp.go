@@ -0,0 +1,575 @@
+// Package zrcp serves the ZEsarUX remote command protocol (ZRCP), the
+// line-based TCP protocol that DeZog and other tools use to debug code in
+// an emulator, on top of a debug.Debugger.
+//
+// A client sends one command per line and the server answers with any
+// output followed by a prompt. "run" answers once the machine stops at a
+// breakpoint or the client sends anything, which is how DeZog pauses.
+// The commands DeZog relies on are supported: registers, memory, numbered
+// breakpoints with PC and memory conditions, stepping, the stack, memory
+// pages, t-state counters and snapshots.
+package zrcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ha1tch/zen80/debug"
+	"github.com/ha1tch/zen80/trace"
+)
+
+const (
+	// DefaultAddr is where ZEsarUX listens, and where DeZog looks
+	DefaultAddr = "localhost:10000"
+	// Version is the ZEsarUX version whose protocol this follows; DeZog
+	// checks it when connecting
+	Version = "10.3"
+
+	welcome    = "Welcome to ZEsarUX remote command protocol (ZRCP)\nWrite help for available commands\n"
+	prompt     = "\ncommand> "
+	stepPrompt = "\ncommand@cpu-step> "
+
+	maxBreakpoints = 100
+)
+
+// breakpoint is one of the numbered breakpoints, as set by set-breakpoint
+type breakpoint struct {
+	cond    string // As given, reported when it fires
+	addr    uint16
+	kind    string // "PC", "MRA" (memory read) or "MWA" (memory write)
+	enabled bool
+}
+
+// Server answers ZRCP commands for one debugger
+type Server struct {
+	d           *debug.Debugger
+	breakpoints [maxBreakpoints + 1]*breakpoint // Numbered from 1
+	memWatch    map[uint16]int                  // set-membreakpoint: 1 read, 2 write, 3 both
+	enabled     bool                            // enable-breakpoints
+	stepMode    bool                            // enter-cpu-step
+	partial     uint64                          // Cycle count at reset-tstates-partial
+}
+
+// NewServer creates a server for a debugger
+func NewServer(d *debug.Debugger) *Server {
+	return &Server{d: d, memWatch: make(map[uint16]int)}
+}
+
+// ListenAndServe serves clients on a TCP address, such as DefaultAddr
+func ListenAndServe(addr string, d *debug.Debugger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return NewServer(d).Serve(l)
+}
+
+// Serve accepts clients one at a time, as ZEsarUX does, until the
+// listener fails
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(c)
+		c.Close()
+	}
+}
+
+// session is one client connection
+type session struct {
+	w     *bufio.Writer
+	lines chan string // Closed when the client goes away
+}
+
+// ServeConn talks to one client until it quits or disconnects
+func (s *Server) ServeConn(c io.ReadWriter) error {
+	sess := &session{w: bufio.NewWriter(c), lines: make(chan string)}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(sess.lines)
+		r := bufio.NewScanner(c)
+		r.Buffer(nil, 1<<20)
+		for r.Scan() {
+			select {
+			case sess.lines <- strings.TrimRight(r.Text(), "\r"):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sess.w.WriteString(welcome)
+	for {
+		sess.w.WriteString(s.prompt())
+		if err := sess.w.Flush(); err != nil {
+			return err
+		}
+		line, ok := <-sess.lines
+		if !ok {
+			return nil
+		}
+		name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if name == "quit" || name == "exit" {
+			return nil
+		}
+		if name == "" {
+			continue
+		}
+		out, err := s.command(sess, name, strings.Fields(args))
+		if err != nil {
+			out = "Error. " + err.Error() + "\n"
+		}
+		sess.w.WriteString(out)
+	}
+}
+
+func (s *Server) prompt() string {
+	if s.stepMode {
+		return stepPrompt
+	}
+	return prompt
+}
+
+// noops are commands accepted for compatibility that need no action here
+var noops = map[string]bool{
+	"close-all-menus": true, "set-debug-settings": true, "set-breakpointaction": true,
+	"set-verbose-level": true, "print-footer": true,
+}
+
+var help = []string{
+	"about", "cpu-step", "cpu-step-over", "disable-breakpoint", "disable-breakpoints",
+	"disassemble", "enable-breakpoint", "enable-breakpoints", "enter-cpu-step",
+	"exit-cpu-step", "extended-stack", "get-current-machine", "get-memory-pages",
+	"get-registers", "get-stack-backtrace", "get-tstates", "get-tstates-partial",
+	"get-version", "hard-reset-cpu", "help", "quit", "read-memory",
+	"reset-tstates-partial", "run", "set-breakpoint", "set-membreakpoint",
+	"clear-membreakpoints", "set-register", "snapshot-load", "snapshot-save",
+	"write-memory", "write-memory-raw",
+}
+
+// command runs one command and returns its output
+func (s *Server) command(sess *session, name string, args []string) (string, error) {
+	d := s.d
+	cpu := d.CPU()
+	switch name {
+	case "about":
+		return "zen80 remote command protocol server\n", nil
+	case "get-version":
+		return Version + "\n", nil
+	case "help":
+		sorted := append([]string(nil), help...)
+		sort.Strings(sorted)
+		return "Available commands:\n" + strings.Join(sorted, "\n") + "\n", nil
+	case "get-current-machine":
+		if n, ok := d.Machine().(debug.Named); ok {
+			return n.Name() + "\n", nil
+		}
+		return "Z80\n", nil
+
+	case "enter-cpu-step":
+		s.stepMode = true
+		return "", nil
+	case "exit-cpu-step":
+		s.stepMode = false
+		return "", nil
+
+	case "get-registers":
+		return Registers(d) + "\n", nil
+	case "set-register":
+		if len(args) != 1 {
+			return "", errors.New("usage: set-register REG=value")
+		}
+		reg, val, ok := strings.Cut(args[0], "=")
+		if !ok {
+			return "", errors.New("usage: set-register REG=value")
+		}
+		v, err := parseNumber(val)
+		if err != nil {
+			return "", err
+		}
+		if err := d.SetRegister(reg, uint16(v)); err != nil {
+			return "", err
+		}
+		return Registers(d) + "\n", nil
+
+	case "read-memory":
+		addr, n, err := addrLen(args, 1)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		for _, v := range d.ReadBlock(addr, n) {
+			fmt.Fprintf(&b, "%02x", v)
+		}
+		return b.String() + "\n", nil
+	case "write-memory":
+		if len(args) < 2 {
+			return "", errors.New("usage: write-memory address value [value...]")
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return "", err
+		}
+		for i, a := range args[1:] {
+			v, err := parseNumber(a)
+			if err != nil || v > 0xFF {
+				return "", fmt.Errorf("bad byte %q", a)
+			}
+			d.Write(uint16(addr)+uint16(i), uint8(v))
+		}
+		return "", nil
+	case "write-memory-raw":
+		if len(args) != 2 || len(args[1])%2 != 0 {
+			return "", errors.New("usage: write-memory-raw address hexbytes")
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < len(args[1]); i += 2 {
+			v, err := strconv.ParseUint(args[1][i:i+2], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("bad hex %q", args[1])
+			}
+			d.Write(uint16(addr)+uint16(i/2), uint8(v))
+		}
+		return "", nil
+	case "disassemble":
+		addr, n, err := addrLen(args, 1)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			in := d.Disassemble(addr)
+			fmt.Fprintf(&b, "%04X %s\n", addr, in)
+			addr += uint16(in.Len())
+		}
+		return b.String(), nil
+
+	case "get-stack-backtrace":
+		n := 5
+		if len(args) > 0 {
+			var err error
+			if n, err = parseCount(args[0]); err != nil {
+				return "", err
+			}
+		}
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fmt.Sprintf("%04XH", s.stackWord(i))
+		}
+		return strings.Join(words, " ") + "\n", nil
+	case "extended-stack":
+		if len(args) == 0 {
+			return "", errors.New("usage: extended-stack enabled|disabled|get n")
+		}
+		if args[0] != "get" {
+			return "", nil
+		}
+		n := 5
+		if len(args) > 1 {
+			var err error
+			if n, err = parseCount(args[1]); err != nil {
+				return "", err
+			}
+		}
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "%04XH default\n", s.stackWord(i))
+		}
+		return b.String(), nil
+
+	case "get-tstates":
+		return fmt.Sprintf("%d\n", cpu.Cycles), nil
+	case "get-tstates-partial":
+		return fmt.Sprintf("%d\n", cpu.Cycles-s.partial), nil
+	case "reset-tstates-partial":
+		s.partial = cpu.Cycles
+		return "", nil
+
+	case "get-memory-pages":
+		p, ok := d.Machine().(debug.Paged)
+		if !ok {
+			return "", errors.New("machine has no memory paging")
+		}
+		var names []string
+		for _, page := range p.Pages() {
+			if page.ROM {
+				names = append(names, fmt.Sprintf("RO%d", page.Bank))
+			} else {
+				names = append(names, fmt.Sprintf("RA%d", page.Bank))
+			}
+		}
+		return strings.Join(names, " ") + "\n", nil
+
+	case "hard-reset-cpu", "reset-cpu":
+		return "", d.Reset()
+	case "snapshot-save", "snapshot-load":
+		snap, ok := d.Machine().(debug.Snapshotter)
+		if !ok {
+			return "", errors.New("machine has no snapshots")
+		}
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: %s file", name)
+		}
+		if name == "snapshot-load" {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return "", err
+			}
+			return "", snap.LoadState(data)
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return "", err
+		}
+		if err := snap.SaveState(f); err != nil {
+			f.Close()
+			return "", err
+		}
+		return "", f.Close()
+
+	case "enable-breakpoints", "disable-breakpoints":
+		s.enabled = name == "enable-breakpoints"
+		s.sync()
+		return "", nil
+	case "set-breakpoint":
+		n, err := breakpointIndex(args)
+		if err != nil {
+			return "", err
+		}
+		if len(args) == 1 {
+			s.breakpoints[n] = nil
+		} else {
+			bp, err := parseCondition(strings.Join(args[1:], " "))
+			if err != nil {
+				return "", err
+			}
+			s.breakpoints[n] = bp
+		}
+		s.sync()
+		return "", nil
+	case "enable-breakpoint", "disable-breakpoint":
+		n, err := breakpointIndex(args)
+		if err != nil {
+			return "", err
+		}
+		if bp := s.breakpoints[n]; bp != nil {
+			bp.enabled = name == "enable-breakpoint"
+		}
+		s.sync()
+		return "", nil
+	case "set-membreakpoint":
+		if len(args) < 2 {
+			return "", errors.New("usage: set-membreakpoint address type [size]")
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return "", err
+		}
+		kind, err := parseNumber(args[1])
+		if err != nil || kind > 3 {
+			return "", fmt.Errorf("bad type %q", args[1])
+		}
+		size := 1
+		if len(args) > 2 {
+			if size, err = parseCount(args[2]); err != nil {
+				return "", err
+			}
+		}
+		for i := 0; i < size; i++ {
+			if a := uint16(addr) + uint16(i); kind == 0 {
+				delete(s.memWatch, a)
+			} else {
+				s.memWatch[a] = int(kind)
+			}
+		}
+		s.sync()
+		return "", nil
+	case "clear-membreakpoints":
+		clear(s.memWatch)
+		s.sync()
+		return "", nil
+
+	case "cpu-step":
+		d.Step()
+		return Registers(d) + "\n", nil
+	case "cpu-step-over":
+		d.StepOver(sess.interrupted)
+		return Registers(d) + "\n", nil
+	case "run":
+		sess.w.WriteString("Running until a breakpoint, key press or data sent, menu opening or other event\n")
+		sess.w.Flush()
+		e := d.Continue(sess.interrupted)
+		return s.describe(e), nil
+	}
+	if noops[name] {
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %s", name)
+}
+
+// interrupted reports whether the client has sent anything since the
+// machine started running, consuming it
+func (sess *session) interrupted() bool {
+	select {
+	case <-sess.lines:
+		return true
+	default:
+		return false
+	}
+}
+
+// describe reports why run stopped, as ZEsarUX does
+func (s *Server) describe(e debug.Event) string {
+	switch e.Reason {
+	case debug.Breakpoint, debug.WatchRead, debug.WatchWrite:
+		kind := map[debug.Reason]string{debug.Breakpoint: "PC", debug.WatchRead: "MRA", debug.WatchWrite: "MWA"}[e.Reason]
+		for _, bp := range s.breakpoints {
+			if bp != nil && bp.enabled && bp.kind == kind && bp.addr == e.Addr {
+				return "Breakpoint fired: " + bp.cond + "\n"
+			}
+		}
+		return fmt.Sprintf("Breakpoint fired: %s=%04XH\n", kind, e.Addr)
+	}
+	return ""
+}
+
+// sync passes the enabled breakpoints to the debugger
+func (s *Server) sync() {
+	s.d.ClearBreakpoints()
+	s.d.ClearWatchpoints()
+	if !s.enabled {
+		return
+	}
+	for _, bp := range s.breakpoints {
+		if bp == nil || !bp.enabled {
+			continue
+		}
+		switch bp.kind {
+		case "PC":
+			s.d.AddBreakpoint(bp.addr)
+		case "MRA":
+			s.d.AddWatchpoint(debug.Watchpoint{Addr: bp.addr, Len: 1, Read: true})
+		case "MWA":
+			s.d.AddWatchpoint(debug.Watchpoint{Addr: bp.addr, Len: 1, Write: true})
+		}
+	}
+	for addr, kind := range s.memWatch {
+		s.d.AddWatchpoint(debug.Watchpoint{Addr: addr, Len: 1, Read: kind&1 != 0, Write: kind&2 != 0})
+	}
+}
+
+func (s *Server) stackWord(i int) uint16 {
+	sp := s.d.CPU().SP + uint16(2*i)
+	return uint16(s.d.Read(sp)) | uint16(s.d.Read(sp+1))<<8
+}
+
+// Registers formats the registers as ZEsarUX's get-registers does. DeZog
+// reads the values at fixed columns, so the layout must not change.
+func Registers(d *debug.Debugger) string {
+	z := d.CPU()
+	iff := []uint8("--")
+	if z.IFF1 {
+		iff[0] = '1'
+	}
+	if z.IFF2 {
+		iff[1] = '2'
+	}
+	return fmt.Sprintf("PC=%04x SP=%04x AF=%04x BC=%04x HL=%04x DE=%04x IX=%04x IY=%04x "+
+		"AF'=%02x%02x BC'=%02x%02x HL'=%02x%02x DE'=%02x%02x I=%02x R=%02x  F=%s F'=%s MEMPTR=%04x IM%d IFF%s VPS: 0 ",
+		z.PC, z.SP, z.AF(), z.BC(), z.HL(), z.DE(), z.IX(), z.IY(),
+		z.A_, z.F_, z.B_, z.C_, z.H_, z.L_, z.D_, z.E_, z.I, z.R,
+		trace.Flags(z.F), trace.Flags(z.F_), z.WZ, z.IM, iff)
+}
+
+// parseNumber reads a number as ZEsarUX does: decimal, or hex with an H
+// suffix. 0x and $ prefixes are accepted too.
+func parseNumber(s string) (uint64, error) {
+	t := strings.ToLower(s)
+	base := 10
+	switch {
+	case strings.HasSuffix(t, "h"):
+		t, base = t[:len(t)-1], 16
+	case strings.HasPrefix(t, "0x"):
+		t, base = t[2:], 16
+	case strings.HasPrefix(t, "$"), strings.HasPrefix(t, "#"):
+		t, base = t[1:], 16
+	}
+	v, err := strconv.ParseUint(t, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return v, nil
+}
+
+func addrLen(args []string, def int) (uint16, int, error) {
+	if len(args) == 0 {
+		return 0, 0, errors.New("missing address")
+	}
+	addr, err := parseNumber(args[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	n := def
+	if len(args) > 1 {
+		if n, err = parseCount(args[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uint16(addr), n, nil
+}
+
+// maxCount bounds the counts clients give, since nothing longer than the
+// address space makes sense
+const maxCount = 0x10000
+
+// parseCount reads a count of bytes, words or instructions
+func parseCount(s string) (int, error) {
+	n, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxCount {
+		return 0, fmt.Errorf("count %s is more than %d", s, maxCount)
+	}
+	return int(n), nil
+}
+
+func breakpointIndex(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New("missing breakpoint number")
+	}
+	n, err := parseNumber(args[0])
+	if err != nil || n < 1 || n > maxBreakpoints {
+		return 0, fmt.Errorf("breakpoint number must be 1 to %d", maxBreakpoints)
+	}
+	return int(n), nil
+}
+
+// parseCondition reads the breakpoint conditions zen80 supports:
+// PC=addr, MRA=addr and MWA=addr
+func parseCondition(cond string) (*breakpoint, error) {
+	kind, val, ok := strings.Cut(strings.ReplaceAll(cond, " ", ""), "=")
+	kind = strings.ToUpper(kind)
+	if !ok || (kind != "PC" && kind != "MRA" && kind != "MWA") {
+		return nil, fmt.Errorf("unsupported condition %q: use PC=, MRA= or MWA=", cond)
+	}
+	addr, err := parseNumber(val)
+	if err != nil {
+		return nil, err
+	}
+	return &breakpoint{cond: cond, addr: uint16(addr), kind: kind, enabled: true}, nil
+}
@@ -0,0 +1,141 @@
+package zrcp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ha1tch/zen80/debug"
+	zio "github.com/ha1tch/zen80/io"
+	"github.com/ha1tch/zen80/memory"
+	"github.com/ha1tch/zen80/z80"
+)
+
+// program: 8000 call 8006; jr 8000 (loop); 8005 halt; 8006 ld (9000),a; inc a; ret
+var program = []uint8{0xCD, 0x06, 0x80, 0x18, 0xFB, 0x76, 0x32, 0x00, 0x90, 0x3C, 0xC9}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// readPrompt reads up to the next prompt and returns what came before it
+func (c *client) readPrompt() string {
+	c.t.Helper()
+	var out strings.Builder
+	for {
+		s, err := c.r.ReadString('>')
+		out.WriteString(s)
+		if err != nil {
+			c.t.Fatalf("reading reply: %v (got %q)", err, out.String())
+		}
+		if strings.HasSuffix(out.String(), "\ncommand>") || strings.HasSuffix(out.String(), "\ncommand@cpu-step>") {
+			c.r.ReadByte() // The space after the prompt
+			text := out.String()
+			return strings.TrimSuffix(text[:strings.LastIndex(text, "\ncommand")], "\n")
+		}
+	}
+}
+
+func (c *client) do(cmd string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]uint8(cmd + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readPrompt()
+}
+
+func newClient(t *testing.T) (*client, *z80.Z80) {
+	mem := memory.NewRAM()
+	mem.Load(0x8000, program)
+	cpu := z80.New(mem, zio.NewNullIO())
+	cpu.PC, cpu.SP = 0x8000, 0xFF00
+	server, conn := net.Pipe()
+	go NewServer(debug.New(debug.NewCPU(cpu))).ServeConn(server)
+	t.Cleanup(func() { conn.Close() })
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if got := c.readPrompt(); !strings.Contains(got, "ZRCP") {
+		t.Fatalf("welcome %q", got)
+	}
+	return c, cpu
+}
+
+func TestRegisters(t *testing.T) {
+	c, _ := newClient(t)
+	c.do("set-register HL=1234H")
+	regs := c.do("set-register AF'=0xBEEF")
+	// DeZog reads the registers at fixed columns
+	for _, f := range []struct {
+		at   int
+		want string
+	}{{3, "8000"}, {11, "ff00"}, {35, "1234"}, {68, "beef"}, {102, "00"}} {
+		if got := regs[f.at : f.at+len(f.want)]; got != f.want {
+			t.Errorf("column %d: %q, want %q in %q", f.at, got, f.want, regs)
+		}
+	}
+	if got := c.do("set-register Q=1"); !strings.HasPrefix(got, "Error.") {
+		t.Errorf("bad register accepted: %q", got)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	c, _ := newClient(t)
+	if got := c.do("read-memory 32768 3"); got != "cd0680" {
+		t.Errorf("read-memory: %q", got)
+	}
+	c.do("write-memory 4000H 1 2 255")
+	c.do("write-memory-raw 16387 a0b1")
+	if got := c.do("read-memory 4000H 5"); got != "0102ffa0b1" {
+		t.Errorf("after writes: %q", got)
+	}
+	if got := c.do("disassemble 8000H 2"); got != "8000 call $8006\n8003 jr $8000" {
+		t.Errorf("disassemble: %q", got)
+	}
+	if got := c.do("get-stack-backtrace 1"); got != "0000H" {
+		t.Errorf("backtrace: %q", got)
+	}
+	for _, cmd := range []string{"get-stack-backtrace 4294967295", "extended-stack get 65537", "set-membreakpoint 0 3 100000", "read-memory 0 65537"} {
+		if got := c.do(cmd); !strings.HasPrefix(got, "Error.") {
+			t.Errorf("%s: %q", cmd, got)
+		}
+	}
+}
+
+func TestStepAndRun(t *testing.T) {
+	c, cpu := newClient(t)
+	c.do("enter-cpu-step")
+	c.do("cpu-step")
+	if cpu.PC != 0x8006 {
+		t.Fatalf("cpu-step: PC=%04X", cpu.PC)
+	}
+	c.do("set-register PC=8000H")
+	c.do("cpu-step-over")
+	if cpu.PC != 0x8003 || cpu.A != 0x00 {
+		t.Fatalf("cpu-step-over: PC=%04X A=%02X", cpu.PC, cpu.A)
+	}
+
+	c.do("enable-breakpoints")
+	c.do("set-breakpoint 1 PC=8009h")
+	if got := c.do("run"); !strings.HasSuffix(got, "Breakpoint fired: PC=8009h") {
+		t.Errorf("run: %q", got)
+	}
+	c.do("disable-breakpoint 1")
+	c.do("set-breakpoint 2 MWA=9000H")
+	if got := c.do("run"); !strings.HasSuffix(got, "Breakpoint fired: MWA=9000H") || cpu.PC != 0x8009 {
+		t.Errorf("run to watchpoint: %q, PC=%04X", got, cpu.PC)
+	}
+
+	// With no breakpoints, run carries on until the client sends something
+	c.do("disable-breakpoints")
+	c.conn.Write([]uint8("run\n"))
+	if line, _ := c.r.ReadString('\n'); !strings.HasPrefix(line, "Running") {
+		t.Fatalf("run: %q", line)
+	}
+	c.conn.Write([]uint8("\n"))
+	c.readPrompt()
+	if got := c.do("get-tstates"); got == "0" {
+		t.Errorf("machine did not run")
+	}
+}